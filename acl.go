@@ -0,0 +1,216 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrInvalidToken     = errors.New("invalid token")
+)
+
+const (
+	ACL_PERM_READ  = "read"
+	ACL_PERM_WRITE = "write"
+	ACL_PERM_WATCH = "watch"
+)
+
+const (
+	ACL_ANY_IDENTITY  = "*"
+	ACL_ANY_NAMESPACE = "*"
+)
+
+//======================
+//       AclRule
+//======================
+// AclRule grant the permissions on the server types and the global keys of a namespace to an identity,
+// ACL_ANY_IDENTITY match all the identities, the anonymous peers included.
+// An empty Namespace is the default namespace, ACL_ANY_NAMESPACE match all the namespaces.
+type AclRule struct {
+	Identity       string   `json:"identity"`
+	Namespace      string   `json:"ns"`
+	AllSrvTypes    bool     `json:"all_srv_types"`
+	SrvTypes       []uint32 `json:"srv_types"`
+	GlobalPrefixes []string `json:"global_prefixes"`
+	Perms          []string `json:"perms"`
+}
+
+func (r *AclRule) IsMatchIdentity(identity string) bool {
+	return r.Identity == ACL_ANY_IDENTITY || (identity != "" && r.Identity == identity)
+}
+
+func (r *AclRule) IsMatchNamespace(ns string) bool {
+	return r.Namespace == ACL_ANY_NAMESPACE || r.Namespace == ns
+}
+
+func (r *AclRule) HasPerm(perm string) bool {
+	for _, p := range r.Perms {
+		if p == perm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsSrvTypeAllowed check the server type, bAllTypes means all the server types are required.
+func (r *AclRule) IsSrvTypeAllowed(srvType uint32, bAllTypes bool) bool {
+	if r.AllSrvTypes {
+		return true
+	}
+
+	if bAllTypes {
+		return false
+	}
+
+	for _, t := range r.SrvTypes {
+		if t == srvType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsGlobalKeyAllowed check the key is under one of the prefixes,
+// the prefixes are compared by path, so "/a" match "/a/b" but not "/ab".
+func (r *AclRule) IsGlobalKeyAllowed(key string) bool {
+	for _, prefix := range r.GlobalPrefixes {
+		if prefix == "/" || key == prefix || strings.HasPrefix(key, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+//======================
+//         Acl
+//======================
+// AclConfig map the tokens and the peers to the identities,
+// the keys of Peers are server type keys ("/type") or server keys ("/type/no").
+type AclConfig struct {
+	Tokens map[string]string `json:"tokens"`
+	Peers  map[string]string `json:"peers"`
+	Rules  []*AclRule        `json:"rules"`
+}
+
+// Acl authorize the peers by the rules, all the requests not granted by a rule are denied.
+// A peer can always access its own server record.
+type Acl struct {
+	cfg              *AclConfig
+	mapPeer2Identity map[string]string
+	lck              *sync.RWMutex
+}
+
+func NewAcl(cfg *AclConfig) *Acl {
+	return &Acl{
+		cfg:              cfg,
+		mapPeer2Identity: make(map[string]string),
+		lck:              &sync.RWMutex{},
+	}
+}
+
+func LoadAcl(filePath string) (*Acl, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &AclConfig{}
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAcl(cfg), nil
+}
+
+// Auth bind the identity of the token to the peer until the peer is disconnected.
+func (a *Acl) Auth(peerType uint32, peerNo uint32, token string) (string, error) {
+	identity, ok := a.cfg.Tokens[token]
+	if !ok || token == "" {
+		return "", ErrInvalidToken
+	}
+
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	a.mapPeer2Identity[GetSrvKey(peerType, peerNo)] = identity
+	return identity, nil
+}
+
+func (a *Acl) Unbind(peerType uint32, peerNo uint32) {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+
+	delete(a.mapPeer2Identity, GetSrvKey(peerType, peerNo))
+}
+
+// GetIdentity return the identity of the token bound to the peer,
+// or the identity of the peer in config, empty if the peer is anonymous.
+func (a *Acl) GetIdentity(peerType uint32, peerNo uint32) string {
+	srvKey := GetSrvKey(peerType, peerNo)
+
+	a.lck.RLock()
+	identity, ok := a.mapPeer2Identity[srvKey]
+	a.lck.RUnlock()
+
+	if ok {
+		return identity
+	}
+
+	identity, ok = a.cfg.Peers[srvKey]
+	if ok {
+		return identity
+	}
+
+	return a.cfg.Peers[GetSrvTypeKey(peerType)]
+}
+
+// CheckSrv check the permission on the server of the namespace, a peer can access its own record in all the namespaces.
+func (a *Acl) CheckSrv(peerType uint32, peerNo uint32, ns string, srvType uint32, srvNo uint32, perm string) error {
+	if peerType == srvType && peerNo == srvNo {
+		return nil
+	}
+
+	return a.CheckSrvType(peerType, peerNo, ns, srvType, perm)
+}
+
+func (a *Acl) CheckSrvType(peerType uint32, peerNo uint32, ns string, srvType uint32, perm string) error {
+	return a.check(peerType, peerNo, ns, perm, func(r *AclRule) bool {
+		return r.IsSrvTypeAllowed(srvType, false)
+	})
+}
+
+// CheckAllSrvTypes check the permission on all the server types of the namespace, e.g. watching all the connections.
+func (a *Acl) CheckAllSrvTypes(peerType uint32, peerNo uint32, ns string, perm string) error {
+	return a.check(peerType, peerNo, ns, perm, func(r *AclRule) bool {
+		return r.IsSrvTypeAllowed(0, true)
+	})
+}
+
+func (a *Acl) CheckGlobalData(peerType uint32, peerNo uint32, ns string, key string, perm string) error {
+	return a.check(peerType, peerNo, ns, perm, func(r *AclRule) bool {
+		return r.IsGlobalKeyAllowed(key)
+	})
+}
+
+func (a *Acl) check(peerType uint32, peerNo uint32, ns string, perm string, isResAllowed func(r *AclRule) bool) error {
+	identity := a.GetIdentity(peerType, peerNo)
+	for _, r := range a.cfg.Rules {
+		if r.IsMatchIdentity(identity) && r.IsMatchNamespace(ns) && r.HasPerm(perm) && isResAllowed(r) {
+			return nil
+		}
+	}
+
+	return ErrPermissionDenied
+}
@@ -0,0 +1,495 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	BOLT_OPEN_TIMEOUT_SEC  = 3
+	BOLT_MAX_TOMBSTONE_NUM = 1024
+)
+
+var (
+	BOLT_BUCKET_SRV      = []byte("srv")
+	BOLT_BUCKET_GLOBAL   = []byte("global")
+	BOLT_BUCKET_META     = []byte("meta")
+	BOLT_BUCKET_RAFT     = []byte("raft")
+	BOLT_BUCKET_RAFT_LOG = []byte("raft_log")
+	BOLT_BUCKET_WATCH    = []byte("watch")
+	BOLT_KEY_REV         = []byte("rev")
+	BOLT_KEY_RAFT_STATE  = []byte("state")
+	BOLT_KEY_WATCHES     = []byte("watches")
+)
+
+// BoltStore keep the latest record of every key in a bbolt database.
+// The records of the removed keys are kept as tombstones until BOLT_MAX_TOMBSTONE_NUM
+// of them are compacted by Flush, the revision is kept in the meta bucket so it can be restored.
+// The raft state and log, and the saved watches are kept in their own buckets.
+type BoltStore struct {
+	path         string
+	db           *bolt.DB
+	tombstoneNum int64
+}
+
+func NewBoltStore(path string) *BoltStore {
+	return &BoltStore{
+		path:         path,
+		db:           nil,
+		tombstoneNum: 0,
+	}
+}
+
+func (s *BoltStore) Load(info *RegInfo) error {
+	err := s.openDB()
+	if err != nil {
+		return err
+	}
+
+	var rev int64 = 0
+	var tombstoneNum int64 = 0
+	records := make([]*DataOprPush, 0)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		rev = getBoltRev(tx.Bucket(BOLT_BUCKET_META))
+		for _, name := range [][]byte{BOLT_BUCKET_SRV, BOLT_BUCKET_GLOBAL} {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				continue
+			}
+
+			err := bucket.ForEach(func(k, v []byte) error {
+				rec := &DataOprPush{}
+				err := json.Unmarshal(v, rec)
+				if err != nil {
+					return err
+				}
+
+				if rec.Operate == DATA_OPR_TYPE_REMOVE {
+					tombstoneNum++
+				}
+
+				records = append(records, rec)
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt64(&s.tombstoneNum, tombstoneNum)
+	err = replayRecords(info, records, 0)
+
+	// the revision of the compacted tombstones
+	info.updateRevision(rev)
+	return err
+}
+
+func (s *BoltStore) Open() error {
+	return s.openDB()
+}
+
+func (s *BoltStore) Append(records ...*DataOprPush) error {
+	if s.db == nil {
+		return ErrStoreNotOpen
+	}
+
+	var tombstoneNum int64 = 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(BOLT_BUCKET_META)
+		if err != nil {
+			return err
+		}
+
+		rev := getBoltRev(meta)
+		for _, rec := range records {
+			name := BOLT_BUCKET_GLOBAL
+			if rec.KeyType == KEY_TYPE_SRV_INFO {
+				name = BOLT_BUCKET_SRV
+			}
+
+			bucket, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+
+			// a record older than the saved one is stale
+			k := []byte(GetNsKey(rec.Namespace, rec.Key))
+			if getBoltRecordRev(bucket, k) > rec.ModRev {
+				continue
+			}
+
+			v, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+
+			err = bucket.Put(k, v)
+			if err != nil {
+				return err
+			}
+
+			// the subtree is removed with the key
+			if rec.Operate == DATA_OPR_TYPE_REMOVE {
+				tombstoneNum++
+				err = deleteBoltSubtree(bucket, k)
+				if err != nil {
+					return err
+				}
+			}
+
+			if rec.ModRev > rev {
+				rev = rec.ModRev
+			}
+		}
+
+		return putBoltRev(meta, rev)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&s.tombstoneNum, tombstoneNum)
+	return nil
+}
+
+// Flush compact the tombstones when there are more than BOLT_MAX_TOMBSTONE_NUM of them.
+func (s *BoltStore) Flush(info *RegInfo) error {
+	if s.db == nil || atomic.LoadInt64(&s.tombstoneNum) < BOLT_MAX_TOMBSTONE_NUM {
+		return nil
+	}
+
+	var compactedNum int64 = 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{BOLT_BUCKET_SRV, BOLT_BUCKET_GLOBAL} {
+			bucket := tx.Bucket(name)
+			if bucket == nil {
+				continue
+			}
+
+			keys := make([][]byte, 0)
+			err := bucket.ForEach(func(k, v []byte) error {
+				rec := &DataOprPush{}
+				err := json.Unmarshal(v, rec)
+				if err == nil && rec.Operate == DATA_OPR_TYPE_REMOVE {
+					keys = append(keys, k)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			for _, k := range keys {
+				err = bucket.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+
+			compactedNum += int64(len(keys))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&s.tombstoneNum, -compactedNum)
+	return nil
+}
+
+func (s *BoltStore) SaveWatches(info *RegInfo, watches []*SavedWatch) error {
+	if s.db == nil {
+		return ErrStoreNotOpen
+	}
+
+	v, err := json.Marshal(watches)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(BOLT_BUCKET_WATCH)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(BOLT_KEY_WATCHES, v)
+	})
+}
+
+func (s *BoltStore) LoadWatches(info *RegInfo) ([]*SavedWatch, error) {
+	err := s.openDB()
+	if err != nil {
+		return nil, err
+	}
+
+	watches := make([]*SavedWatch, 0)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BOLT_BUCKET_WATCH)
+		if bucket == nil {
+			return nil
+		}
+
+		v := bucket.Get(BOLT_KEY_WATCHES)
+		if v == nil {
+			return nil
+		}
+
+		return json.Unmarshal(v, &watches)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return watches, nil
+}
+
+func (s *BoltStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+func (s *BoltStore) openDB() error {
+	if s.db != nil {
+		return nil
+	}
+
+	db, err := bolt.Open(s.path, 0666, &bolt.Options{Timeout: BOLT_OPEN_TIMEOUT_SEC * time.Second})
+	if err != nil {
+		return err
+	}
+
+	s.db = db
+	return nil
+}
+
+//======================
+//     RaftStorage
+//======================
+func (s *BoltStore) LoadRaft() (*RaftHardState, []*RaftEntry, error) {
+	err := s.openDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var state *RaftHardState = nil
+	log := make([]*RaftEntry, 0)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BOLT_BUCKET_RAFT)
+		if bucket != nil {
+			v := bucket.Get(BOLT_KEY_RAFT_STATE)
+			if v != nil {
+				state = &RaftHardState{}
+				err := json.Unmarshal(v, state)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		bucket = tx.Bucket(BOLT_BUCKET_RAFT_LOG)
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			entry := &RaftEntry{}
+			err := json.Unmarshal(v, entry)
+			if err != nil {
+				return err
+			}
+
+			log = append(log, entry)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return state, log, nil
+}
+
+func (s *BoltStore) SaveRaftState(state *RaftHardState) error {
+	if s.db == nil {
+		return ErrStoreNotOpen
+	}
+
+	v, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(BOLT_BUCKET_RAFT)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(BOLT_KEY_RAFT_STATE, v)
+	})
+}
+
+func (s *BoltStore) AppendRaftEntries(entries []*RaftEntry) error {
+	if s.db == nil {
+		return ErrStoreNotOpen
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(BOLT_BUCKET_RAFT_LOG)
+		if err != nil {
+			return err
+		}
+
+		// the entries from the first index are replaced
+		keys := make([][]byte, 0)
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Seek(getBoltRaftKey(entries[0].Index)); k != nil; k, _ = cursor.Next() {
+			keys = append(keys, k)
+		}
+
+		for _, k := range keys {
+			err = bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		return putBoltRaftEntries(bucket, entries)
+	})
+}
+
+func (s *BoltStore) ResetRaftLog(entries []*RaftEntry) error {
+	if s.db == nil {
+		return ErrStoreNotOpen
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(BOLT_BUCKET_RAFT_LOG) != nil {
+			err := tx.DeleteBucket(BOLT_BUCKET_RAFT_LOG)
+			if err != nil {
+				return err
+			}
+		}
+
+		bucket, err := tx.CreateBucketIfNotExists(BOLT_BUCKET_RAFT_LOG)
+		if err != nil {
+			return err
+		}
+
+		return putBoltRaftEntries(bucket, entries)
+	})
+}
+
+func getBoltRev(meta *bolt.Bucket) int64 {
+	if meta == nil {
+		return 0
+	}
+
+	v := meta.Get(BOLT_KEY_REV)
+	if len(v) != 8 {
+		return 0
+	}
+
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+func putBoltRev(meta *bolt.Bucket, rev int64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(rev))
+	return meta.Put(BOLT_KEY_REV, v)
+}
+
+// getBoltRecordRev return the ModRev of the saved record, 0 if not exists.
+func getBoltRecordRev(bucket *bolt.Bucket, k []byte) int64 {
+	v := bucket.Get(k)
+	if v == nil {
+		return 0
+	}
+
+	rec := &DataOprPush{}
+	err := json.Unmarshal(v, rec)
+	if err != nil {
+		return 0
+	}
+
+	return rec.ModRev
+}
+
+// deleteBoltSubtree delete the records of the descendants of the key.
+func deleteBoltSubtree(bucket *bolt.Bucket, k []byte) error {
+	prefix := string(k) + "/"
+	keys := make([][]byte, 0)
+	cursor := bucket.Cursor()
+	for childKey, _ := cursor.Seek([]byte(prefix)); childKey != nil && strings.HasPrefix(string(childKey), prefix); childKey, _ = cursor.Next() {
+		keys = append(keys, childKey)
+	}
+
+	for _, childKey := range keys {
+		err := bucket.Delete(childKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getBoltRaftKey return the big endian index, so the entries are sorted by index.
+func getBoltRaftKey(index uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, index)
+	return k
+}
+
+func putBoltRaftEntries(bucket *bolt.Bucket, entries []*RaftEntry) error {
+	for _, entry := range entries {
+		v, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		err = bucket.Put(getBoltRaftKey(entry.Index), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	CACHE_MAX_ENTRY_NUM = 4096
+)
+
+// cacheEntry is known if the value or the absence of the key is fetched or pushed,
+// a removed key is kept as a known entry which not exists.
+type cacheEntry struct {
+	keyType int
+	key     string
+	value   interface{}
+	modRev  int64
+	bExists bool
+	bKnown  bool
+	elem    *list.Element
+}
+
+//======================
+//     clientCache
+//======================
+// clientCache keep the values read by the client, the values are updated by the data pushes.
+// A removed key is kept as a tombstone, so an older value fetched later is ignored.
+// The least recently used entries are evicted when there are more than maxEntryNum of them.
+type clientCache struct {
+	mapKey2Entry map[string]*cacheEntry
+	lruList      *list.List
+	maxEntryNum  int
+	lck          *sync.Mutex
+}
+
+func newClientCache(maxEntryNum int) *clientCache {
+	if maxEntryNum <= 0 {
+		maxEntryNum = CACHE_MAX_ENTRY_NUM
+	}
+
+	return &clientCache{
+		mapKey2Entry: make(map[string]*cacheEntry),
+		lruList:      list.New(),
+		maxEntryNum:  maxEntryNum,
+		lck:          &sync.Mutex{},
+	}
+}
+
+// Get return the value (*SrvInfo or base64 string) of the key and whether it exists,
+// false if it is not known. A copy of *SrvInfo is returned.
+func (c *clientCache) Get(keyType int, key string) (interface{}, bool, bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	entry, ok := c.mapKey2Entry[getRecordKey(keyType, key)]
+	if !ok || !entry.bKnown {
+		return nil, false, false
+	}
+
+	c.lruList.MoveToFront(entry.elem)
+	return copyCacheValue(entry.value), entry.bExists, true
+}
+
+// Reserve add an unknown entry for the key if it is not cached,
+// so the pushes arrived before the value is fetched are not ignored.
+// Return true if the entry is added, and the entries evicted by it.
+func (c *clientCache) Reserve(keyType int, key string) (bool, []*cacheEntry) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	recordKey := getRecordKey(keyType, key)
+	_, ok := c.mapKey2Entry[recordKey]
+	if ok {
+		return false, nil
+	}
+
+	entry := &cacheEntry{
+		keyType: keyType,
+		key:     key,
+	}
+
+	entry.elem = c.lruList.PushFront(recordKey)
+	c.mapKey2Entry[recordKey] = entry
+
+	evicted := make([]*cacheEntry, 0)
+	for c.lruList.Len() > c.maxEntryNum {
+		elem := c.lruList.Back()
+		evictKey := elem.Value.(string)
+		c.lruList.Remove(elem)
+		evicted = append(evicted, c.mapKey2Entry[evictKey])
+		delete(c.mapKey2Entry, evictKey)
+	}
+
+	return true, evicted
+}
+
+// Set cache the fetched value if it is not older than the cached one, bExists is false if the key not exists.
+// Return the value known now and whether it exists, the value is not cached if the entry is evicted.
+func (c *clientCache) Set(keyType int, key string, value interface{}, modRev int64, bExists bool) (interface{}, bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	entry, ok := c.mapKey2Entry[getRecordKey(keyType, key)]
+	if !ok {
+		return copyCacheValue(value), bExists
+	}
+
+	if entry.bKnown && entry.modRev > modRev {
+		return copyCacheValue(entry.value), entry.bExists
+	}
+
+	entry.value = value
+	entry.modRev = modRev
+	entry.bExists = bExists
+	entry.bKnown = true
+	return copyCacheValue(value), bExists
+}
+
+// Apply update the cached key by the push, the keys not cached are ignored.
+func (c *clientCache) Apply(pushData *DataOprPush) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	recordKey := getRecordKey(pushData.KeyType, pushData.Key)
+	entry, ok := c.mapKey2Entry[recordKey]
+	if !ok || entry.modRev > pushData.ModRev {
+		return
+	}
+
+	if pushData.Operate == DATA_OPR_TYPE_REMOVE {
+		entry.value = nil
+		entry.modRev = pushData.ModRev
+		entry.bExists = false
+		entry.bKnown = true
+		return
+	}
+
+	// the value is absent if the push is not for the cache, fetch it again
+	if (pushData.KeyType == KEY_TYPE_SRV_INFO && pushData.Srv == nil) ||
+		(pushData.KeyType == KEY_TYPE_GLOBAL_DATA && pushData.DataBase64 == "") {
+		entry.value = nil
+		entry.modRev = 0
+		entry.bExists = false
+		entry.bKnown = false
+		return
+	}
+
+	entry.value = pushData.GetValue()
+	entry.modRev = pushData.ModRev
+	entry.bExists = true
+	entry.bKnown = true
+}
+
+// Remove remove the entry of the key, return false if it is not cached.
+func (c *clientCache) Remove(keyType int, key string) bool {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	recordKey := getRecordKey(keyType, key)
+	entry, ok := c.mapKey2Entry[recordKey]
+	if !ok {
+		return false
+	}
+
+	c.lruList.Remove(entry.elem)
+	delete(c.mapKey2Entry, recordKey)
+	return true
+}
+
+// ResetRevisions clear the revisions of all the entries after switching member,
+// so the values fetched from the new member are cached even if the revisions are lower.
+// Return the key type and key of all the entries.
+func (c *clientCache) ResetRevisions() []*cacheEntry {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	entries := make([]*cacheEntry, 0, len(c.mapKey2Entry))
+	for _, entry := range c.mapKey2Entry {
+		entry.modRev = 0
+		entries = append(entries, &cacheEntry{
+			keyType: entry.keyType,
+			key:     entry.key,
+		})
+	}
+
+	return entries
+}
+
+func (c *clientCache) Clear() {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	c.mapKey2Entry = make(map[string]*cacheEntry)
+	c.lruList.Init()
+}
+
+// copyCacheValue return a copy of *SrvInfo, so the cached one is not changed by the caller.
+func copyCacheValue(value interface{}) interface{} {
+	info, ok := value.(*SrvInfo)
+	if !ok || info == nil {
+		return value
+	}
+
+	return info.Clone()
+}
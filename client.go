@@ -1,330 +1,1771 @@
-// Copyright 2022 Guan Jianchang. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
-package reg
-
-import (
-	"encoding/base64"
-	"errors"
-
-	"github.com/yxlib/rpc"
-	"github.com/yxlib/yx"
-)
-
-var (
-	ErrRegCallFailed = errors.New("call failed")
-)
-
-type Client struct {
-	rpcPeer  *rpc.Pipeline
-	observer *Observer
-	logger   *yx.Logger
-	ec       *yx.ErrCatcher
-}
-
-func NewClient(rpcNet rpc.Net, observerNet rpc.Net, srvPeerType uint32, srvPeerNo uint32) *Client {
-	return &Client{
-		rpcPeer:  rpc.NewPipeline(rpcNet, srvPeerType, srvPeerNo, REG_SRV),
-		observer: NewObserver(observerNet, srvPeerType, srvPeerNo),
-		logger:   yx.NewLogger("reg.Client"),
-		ec:       yx.NewErrCatcher("reg.Client"),
-	}
-}
-
-func (c *Client) Start() {
-	c.rpcPeer.SetInterceptor(&rpc.JsonInterceptor{})
-	c.rpcPeer.SetTimeout(TIME_OUT_SEC)
-
-	go c.observer.Start()
-	go c.rpcPeer.Start()
-}
-
-func (c *Client) Stop() {
-	c.observer.Stop()
-	c.rpcPeer.Stop()
-}
-
-func (c *Client) ListenDataOprPush(cb func(keyType int, key string, operate int)) {
-	if cb == nil {
-		return
-	}
-
-	go c.dataOprPushLoop(cb)
-}
-
-func (c *Client) ListenConnChangePush(cb func(srvType uint32, srvNo uint32, connChangeType int)) {
-	if cb == nil {
-		return
-	}
-
-	go c.connChangePushLoop(cb)
-}
-
-func (c *Client) FetchFuncList() error {
-	err := c.rpcPeer.FetchFuncList()
-	return c.ec.Throw("FetchFuncList", err)
-}
-
-func (c *Client) UpdateSrv(srvType uint32, srvNo uint32, bTemp bool, data []byte) error {
-	req := &UpdateSrvReq{}
-	req.SrvType = srvType
-	req.SrvNo = srvNo
-	req.IsTemp = bTemp
-	req.DataBase64 = base64.StdEncoding.EncodeToString(data)
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("UpdateSrv", req, nil)
-	return c.ec.Throw("UpdateSrv", err)
-}
-
-func (c *Client) RemoveSrv(srvType uint32, srvNo uint32) error {
-	req := &RemoveSrvReq{
-		SrvType: srvType,
-		SrvNo:   srvNo,
-	}
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("RemoveSrv", req, nil)
-	return c.ec.Throw("RemoveSrv", err)
-}
-
-func (c *Client) GetSrv(srvType uint32, srvNo uint32) (*SrvInfo, error) {
-	req := &GetSrvReq{
-		SrvType: srvType,
-		SrvNo:   srvNo,
-	}
-
-	resp := &GetSrvResp{}
-	err := c.rpcCall("GetSrv", req, resp)
-	if err != nil {
-		return nil, c.ec.Throw("GetSrv", err)
-	}
-
-	return resp.Data, nil
-}
-
-func (c *Client) GetSrvByKey(key string) (*SrvInfo, error) {
-	req := &GetSrvByKeyReq{
-		Key: key,
-	}
-
-	resp := &GetSrvResp{}
-	err := c.rpcCall("GetSrvByKey", req, resp)
-	if err != nil {
-		return nil, c.ec.Throw("GetSrvByKey", err)
-	}
-
-	return resp.Data, nil
-}
-
-func (c *Client) GetSrvsByType(srvType uint32) ([]*SrvInfo, error) {
-	req := &GetSrvsByTypeReq{
-		SrvType: srvType,
-	}
-
-	resp := &GetSrvsByTypeResp{}
-	err := c.rpcCall("GetSrvsByType", req, resp)
-	if err != nil {
-		return nil, c.ec.Throw("GetSrvsByType", err)
-	}
-
-	return resp.Data, nil
-}
-
-func (c *Client) WatchSrv(srvType uint32, srvNo uint32) error {
-	req := &WatchSrvReq{
-		SrvType: srvType,
-		SrvNo:   srvNo,
-	}
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("WatchSrv", req, nil)
-	return c.ec.Throw("WatchSrv", err)
-}
-
-func (c *Client) StopWatchSrv(srvType uint32, srvNo uint32) error {
-	req := &StopWatchSrvReq{
-		SrvType: srvType,
-		SrvNo:   srvNo,
-	}
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("StopWatchSrv", req, nil)
-	return c.ec.Throw("StopWatchSrv", err)
-}
-
-func (c *Client) WatchSrvsByType(srvType uint32) error {
-	req := &WatchSrvsByTypeReq{
-		SrvType: srvType,
-	}
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("WatchSrvsByType", req, nil)
-	return c.ec.Throw("WatchSrvsByType", err)
-}
-
-func (c *Client) StopWatchSrvsByType(srvType uint32) error {
-	req := &StopWatchSrvsByTypeReq{
-		SrvType: srvType,
-	}
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("StopWatchSrvsByType", req, nil)
-	return c.ec.Throw("StopWatchSrvsByType", err)
-}
-
-func (c *Client) UpdateGlobalData(key string, data []byte) error {
-	req := &UpdateGlobalDataReq{
-		Key:        key,
-		DataBase64: base64.StdEncoding.EncodeToString(data),
-	}
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("UpdateGlobalData", req, nil)
-	return c.ec.Throw("UpdateGlobalData", err)
-}
-
-func (c *Client) RemoveGlobalData(key string) error {
-	req := &RemoveGlobalDataReq{
-		Key: key,
-	}
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("RemoveGlobalData", req, nil)
-	return c.ec.Throw("RemoveGlobalData", err)
-}
-
-func (c *Client) GetGlobalData(key string) ([]byte, error) {
-	req := &GetGlobalDataReq{
-		Key: key,
-	}
-
-	resp := &GetGlobalDataResp{}
-	err := c.rpcCall("GetGlobalData", req, resp)
-	if err != nil {
-		return nil, c.ec.Throw("GetGlobalData", err)
-	}
-
-	data, err := base64.StdEncoding.DecodeString(resp.DataBase64)
-	if err != nil {
-		return nil, c.ec.Throw("GetGlobalData", err)
-	}
-
-	return data, nil
-}
-
-func (c *Client) WatchGlobalData(key string) error {
-	req := &WatchGlobalDataReq{
-		Key: key,
-	}
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("WatchGlobalData", req, nil)
-	return c.ec.Throw("WatchGlobalData", err)
-}
-
-func (c *Client) StopWatchGlobalData(key string) error {
-	req := &StopWatchGlobalDataReq{
-		Key: key,
-	}
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("StopWatchGlobalData", req, nil)
-	return c.ec.Throw("StopWatchGlobalData", err)
-}
-
-func (c *Client) WatchConn() error {
-	req := &WatchConnReq{}
-	// resp := &BaseResp{}
-	err := c.rpcCall("WatchConn", req, nil)
-	return c.ec.Throw("WatchConn", err)
-}
-
-func (c *Client) StopWatchConn() error {
-	req := &StopWatchConnReq{}
-	// resp := &BaseResp{}
-	err := c.rpcCall("StopWatchConn", req, nil)
-	return c.ec.Throw("StopWatchConn", err)
-}
-
-func (c *Client) StopAllWatch(srvType uint32, srvNo uint32) error {
-	req := &StopAllWatchReq{
-		SrvType: srvType,
-		SrvNo:   srvNo,
-	}
-
-	// resp := &BaseResp{}
-	err := c.rpcCall("StopAllWatch", req, nil)
-	return c.ec.Throw("StopAllWatch", err)
-}
-
-// func (c *Client) fetchRegFuncListCb(respData []byte) (*rpc.FetchFuncListResp, error) {
-// 	resp := &rpc.FetchFuncListResp{}
-// 	err := json.Unmarshal(respData, resp)
-// 	if err != nil {
-// 		c.logger.E("fetchRegFuncListCb json.Unmarshal err: ", err)
-// 		return nil, c.ec.Throw("fetchRegFuncListCb", err)
-// 	}
-
-// 	return resp, nil
-// }
-
-func (c *Client) rpcCall(funcName string, req interface{}, resp interface{}) error {
-	var err error = nil
-	defer c.ec.DeferThrow("rpcCall", &err)
-
-	// reqData, err := json.Marshal(req)
-	// if err != nil {
-	// 	c.logger.E("rpcCall json.Marshal err: ", err)
-	// 	return err
-	// }
-
-	// params := make([]rpc.ByteArray, 0)
-	// params = append(params, reqData)
-	code, err := c.rpcPeer.Call(REG_SERVIC_NAME, funcName, req, resp)
-	if err != nil {
-		c.logger.E("rpcCall rpcPeer.Call err, code = ", code, ", ", err)
-	}
-	return err
-	// if err != nil {
-	// 	c.logger.E("rpcCall rpcPeer.Call err: ", err)
-	// 	return err
-	// }
-
-	// err = json.Unmarshal(respData, resp)
-	// if err != nil {
-	// 	c.logger.E("rpcCall json.Unmarshal err: ", err)
-	// 	return err
-	// }
-
-	// if resp.GetResCode() != RES_CODE_SUCC {
-	// 	c.logger.W("rpcCall failed, ", resp.GetResCode(), ", ", resp.GetResMsg())
-	// 	err = ErrRegCallFailed
-	// 	return err
-	// }
-
-	// return nil
-}
-
-func (c *Client) dataOprPushLoop(cb func(keyType int, key string, operate int)) {
-	for {
-		pack, ok := c.observer.PopDataOprPack()
-		if !ok {
-			break
-		}
-
-		cb(pack.KeyType, pack.Key, pack.Operate)
-	}
-}
-
-func (c *Client) connChangePushLoop(cb func(srvType uint32, srvNo uint32, connChangeType int)) {
-	for {
-		pack, ok := c.observer.PopConnChangePack()
-		if !ok {
-			break
-		}
-
-		cb(pack.SrvType, pack.SrvNo, pack.ConnChangeType)
-	}
-}
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/base64"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxlib/rpc"
+	"github.com/yxlib/yx"
+)
+
+const (
+	RECONNECT_INTERVAL_SEC = 1
+)
+
+var (
+	ErrRegCallFailed     = errors.New("call failed")
+	ErrNoMemberAvailable = errors.New("no member available")
+)
+
+// ClientDialer connect to a member of the cluster, return the nets for rpc and observer.
+type ClientDialer func(member *RaftMember) (rpcNet rpc.Net, observerNet rpc.Net, err error)
+
+type Client struct {
+	lastRev      int64
+	rpcPeer      *rpc.Pipeline
+	lckRpcPeer   *sync.RWMutex
+	observer     *Observer
+	members      []*RaftMember
+	curNodeId    uint32
+	dialer       ClientDialer
+	lckFailover  *sync.Mutex
+	reconnectCbs []func(nodeId uint32)
+	bStop        int32
+	mapLock2Chan map[string]chan bool
+	mapLock2Sem  map[string]chan bool
+	lckLock      *sync.Mutex
+	mapLeaderCb  map[uint32]func(leaderNo uint32, bHasLeader bool)
+	lckLeaderCb  *sync.RWMutex
+	dataOprCbs   []func(pushData *DataOprPush)
+	lckDataOprCb *sync.RWMutex
+	connCbs      []func(srvType uint32, srvNo uint32, connChangeType int)
+	lckConnCb    *sync.RWMutex
+	subMgr       *subscriptionMgr
+	lckDispatch  *sync.Mutex
+	watches      *watchRecords
+	cache        *clientCache
+	token        string
+	namespace    string
+	logger       *yx.Logger
+	ec           *yx.ErrCatcher
+}
+
+func NewClient(rpcNet rpc.Net, observerNet rpc.Net, srvPeerType uint32, srvPeerNo uint32) *Client {
+	return &Client{
+		lastRev:      0,
+		rpcPeer:      newRegPipeline(rpcNet, srvPeerType, srvPeerNo),
+		lckRpcPeer:   &sync.RWMutex{},
+		observer:     NewObserver(observerNet, srvPeerType, srvPeerNo),
+		members:      nil,
+		curNodeId:    0,
+		dialer:       nil,
+		lckFailover:  &sync.Mutex{},
+		reconnectCbs: make([]func(nodeId uint32), 0),
+		bStop:        0,
+		mapLock2Chan: make(map[string]chan bool),
+		mapLock2Sem:  make(map[string]chan bool),
+		lckLock:      &sync.Mutex{},
+		mapLeaderCb:  make(map[uint32]func(leaderNo uint32, bHasLeader bool)),
+		lckLeaderCb:  &sync.RWMutex{},
+		dataOprCbs:   make([]func(pushData *DataOprPush), 0),
+		lckDataOprCb: &sync.RWMutex{},
+		connCbs:      make([]func(srvType uint32, srvNo uint32, connChangeType int), 0),
+		lckConnCb:    &sync.RWMutex{},
+		subMgr:       newSubscriptionMgr(),
+		lckDispatch:  &sync.Mutex{},
+		watches:      newWatchRecords(),
+		cache:        nil,
+		token:        "",
+		namespace:    DEFAULT_NAMESPACE,
+		logger:       yx.NewLogger("reg.Client"),
+		ec:           yx.NewErrCatcher("reg.Client"),
+	}
+}
+
+// NewClusterClient connect to the first reachable member. The client switches to
+// the leader when a write is rejected, and to another member when the connection is broken.
+func NewClusterClient(members []*RaftMember, dialer ClientDialer) (*Client, error) {
+	for _, m := range members {
+		rpcNet, observerNet, err := dialer(m)
+		if err != nil {
+			continue
+		}
+
+		c := NewClient(rpcNet, observerNet, m.PeerType, m.PeerNo)
+		c.members = members
+		c.curNodeId = m.NodeId
+		c.dialer = dialer
+		c.observer.SetReconnectable(c.onObserverBroken)
+		return c, nil
+	}
+
+	return nil, ErrNoMemberAvailable
+}
+
+// SetDialer let a client of a standalone registry connect again by dialer when the net is broken,
+// the watches are set again like switching member. It must be called before Start.
+func (c *Client) SetDialer(dialer ClientDialer, srvPeerType uint32, srvPeerNo uint32) {
+	if dialer == nil || c.dialer != nil {
+		return
+	}
+
+	c.members = []*RaftMember{{PeerType: srvPeerType, PeerNo: srvPeerNo}}
+	c.dialer = dialer
+	c.observer.SetReconnectable(c.onObserverBroken)
+}
+
+func newRegPipeline(rpcNet rpc.Net, srvPeerType uint32, srvPeerNo uint32) *rpc.Pipeline {
+	rpcPeer := rpc.NewPipeline(rpcNet, srvPeerType, srvPeerNo, REG_SRV)
+	rpcPeer.SetInterceptor(&rpc.JsonInterceptor{})
+	rpcPeer.SetTimeout(TIME_OUT_SEC)
+	return rpcPeer
+}
+
+func (c *Client) Start() {
+	go c.observer.Start()
+	go c.getRpcPeer().Start()
+	go c.dataOprPushLoop()
+	go c.connChangePushLoop()
+	go c.lockPushLoop()
+	go c.leaderPushLoop()
+	go c.healthPingLoop()
+}
+
+func (c *Client) Stop() {
+	atomic.StoreInt32(&c.bStop, 1)
+
+	c.lckFailover.Lock()
+	defer c.lckFailover.Unlock()
+
+	c.observer.Stop()
+	c.getRpcPeer().Stop()
+}
+
+// SetNamespace set the namespace of all the data and watch requests, it must be called before Start.
+// The locks, the elections and the connection watches are not isolated by namespace.
+func (c *Client) SetNamespace(ns string) error {
+	if !IsValidNamespace(ns) {
+		return c.ec.Throw("SetNamespace", ErrInvalidNamespace)
+	}
+
+	c.namespace = ns
+	return nil
+}
+
+func (c *Client) GetNamespace() string {
+	return c.namespace
+}
+
+// Auth bind the identity of the token to the client, the client authenticates again
+// after switching to another member of the cluster.
+func (c *Client) Auth(token string) (string, error) {
+	identity, err := c.auth(c.getRpcPeer(), token)
+	if err != nil {
+		return "", c.ec.Throw("Auth", err)
+	}
+
+	c.lckRpcPeer.Lock()
+	c.token = token
+	c.lckRpcPeer.Unlock()
+	return identity, nil
+}
+
+func (c *Client) auth(rpcPeer *rpc.Pipeline, token string) (string, error) {
+	req := &AuthReq{
+		Token: token,
+	}
+
+	resp := &AuthResp{}
+	code, err := rpcPeer.Call(REG_SERVIC_NAME, "Auth", req, resp)
+	if code == RES_CODE_PERMISSION_DENIED {
+		return "", ErrInvalidToken
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Identity, nil
+}
+
+func (c *Client) ListenDataOprPush(cb func(keyType int, key string, operate int)) {
+	if cb == nil {
+		return
+	}
+
+	c.addDataOprCb(func(pushData *DataOprPush) {
+		cb(pushData.KeyType, pushData.Key, pushData.Operate)
+	})
+}
+
+// ListenDataOprPushWithValue listen the whole push,
+// which carries the values if the watch was set with WatchOpt.
+func (c *Client) ListenDataOprPushWithValue(cb func(pushData *DataOprPush)) {
+	if cb == nil {
+		return
+	}
+
+	c.addDataOprCb(cb)
+}
+
+func (c *Client) ListenConnChangePush(cb func(srvType uint32, srvNo uint32, connChangeType int)) {
+	if cb == nil {
+		return
+	}
+
+	c.lckConnCb.Lock()
+	defer c.lckConnCb.Unlock()
+
+	cbs := make([]func(srvType uint32, srvNo uint32, connChangeType int), 0, len(c.connCbs)+1)
+	cbs = append(cbs, c.connCbs...)
+	c.connCbs = append(cbs, cb)
+}
+
+// Subscribe return a subscription of the data pushes matched by filter, nil filter match all.
+// It only receives the pushes of the keys watched by the Watch methods, it doesn't watch any key itself.
+// bufSize <= 0 means SUBSCRIPTION_BUF_SIZE, the pushes are dropped if the buffer is full.
+func (c *Client) Subscribe(filter *SubscribeFilter, bufSize int) *Subscription {
+	return c.subMgr.Subscribe(filter, bufSize)
+}
+
+// SubscribeConnChange return a subscription of the connection change pushes, WatchConn must be called
+// to receive them. bufSize <= 0 means SUBSCRIPTION_BUF_SIZE, the pushes are dropped if the buffer is full.
+func (c *Client) SubscribeConnChange(bufSize int) *ConnSubscription {
+	return c.subMgr.SubscribeConnChange(bufSize)
+}
+
+// EnableCache cache the values read by GetSrv, GetSrvByKey and GetGlobalData.
+// The keys are watched with value on the first read, so the cache is kept current by the pushes,
+// and it is resynced after switching member. It must be called before Start.
+func (c *Client) EnableCache() {
+	c.EnableCacheWithSize(CACHE_MAX_ENTRY_NUM)
+}
+
+// EnableCacheWithSize cache at most maxEntryNum keys, the absent keys included.
+// The least recently used key is evicted and no longer watched.
+func (c *Client) EnableCacheWithSize(maxEntryNum int) {
+	if c.cache != nil {
+		return
+	}
+
+	c.cache = newClientCache(maxEntryNum)
+	c.ListenDataOprPushWithValue(c.cache.Apply)
+	c.ListenReconnect(c.resyncCache)
+}
+
+// GetLastRev return the latest revision received from data push,
+// watch with StartRev = GetLastRev() + 1 to resume after reconnect.
+func (c *Client) GetLastRev() int64 {
+	return atomic.LoadInt64(&c.lastRev)
+}
+
+func (c *Client) FetchFuncList() error {
+	err := c.getRpcPeer().FetchFuncList()
+	return c.ec.Throw("FetchFuncList", err)
+}
+
+// ListenReconnect listen the switch of member in cluster mode, the reconnect with SetDialer and the resync after
+// the registry dropped the pushes of the client, cb is called after the watches
+// are set again, and then a push of DATA_OPR_TYPE_RESYNCED is dispatched to the data listeners.
+func (c *Client) ListenReconnect(cb func(nodeId uint32)) {
+	if cb == nil {
+		return
+	}
+
+	c.lckFailover.Lock()
+	defer c.lckFailover.Unlock()
+
+	c.reconnectCbs = append(c.reconnectCbs, cb)
+}
+
+// GetMembers return the members of the cluster and the leader id.
+func (c *Client) GetMembers() ([]*RaftMember, uint32, error) {
+	req := &GetMembersReq{}
+	resp := &GetMembersResp{}
+	err := c.rpcCall("GetMembers", req, resp)
+	if err != nil {
+		return nil, 0, c.ec.Throw("GetMembers", err)
+	}
+
+	return resp.Members, resp.LeaderId, nil
+}
+
+// GetCurNodeId return the member connected now, 0 if not in cluster mode.
+func (c *Client) GetCurNodeId() uint32 {
+	c.lckRpcPeer.RLock()
+	defer c.lckRpcPeer.RUnlock()
+
+	return c.curNodeId
+}
+
+func (c *Client) UpdateSrv(srvType uint32, srvNo uint32, bTemp bool, data []byte) error {
+	err := c.UpdateSrvWithLease(srvType, srvNo, bTemp, data, 0)
+	return c.ec.Throw("UpdateSrv", err)
+}
+
+func (c *Client) UpdateSrvWithLease(srvType uint32, srvNo uint32, bTemp bool, data []byte, ttlSec uint32) error {
+	err := c.UpdateSrvWithMeta(srvType, srvNo, bTemp, data, nil, ttlSec)
+	return c.ec.Throw("UpdateSrvWithLease", err)
+}
+
+// UpdateSrvWithMeta update the server with the structured meta,
+// the meta of an existing server is kept if meta is nil.
+func (c *Client) UpdateSrvWithMeta(srvType uint32, srvNo uint32, bTemp bool, data []byte, meta *SrvMeta, ttlSec uint32) error {
+	req := &UpdateSrvReq{}
+	req.SrvType = srvType
+	req.SrvNo = srvNo
+	req.IsTemp = bTemp
+	req.DataBase64 = base64.StdEncoding.EncodeToString(data)
+	req.Meta = meta
+	req.TTL = ttlSec
+
+	// resp := &BaseResp{}
+	err := c.rpcCall("UpdateSrv", req, nil)
+	return c.ec.Throw("UpdateSrvWithMeta", err)
+}
+
+// SetSrvStatus set the status of a server, the server is kept in the registry.
+func (c *Client) SetSrvStatus(srvType uint32, srvNo uint32, status string) error {
+	req := &SetSrvStatusReq{
+		SrvType: srvType,
+		SrvNo:   srvNo,
+		Status:  status,
+	}
+
+	// resp := &BaseResp{}
+	code, err := c.rpcCallWithCode("SetSrvStatus", req, nil)
+	if code == RES_CODE_SRV_NOT_EXISTS {
+		return c.ec.Throw("SetSrvStatus", ErrSrvNotExists)
+	}
+
+	return c.ec.Throw("SetSrvStatus", err)
+}
+
+func (c *Client) KeepAlive(srvType uint32, srvNo uint32) (uint32, error) {
+	req := &KeepAliveReq{
+		SrvType: srvType,
+		SrvNo:   srvNo,
+	}
+
+	resp := &KeepAliveResp{}
+	err := c.rpcCall("KeepAlive", req, resp)
+	if err != nil {
+		return 0, c.ec.Throw("KeepAlive", err)
+	}
+
+	return resp.TTL, nil
+}
+
+// CompareAndUpdateSrv update the server only if cmp matches,
+// otherwise return false with the current server information.
+func (c *Client) CompareAndUpdateSrv(srvType uint32, srvNo uint32, bTemp bool, data []byte, cmp *Compare) (bool, *SrvInfo, KeyRev, error) {
+	req := &CompareAndUpdateSrvReq{}
+	req.SrvType = srvType
+	req.SrvNo = srvNo
+	req.IsTemp = bTemp
+	req.DataBase64 = base64.StdEncoding.EncodeToString(data)
+	req.Cmp = cmp
+
+	resp := &CompareAndUpdateSrvResp{}
+	code, err := c.rpcCallWithCode("CompareAndUpdateSrv", req, resp)
+	if code == RES_CODE_COMPARE_FAILED {
+		return false, resp.Data, resp.KeyRev, nil
+	}
+
+	if err != nil {
+		return false, nil, KeyRev{}, c.ec.Throw("CompareAndUpdateSrv", err)
+	}
+
+	return true, resp.Data, resp.KeyRev, nil
+}
+
+func (c *Client) RemoveSrv(srvType uint32, srvNo uint32) error {
+	req := &RemoveSrvReq{
+		SrvType: srvType,
+		SrvNo:   srvNo,
+	}
+
+	// resp := &BaseResp{}
+	err := c.rpcCall("RemoveSrv", req, nil)
+	return c.ec.Throw("RemoveSrv", err)
+}
+
+func (c *Client) GetSrv(srvType uint32, srvNo uint32) (*SrvInfo, error) {
+	if c.cache != nil {
+		value, err := c.getCachedValue(KEY_TYPE_SRV_INFO, GetSrvKey(srvType, srvNo))
+		if err != nil {
+			return nil, c.ec.Throw("GetSrv", err)
+		}
+
+		return value.(*SrvInfo), nil
+	}
+
+	info, _, err := c.GetSrvAtRev(srvType, srvNo, 0)
+	if err != nil {
+		return nil, c.ec.Throw("GetSrv", err)
+	}
+
+	return info, nil
+}
+
+func (c *Client) GetSrvAtRev(srvType uint32, srvNo uint32, rev int64) (*SrvInfo, KeyRev, error) {
+	req := &GetSrvReq{
+		SrvType: srvType,
+		SrvNo:   srvNo,
+		Rev:     rev,
+	}
+
+	resp := &GetSrvResp{}
+	err := c.rpcCall("GetSrv", req, resp)
+	if err != nil {
+		return nil, KeyRev{}, c.ec.Throw("GetSrvAtRev", err)
+	}
+
+	return resp.Data, resp.KeyRev, nil
+}
+
+func (c *Client) GetSrvByKey(key string) (*SrvInfo, error) {
+	if c.cache != nil {
+		value, err := c.getCachedValue(KEY_TYPE_SRV_INFO, key)
+		if err != nil {
+			return nil, c.ec.Throw("GetSrvByKey", err)
+		}
+
+		return value.(*SrvInfo), nil
+	}
+
+	info, _, err := c.GetSrvByKeyAtRev(key, 0)
+	if err != nil {
+		return nil, c.ec.Throw("GetSrvByKey", err)
+	}
+
+	return info, nil
+}
+
+func (c *Client) GetSrvByKeyAtRev(key string, rev int64) (*SrvInfo, KeyRev, error) {
+	req := &GetSrvByKeyReq{
+		Key: key,
+		Rev: rev,
+	}
+
+	resp := &GetSrvByKeyResp{}
+	err := c.rpcCall("GetSrvByKey", req, resp)
+	if err != nil {
+		return nil, KeyRev{}, c.ec.Throw("GetSrvByKeyAtRev", err)
+	}
+
+	return resp.Data, resp.KeyRev, nil
+}
+
+func (c *Client) GetSrvsByType(srvType uint32) ([]*SrvInfo, error) {
+	infos, err := c.GetSrvsByTypeWithFilter(srvType, nil)
+	if err != nil {
+		return nil, c.ec.Throw("GetSrvsByType", err)
+	}
+
+	return infos, nil
+}
+
+// GetSrvsByTypeWithFilter return the servers of the type which match the filter.
+func (c *Client) GetSrvsByTypeWithFilter(srvType uint32, filter *SrvFilter) ([]*SrvInfo, error) {
+	req := &GetSrvsByTypeReq{
+		SrvType: srvType,
+		Filter:  filter,
+	}
+
+	resp := &GetSrvsByTypeResp{}
+	err := c.rpcCall("GetSrvsByType", req, resp)
+	if err != nil {
+		return nil, c.ec.Throw("GetSrvsByTypeWithFilter", err)
+	}
+
+	return resp.Data, nil
+}
+
+// FindSrvs return the servers of all the types which match the selector, e.g. "zone=eu,canary".
+func (c *Client) FindSrvs(selector string) ([]*SrvInfo, error) {
+	infos, err := c.findSrvs(0, false, selector)
+	if err != nil {
+		return nil, c.ec.Throw("FindSrvs", err)
+	}
+
+	return infos, nil
+}
+
+func (c *Client) FindSrvsByType(srvType uint32, selector string) ([]*SrvInfo, error) {
+	infos, err := c.findSrvs(srvType, true, selector)
+	if err != nil {
+		return nil, c.ec.Throw("FindSrvsByType", err)
+	}
+
+	return infos, nil
+}
+
+// Txn apply thenOps if all the compares matched, otherwise apply elseOps.
+// Return whether the compares matched and the result of each operation applied,
+// the values of the keys which can not be read by the client are stripped from the results.
+func (c *Client) Txn(cmps []*TxnCompare, thenOps []*TxnOp, elseOps []*TxnOp) (bool, []*DataOprPush, error) {
+	req := &TxnReq{
+		Compares: cmps,
+		Success:  thenOps,
+		Failure:  elseOps,
+	}
+
+	resp := &TxnResp{}
+	err := c.rpcCall("Txn", req, resp)
+	if err != nil {
+		return false, nil, c.ec.Throw("Txn", err)
+	}
+
+	return resp.Succeeded, resp.Results, nil
+}
+
+func (c *Client) WatchSrv(srvType uint32, srvNo uint32) error {
+	err := c.WatchSrvWithOpt(srvType, srvNo, WatchOpt{})
+	return c.ec.Throw("WatchSrv", err)
+}
+
+func (c *Client) WatchSrvWithOpt(srvType uint32, srvNo uint32, opt WatchOpt) error {
+	req := &WatchSrvReq{
+		SrvType:  srvType,
+		SrvNo:    srvNo,
+		WatchOpt: opt,
+	}
+
+	// resp := &BaseResp{}
+	err := c.watchCall("WatchSrv", req)
+	if err != nil {
+		return c.ec.Throw("WatchSrvWithOpt", err)
+	}
+
+	c.watches.Add(getSrvWatchRecordKey(srvType, srvNo), newSrvWatchRecord(srvType, srvNo, opt))
+	return nil
+}
+
+// StopWatchSrv stop the watch, it is kept while the cache still use it.
+func (c *Client) StopWatchSrv(srvType uint32, srvNo uint32) error {
+	req := &StopWatchSrvReq{
+		SrvType: srvType,
+		SrvNo:   srvNo,
+	}
+
+	// resp := &BaseResp{}
+	if !c.watches.Remove(getSrvWatchRecordKey(srvType, srvNo)) {
+		return nil
+	}
+
+	err := c.rpcCall("StopWatchSrv", req, nil)
+	return c.ec.Throw("StopWatchSrv", err)
+}
+
+func (c *Client) WatchSrvsByType(srvType uint32) error {
+	err := c.WatchSrvsByTypeWithOpt(srvType, WatchOpt{})
+	return c.ec.Throw("WatchSrvsByType", err)
+}
+
+func (c *Client) WatchSrvsByTypeWithOpt(srvType uint32, opt WatchOpt) error {
+	req := &WatchSrvsByTypeReq{
+		SrvType:  srvType,
+		WatchOpt: opt,
+	}
+
+	// resp := &BaseResp{}
+	err := c.watchCall("WatchSrvsByType", req)
+	if err != nil {
+		return c.ec.Throw("WatchSrvsByTypeWithOpt", err)
+	}
+
+	c.watches.Add(getSrvTypeWatchRecordKey(srvType), newSrvTypeWatchRecord(srvType, opt))
+	return nil
+}
+
+// StopWatchSrvsByType stop the watch, it is kept while the picker still use it.
+func (c *Client) StopWatchSrvsByType(srvType uint32) error {
+	req := &StopWatchSrvsByTypeReq{
+		SrvType: srvType,
+	}
+
+	// resp := &BaseResp{}
+	if !c.watches.Remove(getSrvTypeWatchRecordKey(srvType)) {
+		return nil
+	}
+
+	err := c.rpcCall("StopWatchSrvsByType", req, nil)
+	return c.ec.Throw("StopWatchSrvsByType", err)
+}
+
+// WatchSrvsBySelector watch the servers of all the types which match the selector,
+// a push is received when a server matched before or after the change is changed.
+func (c *Client) WatchSrvsBySelector(selector string, opt WatchOpt) error {
+	req := &WatchSrvsBySelectorReq{
+		Selector: selector,
+		WatchOpt: opt,
+	}
+
+	// resp := &BaseResp{}
+	err := c.rpcCall("WatchSrvsBySelector", req, nil)
+	if err != nil {
+		return c.ec.Throw("WatchSrvsBySelector", err)
+	}
+
+	c.addSelectorWatchRecord(0, false, selector, opt)
+	return nil
+}
+
+func (c *Client) WatchSrvsByTypeAndSelector(srvType uint32, selector string, opt WatchOpt) error {
+	req := &WatchSrvsBySelectorReq{
+		Selector: selector,
+		SrvType:  srvType,
+		ByType:   true,
+		WatchOpt: opt,
+	}
+
+	// resp := &BaseResp{}
+	err := c.rpcCall("WatchSrvsBySelector", req, nil)
+	if err != nil {
+		return c.ec.Throw("WatchSrvsByTypeAndSelector", err)
+	}
+
+	c.addSelectorWatchRecord(srvType, true, selector, opt)
+	return nil
+}
+
+func (c *Client) StopWatchSrvsBySelector(selector string) error {
+	req := &StopWatchSrvsBySelectorReq{
+		Selector: selector,
+	}
+
+	// resp := &BaseResp{}
+	c.watches.Remove(getSelectorWatchRecordKey(0, false, selector))
+	err := c.rpcCall("StopWatchSrvsBySelector", req, nil)
+	return c.ec.Throw("StopWatchSrvsBySelector", err)
+}
+
+func (c *Client) StopWatchSrvsByTypeAndSelector(srvType uint32, selector string) error {
+	req := &StopWatchSrvsBySelectorReq{
+		Selector: selector,
+		SrvType:  srvType,
+		ByType:   true,
+	}
+
+	// resp := &BaseResp{}
+	c.watches.Remove(getSelectorWatchRecordKey(srvType, true, selector))
+	err := c.rpcCall("StopWatchSrvsBySelector", req, nil)
+	return c.ec.Throw("StopWatchSrvsByTypeAndSelector", err)
+}
+
+func (c *Client) UpdateGlobalData(key string, data []byte) error {
+	req := &UpdateGlobalDataReq{
+		Key:        key,
+		DataBase64: base64.StdEncoding.EncodeToString(data),
+	}
+
+	// resp := &BaseResp{}
+	err := c.rpcCall("UpdateGlobalData", req, nil)
+	return c.ec.Throw("UpdateGlobalData", err)
+}
+
+// CompareAndUpdateGlobalData update the global data only if cmp matches,
+// otherwise return false with the current data.
+func (c *Client) CompareAndUpdateGlobalData(key string, data []byte, cmp *Compare) (bool, []byte, KeyRev, error) {
+	req := &CompareAndUpdateGlobalDataReq{
+		Key:        key,
+		DataBase64: base64.StdEncoding.EncodeToString(data),
+		Cmp:        cmp,
+	}
+
+	resp := &CompareAndUpdateGlobalDataResp{}
+	code, err := c.rpcCallWithCode("CompareAndUpdateGlobalData", req, resp)
+	if code != RES_CODE_COMPARE_FAILED && err != nil {
+		return false, nil, KeyRev{}, c.ec.Throw("CompareAndUpdateGlobalData", err)
+	}
+
+	curData, decErr := base64.StdEncoding.DecodeString(resp.DataBase64)
+	if decErr != nil {
+		return false, nil, KeyRev{}, c.ec.Throw("CompareAndUpdateGlobalData", decErr)
+	}
+
+	return (code != RES_CODE_COMPARE_FAILED), curData, resp.KeyRev, nil
+}
+
+func (c *Client) RemoveGlobalData(key string) error {
+	req := &RemoveGlobalDataReq{
+		Key: key,
+	}
+
+	// resp := &BaseResp{}
+	err := c.rpcCall("RemoveGlobalData", req, nil)
+	return c.ec.Throw("RemoveGlobalData", err)
+}
+
+func (c *Client) GetGlobalData(key string) ([]byte, error) {
+	if c.cache != nil {
+		value, err := c.getCachedValue(KEY_TYPE_GLOBAL_DATA, key)
+		if err != nil {
+			return nil, c.ec.Throw("GetGlobalData", err)
+		}
+
+		data, err := base64.StdEncoding.DecodeString(value.(string))
+		if err != nil {
+			return nil, c.ec.Throw("GetGlobalData", err)
+		}
+
+		return data, nil
+	}
+
+	data, _, err := c.GetGlobalDataAtRev(key, 0)
+	if err != nil {
+		return nil, c.ec.Throw("GetGlobalData", err)
+	}
+
+	return data, nil
+}
+
+func (c *Client) GetGlobalDataAtRev(key string, rev int64) ([]byte, KeyRev, error) {
+	req := &GetGlobalDataReq{
+		Key: key,
+		Rev: rev,
+	}
+
+	resp := &GetGlobalDataResp{}
+	err := c.rpcCall("GetGlobalData", req, resp)
+	if err != nil {
+		return nil, KeyRev{}, c.ec.Throw("GetGlobalDataAtRev", err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(resp.DataBase64)
+	if err != nil {
+		return nil, KeyRev{}, c.ec.Throw("GetGlobalDataAtRev", err)
+	}
+
+	return data, resp.KeyRev, nil
+}
+
+func (c *Client) WatchGlobalData(key string) error {
+	err := c.WatchGlobalDataWithOpt(key, WatchOpt{})
+	return c.ec.Throw("WatchGlobalData", err)
+}
+
+func (c *Client) WatchGlobalDataWithOpt(key string, opt WatchOpt) error {
+	req := &WatchGlobalDataReq{
+		Key:      key,
+		WatchOpt: opt,
+	}
+
+	// resp := &BaseResp{}
+	err := c.watchCall("WatchGlobalData", req)
+	if err != nil {
+		return c.ec.Throw("WatchGlobalDataWithOpt", err)
+	}
+
+	c.watches.Add(getGlobalDataWatchRecordKey(key), newGlobalDataWatchRecord(key, opt))
+	return nil
+}
+
+// StopWatchGlobalData stop the watch, it is kept while the cache still use it.
+func (c *Client) StopWatchGlobalData(key string) error {
+	req := &StopWatchGlobalDataReq{
+		Key: key,
+	}
+
+	// resp := &BaseResp{}
+	if !c.watches.Remove(getGlobalDataWatchRecordKey(key)) {
+		return nil
+	}
+
+	err := c.rpcCall("StopWatchGlobalData", req, nil)
+	return c.ec.Throw("StopWatchGlobalData", err)
+}
+
+func (c *Client) WatchConn() error {
+	req := &WatchConnReq{}
+	// resp := &BaseResp{}
+	err := c.rpcCall("WatchConn", req, nil)
+	if err != nil {
+		return c.ec.Throw("WatchConn", err)
+	}
+
+	c.watches.Add(WATCH_RECORD_CONN, &watchRecord{
+		funcName: "WatchConn",
+		bDataRev: false,
+		newReq: func(opt WatchOpt) interface{} {
+			return &WatchConnReq{}
+		},
+	})
+
+	return nil
+}
+
+func (c *Client) StopWatchConn() error {
+	req := &StopWatchConnReq{}
+	// resp := &BaseResp{}
+	c.watches.Remove(WATCH_RECORD_CONN)
+	err := c.rpcCall("StopWatchConn", req, nil)
+	return c.ec.Throw("StopWatchConn", err)
+}
+
+func (c *Client) StopAllWatch(srvType uint32, srvNo uint32) error {
+	req := &StopAllWatchReq{
+		SrvType: srvType,
+		SrvNo:   srvNo,
+	}
+
+	// resp := &BaseResp{}
+	err := c.rpcCall("StopAllWatch", req, nil)
+	return c.ec.Throw("StopAllWatch", err)
+}
+
+// Lock acquire the lock, if it is held by another server, wait in order until timeout.
+// The lock is owned by the server of the client, so the callers of the client are serialized by name
+// like a sync.Mutex, and it is released when the connection is closed.
+func (c *Client) Lock(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	if !c.acquireLocalLock(name, timeout) {
+		return c.ec.Throw("Lock", ErrLockTimeout)
+	}
+
+	chanGranted := c.addLockWaiter(name)
+	defer c.removeLockWaiter(name, chanGranted)
+
+	req := &LockReq{
+		Name: name,
+		Wait: true,
+	}
+
+	resp := &LockResp{}
+	_, err := c.lockCall("Lock", name, req, resp, time.Until(deadline), true)
+	if err != nil {
+		// the local lock is released by the late cancel on timeout
+		if err != ErrLockTimeout {
+			c.releaseLocalLock(name)
+		}
+
+		return c.ec.Throw("Lock", err)
+	}
+
+	if resp.Acquired {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-chanGranted:
+		return nil
+	case <-timer.C:
+	}
+
+	// stop waiting, the lock is released if it was handed to us just now
+	c.cancelLock(name)
+	c.releaseLocalLock(name)
+	return c.ec.Throw("Lock", ErrLockTimeout)
+}
+
+// TryLock acquire the lock without waiting, return false if it is held by another server
+// or another caller of the client.
+func (c *Client) TryLock(name string, timeout time.Duration) (bool, error) {
+	if !c.tryAcquireLocalLock(name) {
+		return false, nil
+	}
+
+	req := &LockReq{
+		Name: name,
+		Wait: false,
+	}
+
+	resp := &LockResp{}
+	_, err := c.lockCall("Lock", name, req, resp, timeout, true)
+	if err != nil {
+		if err != ErrLockTimeout {
+			c.releaseLocalLock(name)
+		}
+
+		return false, c.ec.Throw("TryLock", err)
+	}
+
+	if !resp.Acquired {
+		c.releaseLocalLock(name)
+	}
+
+	return resp.Acquired, nil
+}
+
+// Unlock release the lock, the first waiter get the lock.
+func (c *Client) Unlock(name string, timeout time.Duration) error {
+	req := &UnlockReq{
+		Name: name,
+	}
+
+	// resp := &BaseResp{}
+	code, err := c.lockCall("Unlock", name, req, nil, timeout, false)
+	if code == RES_CODE_LOCK_NOT_OWNER {
+		c.releaseLocalLock(name)
+		return c.ec.Throw("Unlock", ErrLockNotOwner)
+	}
+
+	if err != nil {
+		return c.ec.Throw("Unlock", err)
+	}
+
+	c.releaseLocalLock(name)
+	return nil
+}
+
+// Campaign run for the leader of the server type of the client, return true if it is the leader now.
+// Otherwise it becomes the leader in order, use ObserveLeader with its own type to be notified.
+func (c *Client) Campaign() (bool, error) {
+	req := &CampaignReq{}
+	resp := &CampaignResp{}
+	err := c.rpcCall("Campaign", req, resp)
+	if err != nil {
+		return false, c.ec.Throw("Campaign", err)
+	}
+
+	return resp.IsLeader, nil
+}
+
+// Resign give up the leadership or stop campaigning.
+func (c *Client) Resign() error {
+	req := &ResignReq{}
+	// resp := &BaseResp{}
+	code, err := c.rpcCallWithCode("Resign", req, nil)
+	if code == RES_CODE_NOT_ELECTION_LEADER {
+		return c.ec.Throw("Resign", ErrNotElectionLeader)
+	}
+
+	return c.ec.Throw("Resign", err)
+}
+
+// GetLeader return the leader of the server type, false if there is no leader.
+func (c *Client) GetLeader(srvType uint32) (uint32, bool, error) {
+	req := &GetLeaderReq{
+		SrvType: srvType,
+	}
+
+	resp := &GetLeaderResp{}
+	err := c.rpcCall("GetLeader", req, resp)
+	if err != nil {
+		return 0, false, c.ec.Throw("GetLeader", err)
+	}
+
+	return resp.LeaderNo, resp.HasLeader, nil
+}
+
+// ObserveLeader call cb when the leader of the server type is changed.
+// It is observed again after reconnect, and cb is called with the leader at that time.
+func (c *Client) ObserveLeader(srvType uint32, cb func(leaderNo uint32, bHasLeader bool)) error {
+	if cb == nil {
+		return nil
+	}
+
+	c.lckLeaderCb.Lock()
+	c.mapLeaderCb[srvType] = cb
+	c.lckLeaderCb.Unlock()
+
+	req := &ObserveLeaderReq{
+		SrvType: srvType,
+	}
+
+	// resp := &BaseResp{}
+	err := c.rpcCall("ObserveLeader", req, nil)
+	if err != nil {
+		return c.ec.Throw("ObserveLeader", err)
+	}
+
+	c.watches.Add(getLeaderWatchRecordKey(srvType), &watchRecord{
+		funcName: "ObserveLeader",
+		bDataRev: false,
+		newReq: func(opt WatchOpt) interface{} {
+			return &ObserveLeaderReq{SrvType: srvType}
+		},
+	})
+
+	return nil
+}
+
+func (c *Client) StopObserveLeader(srvType uint32) error {
+	c.lckLeaderCb.Lock()
+	delete(c.mapLeaderCb, srvType)
+	c.lckLeaderCb.Unlock()
+
+	c.watches.Remove(getLeaderWatchRecordKey(srvType))
+
+	req := &StopObserveLeaderReq{
+		SrvType: srvType,
+	}
+
+	// resp := &BaseResp{}
+	err := c.rpcCall("StopObserveLeader", req, nil)
+	return c.ec.Throw("StopObserveLeader", err)
+}
+
+// func (c *Client) fetchRegFuncListCb(respData []byte) (*rpc.FetchFuncListResp, error) {
+// 	resp := &rpc.FetchFuncListResp{}
+// 	err := json.Unmarshal(respData, resp)
+// 	if err != nil {
+// 		c.logger.E("fetchRegFuncListCb json.Unmarshal err: ", err)
+// 		return nil, c.ec.Throw("fetchRegFuncListCb", err)
+// 	}
+
+// 	return resp, nil
+// }
+
+type nsSetter interface {
+	SetNamespace(ns string)
+}
+
+func (c *Client) rpcCall(funcName string, req interface{}, resp interface{}) error {
+	_, err := c.rpcCallWithCode(funcName, req, resp)
+	return err
+}
+
+func (c *Client) rpcCallWithCode(funcName string, req interface{}, resp interface{}) (int32, error) {
+	var err error = nil
+	defer c.ec.DeferThrow("rpcCallWithCode", &err)
+
+	// reqData, err := json.Marshal(req)
+	// if err != nil {
+	// 	c.logger.E("rpcCall json.Marshal err: ", err)
+	// 	return err
+	// }
+
+	// params := make([]rpc.ByteArray, 0)
+	// params = append(params, reqData)
+	if nsReq, ok := req.(nsSetter); ok {
+		nsReq.SetNamespace(c.namespace)
+	}
+
+	code, err := c.getRpcPeer().Call(REG_SERVIC_NAME, funcName, req, resp)
+	if code == RES_CODE_PERMISSION_DENIED {
+		err = ErrPermissionDenied
+	}
+
+	if code == RES_CODE_QUOTA_EXCEEDED {
+		err = ErrQuotaExceeded
+	}
+
+	if err != nil && c.dialer != nil && c.isFailoverCode(code) {
+		// the write is not applied if rejected by a follower, so retry it on the leader
+		bRetry := (code == RES_CODE_NOT_LEADER)
+		ferr := c.failover(false)
+		if ferr == nil && bRetry {
+			code, err = c.getRpcPeer().Call(REG_SERVIC_NAME, funcName, req, resp)
+		}
+	}
+
+	if err != nil {
+		c.logger.E("rpcCall rpcPeer.Call err, code = ", code, ", ", err)
+	}
+	return code, err
+	// if err != nil {
+	// 	c.logger.E("rpcCall rpcPeer.Call err: ", err)
+	// 	return err
+	// }
+
+	// err = json.Unmarshal(respData, resp)
+	// if err != nil {
+	// 	c.logger.E("rpcCall json.Unmarshal err: ", err)
+	// 	return err
+	// }
+
+	// if resp.GetResCode() != RES_CODE_SUCC {
+	// 	c.logger.W("rpcCall failed, ", resp.GetResCode(), ", ", resp.GetResMsg())
+	// 	err = ErrRegCallFailed
+	// 	return err
+	// }
+
+	// return nil
+}
+
+func (c *Client) findSrvs(srvType uint32, bByType bool, selector string) ([]*SrvInfo, error) {
+	req := &FindSrvsReq{
+		Selector: selector,
+		SrvType:  srvType,
+		ByType:   bByType,
+	}
+
+	resp := &FindSrvsResp{}
+	err := c.rpcCall("FindSrvs", req, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Data, nil
+}
+
+func (c *Client) watchCall(funcName string, req interface{}) error {
+	code, err := c.rpcCallWithCode(funcName, req, nil)
+	if code == RES_CODE_REVISION_COMPACTED {
+		return ErrRevisionCompacted
+	}
+
+	return err
+}
+
+// dataOprPushLoop dispatch each push to all the listeners.
+func (c *Client) dataOprPushLoop() {
+	for {
+		pack, ok := c.observer.PopDataOprPack()
+		if !ok {
+			break
+		}
+
+		if pack.Operate == DATA_OPR_TYPE_RESYNC {
+			c.onPushDropped()
+			continue
+		}
+
+		c.updateLastRev(pack.ModRev)
+		c.dispatchDataOpr(pack)
+	}
+
+	c.subMgr.Close()
+}
+
+// dispatchDataOpr call the listeners and the subscriptions in order,
+// the pushes and the synthetic resynced events are not dispatched at the same time.
+func (c *Client) dispatchDataOpr(pack *DataOprPush) {
+	c.lckDispatch.Lock()
+	defer c.lckDispatch.Unlock()
+
+	c.lckDataOprCb.RLock()
+	cbs := c.dataOprCbs
+	c.lckDataOprCb.RUnlock()
+
+	for _, cb := range cbs {
+		cb(pack)
+	}
+
+	c.subMgr.DeliverDataOpr(pack)
+}
+
+func (c *Client) addDataOprCb(cb func(pushData *DataOprPush)) {
+	c.lckDataOprCb.Lock()
+	defer c.lckDataOprCb.Unlock()
+
+	cbs := make([]func(pushData *DataOprPush), 0, len(c.dataOprCbs)+1)
+	cbs = append(cbs, c.dataOprCbs...)
+	c.dataOprCbs = append(cbs, cb)
+}
+
+// connChangePushLoop dispatch each push to all the listeners, it always runs
+// so the connection change pushes nobody listens are not queued by the observer.
+func (c *Client) connChangePushLoop() {
+	for {
+		pack, ok := c.observer.PopConnChangePack()
+		if !ok {
+			break
+		}
+
+		c.lckConnCb.RLock()
+		cbs := c.connCbs
+		c.lckConnCb.RUnlock()
+
+		for _, cb := range cbs {
+			cb(pack.SrvType, pack.SrvNo, pack.ConnChangeType)
+		}
+
+		c.subMgr.DeliverConnChange(pack)
+	}
+
+	c.subMgr.Close()
+}
+
+func (c *Client) lockPushLoop() {
+	for {
+		pack, ok := c.observer.PopLockPack()
+		if !ok {
+			break
+		}
+
+		c.lckLock.Lock()
+		chanGranted, ok := c.mapLock2Chan[pack.Name]
+		c.lckLock.Unlock()
+
+		if ok {
+			select {
+			case chanGranted <- true:
+			default:
+			}
+		}
+	}
+}
+
+func (c *Client) leaderPushLoop() {
+	for {
+		pack, ok := c.observer.PopLeaderPack()
+		if !ok {
+			break
+		}
+
+		c.lckLeaderCb.RLock()
+		cb, ok := c.mapLeaderCb[pack.SrvType]
+		c.lckLeaderCb.RUnlock()
+
+		if ok {
+			cb(pack.LeaderNo, pack.HasLeader)
+		}
+	}
+}
+
+// healthPingLoop answer the health pings of the reg center.
+func (c *Client) healthPingLoop() {
+	for {
+		pack, ok := c.observer.PopHealthPingPack()
+		if !ok {
+			break
+		}
+
+		req := &HealthPongReq{
+			Seq: pack.Seq,
+		}
+
+		// resp := &BaseResp{}
+		err := c.rpcCall("HealthPong", req, nil)
+		if err != nil {
+			c.logger.E("health pong err: ", err)
+		}
+	}
+}
+
+func (c *Client) getCachedValue(keyType int, key string) (interface{}, error) {
+	value, bExists, ok := c.cache.Get(keyType, key)
+	if !ok {
+		var err error = nil
+		value, bExists, err = c.fillCache(keyType, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if bExists {
+		return value, nil
+	}
+
+	if keyType == KEY_TYPE_SRV_INFO {
+		return nil, ErrSrvNotExists
+	}
+
+	return nil, ErrGlobalDataNotExists
+}
+
+// fillCache watch the key before fetching it, so no change is missed.
+// The key is watched once when it is added to the cache, the absent key is cached too.
+func (c *Client) fillCache(keyType int, key string) (interface{}, bool, error) {
+	bAdded, evicted := c.cache.Reserve(keyType, key)
+	for _, entry := range evicted {
+		c.stopWatchCache(entry.keyType, entry.key)
+	}
+
+	if bAdded {
+		err := c.watchCache(keyType, key)
+		if err != nil {
+			c.cache.Remove(keyType, key)
+			return nil, false, err
+		}
+	}
+
+	return c.fetchCache(keyType, key)
+}
+
+func (c *Client) fetchCache(keyType int, key string) (interface{}, bool, error) {
+	var value interface{} = nil
+	var modRev int64 = 0
+	var code int32 = 0
+	var err error = nil
+	if keyType == KEY_TYPE_SRV_INFO {
+		req := &GetSrvByKeyReq{Key: key}
+		resp := &GetSrvByKeyResp{}
+		code, err = c.rpcCallWithCode("GetSrvByKey", req, resp)
+		value, modRev = resp.Data, resp.ModRev
+	} else {
+		req := &GetGlobalDataReq{Key: key}
+		resp := &GetGlobalDataResp{}
+		code, err = c.rpcCallWithCode("GetGlobalData", req, resp)
+		value, modRev = resp.DataBase64, resp.ModRev
+	}
+
+	bExists := true
+	if code == RES_CODE_SRV_NOT_EXISTS || code == RES_CODE_GLOBAL_DATA_NOT_EXISTS {
+		value, bExists, err = nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	value, bExists = c.cache.Set(keyType, key, value, modRev, bExists)
+	return value, bExists, nil
+}
+
+func (c *Client) watchCache(keyType int, key string) error {
+	opt := WatchOpt{WithValue: true}
+	if keyType == KEY_TYPE_SRV_INFO {
+		srvType, srvNo := GetSrvTypeAndNo(key)
+		return c.watchShared(getSrvWatchRecordKey(srvType, srvNo), newSrvWatchRecord(srvType, srvNo, opt))
+	}
+
+	return c.watchShared(getGlobalDataWatchRecordKey(key), newGlobalDataWatchRecord(key, opt))
+}
+
+func (c *Client) stopWatchCache(keyType int, key string) {
+	var err error = nil
+	if keyType == KEY_TYPE_SRV_INFO {
+		srvType, srvNo := GetSrvTypeAndNo(key)
+		req := &StopWatchSrvReq{SrvType: srvType, SrvNo: srvNo}
+		err = c.stopWatchShared(getSrvWatchRecordKey(srvType, srvNo), "StopWatchSrv", req)
+	} else {
+		req := &StopWatchGlobalDataReq{Key: key}
+		err = c.stopWatchShared(getGlobalDataWatchRecordKey(key), "StopWatchGlobalData", req)
+	}
+
+	if err != nil {
+		c.logger.W("stop watch cache ", key, " err: ", err)
+	}
+}
+
+// resyncCache fetch all the cached keys again, the watches are set again before it.
+func (c *Client) resyncCache(nodeId uint32) {
+	entries := c.cache.ResetRevisions()
+	for _, entry := range entries {
+		_, _, err := c.fetchCache(entry.keyType, entry.key)
+		if err != nil {
+			c.logger.W("resync cache ", entry.key, " err: ", err)
+		}
+	}
+}
+
+func (c *Client) addLockWaiter(name string) chan bool {
+	c.lckLock.Lock()
+	defer c.lckLock.Unlock()
+
+	chanGranted := make(chan bool, 1)
+	c.mapLock2Chan[name] = chanGranted
+	return chanGranted
+}
+
+// removeLockWaiter remove the waiter if it is not replaced by the next caller.
+func (c *Client) removeLockWaiter(name string, chanGranted chan bool) {
+	c.lckLock.Lock()
+	defer c.lckLock.Unlock()
+
+	if c.mapLock2Chan[name] == chanGranted {
+		delete(c.mapLock2Chan, name)
+	}
+}
+
+// getLockSem return the semaphore which serialize the callers of the lock.
+func (c *Client) getLockSem(name string) chan bool {
+	c.lckLock.Lock()
+	defer c.lckLock.Unlock()
+
+	sem, ok := c.mapLock2Sem[name]
+	if !ok {
+		sem = make(chan bool, 1)
+		c.mapLock2Sem[name] = sem
+	}
+
+	return sem
+}
+
+func (c *Client) acquireLocalLock(name string, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case c.getLockSem(name) <- true:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *Client) tryAcquireLocalLock(name string) bool {
+	select {
+	case c.getLockSem(name) <- true:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) releaseLocalLock(name string) {
+	select {
+	case <-c.getLockSem(name):
+	default:
+	}
+}
+
+// lockCall return ErrLockTimeout if the call is not finished in time, in this case
+// the lock is canceled and the local lock is released after the call finished if bCancelLate is true.
+func (c *Client) lockCall(funcName string, name string, req interface{}, resp interface{}, timeout time.Duration, bCancelLate bool) (int32, error) {
+	type callResult struct {
+		code int32
+		err  error
+	}
+
+	chanResult := make(chan *callResult, 1)
+	go func() {
+		code, err := c.rpcCallWithCode(funcName, req, resp)
+		chanResult <- &callResult{code: code, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-chanResult:
+		return result.code, result.err
+	case <-timer.C:
+	}
+
+	if bCancelLate {
+		go func() {
+			<-chanResult
+			c.cancelLock(name)
+			c.releaseLocalLock(name)
+		}()
+	}
+
+	return 0, ErrLockTimeout
+}
+
+func (c *Client) cancelLock(name string) {
+	req := &UnlockReq{
+		Name: name,
+	}
+
+	err := c.rpcCall("Unlock", req, nil)
+	if err != nil {
+		c.logger.W("cancel lock ", name, " err: ", err)
+	}
+}
+
+func (c *Client) updateLastRev(rev int64) {
+	for {
+		lastRev := atomic.LoadInt64(&c.lastRev)
+		if rev <= lastRev || atomic.CompareAndSwapInt64(&c.lastRev, lastRev, rev) {
+			break
+		}
+	}
+}
+
+func (c *Client) getRpcPeer() *rpc.Pipeline {
+	c.lckRpcPeer.RLock()
+	defer c.lckRpcPeer.RUnlock()
+
+	return c.rpcPeer
+}
+
+func (c *Client) getToken() string {
+	c.lckRpcPeer.RLock()
+	defer c.lckRpcPeer.RUnlock()
+
+	return c.token
+}
+
+// isFailoverCode check if the member can not serve the request, a broken net is handled
+// by the observer of the member.
+func (c *Client) isFailoverCode(code int32) bool {
+	return code == RES_CODE_NOT_LEADER || code == RES_CODE_UNAVAILABLE
+}
+
+// onObserverBroken connect again every RECONNECT_INTERVAL_SEC until it succeeds or the client stops.
+func (c *Client) onObserverBroken() {
+	for {
+		err := c.failover(true)
+		if err == nil || atomic.LoadInt32(&c.bStop) == 1 {
+			break
+		}
+
+		c.logger.E("failover err: ", err)
+		time.Sleep(RECONNECT_INTERVAL_SEC * time.Second)
+	}
+}
+
+// failover ask the members for the leader in turn, and switch to it.
+// If there is no leader now, switch to the first reachable member.
+// The current member is connected again if bBroken, e.g. it is restarted.
+func (c *Client) failover(bBroken bool) error {
+	c.lckFailover.Lock()
+	defer c.lckFailover.Unlock()
+
+	if atomic.LoadInt32(&c.bStop) == 1 {
+		return ErrNoMemberAvailable
+	}
+
+	curNodeId := c.GetCurNodeId()
+	members := c.members
+	start := 0
+	for i, m := range members {
+		if m.NodeId == curNodeId {
+			start = i
+			break
+		}
+	}
+
+	for i := 0; i < len(members); i++ {
+		m := members[(start+i)%len(members)]
+		leaderId, err := c.queryLeader(m)
+		if err != nil {
+			c.logger.W("query leader from ", m.NodeId, " err: ", err)
+			continue
+		}
+
+		if leaderId != 0 && leaderId != m.NodeId {
+			leader, ok := c.findMember(leaderId)
+			if ok {
+				err = c.switchMember(leader, bBroken)
+				if err == nil {
+					return nil
+				}
+			}
+		}
+
+		err = c.switchMember(m, bBroken)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return ErrNoMemberAvailable
+}
+
+func (c *Client) queryLeader(m *RaftMember) (uint32, error) {
+	if m.NodeId == c.GetCurNodeId() {
+		resp := &GetMembersResp{}
+		_, err := c.getRpcPeer().Call(REG_SERVIC_NAME, "GetMembers", &GetMembersReq{}, resp)
+		if err == nil {
+			c.updateMembers(resp.Members)
+			return resp.LeaderId, nil
+		}
+	}
+
+	rpcNet, _, err := c.dialer(m)
+	if err != nil {
+		return 0, err
+	}
+
+	rpcPeer := newRegPipeline(rpcNet, m.PeerType, m.PeerNo)
+	go rpcPeer.Start()
+	defer rpcPeer.Stop()
+
+	err = rpcPeer.FetchFuncList()
+	if err != nil {
+		return 0, err
+	}
+
+	resp := &GetMembersResp{}
+	_, err = rpcPeer.Call(REG_SERVIC_NAME, "GetMembers", &GetMembersReq{}, resp)
+	if err != nil {
+		return 0, err
+	}
+
+	c.updateMembers(resp.Members)
+	return resp.LeaderId, nil
+}
+
+func (c *Client) switchMember(m *RaftMember, bReconnect bool) error {
+	if m.NodeId == c.GetCurNodeId() && !bReconnect {
+		return nil
+	}
+
+	rpcNet, observerNet, err := c.dialer(m)
+	if err != nil {
+		return err
+	}
+
+	rpcPeer := newRegPipeline(rpcNet, m.PeerType, m.PeerNo)
+	go rpcPeer.Start()
+
+	err = rpcPeer.FetchFuncList()
+	if err != nil {
+		rpcPeer.Stop()
+		return err
+	}
+
+	token := c.getToken()
+	if token != "" {
+		_, err = c.auth(rpcPeer, token)
+		if err != nil {
+			rpcPeer.Stop()
+			return err
+		}
+	}
+
+	c.lckRpcPeer.Lock()
+	old := c.rpcPeer
+	c.rpcPeer = rpcPeer
+	c.curNodeId = m.NodeId
+	c.lckRpcPeer.Unlock()
+
+	old.Stop()
+	c.observer.SwitchNet(observerNet, m.PeerType, m.PeerNo)
+	c.logger.I("switch to member ", m.NodeId)
+
+	cbs := make([]func(nodeId uint32), len(c.reconnectCbs))
+	copy(cbs, c.reconnectCbs)
+	go c.resyncWatches(m.NodeId, c.GetLastRev(), cbs)
+	return nil
+}
+
+// onPushDropped resync like reconnecting when the registry dropped the pushes after lastRev,
+// the pushes after the gap may be received again.
+func (c *Client) onPushDropped() {
+	c.logger.W("pushes dropped by the registry, resync from ", c.GetLastRev())
+
+	c.lckFailover.Lock()
+	cbs := make([]func(nodeId uint32), len(c.reconnectCbs))
+	copy(cbs, c.reconnectCbs)
+	c.lckFailover.Unlock()
+
+	go c.resyncWatches(c.GetCurNodeId(), c.GetLastRev(), cbs)
+}
+
+// resyncWatches set the recorded watches again on the new member, the data watches
+// resume from lastRev + 1, or from now if it is compacted.
+func (c *Client) resyncWatches(nodeId uint32, lastRev int64, cbs []func(nodeId uint32)) {
+	for _, record := range c.watches.GetAll() {
+		opt := record.opt
+		if record.bDataRev && lastRev > 0 {
+			opt.StartRev = lastRev + 1
+		}
+
+		err := c.watchCall(record.funcName, record.newReq(opt))
+		if err == ErrRevisionCompacted {
+			opt.StartRev = 0
+			err = c.watchCall(record.funcName, record.newReq(opt))
+		}
+
+		if err != nil {
+			c.logger.W("resync watch ", record.funcName, " err: ", err)
+		}
+	}
+
+	c.resyncLeaders()
+	for _, cb := range cbs {
+		go cb(nodeId)
+	}
+
+	if atomic.LoadInt32(&c.bStop) == 1 {
+		return
+	}
+
+	pushData := &DataOprPush{
+		Operate: DATA_OPR_TYPE_RESYNCED,
+	}
+
+	pushData.ModRev = lastRev
+	c.dispatchDataOpr(pushData)
+}
+
+// resyncLeaders call the observers of the leaders with the current leaders,
+// the changes during reconnect are not pushed.
+func (c *Client) resyncLeaders() {
+	c.lckLeaderCb.RLock()
+	mapLeaderCb := make(map[uint32]func(leaderNo uint32, bHasLeader bool), len(c.mapLeaderCb))
+	for srvType, cb := range c.mapLeaderCb {
+		mapLeaderCb[srvType] = cb
+	}
+
+	c.lckLeaderCb.RUnlock()
+
+	for srvType, cb := range mapLeaderCb {
+		leaderNo, bHasLeader, err := c.GetLeader(srvType)
+		if err != nil {
+			c.logger.W("resync leader of ", srvType, " err: ", err)
+			continue
+		}
+
+		cb(leaderNo, bHasLeader)
+	}
+}
+
+// watchShared set the watch of key for an internal watcher, e.g. the picker,
+// the watch is kept until the user and all the internal watchers stop it.
+func (c *Client) watchShared(key string, record *watchRecord) error {
+	err := c.watchCall(record.funcName, record.newReq(record.opt))
+	if err != nil {
+		return err
+	}
+
+	c.watches.AddRef(key, record)
+	return nil
+}
+
+// stopWatchShared stop the watch of key set by watchShared.
+func (c *Client) stopWatchShared(key string, funcName string, req interface{}) error {
+	if !c.watches.Release(key) {
+		return nil
+	}
+
+	return c.rpcCall(funcName, req, nil)
+}
+
+func newSrvWatchRecord(srvType uint32, srvNo uint32, opt WatchOpt) *watchRecord {
+	return &watchRecord{
+		funcName: "WatchSrv",
+		opt:      opt,
+		bDataRev: true,
+		newReq: func(opt WatchOpt) interface{} {
+			return &WatchSrvReq{SrvType: srvType, SrvNo: srvNo, WatchOpt: opt}
+		},
+	}
+}
+
+func newSrvTypeWatchRecord(srvType uint32, opt WatchOpt) *watchRecord {
+	return &watchRecord{
+		funcName: "WatchSrvsByType",
+		opt:      opt,
+		bDataRev: true,
+		newReq: func(opt WatchOpt) interface{} {
+			return &WatchSrvsByTypeReq{SrvType: srvType, WatchOpt: opt}
+		},
+	}
+}
+
+func newGlobalDataWatchRecord(key string, opt WatchOpt) *watchRecord {
+	return &watchRecord{
+		funcName: "WatchGlobalData",
+		opt:      opt,
+		bDataRev: true,
+		newReq: func(opt WatchOpt) interface{} {
+			return &WatchGlobalDataReq{Key: key, WatchOpt: opt}
+		},
+	}
+}
+
+func (c *Client) addSelectorWatchRecord(srvType uint32, bByType bool, selector string, opt WatchOpt) {
+	c.watches.Add(getSelectorWatchRecordKey(srvType, bByType, selector), &watchRecord{
+		funcName: "WatchSrvsBySelector",
+		opt:      opt,
+		bDataRev: false,
+		newReq: func(opt WatchOpt) interface{} {
+			return &WatchSrvsBySelectorReq{Selector: selector, SrvType: srvType, ByType: bByType, WatchOpt: opt}
+		},
+	})
+}
+
+func (c *Client) findMember(nodeId uint32) (*RaftMember, bool) {
+	for _, m := range c.members {
+		if m.NodeId == nodeId {
+			return m, true
+		}
+	}
+
+	return nil, false
+}
+
+func (c *Client) updateMembers(members []*RaftMember) {
+	if len(members) > 0 {
+		c.members = members
+	}
+}
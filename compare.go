@@ -0,0 +1,80 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+var (
+	ErrCompareFailed  = errors.New("compare failed")
+	ErrInvalidCompare = errors.New("invalid compare")
+)
+
+const (
+	CMP_TARGET_EXISTS = 1 + iota
+	CMP_TARGET_VALUE
+	CMP_TARGET_MOD_REV
+	CMP_TARGET_CREATE_REV
+)
+
+type Compare struct {
+	Target     int    `json:"target"`
+	Exists     bool   `json:"exists"`
+	DataBase64 string `json:"data"`
+	Rev        int64  `json:"rev"`
+}
+
+func NewCompareExists(bExists bool) *Compare {
+	return &Compare{
+		Target: CMP_TARGET_EXISTS,
+		Exists: bExists,
+	}
+}
+
+func NewCompareValue(data []byte) *Compare {
+	return &Compare{
+		Target:     CMP_TARGET_VALUE,
+		DataBase64: base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+func NewCompareModRev(rev int64) *Compare {
+	return &Compare{
+		Target: CMP_TARGET_MOD_REV,
+		Rev:    rev,
+	}
+}
+
+func NewCompareCreateRev(rev int64) *Compare {
+	return &Compare{
+		Target: CMP_TARGET_CREATE_REV,
+		Rev:    rev,
+	}
+}
+
+func (c *Compare) IsValid() bool {
+	return c.Target >= CMP_TARGET_EXISTS && c.Target <= CMP_TARGET_CREATE_REV
+}
+
+// IsMatch check the current state of a key, a key not exists has zero revisions.
+func (c *Compare) IsMatch(bExists bool, dataBase64 string, kr KeyRev) bool {
+	switch c.Target {
+	case CMP_TARGET_EXISTS:
+		return bExists == c.Exists
+
+	case CMP_TARGET_VALUE:
+		return bExists && dataBase64 == c.DataBase64
+
+	case CMP_TARGET_MOD_REV:
+		return kr.ModRev == c.Rev
+
+	case CMP_TARGET_CREATE_REV:
+		return kr.CreateRev == c.Rev
+	}
+
+	return false
+}
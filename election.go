@@ -0,0 +1,184 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNotElectionLeader   = errors.New("not election leader")
+	ErrElectionKeyReserved = errors.New("key reserved by the elections")
+)
+
+const (
+	ELECTION_KEY_PREFIX = "/__election"
+)
+
+// isElectionKey check if the key of the default namespace is kept by the elections.
+func isElectionKey(key string) bool {
+	return key == ELECTION_KEY_PREFIX || strings.HasPrefix(key, ELECTION_KEY_PREFIX+"/")
+}
+
+func GetElectionKey(srvType uint32) string {
+	return ELECTION_KEY_PREFIX + "/" + strconv.FormatUint(uint64(srvType), 10)
+}
+
+// GetElectionLeaderData return the global data of the election when the server is the leader.
+func GetElectionLeaderData(srvNo uint32) string {
+	return base64.StdEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(srvNo), 10)))
+}
+
+func ParseElectionLeaderData(dataBase64 string) (uint32, bool) {
+	data, err := base64.StdEncoding.DecodeString(dataBase64)
+	if err != nil {
+		return 0, false
+	}
+
+	srvNo, err := strconv.ParseUint(string(data), 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint32(srvNo), true
+}
+
+//======================
+//     electionMgr
+//======================
+// electionMgr keep the candidates of each server type in order and the observers of the leader,
+// the leader itself is kept in the global data.
+type electionMgr struct {
+	mapType2Candidates map[uint32][]uint32
+	mapType2Observers  map[uint32]RegObserverList
+	lck                *sync.Mutex
+}
+
+func newElectionMgr() *electionMgr {
+	return &electionMgr{
+		mapType2Candidates: make(map[uint32][]uint32),
+		mapType2Observers:  make(map[uint32]RegObserverList),
+		lck:                &sync.Mutex{},
+	}
+}
+
+func (m *electionMgr) Lock() {
+	m.lck.Lock()
+}
+
+func (m *electionMgr) Unlock() {
+	m.lck.Unlock()
+}
+
+func (m *electionMgr) AddCandidate(srvType uint32, srvNo uint32) {
+	candidates := m.mapType2Candidates[srvType]
+	for _, no := range candidates {
+		if no == srvNo {
+			return
+		}
+	}
+
+	m.mapType2Candidates[srvType] = append(candidates, srvNo)
+}
+
+func (m *electionMgr) RemoveCandidate(srvType uint32, srvNo uint32) bool {
+	candidates := m.mapType2Candidates[srvType]
+	for i, no := range candidates {
+		if no == srvNo {
+			m.setCandidates(srvType, append(candidates[:i], candidates[i+1:]...))
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *electionMgr) PopCandidate(srvType uint32) (uint32, bool) {
+	candidates := m.mapType2Candidates[srvType]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	m.setCandidates(srvType, candidates[1:])
+	return candidates[0], true
+}
+
+func (m *electionMgr) AddObserver(srvType uint32, observerType uint32, observerNo uint32) {
+	observers := m.mapType2Observers[srvType]
+	for _, o := range observers {
+		if o.IsSameObserver(observerType, observerNo) {
+			return
+		}
+	}
+
+	m.mapType2Observers[srvType] = append(observers, NewRegObserver(observerType, observerNo))
+}
+
+func (m *electionMgr) RemoveObserver(srvType uint32, observerType uint32, observerNo uint32) {
+	observers := m.mapType2Observers[srvType]
+	for i, o := range observers {
+		if o.IsSameObserver(observerType, observerNo) {
+			observers = append(observers[:i], observers[i+1:]...)
+			break
+		}
+	}
+
+	if len(observers) == 0 {
+		delete(m.mapType2Observers, srvType)
+	} else {
+		m.mapType2Observers[srvType] = observers
+	}
+}
+
+func (m *electionMgr) RemoveAllObserverOfSrv(observerType uint32, observerNo uint32) {
+	for srvType := range m.mapType2Observers {
+		m.RemoveObserver(srvType, observerType, observerNo)
+	}
+}
+
+// GetPushList return the observers and the candidates of the server type,
+// extraNos are the servers which are no longer candidates, e.g. the old leader.
+func (m *electionMgr) GetPushList(srvType uint32, extraNos ...uint32) RegObserverList {
+	list := make(RegObserverList, 0)
+	list = append(list, m.mapType2Observers[srvType]...)
+
+	candidates := m.mapType2Candidates[srvType]
+	srvNos := make([]uint32, 0, len(candidates)+len(extraNos))
+	srvNos = append(srvNos, candidates...)
+	srvNos = append(srvNos, extraNos...)
+	for _, srvNo := range srvNos {
+		bExists := false
+		for _, o := range list {
+			if o.IsSameObserver(srvType, srvNo) {
+				bExists = true
+				break
+			}
+		}
+
+		if !bExists {
+			list = append(list, NewRegObserver(srvType, srvNo))
+		}
+	}
+
+	return list
+}
+
+// ResetCandidates remove all the candidates, they are kept by the leader only.
+func (m *electionMgr) ResetCandidates() {
+	m.mapType2Candidates = make(map[uint32][]uint32)
+}
+
+func (m *electionMgr) setCandidates(srvType uint32, candidates []uint32) {
+	if len(candidates) == 0 {
+		delete(m.mapType2Candidates, srvType)
+		return
+	}
+
+	m.mapType2Candidates[srvType] = candidates
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+const (
+	MAX_EVENT_LOG = 1024
+)
+
+// eventLog keep the latest data pushes for resuming watches,
+// it is only accessed in the push loop so no lock is required.
+type eventLog struct {
+	events     []*DataOprPush
+	maxSize    int
+	compactRev int64
+}
+
+func newEventLog(maxSize int) *eventLog {
+	return &eventLog{
+		events:     make([]*DataOprPush, 0, maxSize),
+		maxSize:    maxSize,
+		compactRev: 0,
+	}
+}
+
+// SetCompactRev mark all the revisions not greater than rev as compacted.
+func (l *eventLog) SetCompactRev(rev int64) {
+	if rev > l.compactRev {
+		l.compactRev = rev
+	}
+}
+
+func (l *eventLog) Append(pushData *DataOprPush) {
+	if len(l.events) >= l.maxSize {
+		l.SetCompactRev(l.events[0].ModRev)
+		l.events = append(l.events[:0], l.events[1:]...)
+	}
+
+	l.events = append(l.events, pushData)
+}
+
+// GetSince return the events which revision is not less than startRev and match the filter.
+func (l *eventLog) GetSince(startRev int64, filter func(pushData *DataOprPush) bool) ([]*DataOprPush, error) {
+	if startRev <= l.compactRev {
+		return nil, ErrRevisionCompacted
+	}
+
+	list := make([]*DataOprPush, 0)
+	for _, pushData := range l.events {
+		if pushData.ModRev >= startRev && filter(pushData) {
+			list = append(list, pushData)
+		}
+	}
+
+	return list, nil
+}
@@ -6,4 +6,5 @@ require (
 	github.com/yxlib/rpc v0.3.8
 	github.com/yxlib/server v0.3.15
 	github.com/yxlib/yx v0.3.7
+	go.etcd.io/bbolt v1.3.6
 )
@@ -0,0 +1,156 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrHealthCheckSkipped = errors.New("health check skipped")
+	ErrHealthCheckTimeout = errors.New("health check timeout")
+)
+
+const (
+	SRV_HEALTH_UNKNOWN = iota
+	SRV_HEALTH_HEALTHY
+	SRV_HEALTH_UNHEALTHY
+)
+
+const (
+	HEALTH_CHECK_INTERVAL_SEC = 10
+	HEALTH_CHECK_TIMEOUT_MS   = 3000
+	HEALTH_FAIL_THRESHOLD     = 3
+	HEALTH_CHECK_WORKER_NUM   = 16
+)
+
+// HealthChecker probe a registered server, return nil if it is healthy,
+// ErrHealthCheckSkipped if it can't be probed by this checker.
+type HealthChecker interface {
+	Check(info *SrvInfo) error
+}
+
+// HealthPongHandler is implemented by the checkers waiting for the HealthPong of the servers.
+type HealthPongHandler interface {
+	OnPong(srvType uint32, srvNo uint32, seq uint64)
+}
+
+//======================
+//   TcpHealthChecker
+//======================
+// TcpHealthChecker connect to the first endpoint of the protocol, any endpoint if protocol is empty.
+type TcpHealthChecker struct {
+	protocol string
+	timeout  time.Duration
+}
+
+func NewTcpHealthChecker(protocol string, timeoutMs uint32) *TcpHealthChecker {
+	if timeoutMs == 0 {
+		timeoutMs = HEALTH_CHECK_TIMEOUT_MS
+	}
+
+	return &TcpHealthChecker{
+		protocol: protocol,
+		timeout:  time.Duration(timeoutMs) * time.Millisecond,
+	}
+}
+
+func (c *TcpHealthChecker) Check(info *SrvInfo) error {
+	ep, ok := info.GetEndpoint(c.protocol)
+	if !ok {
+		return ErrHealthCheckSkipped
+	}
+
+	addr := net.JoinHostPort(ep.Host, strconv.Itoa(int(ep.Port)))
+	conn, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return err
+	}
+
+	conn.Close()
+	return nil
+}
+
+//======================
+//   PingHealthChecker
+//======================
+type pingWaiter struct {
+	srvType  uint32
+	srvNo    uint32
+	chanPong chan bool
+}
+
+// PingHealthChecker push a HealthPingPush to the server by its push queue and wait for its HealthPong,
+// the server must be connected to the node running the check.
+type PingHealthChecker struct {
+	timeout       time.Duration
+	seq           uint64
+	mapSeq2Waiter map[uint64]*pingWaiter
+	lck           *sync.Mutex
+}
+
+func NewPingHealthChecker(timeoutMs uint32) *PingHealthChecker {
+	if timeoutMs == 0 {
+		timeoutMs = HEALTH_CHECK_TIMEOUT_MS
+	}
+
+	return &PingHealthChecker{
+		timeout:       time.Duration(timeoutMs) * time.Millisecond,
+		seq:           0,
+		mapSeq2Waiter: make(map[uint64]*pingWaiter),
+		lck:           &sync.Mutex{},
+	}
+}
+
+func (c *PingHealthChecker) Check(info *SrvInfo) error {
+	seq := atomic.AddUint64(&c.seq, 1)
+	w := &pingWaiter{
+		srvType:  info.SrvType,
+		srvNo:    info.SrvNo,
+		chanPong: make(chan bool, 1),
+	}
+
+	c.lck.Lock()
+	c.mapSeq2Waiter[seq] = w
+	c.lck.Unlock()
+
+	defer func() {
+		c.lck.Lock()
+		delete(c.mapSeq2Waiter, seq)
+		c.lck.Unlock()
+	}()
+
+	RegCenter.pushTo(info.SrvType, info.SrvNo, &HealthPingPush{Seq: seq}, HEALTH_PING_FUNC_NO)
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+
+	select {
+	case <-w.chanPong:
+		return nil
+	case <-timer.C:
+		return ErrHealthCheckTimeout
+	}
+}
+
+func (c *PingHealthChecker) OnPong(srvType uint32, srvNo uint32, seq uint64) {
+	c.lck.Lock()
+	w, ok := c.mapSeq2Waiter[seq]
+	c.lck.Unlock()
+
+	if !ok || w.srvType != srvType || w.srvNo != srvNo {
+		return
+	}
+
+	select {
+	case w.chanPong <- true:
+	default:
+	}
+}
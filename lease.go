@@ -0,0 +1,180 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLeaseNotExists = errors.New("lease not exists")
+	ErrLeaseZeroTTL   = errors.New("lease ttl is zero")
+)
+
+const (
+	LEASE_CHECK_INTERVAL_MS = 500
+)
+
+//======================
+//        Lease
+//======================
+// Lease is identified by the id of the command granting it, so an expired lease is never mistaken
+// for the lease granted again to the same server. The deadline is only kept by the node itself.
+type Lease struct {
+	Id        int64         `json:"id,omitempty"`
+	Namespace string        `json:"ns,omitempty"`
+	SrvType   uint32        `json:"type"`
+	SrvNo     uint32        `json:"no"`
+	TTL       time.Duration `json:"ttl"`
+	Deadline  time.Time     `json:"-"`
+}
+
+func NewLease(id int64, ns string, srvType uint32, srvNo uint32, ttlSec uint32) *Lease {
+	l := &Lease{
+		Id:        id,
+		Namespace: ns,
+		SrvType:   srvType,
+		SrvNo:     srvNo,
+		TTL:       time.Duration(ttlSec) * time.Second,
+	}
+
+	l.Renew()
+	return l
+}
+
+func (l *Lease) Renew() {
+	l.Deadline = time.Now().Add(l.TTL)
+}
+
+func (l *Lease) IsExpired(now time.Time) bool {
+	return now.After(l.Deadline)
+}
+
+func (l *Lease) GetTTLSec() uint32 {
+	return uint32(l.TTL / time.Second)
+}
+
+func (l *Lease) GetKey() string {
+	return GetNsKey(l.Namespace, GetSrvKey(l.SrvType, l.SrvNo))
+}
+
+//======================
+//      leaseMgr
+//======================
+type leaseMgr struct {
+	mapKey2Lease map[string]*Lease
+	lck          *sync.Mutex
+}
+
+func newLeaseMgr() *leaseMgr {
+	return &leaseMgr{
+		mapKey2Lease: make(map[string]*Lease),
+		lck:          &sync.Mutex{},
+	}
+}
+
+func (m *leaseMgr) Grant(id int64, ns string, srvType uint32, srvNo uint32, ttlSec uint32) error {
+	if ttlSec == 0 {
+		return ErrLeaseZeroTTL
+	}
+
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	l := NewLease(id, ns, srvType, srvNo, ttlSec)
+	m.mapKey2Lease[l.GetKey()] = l
+	return nil
+}
+
+func (m *leaseMgr) KeepAlive(ns string, srvType uint32, srvNo uint32) (uint32, error) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	key := GetNsKey(ns, GetSrvKey(srvType, srvNo))
+	l, ok := m.mapKey2Lease[key]
+	if !ok {
+		return 0, ErrLeaseNotExists
+	}
+
+	l.Renew()
+	return l.GetTTLSec(), nil
+}
+
+func (m *leaseMgr) Revoke(ns string, srvType uint32, srvNo uint32) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	key := GetNsKey(ns, GetSrvKey(srvType, srvNo))
+	delete(m.mapKey2Lease, key)
+}
+
+// GetExpired return the copies of the expired leases, they are kept until they are revoked
+// by the commands, see RevokeIfMatch.
+func (m *leaseMgr) GetExpired(now time.Time) []*Lease {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	expired := make([]*Lease, 0)
+	for _, l := range m.mapKey2Lease {
+		if l.IsExpired(now) {
+			copyLease := *l
+			expired = append(expired, &copyLease)
+		}
+	}
+
+	return expired
+}
+
+// RevokeIfMatch revoke the lease of the server if it is still the lease of id,
+// return false if the server has no lease or is granted again.
+func (m *leaseMgr) RevokeIfMatch(id int64, ns string, srvType uint32, srvNo uint32) bool {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	key := GetNsKey(ns, GetSrvKey(srvType, srvNo))
+	l, ok := m.mapKey2Lease[key]
+	if !ok || l.Id != id {
+		return false
+	}
+
+	delete(m.mapKey2Lease, key)
+	return true
+}
+
+func (m *leaseMgr) GetAll() []*Lease {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	leases := make([]*Lease, 0, len(m.mapKey2Lease))
+	for _, l := range m.mapKey2Lease {
+		leases = append(leases, l)
+	}
+
+	return leases
+}
+
+// Reset replace all the leases, the deadlines are renewed.
+func (m *leaseMgr) Reset(leases []*Lease) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	m.mapKey2Lease = make(map[string]*Lease)
+	for _, l := range leases {
+		l.Renew()
+		m.mapKey2Lease[l.GetKey()] = l
+	}
+}
+
+// RenewAll give all the leases a full ttl, it is used when a new leader take over.
+func (m *leaseMgr) RenewAll() {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	for _, l := range m.mapKey2Lease {
+		l.Renew()
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"testing"
+	"time"
+)
+
+func applyTestCmd(t *testing.T, sm *RegStateMachine, cmd *RegCmd) *RegCmdResult {
+	result, err := sm.ApplyCmd(cmd)
+	if err != nil {
+		t.Fatal("apply command ", cmd.Type, " err: ", err)
+	}
+
+	return result
+}
+
+func newTestUpdateSrvCmd(srvType uint32, srvNo uint32, ttlSec uint32, leaseId int64) *RegCmd {
+	cmd := NewRegCmd(REG_CMD_UPDATE_SRV)
+	cmd.SrvType = srvType
+	cmd.SrvNo = srvNo
+	cmd.TTL = ttlSec
+	cmd.LeaseId = leaseId
+	return cmd
+}
+
+func newTestExpireLeaseCmd(l *Lease) *RegCmd {
+	cmd := NewRegCmd(REG_CMD_EXPIRE_LEASE)
+	cmd.SrvType = l.SrvType
+	cmd.SrvNo = l.SrvNo
+	cmd.LeaseId = l.Id
+	return cmd
+}
+
+func TestExpireLease(t *testing.T) {
+	sm := NewRegStateMachine(NewRegInfo())
+	applyTestCmd(t, sm, newTestUpdateSrvCmd(1, 1, 1, 100))
+
+	expired := sm.leases.GetExpired(time.Now().Add(2 * time.Second))
+	if len(expired) != 1 || expired[0].Id != 100 {
+		t.Fatal("the lease should be expired, num: ", len(expired))
+	}
+
+	result := applyTestCmd(t, sm, newTestExpireLeaseCmd(expired[0]))
+	if len(result.PushList) != 1 || result.PushList[0].Operate != DATA_OPR_TYPE_REMOVE {
+		t.Fatal("the server of the expired lease should be removed")
+	}
+
+	if sm.GetRegInfo().HasSrv(1, 1) {
+		t.Fatal("the server should not exist")
+	}
+
+	// expired twice
+	result = applyTestCmd(t, sm, newTestExpireLeaseCmd(expired[0]))
+	if len(result.PushList) != 0 {
+		t.Fatal("the revoked lease should not remove anything")
+	}
+}
+
+func TestExpireLeaseGrantedAgain(t *testing.T) {
+	sm := NewRegStateMachine(NewRegInfo())
+	applyTestCmd(t, sm, newTestUpdateSrvCmd(1, 1, 1, 100))
+	expired := sm.leases.GetExpired(time.Now().Add(2 * time.Second))
+
+	// registered again before the expiration is applied
+	applyTestCmd(t, sm, newTestUpdateSrvCmd(1, 1, 1, 101))
+
+	rev := sm.GetRevision()
+	result := applyTestCmd(t, sm, newTestExpireLeaseCmd(expired[0]))
+	if len(result.PushList) != 0 || sm.GetRevision() != rev {
+		t.Fatal("the server granted again should not be removed")
+	}
+
+	if !sm.GetRegInfo().HasSrv(1, 1) {
+		t.Fatal("the server should be kept")
+	}
+
+	ttlSec, err := sm.leases.KeepAlive(DEFAULT_NAMESPACE, 1, 1)
+	if err != nil || ttlSec != 1 {
+		t.Fatal("the new lease should be kept, err: ", err)
+	}
+}
+
+func TestCompareAndUpdateSrvWithLease(t *testing.T) {
+	c := newRegCenter()
+	_, err := c.CompareAndUpdateSrv(1, 1, true, "", nil, NewCompareExists(false), 5)
+	if err != nil {
+		t.Fatal("compare and update err: ", err)
+	}
+
+	ttlSec, err := c.sm.leases.KeepAlive(DEFAULT_NAMESPACE, 1, 1)
+	if err != nil || ttlSec != 5 {
+		t.Fatal("the lease should be granted with the update, err: ", err)
+	}
+
+	_, err = c.CompareAndUpdateSrv(1, 2, true, "", nil, NewCompareExists(true), 5)
+	if err != ErrCompareFailed {
+		t.Fatal("the compare should fail, err: ", err)
+	}
+
+	_, err = c.sm.leases.KeepAlive(DEFAULT_NAMESPACE, 1, 2)
+	if err != ErrLeaseNotExists {
+		t.Fatal("no lease should be granted if the compare failed, err: ", err)
+	}
+}
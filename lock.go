@@ -0,0 +1,121 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrLockNotOwner    = errors.New("lock not owned")
+	ErrLockTimeout     = errors.New("lock timeout")
+	ErrInvalidLockName = errors.New("invalid lock name")
+	ErrLockKeyReserved = errors.New("key reserved by the locks")
+)
+
+const (
+	LOCK_KEY_PREFIX = "/__lock"
+)
+
+// GetLockKey return the key of the lock, the name must be a single segment,
+// otherwise the lock would be removed with the lock of its parent key.
+func GetLockKey(name string) (string, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return "", ErrInvalidLockName
+	}
+
+	return LOCK_KEY_PREFIX + "/" + name, nil
+}
+
+// isLockKey check if the key of the default namespace is kept by the locks.
+func isLockKey(key string) bool {
+	return key == LOCK_KEY_PREFIX || strings.HasPrefix(key, LOCK_KEY_PREFIX+"/")
+}
+
+// GetLockOwner return the global data of a lock held by the server.
+func GetLockOwner(srvType uint32, srvNo uint32) string {
+	return base64.StdEncoding.EncodeToString([]byte(GetSrvKey(srvType, srvNo)))
+}
+
+//======================
+//      lockMgr
+//======================
+// lockMgr keep the waiters of each lock in order, and serialize the lock operations.
+type lockMgr struct {
+	mapKey2Waiters map[string][]*RegObserver
+	lck            *sync.Mutex
+}
+
+func newLockMgr() *lockMgr {
+	return &lockMgr{
+		mapKey2Waiters: make(map[string][]*RegObserver),
+		lck:            &sync.Mutex{},
+	}
+}
+
+func (m *lockMgr) Lock() {
+	m.lck.Lock()
+}
+
+func (m *lockMgr) Unlock() {
+	m.lck.Unlock()
+}
+
+// AddWaiter append the server to the queue if it is not in.
+func (m *lockMgr) AddWaiter(key string, srvType uint32, srvNo uint32) {
+	waiters := m.mapKey2Waiters[key]
+	for _, w := range waiters {
+		if w.IsSameObserver(srvType, srvNo) {
+			return
+		}
+	}
+
+	m.mapKey2Waiters[key] = append(waiters, NewRegObserver(srvType, srvNo))
+}
+
+func (m *lockMgr) RemoveWaiter(key string, srvType uint32, srvNo uint32) bool {
+	waiters := m.mapKey2Waiters[key]
+	for i, w := range waiters {
+		if w.IsSameObserver(srvType, srvNo) {
+			m.setWaiters(key, append(waiters[:i], waiters[i+1:]...))
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *lockMgr) PopWaiter(key string) (*RegObserver, bool) {
+	waiters := m.mapKey2Waiters[key]
+	if len(waiters) == 0 {
+		return nil, false
+	}
+
+	m.setWaiters(key, waiters[1:])
+	return waiters[0], true
+}
+
+func (m *lockMgr) RemoveAllWaiterOfSrv(srvType uint32, srvNo uint32) {
+	for key := range m.mapKey2Waiters {
+		m.RemoveWaiter(key, srvType, srvNo)
+	}
+}
+
+// Reset remove all the waiters, they are kept by the leader only.
+func (m *lockMgr) Reset() {
+	m.mapKey2Waiters = make(map[string][]*RegObserver)
+}
+
+func (m *lockMgr) setWaiters(key string, waiters []*RegObserver) {
+	if len(waiters) == 0 {
+		delete(m.mapKey2Waiters, key)
+		return
+	}
+
+	m.mapKey2Waiters[key] = waiters
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"testing"
+)
+
+func TestGetLockKey(t *testing.T) {
+	cases := []struct {
+		name  string
+		key   string
+		bFail bool
+	}{
+		{"a", LOCK_KEY_PREFIX + "/a", false},
+		{"a.b-c", LOCK_KEY_PREFIX + "/a.b-c", false},
+		{"", "", true},
+		{"a/b", "", true},
+		{"/a", "", true},
+		{"a/", "", true},
+		{"a//b", "", true},
+	}
+
+	for _, tc := range cases {
+		key, err := GetLockKey(tc.name)
+		if tc.bFail {
+			if err != ErrInvalidLockName {
+				t.Fatal("lock name ", tc.name, " should be invalid, err: ", err)
+			}
+
+			continue
+		}
+
+		if err != nil || key != tc.key {
+			t.Fatal("lock name ", tc.name, " should be ", tc.key, ", key: ", key, ", err: ", err)
+		}
+	}
+}
+
+func TestLockNestedName(t *testing.T) {
+	c := newRegCenter()
+
+	bLocked, err := c.Lock("a", 1, 1, false)
+	if err != nil || !bLocked {
+		t.Fatal("lock a should be acquired, err: ", err)
+	}
+
+	_, err = c.Lock("a/b", 1, 2, false)
+	if err != ErrInvalidLockName {
+		t.Fatal("the nested lock name should be rejected, err: ", err)
+	}
+
+	bLocked, err = c.Lock("ab", 1, 2, false)
+	if err != nil || !bLocked {
+		t.Fatal("lock ab should be acquired, err: ", err)
+	}
+
+	err = c.Unlock("a", 1, 1)
+	if err != nil {
+		t.Fatal("unlock a err: ", err)
+	}
+
+	bLocked, err = c.Lock("ab", 1, 3, false)
+	if err != nil || bLocked {
+		t.Fatal("lock ab should still be held after a is released, err: ", err)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidNamespace = errors.New("invalid namespace")
+	ErrQuotaExceeded    = errors.New("namespace quota exceeded")
+	ErrNsKeyReserved    = errors.New("key reserved by the namespaces")
+)
+
+const (
+	DEFAULT_NAMESPACE    = ""
+	NAMESPACE_KEY_PREFIX = "/@"
+)
+
+func IsValidNamespace(ns string) bool {
+	return !strings.ContainsAny(ns, "/@ \t")
+}
+
+// GetNsKey return the key qualified by the namespace, e.g. "/@dev/1/2",
+// the keys of the default namespace are not changed.
+func GetNsKey(ns string, key string) string {
+	if ns == DEFAULT_NAMESPACE {
+		return key
+	}
+
+	if len(ParseInfoPath(key)) == 0 {
+		return NAMESPACE_KEY_PREFIX + ns
+	}
+
+	return NAMESPACE_KEY_PREFIX + ns + key
+}
+
+func isNsKey(key string) bool {
+	return strings.HasPrefix(key, NAMESPACE_KEY_PREFIX)
+}
+
+// checkNsKey check the key of the namespace, the keys prefixed by NAMESPACE_KEY_PREFIX are reserved
+// in the default namespace, they are the qualified keys of the other namespaces.
+func checkNsKey(ns string, key string) error {
+	if ns == DEFAULT_NAMESPACE && isNsKey(key) {
+		return ErrNsKeyReserved
+	}
+
+	return nil
+}
+
+// NamespaceQuota limit the number of the keys in a namespace, zero means no limit.
+type NamespaceQuota struct {
+	MaxSrvNum        int `json:"max_srv"`
+	MaxGlobalDataNum int `json:"max_global"`
+}
+
+//======================
+//     RegNamespace
+//======================
+// RegNamespace operate the registry of a namespace, the servers and the global data
+// of the namespaces are isolated. The methods of RegCenter operate the default namespace.
+type RegNamespace struct {
+	name string
+	c    *regCenter
+}
+
+func newRegNamespace(name string, c *regCenter) *RegNamespace {
+	return &RegNamespace{
+		name: name,
+		c:    c,
+	}
+}
+
+func (n *RegNamespace) GetName() string {
+	return n.name
+}
+
+// GetRegInfo return the RegInfo of the namespace, it is empty if the namespace has no data.
+func (n *RegNamespace) GetRegInfo() *RegInfo {
+	return n.c.info.GetNamespace(n.name)
+}
+
+func (n *RegNamespace) UpdateSrv(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string) error {
+	err := n.UpdateSrvWithLease(srvType, srvNo, bTemp, dataBase64, 0)
+	return n.c.ec.Throw("UpdateSrv", err)
+}
+
+// UpdateSrvWithLease update the server and grant a lease if ttlSec > 0.
+func (n *RegNamespace) UpdateSrvWithLease(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string, ttlSec uint32) error {
+	err := n.UpdateSrvWithMeta(srvType, srvNo, bTemp, dataBase64, nil, ttlSec)
+	return n.c.ec.Throw("UpdateSrvWithLease", err)
+}
+
+// UpdateSrvWithMeta update the server with the meta, the meta of an existing server is kept if meta is nil.
+// The status set by the admin is kept, see SrvMeta.Merge.
+func (n *RegNamespace) UpdateSrvWithMeta(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string, meta *SrvMeta, ttlSec uint32) error {
+	if !isValidSrvMeta(meta) {
+		return n.c.ec.Throw("UpdateSrvWithMeta", ErrInvalidSrvStatus)
+	}
+
+	cmd := n.newRegCmd(REG_CMD_UPDATE_SRV)
+	cmd.SrvType = srvType
+	cmd.SrvNo = srvNo
+	cmd.IsTemp = bTemp
+	cmd.DataBase64 = dataBase64
+	cmd.Meta = meta
+	cmd.TTL = ttlSec
+
+	_, err := n.c.execCmd(cmd)
+	return n.c.ec.Throw("UpdateSrvWithMeta", err)
+}
+
+// CompareAndUpdateSrv update the server if cmp matches, and grant a lease in the same command if ttlSec > 0.
+func (n *RegNamespace) CompareAndUpdateSrv(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string, meta *SrvMeta, cmp *Compare, ttlSec uint32) (*DataOprPush, error) {
+	if !isValidSrvMeta(meta) {
+		return nil, n.c.ec.Throw("CompareAndUpdateSrv", ErrInvalidSrvStatus)
+	}
+
+	cmd := n.newRegCmd(REG_CMD_COMPARE_AND_UPDATE_SRV)
+	cmd.SrvType = srvType
+	cmd.SrvNo = srvNo
+	cmd.IsTemp = bTemp
+	cmd.DataBase64 = dataBase64
+	cmd.Meta = meta
+	cmd.Cmp = cmp
+	cmd.TTL = ttlSec
+
+	result, err := n.c.execCmd(cmd)
+	if err != nil {
+		return result.GetFirstPush(), n.c.ec.Throw("CompareAndUpdateSrv", err)
+	}
+
+	return result.GetFirstPush(), nil
+}
+
+func (n *RegNamespace) RemoveSrv(srvType uint32, srvNo uint32) error {
+	cmd := n.newRegCmd(REG_CMD_REMOVE_SRV)
+	cmd.SrvType = srvType
+	cmd.SrvNo = srvNo
+
+	_, err := n.c.execCmd(cmd)
+	return n.c.ec.Throw("RemoveSrv", err)
+}
+
+// SetSrvStatus set the status of the server, e.g. SRV_STATUS_DRAINING take it out of rotation
+// without unregistering it. The watchers get a push of the updated server.
+func (n *RegNamespace) SetSrvStatus(srvType uint32, srvNo uint32, status string) error {
+	if !IsValidSrvStatus(status) {
+		return ErrInvalidSrvStatus
+	}
+
+	cmd := n.newRegCmd(REG_CMD_SET_SRV_STATUS)
+	cmd.SrvType = srvType
+	cmd.SrvNo = srvNo
+	cmd.Status = status
+	_, err := n.c.execCmd(cmd)
+	return err
+}
+
+// SetSrvHealth set the health status of the server, the watchers get a push of DATA_OPR_TYPE_HEALTH.
+func (n *RegNamespace) SetSrvHealth(srvType uint32, srvNo uint32, health int) error {
+	cmd := n.newRegCmd(REG_CMD_SET_SRV_HEALTH)
+	cmd.SrvType = srvType
+	cmd.SrvNo = srvNo
+	cmd.Health = health
+	_, err := n.c.execCmd(cmd)
+	return err
+}
+
+func (n *RegNamespace) GrantLease(srvType uint32, srvNo uint32, ttlSec uint32) error {
+	cmd := n.newRegCmd(REG_CMD_GRANT_LEASE)
+	cmd.SrvType = srvType
+	cmd.SrvNo = srvNo
+	cmd.TTL = ttlSec
+
+	_, err := n.c.execCmd(cmd)
+	return n.c.ec.Throw("GrantLease", err)
+}
+
+// KeepAlive renew the lease, in cluster mode only the leader keep the deadlines.
+func (n *RegNamespace) KeepAlive(srvType uint32, srvNo uint32) (uint32, error) {
+	if n.c.raft != nil && !n.c.raft.IsLeader() {
+		return 0, n.c.ec.Throw("KeepAlive", ErrRaftNotLeader)
+	}
+
+	ttlSec, err := n.c.sm.leases.KeepAlive(n.name, srvType, srvNo)
+	if err != nil {
+		return 0, n.c.ec.Throw("KeepAlive", err)
+	}
+
+	return ttlSec, nil
+}
+
+func (n *RegNamespace) RevokeLease(srvType uint32, srvNo uint32) error {
+	cmd := n.newRegCmd(REG_CMD_REVOKE_LEASE)
+	cmd.SrvType = srvType
+	cmd.SrvNo = srvNo
+
+	_, err := n.c.execCmd(cmd)
+	return n.c.ec.Throw("RevokeLease", err)
+}
+
+func (n *RegNamespace) UpdateGlobalData(key string, dataBase64 string) error {
+	cmd := n.newRegCmd(REG_CMD_UPDATE_GLOBAL_DATA)
+	cmd.Key = key
+	cmd.DataBase64 = dataBase64
+
+	_, err := n.c.execCmd(cmd)
+	return n.c.ec.Throw("UpdateGlobalData", err)
+}
+
+func (n *RegNamespace) CompareAndUpdateGlobalData(key string, dataBase64 string, cmp *Compare) (*DataOprPush, error) {
+	cmd := n.newRegCmd(REG_CMD_COMPARE_AND_UPDATE_GLOBAL_DATA)
+	cmd.Key = key
+	cmd.DataBase64 = dataBase64
+	cmd.Cmp = cmp
+
+	result, err := n.c.execCmd(cmd)
+	if err != nil {
+		return result.GetFirstPush(), n.c.ec.Throw("CompareAndUpdateGlobalData", err)
+	}
+
+	return result.GetFirstPush(), nil
+}
+
+func (n *RegNamespace) RemoveGlobalData(key string) error {
+	cmd := n.newRegCmd(REG_CMD_REMOVE_GLOBAL_DATA)
+	cmd.Key = key
+
+	_, err := n.c.execCmd(cmd)
+	return n.c.ec.Throw("RemoveGlobalData", err)
+}
+
+// Txn apply thenOps if all the compares match, otherwise elseOps, in a single revision.
+func (n *RegNamespace) Txn(cmps []*TxnCompare, thenOps []*TxnOp, elseOps []*TxnOp) (bool, []*DataOprPush, error) {
+	cmd := n.newRegCmd(REG_CMD_TXN)
+	cmd.Compares = cmps
+	cmd.Success = thenOps
+	cmd.Failure = elseOps
+
+	result, err := n.c.execCmd(cmd)
+	if err != nil {
+		return false, nil, n.c.ec.Throw("Txn", err)
+	}
+
+	return result.Succeeded, result.PushList, nil
+}
+
+func (n *RegNamespace) newRegCmd(cmdType int) *RegCmd {
+	cmd := NewRegCmd(cmdType)
+	cmd.Namespace = n.name
+	return cmd
+}
@@ -1,93 +1,329 @@
-// Copyright 2022 Guan Jianchang. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
-package reg
-
-import (
-	"encoding/json"
-
-	"github.com/yxlib/rpc"
-	"github.com/yxlib/yx"
-)
-
-type Observer struct {
-	net                rpc.Net
-	chanDataOprPush    chan *DataOprPush
-	chanConnChangePush chan *ConnChangePush
-	logger             *yx.Logger
-}
-
-func NewObserver(net rpc.Net, peerType uint32, peerNo uint32) *Observer {
-	o := &Observer{
-		net:                net,
-		chanDataOprPush:    make(chan *DataOprPush),
-		chanConnChangePush: make(chan *ConnChangePush),
-		logger:             yx.NewLogger("reg.Observer"),
-	}
-
-	o.net.SetMark(PUSH_MARK, peerType, peerNo)
-	return o
-}
-
-func (o *Observer) Start() {
-	o.readPackLoop()
-}
-
-func (o *Observer) Stop() {
-	o.net.Close()
-}
-
-func (o *Observer) PopDataOprPack() (*DataOprPush, bool) {
-	pack, ok := <-o.chanDataOprPush
-	return pack, ok
-}
-
-func (o *Observer) PopConnChangePack() (*ConnChangePush, bool) {
-	pack, ok := <-o.chanConnChangePush
-	return pack, ok
-}
-
-func (o *Observer) readPackLoop() {
-	for {
-		data, err := o.net.ReadRpcPack()
-		if err != nil {
-			break
-		}
-
-		h := rpc.NewPackHeader(PUSH_MARK, 0, 0)
-		err = h.Unmarshal(data.Payload)
-		if err != nil {
-			continue
-		}
-
-		headerLen := h.GetHeaderLen()
-		o.handlePack(h.FuncNo, data.Payload[headerLen:])
-	}
-
-	close(o.chanDataOprPush)
-	close(o.chanConnChangePush)
-}
-
-func (o *Observer) handlePack(funcNo uint16, payload []byte) {
-	if funcNo == DATA_OPR_PUSH_FUNC_NO {
-		pushPack := &DataOprPush{}
-		err := json.Unmarshal(payload, pushPack)
-		if err != nil {
-			o.logger.E("handlePack json.Unmarshal err: ", err)
-			return
-		}
-
-		o.chanDataOprPush <- pushPack
-
-	} else if funcNo == CONN_CHANGE_FUNC_NO {
-		pushPack := &ConnChangePush{}
-		err := json.Unmarshal(payload, pushPack)
-		if err != nil {
-			o.logger.E("handlePack json.Unmarshal err: ", err)
-			return
-		}
-
-		o.chanConnChangePush <- pushPack
-	}
-}
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/yxlib/rpc"
+	"github.com/yxlib/yx"
+)
+
+//======================
+//      pushFifo
+//======================
+// pushFifo is an unbounded queue of the pushes of a kind, Push never block.
+type pushFifo struct {
+	items   []interface{}
+	bClosed bool
+	cond    *sync.Cond
+}
+
+func newPushFifo() *pushFifo {
+	return &pushFifo{
+		items:   make([]interface{}, 0),
+		bClosed: false,
+		cond:    sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+func (q *pushFifo) Push(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	if q.bClosed {
+		return
+	}
+
+	q.items = append(q.items, item)
+	q.cond.Signal()
+}
+
+// Pop block until there is an item, return false if it is closed and empty.
+func (q *pushFifo) Pop() (interface{}, bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	for len(q.items) == 0 && !q.bClosed {
+		q.cond.Wait()
+	}
+
+	if len(q.items) == 0 {
+		return nil, false
+	}
+
+	item := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return item, true
+}
+
+// Close wake up the consumer, the queued items are still popped.
+func (q *pushFifo) Close() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+
+	q.bClosed = true
+	q.cond.Broadcast()
+}
+
+//======================
+//      Observer
+//======================
+// Observer read the pushes and queue them by kind, each kind is queued separately without limit,
+// so the read loop never block and a slow consumer of one kind never stall the others.
+// The pushes to a client are bounded by the push queue of the registry.
+type Observer struct {
+	net            rpc.Net
+	lckNet         *sync.Mutex
+	chanNetSwitch  chan bool
+	netBrokenCb    func()
+	bStop          bool
+	queDataOprPush *pushFifo
+	queConnChange  *pushFifo
+	queLockPush    *pushFifo
+	queLeaderPush  *pushFifo
+	queHealthPing  *pushFifo
+	logger         *yx.Logger
+}
+
+func NewObserver(net rpc.Net, peerType uint32, peerNo uint32) *Observer {
+	o := &Observer{
+		net:            net,
+		lckNet:         &sync.Mutex{},
+		chanNetSwitch:  nil,
+		netBrokenCb:    nil,
+		bStop:          false,
+		queDataOprPush: newPushFifo(),
+		queConnChange:  newPushFifo(),
+		queLockPush:    newPushFifo(),
+		queLeaderPush:  newPushFifo(),
+		queHealthPing:  newPushFifo(),
+		logger:         yx.NewLogger("reg.Observer"),
+	}
+
+	o.net.SetMark(PUSH_MARK, peerType, peerNo)
+	return o
+}
+
+func (o *Observer) Start() {
+	o.readPackLoop()
+}
+
+func (o *Observer) Stop() {
+	o.lckNet.Lock()
+	o.bStop = true
+	net := o.net
+	if o.chanNetSwitch != nil {
+		close(o.chanNetSwitch)
+	}
+
+	o.lckNet.Unlock()
+
+	net.Close()
+}
+
+// SetReconnectable keep the push channels open when the net is broken,
+// cb is called and the pushes continue after SwitchNet. It must be called before Start.
+func (o *Observer) SetReconnectable(cb func()) {
+	o.chanNetSwitch = make(chan bool, 1)
+	o.netBrokenCb = cb
+}
+
+// SwitchNet close the current net and read the pushes from net, it never block.
+func (o *Observer) SwitchNet(net rpc.Net, peerType uint32, peerNo uint32) {
+	net.SetMark(PUSH_MARK, peerType, peerNo)
+
+	o.lckNet.Lock()
+	if o.bStop {
+		o.lckNet.Unlock()
+		net.Close()
+		return
+	}
+
+	old := o.net
+	o.net = net
+
+	// the read loop always read the latest net, so a pending signal is enough
+	select {
+	case o.chanNetSwitch <- true:
+	default:
+	}
+
+	o.lckNet.Unlock()
+
+	old.Close()
+}
+
+func (o *Observer) PopDataOprPack() (*DataOprPush, bool) {
+	pack, ok := o.queDataOprPush.Pop()
+	if !ok {
+		return nil, false
+	}
+
+	return pack.(*DataOprPush), true
+}
+
+func (o *Observer) PopConnChangePack() (*ConnChangePush, bool) {
+	pack, ok := o.queConnChange.Pop()
+	if !ok {
+		return nil, false
+	}
+
+	return pack.(*ConnChangePush), true
+}
+
+func (o *Observer) PopLockPack() (*LockPush, bool) {
+	pack, ok := o.queLockPush.Pop()
+	if !ok {
+		return nil, false
+	}
+
+	return pack.(*LockPush), true
+}
+
+func (o *Observer) PopLeaderPack() (*LeaderPush, bool) {
+	pack, ok := o.queLeaderPush.Pop()
+	if !ok {
+		return nil, false
+	}
+
+	return pack.(*LeaderPush), true
+}
+
+func (o *Observer) PopHealthPingPack() (*HealthPingPush, bool) {
+	pack, ok := o.queHealthPing.Pop()
+	if !ok {
+		return nil, false
+	}
+
+	return pack.(*HealthPingPush), true
+}
+
+func (o *Observer) getNet() rpc.Net {
+	o.lckNet.Lock()
+	defer o.lckNet.Unlock()
+
+	return o.net
+}
+
+// isBroken check if the net is closed by itself, not by Stop or SwitchNet.
+func (o *Observer) isBroken(net rpc.Net) bool {
+	o.lckNet.Lock()
+	defer o.lckNet.Unlock()
+
+	return !o.bStop && net == o.net
+}
+
+func (o *Observer) readPackLoop() {
+	net := o.getNet()
+	for {
+		o.readNet(net)
+		if o.chanNetSwitch == nil {
+			break
+		}
+
+		if o.isBroken(net) && o.netBrokenCb != nil {
+			go o.netBrokenCb()
+		}
+
+		_, ok := <-o.chanNetSwitch
+		if !ok {
+			break
+		}
+
+		net = o.getNet()
+	}
+
+	o.queDataOprPush.Close()
+	o.queConnChange.Close()
+	o.queLockPush.Close()
+	o.queLeaderPush.Close()
+	o.queHealthPing.Close()
+}
+
+func (o *Observer) readNet(net rpc.Net) {
+	for {
+		data, err := net.ReadRpcPack()
+		if err != nil {
+			break
+		}
+
+		h := rpc.NewPackHeader(PUSH_MARK, 0, 0)
+		err = h.Unmarshal(data.Payload)
+		if err != nil {
+			continue
+		}
+
+		headerLen := h.GetHeaderLen()
+		o.handlePack(h.FuncNo, data.Payload[headerLen:])
+	}
+}
+
+func (o *Observer) handlePack(funcNo uint16, payload []byte) {
+	if funcNo == DATA_OPR_PUSH_FUNC_NO {
+		pushPack := &DataOprPush{}
+		err := json.Unmarshal(payload, pushPack)
+		if err != nil {
+			o.logger.E("handlePack json.Unmarshal err: ", err)
+			return
+		}
+
+		o.queDataOprPush.Push(pushPack)
+
+	} else if funcNo == BATCH_PUSH_FUNC_NO {
+		batchPack := &DataOprBatchPush{}
+		err := json.Unmarshal(payload, batchPack)
+		if err != nil {
+			o.logger.E("handlePack json.Unmarshal err: ", err)
+			return
+		}
+
+		for _, pushPack := range batchPack.Pushes {
+			o.queDataOprPush.Push(pushPack)
+		}
+
+	} else if funcNo == CONN_CHANGE_FUNC_NO {
+		pushPack := &ConnChangePush{}
+		err := json.Unmarshal(payload, pushPack)
+		if err != nil {
+			o.logger.E("handlePack json.Unmarshal err: ", err)
+			return
+		}
+
+		o.queConnChange.Push(pushPack)
+
+	} else if funcNo == LOCK_PUSH_FUNC_NO {
+		pushPack := &LockPush{}
+		err := json.Unmarshal(payload, pushPack)
+		if err != nil {
+			o.logger.E("handlePack json.Unmarshal err: ", err)
+			return
+		}
+
+		o.queLockPush.Push(pushPack)
+
+	} else if funcNo == LEADER_PUSH_FUNC_NO {
+		pushPack := &LeaderPush{}
+		err := json.Unmarshal(payload, pushPack)
+		if err != nil {
+			o.logger.E("handlePack json.Unmarshal err: ", err)
+			return
+		}
+
+		o.queLeaderPush.Push(pushPack)
+
+	} else if funcNo == HEALTH_PING_FUNC_NO {
+		pushPack := &HealthPingPush{}
+		err := json.Unmarshal(payload, pushPack)
+		if err != nil {
+			o.logger.E("handlePack json.Unmarshal err: ", err)
+			return
+		}
+
+		o.queHealthPing.Push(pushPack)
+	}
+}
@@ -0,0 +1,502 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"errors"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yxlib/yx"
+)
+
+var (
+	ErrPickerSrvTypeNotAdded = errors.New("server type not added to picker")
+	ErrPickerNoSrv           = errors.New("no server to pick")
+	ErrInvalidPickStrategy   = errors.New("invalid pick strategy")
+)
+
+const (
+	PICK_STRATEGY_ROUND_ROBIN = 1 + iota
+	PICK_STRATEGY_RANDOM
+	PICK_STRATEGY_WEIGHTED
+	PICK_STRATEGY_LRU
+	PICK_STRATEGY_CONSISTENT_HASH
+)
+
+const (
+	CONSISTENT_HASH_VIRTUAL_NODES = 100
+)
+
+//======================
+//     PickStrategy
+//======================
+// PickStrategy choose a server from the servers of a type,
+// Update is called with the servers sorted by SrvNo when they are changed.
+type PickStrategy interface {
+	Update(srvs []*SrvInfo)
+	Pick(hashKey string) (*SrvInfo, bool)
+}
+
+func NewPickStrategy(strategyType int, weightFunc func(info *SrvInfo) uint32) (PickStrategy, error) {
+	switch strategyType {
+	case PICK_STRATEGY_ROUND_ROBIN:
+		return &roundRobinStrategy{}, nil
+	case PICK_STRATEGY_RANDOM:
+		return &randomStrategy{}, nil
+	case PICK_STRATEGY_WEIGHTED:
+		return &weightedStrategy{weightFunc: weightFunc}, nil
+	case PICK_STRATEGY_LRU:
+		return &lruStrategy{lck: &sync.Mutex{}}, nil
+	case PICK_STRATEGY_CONSISTENT_HASH:
+		return &consistentHashStrategy{}, nil
+	default:
+		return nil, ErrInvalidPickStrategy
+	}
+}
+
+// roundRobinStrategy
+type roundRobinStrategy struct {
+	srvs []*SrvInfo
+	next uint32
+}
+
+func (s *roundRobinStrategy) Update(srvs []*SrvInfo) {
+	s.srvs = srvs
+}
+
+func (s *roundRobinStrategy) Pick(hashKey string) (*SrvInfo, bool) {
+	if len(s.srvs) == 0 {
+		return nil, false
+	}
+
+	idx := atomic.AddUint32(&s.next, 1) - 1
+	return s.srvs[idx%uint32(len(s.srvs))], true
+}
+
+// randomStrategy
+type randomStrategy struct {
+	srvs []*SrvInfo
+}
+
+func (s *randomStrategy) Update(srvs []*SrvInfo) {
+	s.srvs = srvs
+}
+
+func (s *randomStrategy) Pick(hashKey string) (*SrvInfo, bool) {
+	if len(s.srvs) == 0 {
+		return nil, false
+	}
+
+	return s.srvs[rand.Intn(len(s.srvs))], true
+}
+
+// weightedStrategy pick a server randomly in proportion to the weight, the Weight of the meta
+// is 1 if it is not set, only the servers weighted 0 by the weight func are never picked.
+type weightedStrategy struct {
+	srvs        []*SrvInfo
+	sumWeights  []uint64
+	totalWeight uint64
+	weightFunc  func(info *SrvInfo) uint32
+}
+
+func (s *weightedStrategy) Update(srvs []*SrvInfo) {
+	s.srvs = srvs
+	s.sumWeights = make([]uint64, len(srvs))
+	s.totalWeight = 0
+	for i, info := range srvs {
+		weight := info.Weight
+		if s.weightFunc != nil {
+			weight = s.weightFunc(info)
+		} else if weight == 0 {
+			weight = 1
+		}
+
+		s.totalWeight += uint64(weight)
+		s.sumWeights[i] = s.totalWeight
+	}
+}
+
+func (s *weightedStrategy) Pick(hashKey string) (*SrvInfo, bool) {
+	if s.totalWeight == 0 {
+		return nil, false
+	}
+
+	r := uint64(rand.Int63n(int64(s.totalWeight)))
+	idx := sort.Search(len(s.sumWeights), func(i int) bool {
+		return s.sumWeights[i] > r
+	})
+
+	return s.srvs[idx], true
+}
+
+// lruStrategy pick the server which is least recently picked,
+// the new servers are picked first.
+type lruStrategy struct {
+	srvs []*SrvInfo
+	lck  *sync.Mutex
+}
+
+func (s *lruStrategy) Update(srvs []*SrvInfo) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	mapNo2Srv := make(map[uint32]*SrvInfo)
+	for _, info := range srvs {
+		mapNo2Srv[info.SrvNo] = info
+	}
+
+	used := make([]*SrvInfo, 0, len(srvs))
+	for _, info := range s.srvs {
+		newInfo, ok := mapNo2Srv[info.SrvNo]
+		if ok {
+			used = append(used, newInfo)
+			delete(mapNo2Srv, info.SrvNo)
+		}
+	}
+
+	ordered := make([]*SrvInfo, 0, len(srvs))
+	for _, info := range srvs {
+		_, ok := mapNo2Srv[info.SrvNo]
+		if ok {
+			ordered = append(ordered, info)
+		}
+	}
+
+	s.srvs = append(ordered, used...)
+}
+
+func (s *lruStrategy) Pick(hashKey string) (*SrvInfo, bool) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if len(s.srvs) == 0 {
+		return nil, false
+	}
+
+	info := s.srvs[0]
+	copy(s.srvs, s.srvs[1:])
+	s.srvs[len(s.srvs)-1] = info
+	return info, true
+}
+
+// consistentHashStrategy map the hash key to a server on a ring of virtual nodes,
+// so the same key is picked to the same server while the servers are not changed.
+type consistentHashStrategy struct {
+	hashes      []uint32
+	mapHash2Srv map[uint32]*SrvInfo
+}
+
+func (s *consistentHashStrategy) Update(srvs []*SrvInfo) {
+	hashes := make([]uint32, 0, len(srvs)*CONSISTENT_HASH_VIRTUAL_NODES)
+	mapHash2Srv := make(map[uint32]*SrvInfo)
+	for _, info := range srvs {
+		srvKey := GetSrvKey(info.SrvType, info.SrvNo)
+		for i := 0; i < CONSISTENT_HASH_VIRTUAL_NODES; i++ {
+			h := crc32.ChecksumIEEE([]byte(srvKey + "#" + strconv.Itoa(i)))
+			_, ok := mapHash2Srv[h]
+			if ok {
+				continue
+			}
+
+			hashes = append(hashes, h)
+			mapHash2Srv[h] = info
+		}
+	}
+
+	sort.Slice(hashes, func(i, j int) bool {
+		return hashes[i] < hashes[j]
+	})
+
+	s.hashes = hashes
+	s.mapHash2Srv = mapHash2Srv
+}
+
+func (s *consistentHashStrategy) Pick(hashKey string) (*SrvInfo, bool) {
+	if len(s.hashes) == 0 {
+		return nil, false
+	}
+
+	h := crc32.ChecksumIEEE([]byte(hashKey))
+	idx := sort.Search(len(s.hashes), func(i int) bool {
+		return s.hashes[i] >= h
+	})
+
+	if idx == len(s.hashes) {
+		idx = 0
+	}
+
+	return s.mapHash2Srv[s.hashes[idx]], true
+}
+
+//======================
+//       Picker
+//======================
+// pickerSrvSet keep the servers of a type with their ModRev, the pushes received while syncing
+// are kept in mapNo2PushRev, removed ones included, so they are not overwritten by the older fetch.
+type pickerSrvSet struct {
+	mapNo2Srv     map[uint32]*SrvInfo
+	mapNo2Rev     map[uint32]int64
+	mapNo2PushRev map[uint32]int64
+	syncNum       int
+	strategy      PickStrategy
+}
+
+func newPickerSrvSet(strategy PickStrategy) *pickerSrvSet {
+	return &pickerSrvSet{
+		mapNo2Srv:     make(map[uint32]*SrvInfo),
+		mapNo2Rev:     make(map[uint32]int64),
+		mapNo2PushRev: make(map[uint32]int64),
+		syncNum:       0,
+		strategy:      strategy,
+	}
+}
+
+// Picker keep the servers of the added types by watching them,
+// so Pick is done locally. The client must be started before AddSrvType.
+type Picker struct {
+	client       *Client
+	strategyType int
+	weightFunc   func(info *SrvInfo) uint32
+	mapType2Set  map[uint32]*pickerSrvSet
+	lck          *sync.RWMutex
+	logger       *yx.Logger
+	ec           *yx.ErrCatcher
+}
+
+func NewPicker(c *Client, strategyType int) *Picker {
+	p := &Picker{
+		client:       c,
+		strategyType: strategyType,
+		weightFunc:   nil,
+		mapType2Set:  make(map[uint32]*pickerSrvSet),
+		lck:          &sync.RWMutex{},
+		logger:       yx.NewLogger("reg.Picker"),
+		ec:           yx.NewErrCatcher("reg.Picker"),
+	}
+
+	c.ListenDataOprPushWithValue(p.onDataOprPush)
+	c.ListenReconnect(p.onReconnect)
+	return p
+}
+
+// SetWeightFunc set the weight of each server for PICK_STRATEGY_WEIGHTED,
+// the Weight of the meta is used by default, 1 if it is not set. It must be called before AddSrvType.
+func (p *Picker) SetWeightFunc(f func(info *SrvInfo) uint32) {
+	p.weightFunc = f
+}
+
+// AddSrvType fetch the servers of the type and watch them.
+func (p *Picker) AddSrvType(srvType uint32) error {
+	strategy, err := NewPickStrategy(p.strategyType, p.weightFunc)
+	if err != nil {
+		return p.ec.Throw("AddSrvType", err)
+	}
+
+	p.lck.Lock()
+	_, ok := p.mapType2Set[srvType]
+	if !ok {
+		p.mapType2Set[srvType] = newPickerSrvSet(strategy)
+	}
+	p.lck.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	// watch the type first, so no change is missed between the fetch and the watch
+	err = p.client.watchShared(getSrvTypeWatchRecordKey(srvType), newSrvTypeWatchRecord(srvType, WatchOpt{WithValue: true}))
+	if err != nil {
+		p.lck.Lock()
+		delete(p.mapType2Set, srvType)
+		p.lck.Unlock()
+		return p.ec.Throw("AddSrvType", err)
+	}
+
+	err = p.syncSrvType(srvType)
+	return p.ec.Throw("AddSrvType", err)
+}
+
+// RemoveSrvType stop picking the type, the watch of the type set by the user is kept.
+func (p *Picker) RemoveSrvType(srvType uint32) error {
+	p.lck.Lock()
+	_, ok := p.mapType2Set[srvType]
+	delete(p.mapType2Set, srvType)
+	p.lck.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	req := &StopWatchSrvsByTypeReq{
+		SrvType: srvType,
+	}
+
+	err := p.client.stopWatchShared(getSrvTypeWatchRecordKey(srvType), "StopWatchSrvsByType", req)
+	return p.ec.Throw("RemoveSrvType", err)
+}
+
+// Pick choose a server of the type, hashKey is only used by PICK_STRATEGY_CONSISTENT_HASH.
+func (p *Picker) Pick(srvType uint32, hashKey string) (*SrvInfo, error) {
+	p.lck.RLock()
+	defer p.lck.RUnlock()
+
+	set, ok := p.mapType2Set[srvType]
+	if !ok {
+		return nil, ErrPickerSrvTypeNotAdded
+	}
+
+	info, ok := set.strategy.Pick(hashKey)
+	if !ok {
+		return nil, ErrPickerNoSrv
+	}
+
+	return info, nil
+}
+
+// syncSrvType fetch the servers of the type, the type must be watched.
+// A server pushed while fetching is kept if its ModRev is not older than the fetched one.
+func (p *Picker) syncSrvType(srvType uint32) error {
+	p.lck.Lock()
+	set, ok := p.mapType2Set[srvType]
+	if ok {
+		set.syncNum++
+	}
+	p.lck.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	req := &GetSrvsByTypeReq{
+		SrvType: srvType,
+	}
+
+	resp := &GetSrvsByTypeResp{}
+	code, err := p.client.rpcCallWithCode("GetSrvsByType", req, resp)
+	if code == RES_CODE_SRV_TYPE_NOT_EXISTS {
+		err = nil
+	}
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	set.syncNum--
+	if err == nil {
+		p.mergeFetched(set, resp.Data, resp.Revs)
+	}
+
+	if set.syncNum == 0 {
+		set.mapNo2PushRev = make(map[uint32]int64)
+	}
+
+	return err
+}
+
+// mergeFetched must be called with the lock held, it replace the servers by the fetched ones
+// except the servers pushed while fetching with a newer ModRev.
+func (p *Picker) mergeFetched(set *pickerSrvSet, infos []*SrvInfo, revs []KeyRev) {
+	mapNo2Srv := make(map[uint32]*SrvInfo)
+	mapNo2Rev := make(map[uint32]int64)
+	for i, info := range infos {
+		var modRev int64 = 0
+		if i < len(revs) {
+			modRev = revs[i].ModRev
+		}
+
+		pushRev, ok := set.mapNo2PushRev[info.SrvNo]
+		if ok && pushRev >= modRev {
+			continue
+		}
+
+		mapNo2Srv[info.SrvNo] = info
+		mapNo2Rev[info.SrvNo] = modRev
+	}
+
+	for srvNo, pushRev := range set.mapNo2PushRev {
+		_, ok := mapNo2Rev[srvNo]
+		if ok {
+			continue
+		}
+
+		info, ok := set.mapNo2Srv[srvNo]
+		if ok && set.mapNo2Rev[srvNo] == pushRev {
+			mapNo2Srv[srvNo] = info
+			mapNo2Rev[srvNo] = pushRev
+		}
+	}
+
+	set.mapNo2Srv = mapNo2Srv
+	set.mapNo2Rev = mapNo2Rev
+	p.updateStrategy(set)
+}
+
+func (p *Picker) onDataOprPush(pushData *DataOprPush) {
+	if pushData.KeyType != KEY_TYPE_SRV_INFO {
+		return
+	}
+
+	srvType, srvNo := GetSrvTypeAndNo(pushData.Key)
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	set, ok := p.mapType2Set[srvType]
+	if !ok || set.mapNo2Rev[srvNo] > pushData.ModRev {
+		return
+	}
+
+	if pushData.Operate == DATA_OPR_TYPE_REMOVE {
+		delete(set.mapNo2Srv, srvNo)
+		delete(set.mapNo2Rev, srvNo)
+	} else if pushData.Srv != nil {
+		set.mapNo2Srv[srvNo] = pushData.Srv
+		set.mapNo2Rev[srvNo] = pushData.ModRev
+	} else {
+		return
+	}
+
+	if set.syncNum > 0 {
+		set.mapNo2PushRev[srvNo] = pushData.ModRev
+	}
+
+	p.updateStrategy(set)
+}
+
+func (p *Picker) onReconnect(nodeId uint32) {
+	p.lck.RLock()
+	srvTypes := make([]uint32, 0, len(p.mapType2Set))
+	for srvType := range p.mapType2Set {
+		srvTypes = append(srvTypes, srvType)
+	}
+	p.lck.RUnlock()
+
+	for _, srvType := range srvTypes {
+		err := p.syncSrvType(srvType)
+		if err != nil {
+			p.logger.E("sync server type ", srvType, " err: ", err)
+		}
+	}
+}
+
+// updateStrategy must be called with the lock held, the servers out of rotation are skipped.
+func (p *Picker) updateStrategy(set *pickerSrvSet) {
+	srvs := make([]*SrvInfo, 0, len(set.mapNo2Srv))
+	for _, info := range set.mapNo2Srv {
+		if IsInRotation(info) {
+			srvs = append(srvs, info)
+		}
+	}
+
+	sort.Slice(srvs, func(i, j int) bool {
+		return srvs[i].SrvNo < srvs[j].SrvNo
+	})
+
+	set.strategy.Update(srvs)
+}
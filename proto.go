@@ -1,244 +1,608 @@
-// Copyright 2022 Guan Jianchang. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
-package reg
-
-const (
-	REG_SERVIC_NAME       = "reg"
-	REG_SRV               = "REG_SRV"
-	TIME_OUT_SEC          = 3
-	PUSH_MARK             = "REG_PUSH"
-	DATA_OPR_PUSH_FUNC_NO = 1
-	CONN_CHANGE_FUNC_NO   = 2
-)
-
-const (
-	// RES_CODE_SUCC                   = 0
-	RES_CODE_SRV_NOT_EXISTS         = 100
-	RES_CODE_SRV_TYPE_NOT_EXISTS    = 101
-	RES_CODE_GLOBAL_DATA_NOT_EXISTS = 102
-)
-
-// RegResp
-// type RegResp interface {
-// 	SetResult(code int, msg string)
-// 	GetResCode() int
-// 	GetResMsg() string
-// }
-
-// type BaseResp struct {
-// 	ResCode int    `json:"resCode"`
-// 	Msg     string `json:"msg"`
-// }
-
-// func (r *BaseResp) SetResult(code int, msg string) {
-// 	r.ResCode = code
-// 	r.Msg = msg
-// }
-
-// func (r *BaseResp) GetResCode() int {
-// 	return r.ResCode
-// }
-
-// func (r *BaseResp) GetResMsg() string {
-// 	return r.Msg
-// }
-
-// UpdateSrv
-type UpdateSrvReq struct {
-	SrvInfo
-}
-
-// type UpdateSrvResp struct {
-// 	BaseResp
-// }
-
-// RemoveSrv
-type RemoveSrvReq struct {
-	SrvType uint32 `json:"type"`
-	SrvNo   uint32 `json:"no"`
-}
-
-// type RemoveSrvResp struct {
-// 	BaseResp
-// }
-
-// GetSrv
-type GetSrvReq struct {
-	SrvType uint32 `json:"type"`
-	SrvNo   uint32 `json:"no"`
-}
-
-type GetSrvResp struct {
-	// BaseResp
-	Data *SrvInfo `json:"data"`
-}
-
-// GetSrvByKey
-type GetSrvByKeyReq struct {
-	Key string `json:"key"`
-}
-
-type GetSrvByKeyResp struct {
-	// BaseResp
-	Data *SrvInfo `json:"data"`
-}
-
-// GetSrvsByType
-type GetSrvsByTypeReq struct {
-	SrvType uint32 `json:"type"`
-}
-
-type GetSrvsByTypeResp struct {
-	// BaseResp
-	Data []*SrvInfo `json:"data"`
-}
-
-// WatchSrv
-type WatchSrvReq struct {
-	SrvType uint32 `json:"type"`
-	SrvNo   uint32 `json:"no"`
-}
-
-// type WatchSrvResp struct {
-// 	BaseResp
-// }
-
-// StopWatchSrv
-type StopWatchSrvReq struct {
-	SrvType uint32 `json:"type"`
-	SrvNo   uint32 `json:"no"`
-}
-
-// type StopWatchSrvResp struct {
-// 	BaseResp
-// }
-
-// WatchSrvsByType
-type WatchSrvsByTypeReq struct {
-	SrvType uint32 `json:"type"`
-}
-
-// type WatchSrvsByTypeResp struct {
-// 	BaseResp
-// }
-
-// StopWatchSrvsByType
-type StopWatchSrvsByTypeReq struct {
-	SrvType uint32 `json:"type"`
-}
-
-// type StopWatchSrvsByTypeResp struct {
-// 	BaseResp
-// }
-
-// UpdateGlobalData
-type UpdateGlobalDataReq struct {
-	Key        string `json:"key"`
-	DataBase64 string `json:"data"`
-}
-
-// type UpdateGlobalDataResp struct {
-// 	BaseResp
-// }
-
-// RemoveGlobalData
-type RemoveGlobalDataReq struct {
-	Key string `json:"key"`
-}
-
-// type RemoveGlobalDataResp struct {
-// 	BaseResp
-// }
-
-// GetGlobalData
-type GetGlobalDataReq struct {
-	Key string `json:"key"`
-}
-
-type GetGlobalDataResp struct {
-	// BaseResp
-	DataBase64 string `json:"data"`
-}
-
-// WatchGlobalData
-type WatchGlobalDataReq struct {
-	Key string `json:"key"`
-}
-
-// type WatchGlobalDataResp struct {
-// 	BaseResp
-// }
-
-// StopWatchGlobalData
-type StopWatchGlobalDataReq struct {
-	Key string `json:"key"`
-}
-
-// type StopWatchGlobalDataResp struct {
-// 	BaseResp
-// }
-
-// WatchConn
-type WatchConnReq struct {
-}
-
-// type WatchConnResp struct {
-// 	BaseResp
-// }
-
-// StopWatchConnReq
-type StopWatchConnReq struct {
-}
-
-// type StopWatchConnResp struct {
-// 	BaseResp
-// }
-
-type StopAllWatchReq struct {
-	SrvType uint32 `json:"type"`
-	SrvNo   uint32 `json:"no"`
-}
-
-// type StopAllWatchResp struct {
-// 	BaseResp
-// }
-
-const (
-	KEY_TYPE_SRV_INFO = 1 + iota
-	KEY_TYPE_GLOBAL_DATA
-)
-
-type DataOprPush struct {
-	KeyType int    `json:"key_type"`
-	Key     string `json:"key"`
-	Operate int    `json:"opr"`
-}
-
-func NewDataOprPush(keyType int, key string, operate int) *DataOprPush {
-	return &DataOprPush{
-		KeyType: keyType,
-		Key:     key,
-		Operate: operate,
-	}
-}
-
-const (
-	CONN_CHANGE_TYPE_OPEN = 1 + iota
-	CONN_CHANGE_TYPE_CLOSE
-)
-
-type ConnChangePush struct {
-	SrvType        uint32 `json:"type"`
-	SrvNo          uint32 `json:"no"`
-	ConnChangeType int    `json:"change"`
-}
-
-func NewConnChangePush(srvType uint32, srvNo uint32, connChangeType int) *ConnChangePush {
-	return &ConnChangePush{
-		SrvType:        srvType,
-		SrvNo:          srvNo,
-		ConnChangeType: connChangeType,
-	}
-}
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import "encoding/base64"
+
+const (
+	REG_SERVIC_NAME       = "reg"
+	REG_SRV               = "REG_SRV"
+	TIME_OUT_SEC          = 3
+	PUSH_MARK             = "REG_PUSH"
+	DATA_OPR_PUSH_FUNC_NO = 1
+	CONN_CHANGE_FUNC_NO   = 2
+	LOCK_PUSH_FUNC_NO     = 3
+	LEADER_PUSH_FUNC_NO   = 4
+	HEALTH_PING_FUNC_NO   = 5
+	BATCH_PUSH_FUNC_NO    = 6
+)
+
+const (
+	// RES_CODE_SUCC                   = 0
+	RES_CODE_SRV_NOT_EXISTS         = 100
+	RES_CODE_SRV_TYPE_NOT_EXISTS    = 101
+	RES_CODE_GLOBAL_DATA_NOT_EXISTS = 102
+	RES_CODE_LEASE_NOT_EXISTS       = 103
+	RES_CODE_REVISION_COMPACTED     = 104
+	RES_CODE_FUTURE_REVISION        = 105
+	RES_CODE_COMPARE_FAILED         = 106
+	RES_CODE_INVALID_PARAM          = 107
+	RES_CODE_NOT_LEADER             = 108
+	RES_CODE_UNAVAILABLE            = 109
+	RES_CODE_LOCK_NOT_OWNER         = 110
+	RES_CODE_NOT_ELECTION_LEADER    = 111
+	RES_CODE_PERMISSION_DENIED      = 112
+	RES_CODE_QUOTA_EXCEEDED         = 113
+)
+
+// RegResp
+// type RegResp interface {
+// 	SetResult(code int, msg string)
+// 	GetResCode() int
+// 	GetResMsg() string
+// }
+
+// type BaseResp struct {
+// 	ResCode int    `json:"resCode"`
+// 	Msg     string `json:"msg"`
+// }
+
+// func (r *BaseResp) SetResult(code int, msg string) {
+// 	r.ResCode = code
+// 	r.Msg = msg
+// }
+
+// func (r *BaseResp) GetResCode() int {
+// 	return r.ResCode
+// }
+
+// func (r *BaseResp) GetResMsg() string {
+// 	return r.Msg
+// }
+
+// WatchOpt
+type WatchOpt struct {
+	WithValue     bool  `json:"with_value"`
+	WithPrevValue bool  `json:"with_prev"`
+	StartRev      int64 `json:"start_rev"`
+	Recursive     bool  `json:"recursive"`
+}
+
+// Merge keep the values pushed for either of the options, the watchers of a connection share the pushes.
+func (o *WatchOpt) Merge(opt WatchOpt) {
+	o.WithValue = o.WithValue || opt.WithValue
+	o.WithPrevValue = o.WithPrevValue || opt.WithPrevValue
+}
+
+// NsReq is embedded in the requests of the data and the watches,
+// an empty namespace is the default namespace.
+type NsReq struct {
+	Namespace string `json:"ns,omitempty"`
+}
+
+func (r *NsReq) GetNamespace() string {
+	return r.Namespace
+}
+
+func (r *NsReq) SetNamespace(ns string) {
+	r.Namespace = ns
+}
+
+// Auth
+type AuthReq struct {
+	Token string `json:"token"`
+}
+
+type AuthResp struct {
+	Identity string `json:"identity"`
+}
+
+// UpdateSrv
+// the meta of an existing server is kept if Meta is nil, the health is set by the registry
+type UpdateSrvReq struct {
+	NsReq
+	SrvType    uint32   `json:"type"`
+	SrvNo      uint32   `json:"no"`
+	IsTemp     bool     `json:"bTemp"`
+	DataBase64 string   `json:"data"`
+	Meta       *SrvMeta `json:"meta,omitempty"`
+	TTL        uint32   `json:"ttl"`
+}
+
+// type UpdateSrvResp struct {
+// 	BaseResp
+// }
+
+// CompareAndUpdateSrv
+type CompareAndUpdateSrvReq struct {
+	UpdateSrvReq
+	Cmp *Compare `json:"cmp"`
+}
+
+type CompareAndUpdateSrvResp struct {
+	Data *SrvInfo `json:"data"`
+	KeyRev
+}
+
+// RemoveSrv
+type RemoveSrvReq struct {
+	NsReq
+	SrvType uint32 `json:"type"`
+	SrvNo   uint32 `json:"no"`
+}
+
+// type RemoveSrvResp struct {
+// 	BaseResp
+// }
+
+// SetSrvStatus
+type SetSrvStatusReq struct {
+	NsReq
+	SrvType uint32 `json:"type"`
+	SrvNo   uint32 `json:"no"`
+	Status  string `json:"status"`
+}
+
+// type SetSrvStatusResp struct {
+// 	BaseResp
+// }
+
+// KeepAlive
+type KeepAliveReq struct {
+	NsReq
+	SrvType uint32 `json:"type"`
+	SrvNo   uint32 `json:"no"`
+}
+
+type KeepAliveResp struct {
+	TTL uint32 `json:"ttl"`
+}
+
+// GetSrv
+type GetSrvReq struct {
+	NsReq
+	SrvType uint32 `json:"type"`
+	SrvNo   uint32 `json:"no"`
+	Rev     int64  `json:"rev"`
+}
+
+type GetSrvResp struct {
+	// BaseResp
+	Data *SrvInfo `json:"data"`
+	KeyRev
+	Rev int64 `json:"rev"`
+}
+
+// GetSrvByKey
+type GetSrvByKeyReq struct {
+	NsReq
+	Key string `json:"key"`
+	Rev int64  `json:"rev"`
+}
+
+type GetSrvByKeyResp struct {
+	// BaseResp
+	Data *SrvInfo `json:"data"`
+	KeyRev
+	Rev int64 `json:"rev"`
+}
+
+// GetSrvsByType
+type GetSrvsByTypeReq struct {
+	NsReq
+	SrvType uint32     `json:"type"`
+	Filter  *SrvFilter `json:"filter,omitempty"`
+}
+
+// GetSrvsByTypeResp keep the revisions of the servers in Revs by index.
+type GetSrvsByTypeResp struct {
+	// BaseResp
+	Data []*SrvInfo `json:"data"`
+	Revs []KeyRev   `json:"revs,omitempty"`
+}
+
+// FindSrvs
+type FindSrvsReq struct {
+	NsReq
+	Selector string `json:"selector"`
+	SrvType  uint32 `json:"type"`
+	ByType   bool   `json:"by_type"`
+}
+
+type FindSrvsResp struct {
+	Data []*SrvInfo `json:"data"`
+}
+
+// Txn
+type TxnReq struct {
+	NsReq
+	Compares []*TxnCompare `json:"cmp"`
+	Success  []*TxnOp      `json:"then"`
+	Failure  []*TxnOp      `json:"else"`
+}
+
+type TxnResp struct {
+	Succeeded bool           `json:"succ"`
+	Results   []*DataOprPush `json:"results"`
+}
+
+// WatchSrv
+type WatchSrvReq struct {
+	NsReq
+	SrvType uint32 `json:"type"`
+	SrvNo   uint32 `json:"no"`
+	WatchOpt
+}
+
+// type WatchSrvResp struct {
+// 	BaseResp
+// }
+
+// StopWatchSrv
+type StopWatchSrvReq struct {
+	NsReq
+	SrvType uint32 `json:"type"`
+	SrvNo   uint32 `json:"no"`
+}
+
+// type StopWatchSrvResp struct {
+// 	BaseResp
+// }
+
+// WatchSrvsByType
+type WatchSrvsByTypeReq struct {
+	NsReq
+	SrvType uint32 `json:"type"`
+	WatchOpt
+}
+
+// type WatchSrvsByTypeResp struct {
+// 	BaseResp
+// }
+
+// StopWatchSrvsByType
+type StopWatchSrvsByTypeReq struct {
+	NsReq
+	SrvType uint32 `json:"type"`
+}
+
+// type StopWatchSrvsByTypeResp struct {
+// 	BaseResp
+// }
+
+// WatchSrvsBySelector
+type WatchSrvsBySelectorReq struct {
+	NsReq
+	Selector string `json:"selector"`
+	SrvType  uint32 `json:"type"`
+	ByType   bool   `json:"by_type"`
+	WatchOpt
+}
+
+// type WatchSrvsBySelectorResp struct {
+// 	BaseResp
+// }
+
+// StopWatchSrvsBySelector
+type StopWatchSrvsBySelectorReq struct {
+	NsReq
+	Selector string `json:"selector"`
+	SrvType  uint32 `json:"type"`
+	ByType   bool   `json:"by_type"`
+}
+
+// type StopWatchSrvsBySelectorResp struct {
+// 	BaseResp
+// }
+
+// UpdateGlobalData
+type UpdateGlobalDataReq struct {
+	NsReq
+	Key        string `json:"key"`
+	DataBase64 string `json:"data"`
+}
+
+// type UpdateGlobalDataResp struct {
+// 	BaseResp
+// }
+
+// CompareAndUpdateGlobalData
+type CompareAndUpdateGlobalDataReq struct {
+	NsReq
+	Key        string   `json:"key"`
+	DataBase64 string   `json:"data"`
+	Cmp        *Compare `json:"cmp"`
+}
+
+type CompareAndUpdateGlobalDataResp struct {
+	DataBase64 string `json:"data"`
+	KeyRev
+}
+
+// RemoveGlobalData
+type RemoveGlobalDataReq struct {
+	NsReq
+	Key string `json:"key"`
+}
+
+// type RemoveGlobalDataResp struct {
+// 	BaseResp
+// }
+
+// GetGlobalData
+type GetGlobalDataReq struct {
+	NsReq
+	Key string `json:"key"`
+	Rev int64  `json:"rev"`
+}
+
+type GetGlobalDataResp struct {
+	// BaseResp
+	DataBase64 string `json:"data"`
+	KeyRev
+	Rev int64 `json:"rev"`
+}
+
+// WatchGlobalData
+type WatchGlobalDataReq struct {
+	NsReq
+	Key string `json:"key"`
+	WatchOpt
+}
+
+// type WatchGlobalDataResp struct {
+// 	BaseResp
+// }
+
+// StopWatchGlobalData
+type StopWatchGlobalDataReq struct {
+	NsReq
+	Key string `json:"key"`
+}
+
+// type StopWatchGlobalDataResp struct {
+// 	BaseResp
+// }
+
+// WatchConn
+type WatchConnReq struct {
+}
+
+// type WatchConnResp struct {
+// 	BaseResp
+// }
+
+// StopWatchConnReq
+type StopWatchConnReq struct {
+}
+
+// type StopWatchConnResp struct {
+// 	BaseResp
+// }
+
+type StopAllWatchReq struct {
+	SrvType uint32 `json:"type"`
+	SrvNo   uint32 `json:"no"`
+}
+
+// type StopAllWatchResp struct {
+// 	BaseResp
+// }
+
+// GetMembers
+type GetMembersReq struct {
+}
+
+type GetMembersResp struct {
+	Members  []*RaftMember `json:"members"`
+	LeaderId uint32        `json:"leader"`
+}
+
+// Lock
+type LockReq struct {
+	Name string `json:"name"`
+	Wait bool   `json:"wait"`
+}
+
+type LockResp struct {
+	Acquired bool `json:"acquired"`
+}
+
+// Unlock
+type UnlockReq struct {
+	Name string `json:"name"`
+}
+
+// type UnlockResp struct {
+// 	BaseResp
+// }
+
+// Campaign
+type CampaignReq struct {
+}
+
+type CampaignResp struct {
+	IsLeader bool `json:"leader"`
+}
+
+// Resign
+type ResignReq struct {
+}
+
+// type ResignResp struct {
+// 	BaseResp
+// }
+
+// GetLeader
+type GetLeaderReq struct {
+	SrvType uint32 `json:"type"`
+}
+
+type GetLeaderResp struct {
+	LeaderNo  uint32 `json:"no"`
+	HasLeader bool   `json:"has_leader"`
+}
+
+// ObserveLeader
+type ObserveLeaderReq struct {
+	SrvType uint32 `json:"type"`
+}
+
+// type ObserveLeaderResp struct {
+// 	BaseResp
+// }
+
+// StopObserveLeader
+type StopObserveLeaderReq struct {
+	SrvType uint32 `json:"type"`
+}
+
+// type StopObserveLeaderResp struct {
+// 	BaseResp
+// }
+
+// HealthPong
+type HealthPongReq struct {
+	Seq uint64 `json:"seq"`
+}
+
+// type HealthPongResp struct {
+// 	BaseResp
+// }
+
+const (
+	KEY_TYPE_SRV_INFO = 1 + iota
+	KEY_TYPE_GLOBAL_DATA
+)
+
+type DataOprPush struct {
+	Namespace string `json:"ns,omitempty"`
+	KeyType   int    `json:"key_type"`
+	Key       string `json:"key"`
+	Operate   int    `json:"opr"`
+	KeyRev
+	Srv            *SrvInfo `json:"srv,omitempty"`
+	PrevSrv        *SrvInfo `json:"prev_srv,omitempty"`
+	DataBase64     string   `json:"data,omitempty"`
+	PrevDataBase64 string   `json:"prev_data,omitempty"`
+}
+
+func NewDataOprPush(keyType int, key string, operate int, kr KeyRev) *DataOprPush {
+	return &DataOprPush{
+		KeyType: keyType,
+		Key:     key,
+		Operate: operate,
+		KeyRev:  kr,
+	}
+}
+
+func (p *DataOprPush) SetValue(data interface{}, prevData interface{}) {
+	switch d := data.(type) {
+	case *SrvInfo:
+		p.Srv = d
+	case string:
+		p.DataBase64 = d
+	}
+
+	switch d := prevData.(type) {
+	case *SrvInfo:
+		p.PrevSrv = d
+	case string:
+		p.PrevDataBase64 = d
+	}
+}
+
+// WithOpt return a push only contains the values required by opt.
+func (p *DataOprPush) WithOpt(opt WatchOpt) *DataOprPush {
+	pushData := *p
+	if !opt.WithValue {
+		pushData.Srv = nil
+		pushData.DataBase64 = ""
+	}
+
+	if !opt.WithPrevValue {
+		pushData.PrevSrv = nil
+		pushData.PrevDataBase64 = ""
+	}
+
+	return &pushData
+}
+
+// GetValue return the *SrvInfo or the base64 string of the push.
+func (p *DataOprPush) GetValue() interface{} {
+	if p.KeyType == KEY_TYPE_SRV_INFO {
+		return p.Srv
+	}
+
+	return p.DataBase64
+}
+
+// GetRecordKey return a key which is unique in both trees of all the namespaces.
+func (p *DataOprPush) GetRecordKey() string {
+	return getRecordKey(p.KeyType, GetNsKey(p.Namespace, p.Key))
+}
+
+func getRecordKey(keyType int, key string) string {
+	if keyType == KEY_TYPE_SRV_INFO {
+		return "srv:" + key
+	}
+
+	return "global:" + key
+}
+
+func (p *DataOprPush) GetData() ([]byte, error) {
+	if p.Srv != nil {
+		return base64.StdEncoding.DecodeString(p.Srv.DataBase64)
+	}
+
+	return base64.StdEncoding.DecodeString(p.DataBase64)
+}
+
+func (p *DataOprPush) GetPrevData() ([]byte, error) {
+	if p.PrevSrv != nil {
+		return base64.StdEncoding.DecodeString(p.PrevSrv.DataBase64)
+	}
+
+	return base64.StdEncoding.DecodeString(p.PrevDataBase64)
+}
+
+const (
+	CONN_CHANGE_TYPE_OPEN = 1 + iota
+	CONN_CHANGE_TYPE_CLOSE
+)
+
+// DataOprBatchPush carry the pushes coalesced in a batch window or the pushes of a txn,
+// in the order of the revisions.
+type DataOprBatchPush struct {
+	Pushes []*DataOprPush `json:"pushes"`
+}
+
+type ConnChangePush struct {
+	SrvType        uint32 `json:"type"`
+	SrvNo          uint32 `json:"no"`
+	ConnChangeType int    `json:"change"`
+}
+
+func NewConnChangePush(srvType uint32, srvNo uint32, connChangeType int) *ConnChangePush {
+	return &ConnChangePush{
+		SrvType:        srvType,
+		SrvNo:          srvNo,
+		ConnChangeType: connChangeType,
+	}
+}
+
+type LockPush struct {
+	Name string `json:"name"`
+}
+
+type LeaderPush struct {
+	SrvType   uint32 `json:"type"`
+	LeaderNo  uint32 `json:"no"`
+	HasLeader bool   `json:"has_leader"`
+}
+
+type HealthPingPush struct {
+	Seq uint64 `json:"seq"`
+}
@@ -0,0 +1,269 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/yxlib/rpc"
+)
+
+var (
+	ErrPushQueueOverflow = errors.New("push queue overflow")
+)
+
+const (
+	PUSH_QUEUE_SIZE = 1024
+	PUSH_BATCH_MAX  = 256
+)
+
+// the policies when the push queue of an observer is full
+const (
+	PUSH_OVERFLOW_DROP_OLDEST = 1 + iota
+	PUSH_OVERFLOW_COALESCE
+	PUSH_OVERFLOW_DISCONNECT
+)
+
+// ObserverCloser is implemented by the pushers which can close the push connection of a peer,
+// the rpc connection of the peer must be kept.
+// PUSH_OVERFLOW_DISCONNECT falls back to PUSH_OVERFLOW_DROP_OLDEST if the pusher is not an ObserverCloser.
+type ObserverCloser interface {
+	CloseObserver(peerType uint32, peerNo uint32) error
+}
+
+type PushQueueStat struct {
+	SrvType uint32 `json:"type"`
+	SrvNo   uint32 `json:"no"`
+	Depth   int    `json:"depth"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type pushItem struct {
+	key      string
+	funcNo   uint16
+	pushData interface{}
+	payload  []rpc.ByteArray
+}
+
+// getPushCoalesceKey return the key of the pushes which can replace each other, empty if it can't be coalesced.
+func getPushCoalesceKey(pushData interface{}) string {
+	switch p := pushData.(type) {
+	case *DataOprPush:
+		return "data:" + p.GetRecordKey()
+	case *ConnChangePush:
+		return "conn:" + GetSrvKey(p.SrvType, p.SrvNo)
+	case *LeaderPush:
+		return "leader:" + strconv.FormatUint(uint64(p.SrvType), 10)
+	default:
+		return ""
+	}
+}
+
+//======================
+//      pushQueue
+//======================
+// pushQueue is the bounded outbound queue of an observer, the pushes are sent in order by one sender.
+// After the oldest pushes are dropped, a push of DATA_OPR_TYPE_RESYNC is sent before the next one.
+type pushQueue struct {
+	srvType  uint32
+	srvNo    uint32
+	items    []*pushItem
+	maxSize  int
+	bSending bool
+	bDropped bool
+	dropped  uint64
+	lck      *sync.Mutex
+}
+
+func newPushQueue(srvType uint32, srvNo uint32, maxSize int) *pushQueue {
+	return &pushQueue{
+		srvType:  srvType,
+		srvNo:    srvNo,
+		items:    make([]*pushItem, 0),
+		maxSize:  maxSize,
+		bSending: false,
+		bDropped: false,
+		dropped:  0,
+		lck:      &sync.Mutex{},
+	}
+}
+
+// Push add the item by the overflow policy, return true if a sender should be started.
+// ErrPushQueueOverflow is returned and the queue is cleared if it is full under PUSH_OVERFLOW_DISCONNECT.
+func (q *pushQueue) Push(item *pushItem, policy int) (bool, error) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+
+	if len(q.items) >= q.maxSize {
+		switch policy {
+		case PUSH_OVERFLOW_DISCONNECT:
+			q.dropped += uint64(len(q.items))
+			q.items = make([]*pushItem, 0)
+			return false, ErrPushQueueOverflow
+
+		case PUSH_OVERFLOW_COALESCE:
+			if q.coalesce(item) {
+				return false, nil
+			}
+
+			q.dropOldest()
+
+		default:
+			q.dropOldest()
+		}
+	}
+
+	q.items = append(q.items, item)
+	if q.bSending {
+		return false, nil
+	}
+
+	q.bSending = true
+	return true, nil
+}
+
+// Pop return the oldest item, the sender must exit if it returns false.
+func (q *pushQueue) Pop() (*pushItem, bool) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+
+	if len(q.items) == 0 {
+		q.bSending = false
+		return nil, false
+	}
+
+	if q.bDropped {
+		q.bDropped = false
+		item, err := newResyncPushItem()
+		if err == nil {
+			return item, true
+		}
+	}
+
+	item := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return item, true
+}
+
+// PopBatch pop at most maxNum leading items of funcNo.
+func (q *pushQueue) PopBatch(funcNo uint16, maxNum int) []*pushItem {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+
+	n := 0
+	for n < len(q.items) && n < maxNum && q.items[n].funcNo == funcNo {
+		n++
+	}
+
+	items := make([]*pushItem, n)
+	copy(items, q.items[:n])
+	for i := 0; i < n; i++ {
+		q.items[i] = nil
+	}
+
+	q.items = q.items[n:]
+	return items
+}
+
+func (q *pushQueue) Clear() {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+
+	q.items = make([]*pushItem, 0)
+}
+
+func (q *pushQueue) GetStat() *PushQueueStat {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+
+	return &PushQueueStat{
+		SrvType: q.srvType,
+		SrvNo:   q.srvNo,
+		Depth:   len(q.items),
+		Dropped: q.dropped,
+	}
+}
+
+// coalesce replace the latest queued item of the same key, the position of the replaced item is kept.
+func (q *pushQueue) coalesce(item *pushItem) bool {
+	if item.key == "" {
+		return false
+	}
+
+	for i := len(q.items) - 1; i >= 0; i-- {
+		if q.items[i].key == item.key {
+			q.items[i] = item
+			q.dropped++
+			return true
+		}
+	}
+
+	return false
+}
+
+func (q *pushQueue) dropOldest() {
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.dropped++
+	q.bDropped = true
+}
+
+func newResyncPushItem() (*pushItem, error) {
+	pushData := &DataOprPush{
+		Operate: DATA_OPR_TYPE_RESYNC,
+	}
+
+	payload, err := marshalPushPayload(pushData, DATA_OPR_PUSH_FUNC_NO)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pushItem{
+		key:      "",
+		funcNo:   DATA_OPR_PUSH_FUNC_NO,
+		pushData: pushData,
+		payload:  payload,
+	}, nil
+}
+
+// coalesceDataPushes merge the pushes of the same key into the last one, which keep the previous value
+// of the first one. The merged push is put at the position of the last one, so the revisions are in order.
+func coalesceDataPushes(list []*DataOprPush) []*DataOprPush {
+	mapKey2Idx := make(map[string]int)
+	merged := make([]*DataOprPush, 0, len(list))
+	for _, pushData := range list {
+		key := pushData.GetRecordKey()
+		idx, ok := mapKey2Idx[key]
+		if ok {
+			first := merged[idx]
+			mergedPush := *pushData
+			mergedPush.PrevSrv = first.PrevSrv
+			mergedPush.PrevDataBase64 = first.PrevDataBase64
+
+			// a health change after an update is still an update
+			if mergedPush.Operate == DATA_OPR_TYPE_HEALTH && first.Operate != DATA_OPR_TYPE_HEALTH {
+				mergedPush.Operate = DATA_OPR_TYPE_UPDATE
+			}
+
+			merged[idx] = nil
+			pushData = &mergedPush
+		}
+
+		mapKey2Idx[key] = len(merged)
+		merged = append(merged, pushData)
+	}
+
+	result := make([]*DataOprPush, 0, len(mapKey2Idx))
+	for _, pushData := range merged {
+		if pushData != nil {
+			result = append(result, pushData)
+		}
+	}
+
+	return result
+}
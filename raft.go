@@ -0,0 +1,1045 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxlib/yx"
+)
+
+var (
+	ErrRaftNotLeader       = errors.New("raft node is not leader")
+	ErrRaftStopped         = errors.New("raft node stopped")
+	ErrRaftProposeTimeout  = errors.New("raft propose timeout")
+	ErrRaftMemberNotExists = errors.New("raft member not exists")
+)
+
+const (
+	RAFT_STATE_FOLLOWER = iota
+	RAFT_STATE_CANDIDATE
+	RAFT_STATE_LEADER
+)
+
+const (
+	RAFT_MSG_VOTE = 1 + iota
+	RAFT_MSG_VOTE_RESP
+	RAFT_MSG_APPEND
+	RAFT_MSG_APPEND_RESP
+	RAFT_MSG_SNAPSHOT
+)
+
+const (
+	RAFT_TICK_MS             = 100
+	RAFT_HEARTBEAT_TICK      = 1
+	RAFT_ELECTION_TICK       = 10
+	RAFT_MAX_APPEND_ENTRIES  = 64
+	RAFT_MAX_LOG_ENTRIES     = 10000
+	RAFT_PROPOSE_TIMEOUT_SEC = 5
+	MAX_RAFT_MSG_QUE         = 256
+)
+
+//======================
+//     RaftMember
+//======================
+type RaftMember struct {
+	NodeId   uint32 `json:"id"`
+	PeerType uint32 `json:"peer_type"`
+	PeerNo   uint32 `json:"peer_no"`
+	Addr     string `json:"addr"`
+}
+
+type RaftEntry struct {
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+	Data  []byte `json:"data"`
+}
+
+// RaftMsg is the message between the raft nodes.
+// LogIndex and LogTerm are the last log of a vote, the previous log of an append,
+// or the last included log of a snapshot.
+// MatchIndex is the last matched log of an append response, or the hint to retry from when rejected.
+// NeedSnapshot of a rejected append response ask for a snapshot, the data of the follower can not be trusted.
+type RaftMsg struct {
+	Type         int          `json:"type"`
+	Term         uint64       `json:"term"`
+	From         uint32       `json:"from"`
+	To           uint32       `json:"to"`
+	LogIndex     uint64       `json:"log_index"`
+	LogTerm      uint64       `json:"log_term"`
+	Rev          int64        `json:"rev"`
+	Entries      []*RaftEntry `json:"entries,omitempty"`
+	Commit       uint64       `json:"commit"`
+	Snapshot     []byte       `json:"snapshot,omitempty"`
+	Reject       bool         `json:"reject"`
+	MatchIndex   uint64       `json:"match"`
+	NeedSnapshot bool         `json:"need_snapshot,omitempty"`
+}
+
+//======================
+//    RaftTransport
+//======================
+// RaftTransport deliver the messages to the node msg.To,
+// the receiver should call RaftNode.Step. Messages may be dropped.
+type RaftTransport interface {
+	Send(msg *RaftMsg) error
+}
+
+//======================
+//  RaftStateMachine
+//======================
+type RaftStateMachine interface {
+	// Apply apply a committed entry, it is called in order on every node.
+	Apply(data []byte) (interface{}, error)
+
+	Snapshot() ([]byte, error)
+	Restore(snapshot []byte) error
+
+	// GetRevision is used to elect the node with the latest data when the logs are equal.
+	GetRevision() int64
+}
+
+//======================
+//     RaftStorage
+//======================
+// RaftHardState is the state must be kept over restart. Applied is the last entry applied
+// to the data, and AppliedRev is the revision of the data at that time.
+type RaftHardState struct {
+	Term       uint64 `json:"term"`
+	VotedFor   uint32 `json:"vote"`
+	Applied    uint64 `json:"applied"`
+	AppliedRev int64  `json:"applied_rev"`
+}
+
+// RaftStorage persist the hard state and the log, every call must be durable when it returns.
+type RaftStorage interface {
+	// LoadRaft return the saved state and log, nil state and empty log if nothing saved.
+	// The first entry of the log is the last compacted one.
+	LoadRaft() (*RaftHardState, []*RaftEntry, error)
+
+	SaveRaftState(state *RaftHardState) error
+
+	// AppendRaftEntries save the entries, the saved entries from the index of the first one are replaced.
+	AppendRaftEntries(entries []*RaftEntry) error
+
+	// ResetRaftLog replace the whole log, it is called after compaction or restoring a snapshot.
+	ResetRaftLog(entries []*RaftEntry) error
+}
+
+//======================
+//      RaftNode
+//======================
+type raftResult struct {
+	val interface{}
+	err error
+}
+
+type raftProposal struct {
+	data       []byte
+	term       uint64
+	chanResult chan *raftResult
+}
+
+type RaftNode struct {
+	id        uint32
+	members   []*RaftMember
+	transport RaftTransport
+	sm        RaftStateMachine
+	storage   RaftStorage
+	maxLogNum int
+
+	// the following fields are only accessed in the run loop
+	state            int
+	term             uint64
+	votedFor         uint32
+	log              []*RaftEntry
+	commitIndex      uint64
+	lastApplied      uint64
+	votes            map[uint32]bool
+	nextIndex        map[uint32]uint64
+	matchIndex       map[uint32]uint64
+	mapNeedSnapshot  map[uint32]bool
+	snapshotTick     map[uint32]int
+	mapActive        map[uint32]bool
+	mapIndex2Pending map[uint64]*raftProposal
+	bNeedSnapshot    bool
+	electionElapsed  int
+	electionTimeout  int
+	heartbeatElapsed int
+	quorumElapsed    int
+
+	leaderId    uint32
+	leaderCb    func(leaderId uint32)
+	chanMsg     chan *RaftMsg
+	chanPropose chan *raftProposal
+	chanStop    chan bool
+	stopOnce    *sync.Once
+	logger      *yx.Logger
+}
+
+func NewRaftNode(id uint32, members []*RaftMember, transport RaftTransport, sm RaftStateMachine) *RaftNode {
+	return &RaftNode{
+		id:               id,
+		members:          members,
+		transport:        transport,
+		sm:               sm,
+		storage:          nil,
+		maxLogNum:        RAFT_MAX_LOG_ENTRIES,
+		state:            RAFT_STATE_FOLLOWER,
+		term:             0,
+		votedFor:         0,
+		log:              []*RaftEntry{{Term: 0, Index: 0}},
+		commitIndex:      0,
+		lastApplied:      0,
+		votes:            make(map[uint32]bool),
+		nextIndex:        make(map[uint32]uint64),
+		matchIndex:       make(map[uint32]uint64),
+		mapNeedSnapshot:  make(map[uint32]bool),
+		snapshotTick:     make(map[uint32]int),
+		mapActive:        make(map[uint32]bool),
+		mapIndex2Pending: make(map[uint64]*raftProposal),
+		bNeedSnapshot:    false,
+		electionElapsed:  0,
+		electionTimeout:  RAFT_ELECTION_TICK,
+		heartbeatElapsed: 0,
+		quorumElapsed:    0,
+		leaderId:         0,
+		leaderCb:         nil,
+		chanMsg:          make(chan *RaftMsg, MAX_RAFT_MSG_QUE),
+		chanPropose:      make(chan *raftProposal, MAX_RAFT_MSG_QUE),
+		chanStop:         make(chan bool),
+		stopOnce:         &sync.Once{},
+		logger:           yx.NewLogger("RaftNode"),
+	}
+}
+
+// SetLeaderChangeCb set the callback when the leader changed, it must be set before Start.
+func (n *RaftNode) SetLeaderChangeCb(cb func(leaderId uint32)) {
+	n.leaderCb = cb
+}
+
+// SetStorage persist the state and the log by s, it must be set before Start.
+// Without a storage, a restarted node may vote twice in a term.
+func (n *RaftNode) SetStorage(s RaftStorage) {
+	n.storage = s
+}
+
+// SetMaxLogEntries set the number of the entries to keep before compaction, it must be set before Start.
+func (n *RaftNode) SetMaxLogEntries(maxNum int) {
+	if maxNum > 0 {
+		n.maxLogNum = maxNum
+	}
+}
+
+func (n *RaftNode) GetId() uint32 {
+	return n.id
+}
+
+func (n *RaftNode) GetMembers() []*RaftMember {
+	return n.members
+}
+
+func (n *RaftNode) GetMember(nodeId uint32) (*RaftMember, error) {
+	for _, m := range n.members {
+		if m.NodeId == nodeId {
+			return m, nil
+		}
+	}
+
+	return nil, ErrRaftMemberNotExists
+}
+
+// GetLeaderId return the known leader, 0 means no leader.
+func (n *RaftNode) GetLeaderId() uint32 {
+	return atomic.LoadUint32(&n.leaderId)
+}
+
+func (n *RaftNode) IsLeader() bool {
+	return n.GetLeaderId() == n.id
+}
+
+// Start load the persisted state and log, then run the node.
+func (n *RaftNode) Start() error {
+	err := n.load()
+	if err != nil {
+		return err
+	}
+
+	n.resetElectionTimeout()
+	go n.run()
+	return nil
+}
+
+func (n *RaftNode) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.chanStop)
+	})
+}
+
+// Step put a message from the transport into the node, it is dropped if the queue is full.
+func (n *RaftNode) Step(msg *RaftMsg) {
+	select {
+	case n.chanMsg <- msg:
+	default:
+		n.logger.W("message queue is full, drop message ", msg.Type, " from ", msg.From)
+	}
+}
+
+// Propose replicate data to the cluster, and return the result of
+// RaftStateMachine.Apply after it is committed and applied on this node.
+func (n *RaftNode) Propose(data []byte) (interface{}, error) {
+	p := &raftProposal{
+		data:       data,
+		chanResult: make(chan *raftResult, 1),
+	}
+
+	timer := time.NewTimer(RAFT_PROPOSE_TIMEOUT_SEC * time.Second)
+	defer timer.Stop()
+
+	select {
+	case n.chanPropose <- p:
+	case <-n.chanStop:
+		return nil, ErrRaftStopped
+	case <-timer.C:
+		return nil, ErrRaftProposeTimeout
+	}
+
+	select {
+	case res := <-p.chanResult:
+		return res.val, res.err
+	case <-n.chanStop:
+		return nil, ErrRaftStopped
+	case <-timer.C:
+		return nil, ErrRaftProposeTimeout
+	}
+}
+
+func (n *RaftNode) run() {
+	ticker := time.NewTicker(RAFT_TICK_MS * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.chanStop:
+			goto Exit0
+
+		case <-ticker.C:
+			n.tick()
+
+		case msg := <-n.chanMsg:
+			n.step(msg)
+
+		case p := <-n.chanPropose:
+			n.propose(p)
+		}
+	}
+
+Exit0:
+	n.failPending(ErrRaftStopped)
+}
+
+//======================
+//      storage
+//======================
+// load restore the state and the log, the entries after the applied one are applied
+// again when they are committed. If the data does not match the applied entry,
+// the node ask the leader for a snapshot.
+func (n *RaftNode) load() error {
+	var state *RaftHardState = nil
+	if n.storage != nil {
+		var entries []*RaftEntry = nil
+		var err error = nil
+		state, entries, err = n.storage.LoadRaft()
+		if err != nil {
+			return err
+		}
+
+		if len(entries) > 0 {
+			n.log = entries
+		}
+	}
+
+	// the data loaded without the raft state can not be matched with the log
+	if state == nil {
+		n.bNeedSnapshot = (n.sm.GetRevision() > 0)
+		return nil
+	}
+
+	n.term = state.Term
+	n.votedFor = state.VotedFor
+
+	applied := state.Applied
+	if applied < n.getFirstIndex() {
+		applied = n.getFirstIndex()
+	} else if applied > n.getLastIndex() {
+		applied = n.getLastIndex()
+	}
+
+	if applied != state.Applied || n.sm.GetRevision() != state.AppliedRev {
+		n.bNeedSnapshot = true
+		n.logger.W("node ", n.id, " data is not at the applied entry ", state.Applied, ", revision ", n.sm.GetRevision(), " expect ", state.AppliedRev)
+	}
+
+	n.lastApplied = applied
+	n.commitIndex = applied
+	n.logger.I("node ", n.id, " loaded at term ", n.term, ", applied ", n.lastApplied, ", last index ", n.getLastIndex())
+	return nil
+}
+
+// persistState save the term, the vote and the applied entry,
+// it must be done before sending any message depending on them.
+func (n *RaftNode) persistState() error {
+	if n.storage == nil {
+		return nil
+	}
+
+	err := n.storage.SaveRaftState(&RaftHardState{
+		Term:       n.term,
+		VotedFor:   n.votedFor,
+		Applied:    n.lastApplied,
+		AppliedRev: n.sm.GetRevision(),
+	})
+
+	if err != nil {
+		n.logger.E("save raft state err: ", err)
+	}
+
+	return err
+}
+
+func (n *RaftNode) persistEntries(entries []*RaftEntry) error {
+	if n.storage == nil || len(entries) == 0 {
+		return nil
+	}
+
+	err := n.storage.AppendRaftEntries(entries)
+	if err != nil {
+		n.logger.E("append raft entries err: ", err)
+	}
+
+	return err
+}
+
+func (n *RaftNode) persistLog() error {
+	if n.storage == nil {
+		return nil
+	}
+
+	err := n.storage.ResetRaftLog(n.log)
+	if err != nil {
+		n.logger.E("reset raft log err: ", err)
+	}
+
+	return err
+}
+
+//======================
+//        log
+//======================
+func (n *RaftNode) getFirstIndex() uint64 {
+	return n.log[0].Index
+}
+
+func (n *RaftNode) getLastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *RaftNode) getLastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+func (n *RaftNode) getTerm(index uint64) (uint64, bool) {
+	if index < n.getFirstIndex() || index > n.getLastIndex() {
+		return 0, false
+	}
+
+	return n.log[index-n.getFirstIndex()].Term, true
+}
+
+func (n *RaftNode) getEntries(from uint64, maxNum int) []*RaftEntry {
+	if from > n.getLastIndex() {
+		return nil
+	}
+
+	start := from - n.getFirstIndex()
+	end := uint64(len(n.log))
+	if end-start > uint64(maxNum) {
+		end = start + uint64(maxNum)
+	}
+
+	return append([]*RaftEntry{}, n.log[start:end]...)
+}
+
+func (n *RaftNode) truncateFrom(index uint64) {
+	n.log = n.log[:index-n.getFirstIndex()]
+}
+
+// compact drop the applied entries when the log is too long,
+// the followers lagged behind will receive a snapshot.
+func (n *RaftNode) compact() {
+	if len(n.log) <= n.maxLogNum || n.lastApplied <= n.getFirstIndex() {
+		return
+	}
+
+	start := n.lastApplied - n.getFirstIndex()
+	entries := make([]*RaftEntry, 0, uint64(len(n.log))-start)
+	entries = append(entries, &RaftEntry{Term: n.log[start].Term, Index: n.lastApplied})
+	entries = append(entries, n.log[start+1:]...)
+	n.log = entries
+	n.persistLog()
+}
+
+//======================
+//       state
+//======================
+func (n *RaftNode) tick() {
+	if n.state == RAFT_STATE_LEADER {
+		n.quorumElapsed++
+		if n.quorumElapsed >= RAFT_ELECTION_TICK {
+			n.quorumElapsed = 0
+			if !n.checkQuorum() {
+				return
+			}
+		}
+
+		n.heartbeatElapsed++
+		if n.heartbeatElapsed >= RAFT_HEARTBEAT_TICK {
+			n.heartbeatElapsed = 0
+			n.broadcastAppend()
+		}
+
+		return
+	}
+
+	n.electionElapsed++
+	if n.electionElapsed >= n.electionTimeout {
+		n.campaign()
+	}
+}
+
+func (n *RaftNode) resetElectionTimeout() {
+	n.electionElapsed = 0
+	n.electionTimeout = RAFT_ELECTION_TICK + rand.Intn(RAFT_ELECTION_TICK)
+}
+
+func (n *RaftNode) setLeader(leaderId uint32) {
+	old := atomic.SwapUint32(&n.leaderId, leaderId)
+	if old != leaderId && n.leaderCb != nil {
+		n.leaderCb(leaderId)
+	}
+}
+
+func (n *RaftNode) becomeFollower(term uint64, leaderId uint32) {
+	if n.state == RAFT_STATE_LEADER {
+		n.failPending(ErrRaftNotLeader)
+	}
+
+	if term > n.term {
+		n.term = term
+		n.votedFor = 0
+		n.persistState()
+	}
+
+	n.state = RAFT_STATE_FOLLOWER
+	n.resetElectionTimeout()
+	n.setLeader(leaderId)
+}
+
+func (n *RaftNode) campaign() {
+	n.state = RAFT_STATE_CANDIDATE
+	n.term++
+	n.votedFor = n.id
+	n.votes = map[uint32]bool{n.id: true}
+	n.resetElectionTimeout()
+	n.setLeader(0)
+	n.logger.I("node ", n.id, " start campaign at term ", n.term)
+
+	// the vote for itself must be kept, campaign again at the next timeout
+	err := n.persistState()
+	if err != nil {
+		return
+	}
+
+	if n.isQuorum(len(n.votes)) {
+		n.becomeLeader()
+		return
+	}
+
+	for _, m := range n.members {
+		if m.NodeId == n.id {
+			continue
+		}
+
+		n.send(&RaftMsg{
+			Type:     RAFT_MSG_VOTE,
+			To:       m.NodeId,
+			LogIndex: n.getLastIndex(),
+			LogTerm:  n.getLastTerm(),
+			Rev:      n.sm.GetRevision(),
+		})
+	}
+}
+
+// becomeLeader send the entries after the last one to every follower and go back on rejection,
+// a follower lagged behind the compacted log or asking for it receive a snapshot.
+func (n *RaftNode) becomeLeader() {
+	n.state = RAFT_STATE_LEADER
+	n.heartbeatElapsed = 0
+	n.quorumElapsed = 0
+	n.nextIndex = make(map[uint32]uint64)
+	n.matchIndex = make(map[uint32]uint64)
+	n.mapNeedSnapshot = make(map[uint32]bool)
+	n.snapshotTick = make(map[uint32]int)
+	n.mapActive = make(map[uint32]bool)
+	for _, m := range n.members {
+		n.nextIndex[m.NodeId] = n.getLastIndex() + 1
+		n.matchIndex[m.NodeId] = 0
+	}
+
+	// the data of the leader is the base of the others
+	n.bNeedSnapshot = false
+
+	n.logger.I("node ", n.id, " become leader at term ", n.term)
+	n.setLeader(n.id)
+
+	// commit the entries of the previous terms with an empty entry
+	_, err := n.appendEntry(nil)
+	if err != nil {
+		return
+	}
+
+	n.broadcastAppend()
+}
+
+func (n *RaftNode) isQuorum(num int) bool {
+	return num > len(n.members)/2
+}
+
+// checkQuorum step down if the majority has not responded in an election timeout,
+// so an isolated leader stop accepting the writes which can never be committed.
+func (n *RaftNode) checkQuorum() bool {
+	num := 1
+	for nodeId := range n.mapActive {
+		if nodeId != n.id {
+			num++
+		}
+	}
+
+	n.mapActive = make(map[uint32]bool)
+	if n.isQuorum(num) {
+		return true
+	}
+
+	n.logger.W("node ", n.id, " lost the quorum at term ", n.term)
+	n.becomeFollower(n.term, 0)
+	return false
+}
+
+//======================
+//      propose
+//======================
+func (n *RaftNode) propose(p *raftProposal) {
+	if n.state != RAFT_STATE_LEADER {
+		p.chanResult <- &raftResult{err: ErrRaftNotLeader}
+		return
+	}
+
+	p.term = n.term
+	index, err := n.appendEntry(p.data)
+	if err != nil {
+		p.chanResult <- &raftResult{err: err}
+		return
+	}
+
+	n.mapIndex2Pending[index] = p
+	n.broadcastAppend()
+}
+
+// appendEntry append an entry to the log of the leader, the leader step down
+// if it can not be persisted, or the log may have a hole.
+func (n *RaftNode) appendEntry(data []byte) (uint64, error) {
+	index := n.getLastIndex() + 1
+	entry := &RaftEntry{Term: n.term, Index: index, Data: data}
+	err := n.persistEntries([]*RaftEntry{entry})
+	if err != nil {
+		n.becomeFollower(n.term, 0)
+		return 0, ErrRaftNotLeader
+	}
+
+	n.log = append(n.log, entry)
+	n.matchIndex[n.id] = index
+	n.maybeCommit()
+	return index, nil
+}
+
+func (n *RaftNode) failPending(err error) {
+	for index, p := range n.mapIndex2Pending {
+		p.chanResult <- &raftResult{err: err}
+		delete(n.mapIndex2Pending, index)
+	}
+}
+
+func (n *RaftNode) maybeCommit() {
+	for index := n.getLastIndex(); index > n.commitIndex; index-- {
+		term, _ := n.getTerm(index)
+		if term != n.term {
+			break
+		}
+
+		num := 0
+		for _, m := range n.members {
+			if n.matchIndex[m.NodeId] >= index {
+				num++
+			}
+		}
+
+		if n.isQuorum(num) {
+			n.commitIndex = index
+			n.applyCommitted()
+			break
+		}
+	}
+}
+
+func (n *RaftNode) applyCommitted() {
+	if n.lastApplied >= n.commitIndex {
+		return
+	}
+
+	for n.lastApplied < n.commitIndex {
+		n.lastApplied++
+		entry := n.log[n.lastApplied-n.getFirstIndex()]
+
+		var res *raftResult = &raftResult{}
+		if len(entry.Data) > 0 {
+			res.val, res.err = n.sm.Apply(entry.Data)
+		}
+
+		p, ok := n.mapIndex2Pending[entry.Index]
+		if ok {
+			delete(n.mapIndex2Pending, entry.Index)
+			if p.term != entry.Term {
+				res = &raftResult{err: ErrRaftNotLeader}
+			}
+
+			p.chanResult <- res
+		}
+	}
+
+	n.persistState()
+	n.compact()
+}
+
+//======================
+//      message
+//======================
+func (n *RaftNode) send(msg *RaftMsg) {
+	msg.From = n.id
+	msg.Term = n.term
+	err := n.transport.Send(msg)
+	if err != nil {
+		n.logger.D("send message to ", msg.To, " err: ", err)
+	}
+}
+
+func (n *RaftNode) step(msg *RaftMsg) {
+	if msg.Term > n.term {
+		var leaderId uint32 = 0
+		if msg.Type == RAFT_MSG_APPEND || msg.Type == RAFT_MSG_SNAPSHOT {
+			leaderId = msg.From
+		}
+
+		n.becomeFollower(msg.Term, leaderId)
+	}
+
+	switch msg.Type {
+	case RAFT_MSG_VOTE:
+		n.handleVote(msg)
+	case RAFT_MSG_VOTE_RESP:
+		n.handleVoteResp(msg)
+	case RAFT_MSG_APPEND:
+		n.handleAppend(msg)
+	case RAFT_MSG_APPEND_RESP:
+		n.handleAppendResp(msg)
+	case RAFT_MSG_SNAPSHOT:
+		n.handleSnapshot(msg)
+	}
+}
+
+func (n *RaftNode) handleVote(msg *RaftMsg) {
+	bGrant := false
+	if msg.Term == n.term && (n.votedFor == 0 || n.votedFor == msg.From) {
+		lastTerm := n.getLastTerm()
+		lastIndex := n.getLastIndex()
+		if msg.LogTerm != lastTerm {
+			bGrant = (msg.LogTerm > lastTerm)
+		} else if msg.LogIndex != lastIndex {
+			bGrant = (msg.LogIndex > lastIndex)
+		} else {
+			bGrant = (msg.Rev >= n.sm.GetRevision())
+		}
+	}
+
+	if bGrant {
+		n.votedFor = msg.From
+		err := n.persistState()
+		if err != nil {
+			n.votedFor = 0
+			bGrant = false
+		} else {
+			n.resetElectionTimeout()
+		}
+	}
+
+	n.send(&RaftMsg{
+		Type:   RAFT_MSG_VOTE_RESP,
+		To:     msg.From,
+		Reject: !bGrant,
+	})
+}
+
+func (n *RaftNode) handleVoteResp(msg *RaftMsg) {
+	if n.state != RAFT_STATE_CANDIDATE || msg.Term != n.term {
+		return
+	}
+
+	n.votes[msg.From] = !msg.Reject
+	num := 0
+	for _, bGrant := range n.votes {
+		if bGrant {
+			num++
+		}
+	}
+
+	if n.isQuorum(num) {
+		n.becomeLeader()
+	}
+}
+
+func (n *RaftNode) broadcastAppend() {
+	for _, m := range n.members {
+		if m.NodeId != n.id {
+			n.sendAppend(m.NodeId)
+		}
+	}
+}
+
+func (n *RaftNode) sendAppend(to uint32) {
+	if n.mapNeedSnapshot[to] || n.nextIndex[to] <= n.getFirstIndex() {
+		n.sendSnapshot(to)
+		return
+	}
+
+	prevIndex := n.nextIndex[to] - 1
+	prevTerm, _ := n.getTerm(prevIndex)
+	n.send(&RaftMsg{
+		Type:     RAFT_MSG_APPEND,
+		To:       to,
+		LogIndex: prevIndex,
+		LogTerm:  prevTerm,
+		Entries:  n.getEntries(prevIndex+1, RAFT_MAX_APPEND_ENTRIES),
+		Commit:   n.commitIndex,
+	})
+}
+
+// sendSnapshot send the applied data, it is resent if not acknowledged for an election timeout.
+func (n *RaftNode) sendSnapshot(to uint32) {
+	tick, ok := n.snapshotTick[to]
+	if ok && tick < RAFT_ELECTION_TICK {
+		n.snapshotTick[to] = tick + 1
+		return
+	}
+
+	snapshot, err := n.sm.Snapshot()
+	if err != nil {
+		n.logger.E("take snapshot err: ", err)
+		return
+	}
+
+	n.snapshotTick[to] = 0
+	term, _ := n.getTerm(n.lastApplied)
+	n.send(&RaftMsg{
+		Type:     RAFT_MSG_SNAPSHOT,
+		To:       to,
+		LogIndex: n.lastApplied,
+		LogTerm:  term,
+		Rev:      n.sm.GetRevision(),
+		Snapshot: snapshot,
+		Commit:   n.commitIndex,
+	})
+}
+
+func (n *RaftNode) handleAppend(msg *RaftMsg) {
+	resp := &RaftMsg{
+		Type: RAFT_MSG_APPEND_RESP,
+		To:   msg.From,
+	}
+
+	if msg.Term < n.term {
+		resp.Reject = true
+		n.send(resp)
+		return
+	}
+
+	n.becomeFollower(msg.Term, msg.From)
+
+	if n.bNeedSnapshot {
+		resp.Reject = true
+		resp.MatchIndex = n.commitIndex
+		resp.NeedSnapshot = true
+		n.send(resp)
+		return
+	}
+
+	prevTerm, ok := n.getTerm(msg.LogIndex)
+	if msg.LogIndex >= n.getFirstIndex() && (!ok || prevTerm != msg.LogTerm) {
+		resp.Reject = true
+		resp.MatchIndex = n.commitIndex
+		n.send(resp)
+		return
+	}
+
+	lastNewIndex := msg.LogIndex
+	var firstNewIndex uint64 = 0
+	for _, entry := range msg.Entries {
+		lastNewIndex = entry.Index
+		if entry.Index <= n.getFirstIndex() {
+			continue
+		}
+
+		term, ok := n.getTerm(entry.Index)
+		if ok && term == entry.Term {
+			continue
+		}
+
+		if ok {
+			n.truncateFrom(entry.Index)
+		}
+
+		if firstNewIndex == 0 {
+			firstNewIndex = entry.Index
+		}
+
+		n.log = append(n.log, entry)
+	}
+
+	// the entries must be kept before acknowledged
+	if firstNewIndex > 0 {
+		err := n.persistEntries(n.log[firstNewIndex-n.getFirstIndex():])
+		if err != nil {
+			n.truncateFrom(firstNewIndex)
+			resp.Reject = true
+			resp.MatchIndex = n.commitIndex
+			n.send(resp)
+			return
+		}
+	}
+
+	commitIndex := msg.Commit
+	if commitIndex > lastNewIndex {
+		commitIndex = lastNewIndex
+	}
+
+	if commitIndex > n.commitIndex {
+		n.commitIndex = commitIndex
+		n.applyCommitted()
+	}
+
+	resp.MatchIndex = lastNewIndex
+	n.send(resp)
+}
+
+func (n *RaftNode) handleAppendResp(msg *RaftMsg) {
+	if n.state != RAFT_STATE_LEADER || msg.Term != n.term {
+		return
+	}
+
+	n.mapActive[msg.From] = true
+	if msg.Reject {
+		if msg.NeedSnapshot {
+			n.mapNeedSnapshot[msg.From] = true
+		}
+
+		n.nextIndex[msg.From] = msg.MatchIndex + 1
+		n.sendAppend(msg.From)
+		return
+	}
+
+	if msg.MatchIndex > n.matchIndex[msg.From] {
+		n.matchIndex[msg.From] = msg.MatchIndex
+	}
+
+	delete(n.mapNeedSnapshot, msg.From)
+	delete(n.snapshotTick, msg.From)
+	n.nextIndex[msg.From] = n.matchIndex[msg.From] + 1
+	n.maybeCommit()
+
+	if n.nextIndex[msg.From] <= n.getLastIndex() {
+		n.sendAppend(msg.From)
+	}
+}
+
+// handleSnapshot restore the data and keep the entries after the snapshot if they match.
+// A stale snapshot is ignored unless the data of the node can not be trusted.
+func (n *RaftNode) handleSnapshot(msg *RaftMsg) {
+	resp := &RaftMsg{
+		Type: RAFT_MSG_APPEND_RESP,
+		To:   msg.From,
+	}
+
+	if msg.Term < n.term {
+		resp.Reject = true
+		n.send(resp)
+		return
+	}
+
+	n.becomeFollower(msg.Term, msg.From)
+
+	// the applied entries are committed, so they match the leader
+	if msg.LogIndex <= n.lastApplied && !n.bNeedSnapshot {
+		n.logger.D("node ", n.id, " ignore stale snapshot at ", msg.LogIndex, ", applied ", n.lastApplied)
+		resp.MatchIndex = n.lastApplied
+		n.send(resp)
+		return
+	}
+
+	err := n.sm.Restore(msg.Snapshot)
+	if err != nil {
+		n.logger.E("restore snapshot err: ", err)
+		resp.Reject = true
+		resp.MatchIndex = n.commitIndex
+		resp.NeedSnapshot = n.bNeedSnapshot
+		n.send(resp)
+		return
+	}
+
+	n.bNeedSnapshot = false
+	n.logger.I("node ", n.id, " restored from snapshot of ", msg.From, " at ", msg.LogIndex)
+
+	term, ok := n.getTerm(msg.LogIndex)
+	if ok && term == msg.LogTerm {
+		n.log = n.log[msg.LogIndex-n.getFirstIndex():]
+	} else {
+		n.log = []*RaftEntry{{Term: msg.LogTerm, Index: msg.LogIndex}}
+	}
+
+	n.log[0] = &RaftEntry{Term: msg.LogTerm, Index: msg.LogIndex}
+	n.lastApplied = msg.LogIndex
+	if n.commitIndex < msg.LogIndex || n.commitIndex > n.getLastIndex() {
+		n.commitIndex = msg.LogIndex
+	}
+
+	n.persistLog()
+	n.persistState()
+	n.applyCommitted()
+
+	// the entries after the snapshot are not verified yet
+	resp.MatchIndex = msg.LogIndex
+	n.send(resp)
+}
@@ -0,0 +1,294 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const (
+	RAFT_STATE_FILE_SUFFIX = ".raft"
+	RAFT_LOG_FILE_SUFFIX   = ".raftlog"
+)
+
+// appendRaftEntries append the entries to the log, the entries from the index of the first one are replaced.
+func appendRaftEntries(log []*RaftEntry, entries []*RaftEntry) []*RaftEntry {
+	if len(entries) == 0 {
+		return log
+	}
+
+	if len(log) > 0 {
+		first := log[0].Index
+		index := entries[0].Index
+		if index <= first {
+			log = log[:0]
+		} else if index-first < uint64(len(log)) {
+			log = log[:index-first]
+		}
+	}
+
+	return append(log, entries...)
+}
+
+//======================
+//   MemRaftStorage
+//======================
+// MemRaftStorage keep the raft state in memory, it is useful in tests.
+type MemRaftStorage struct {
+	state *RaftHardState
+	log   []*RaftEntry
+	lck   *sync.Mutex
+}
+
+func NewMemRaftStorage() *MemRaftStorage {
+	return &MemRaftStorage{
+		state: nil,
+		log:   make([]*RaftEntry, 0),
+		lck:   &sync.Mutex{},
+	}
+}
+
+func (s *MemRaftStorage) LoadRaft() (*RaftHardState, []*RaftEntry, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	var state *RaftHardState = nil
+	if s.state != nil {
+		copyState := *s.state
+		state = &copyState
+	}
+
+	return state, append([]*RaftEntry{}, s.log...), nil
+}
+
+func (s *MemRaftStorage) SaveRaftState(state *RaftHardState) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	copyState := *state
+	s.state = &copyState
+	return nil
+}
+
+func (s *MemRaftStorage) AppendRaftEntries(entries []*RaftEntry) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.log = appendRaftEntries(s.log, entries)
+	return nil
+}
+
+func (s *MemRaftStorage) ResetRaftLog(entries []*RaftEntry) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.log = append([]*RaftEntry{}, entries...)
+	return nil
+}
+
+//======================
+//   FileRaftStorage
+//======================
+// FileRaftStorage save the hard state to path+RAFT_STATE_FILE_SUFFIX, and append
+// the entries to path+RAFT_LOG_FILE_SUFFIX, one json entry per line.
+// An entry replace the entries from its index when the log is loaded.
+type FileRaftStorage struct {
+	statePath string
+	logPath   string
+	f         *os.File
+	validSize int64
+	lck       *sync.Mutex
+}
+
+func NewFileRaftStorage(path string) *FileRaftStorage {
+	return &FileRaftStorage{
+		statePath: path + RAFT_STATE_FILE_SUFFIX,
+		logPath:   path + RAFT_LOG_FILE_SUFFIX,
+		f:         nil,
+		validSize: -1,
+		lck:       &sync.Mutex{},
+	}
+}
+
+func (s *FileRaftStorage) LoadRaft() (*RaftHardState, []*RaftEntry, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	var state *RaftHardState = nil
+	data, err := ioutil.ReadFile(s.statePath)
+	if err == nil {
+		state = &RaftHardState{}
+		err = json.Unmarshal(data, state)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	log, err := s.readLog()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return state, log, nil
+}
+
+func (s *FileRaftStorage) SaveRaftState(state *RaftHardState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	return WriteFileAtomic(s.statePath, data)
+}
+
+func (s *FileRaftStorage) AppendRaftEntries(entries []*RaftEntry) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	err := s.openLog()
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeRaftEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	n, err := s.f.Write(data)
+	s.validSize += int64(n)
+	if err != nil {
+		return err
+	}
+
+	return s.f.Sync()
+}
+
+func (s *FileRaftStorage) ResetRaftLog(entries []*RaftEntry) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	data, err := encodeRaftEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	s.closeLog()
+	err = WriteFileAtomic(s.logPath, data)
+	if err != nil {
+		return err
+	}
+
+	s.validSize = int64(len(data))
+	return nil
+}
+
+func (s *FileRaftStorage) Close() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	return s.closeLog()
+}
+
+// readLog read the entries, a broken tail left by a crash is ignored and will be cut when opened.
+func (s *FileRaftStorage) readLog() ([]*RaftEntry, error) {
+	log := make([]*RaftEntry, 0)
+	f, err := os.Open(s.logPath)
+	if os.IsNotExist(err) {
+		return log, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	validSize := int64(0)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+
+			break
+		}
+
+		entry := &RaftEntry{}
+		err = json.Unmarshal(bytes.TrimSpace(line), entry)
+		if err != nil {
+			break
+		}
+
+		log = appendRaftEntries(log, []*RaftEntry{entry})
+		validSize += int64(len(line))
+	}
+
+	s.closeLog()
+	s.validSize = validSize
+	return log, nil
+}
+
+func (s *FileRaftStorage) openLog() error {
+	if s.f != nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(s.logPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	// the size is unknown if the log is not loaded
+	if s.validSize < 0 {
+		s.validSize, err = f.Seek(0, io.SeekEnd)
+	} else {
+		err = f.Truncate(s.validSize)
+		if err == nil {
+			_, err = f.Seek(s.validSize, io.SeekStart)
+		}
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.f = f
+	return nil
+}
+
+func (s *FileRaftStorage) closeLog() error {
+	if s.f == nil {
+		return nil
+	}
+
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+func encodeRaftEntries(entries []*RaftEntry) ([]byte, error) {
+	buff := &bytes.Buffer{}
+	enc := json.NewEncoder(buff)
+	for _, entry := range entries {
+		err := enc.Encode(entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buff.Bytes(), nil
+}
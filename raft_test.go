@@ -0,0 +1,357 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_RAFT_WAIT_SEC = 10
+)
+
+//======================
+//  testStateMachine
+//======================
+// testStateMachine keep the applied data in order, it is kept over the restart of a node.
+type testStateMachine struct {
+	data     []string
+	restored int
+	lck      *sync.Mutex
+}
+
+func newTestStateMachine() *testStateMachine {
+	return &testStateMachine{
+		data:     make([]string, 0),
+		restored: 0,
+		lck:      &sync.Mutex{},
+	}
+}
+
+func (m *testStateMachine) Apply(data []byte) (interface{}, error) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	m.data = append(m.data, string(data))
+	return len(m.data), nil
+}
+
+func (m *testStateMachine) Snapshot() ([]byte, error) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	return json.Marshal(m.data)
+}
+
+func (m *testStateMachine) Restore(snapshot []byte) error {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	data := make([]string, 0)
+	err := json.Unmarshal(snapshot, &data)
+	if err != nil {
+		return err
+	}
+
+	m.data = data
+	m.restored++
+	return nil
+}
+
+func (m *testStateMachine) GetRevision() int64 {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	return int64(len(m.data))
+}
+
+func (m *testStateMachine) GetData() []string {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	return append([]string{}, m.data...)
+}
+
+func (m *testStateMachine) GetRestored() int {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	return m.restored
+}
+
+//======================
+//     testCluster
+//======================
+type testCluster struct {
+	t         *testing.T
+	members   []*RaftMember
+	transport *LoopbackTransport
+	nodes     map[uint32]*RaftNode
+	sms       map[uint32]*testStateMachine
+	storages  map[uint32]*MemRaftStorage
+	maxLogNum int
+}
+
+func newTestCluster(t *testing.T, num int, maxLogNum int) *testCluster {
+	c := &testCluster{
+		t:         t,
+		members:   make([]*RaftMember, 0, num),
+		transport: NewLoopbackTransport(),
+		nodes:     make(map[uint32]*RaftNode),
+		sms:       make(map[uint32]*testStateMachine),
+		storages:  make(map[uint32]*MemRaftStorage),
+		maxLogNum: maxLogNum,
+	}
+
+	for i := 1; i <= num; i++ {
+		c.members = append(c.members, &RaftMember{NodeId: uint32(i)})
+	}
+
+	for _, m := range c.members {
+		c.sms[m.NodeId] = newTestStateMachine()
+		c.storages[m.NodeId] = NewMemRaftStorage()
+		c.startNode(m.NodeId)
+	}
+
+	return c
+}
+
+func (c *testCluster) startNode(id uint32) {
+	n := NewRaftNode(id, c.members, c.transport, c.sms[id])
+	n.SetStorage(c.storages[id])
+	n.SetMaxLogEntries(c.maxLogNum)
+	c.nodes[id] = n
+	c.transport.AddNode(n)
+
+	err := n.Start()
+	if err != nil {
+		c.t.Fatal("start node ", id, " err: ", err)
+	}
+}
+
+func (c *testCluster) Stop() {
+	for _, n := range c.nodes {
+		n.Stop()
+	}
+}
+
+// WaitLeader wait for a leader which is not excluded and known by all the other connected nodes.
+func (c *testCluster) WaitLeader(excludeIds ...uint32) *RaftNode {
+	var leader *RaftNode = nil
+	waitFor(c.t, "leader elected", func() bool {
+		leader = nil
+		for id, n := range c.nodes {
+			if n.IsLeader() && !isTestNodeExcluded(id, excludeIds) {
+				leader = n
+			}
+		}
+
+		if leader == nil {
+			return false
+		}
+
+		for id, n := range c.nodes {
+			if !isTestNodeExcluded(id, excludeIds) && n.GetLeaderId() != leader.GetId() {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	return leader
+}
+
+func (c *testCluster) Propose(leader *RaftNode, from int, num int) {
+	for i := from; i < from+num; i++ {
+		_, err := leader.Propose([]byte(fmt.Sprint("data", i)))
+		if err != nil {
+			c.t.Fatal("propose ", i, " err: ", err)
+		}
+	}
+}
+
+func (c *testCluster) WaitData(id uint32, num int) {
+	waitFor(c.t, fmt.Sprint("node ", id, " applied ", num), func() bool {
+		return len(c.sms[id].GetData()) == num
+	})
+
+	data := c.sms[id].GetData()
+	for i, v := range data {
+		if v != fmt.Sprint("data", i) {
+			c.t.Fatal("node ", id, " data ", i, " is ", v)
+		}
+	}
+}
+
+func isTestNodeExcluded(id uint32, excludeIds []uint32) bool {
+	for _, excludeId := range excludeIds {
+		if id == excludeId {
+			return true
+		}
+	}
+
+	return false
+}
+
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	deadline := time.Now().Add(TEST_RAFT_WAIT_SEC * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatal("timeout waiting for ", desc)
+}
+
+//======================
+//        tests
+//======================
+func TestRaftElectAndReplicate(t *testing.T) {
+	c := newTestCluster(t, 3, RAFT_MAX_LOG_ENTRIES)
+	defer c.Stop()
+
+	leader := c.WaitLeader()
+	c.Propose(leader, 0, 10)
+	for id := range c.nodes {
+		c.WaitData(id, 10)
+	}
+}
+
+func TestRaftLeaderFailover(t *testing.T) {
+	c := newTestCluster(t, 3, RAFT_MAX_LOG_ENTRIES)
+	defer c.Stop()
+
+	oldLeader := c.WaitLeader()
+	c.Propose(oldLeader, 0, 5)
+
+	c.transport.Disconnect(oldLeader.GetId())
+	leader := c.WaitLeader(oldLeader.GetId())
+	c.Propose(leader, 5, 5)
+
+	_, err := oldLeader.Propose([]byte("lost"))
+	if err == nil {
+		t.Fatal("the isolated leader should not commit")
+	}
+
+	c.transport.Reconnect(oldLeader.GetId())
+	c.WaitLeader()
+	for id := range c.nodes {
+		c.WaitData(id, 10)
+	}
+}
+
+func TestRaftSnapshotInstall(t *testing.T) {
+	c := newTestCluster(t, 3, 8)
+	defer c.Stop()
+
+	leader := c.WaitLeader()
+	c.Propose(leader, 0, 3)
+
+	var followerId uint32 = 0
+	for id := range c.nodes {
+		if id != leader.GetId() {
+			followerId = id
+			break
+		}
+	}
+
+	c.WaitData(followerId, 3)
+	c.transport.Disconnect(followerId)
+	c.Propose(leader, 3, 30)
+
+	c.transport.Reconnect(followerId)
+	for id := range c.nodes {
+		c.WaitData(id, 33)
+	}
+
+	if c.sms[followerId].GetRestored() == 0 {
+		t.Fatal("the lagged follower should be restored from a snapshot")
+	}
+}
+
+func TestRaftRestartKeepState(t *testing.T) {
+	c := newTestCluster(t, 3, RAFT_MAX_LOG_ENTRIES)
+	defer c.Stop()
+
+	leader := c.WaitLeader()
+	c.Propose(leader, 0, 5)
+
+	var followerId uint32 = 0
+	for id := range c.nodes {
+		if id != leader.GetId() {
+			followerId = id
+			break
+		}
+	}
+
+	c.WaitData(followerId, 5)
+	c.nodes[followerId].Stop()
+
+	state, log, _ := c.storages[followerId].LoadRaft()
+	if state == nil || state.Term == 0 || state.Applied < 6 {
+		t.Fatal("the term and the applied entry should be saved, state: ", state)
+	}
+
+	if len(log) == 0 || log[len(log)-1].Index < 6 {
+		t.Fatal("the entries should be saved, log num: ", len(log))
+	}
+
+	c.startNode(followerId)
+	c.Propose(leader, 5, 5)
+	for id := range c.nodes {
+		c.WaitData(id, 10)
+	}
+
+	if c.sms[followerId].GetRestored() != 0 {
+		t.Fatal("the restarted follower should catch up by its own log")
+	}
+}
+
+func TestRaftIgnoreStaleSnapshot(t *testing.T) {
+	sm := newTestStateMachine()
+	n := NewRaftNode(1, []*RaftMember{{NodeId: 1}, {NodeId: 2}}, NewLoopbackTransport(), sm)
+	n.log = append(n.log, &RaftEntry{Term: 1, Index: 1, Data: []byte("data0")})
+	n.commitIndex = 1
+	n.applyCommitted()
+
+	n.handleSnapshot(&RaftMsg{Type: RAFT_MSG_SNAPSHOT, Term: 1, From: 2, LogIndex: 1, LogTerm: 1, Snapshot: []byte("[]")})
+	if sm.GetRestored() != 0 || len(sm.GetData()) != 1 {
+		t.Fatal("the snapshot at the applied entry should be ignored")
+	}
+
+	n.handleSnapshot(&RaftMsg{Type: RAFT_MSG_SNAPSHOT, Term: 1, From: 2, LogIndex: 2, LogTerm: 1, Snapshot: []byte(`["data0","data1"]`)})
+	if sm.GetRestored() != 1 || len(sm.GetData()) != 2 {
+		t.Fatal("the newer snapshot should be restored")
+	}
+}
+
+func TestRaftLeaderStepDown(t *testing.T) {
+	c := newTestCluster(t, 3, RAFT_MAX_LOG_ENTRIES)
+	defer c.Stop()
+
+	leader := c.WaitLeader()
+	for id := range c.nodes {
+		if id != leader.GetId() {
+			c.transport.Disconnect(id)
+		}
+	}
+
+	waitFor(t, "leader step down", func() bool {
+		return !leader.IsLeader()
+	})
+
+	_, err := leader.Propose([]byte("lost"))
+	if err != ErrRaftNotLeader {
+		t.Fatal("the leader without quorum should reject the proposal, err: ", err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"sync"
+
+	"github.com/yxlib/rpc"
+	"github.com/yxlib/yx"
+)
+
+//======================
+//  LoopbackTransport
+//======================
+// LoopbackTransport deliver the messages between the nodes in the same process,
+// it is used to test a cluster without network.
+type LoopbackTransport struct {
+	mapId2Node      map[uint32]*RaftNode
+	mapDisconnected map[uint32]bool
+	lck             *sync.RWMutex
+}
+
+func NewLoopbackTransport() *LoopbackTransport {
+	return &LoopbackTransport{
+		mapId2Node:      make(map[uint32]*RaftNode),
+		mapDisconnected: make(map[uint32]bool),
+		lck:             &sync.RWMutex{},
+	}
+}
+
+func (t *LoopbackTransport) AddNode(n *RaftNode) {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+
+	t.mapId2Node[n.GetId()] = n
+}
+
+// Disconnect drop all the messages from or to the node.
+func (t *LoopbackTransport) Disconnect(nodeId uint32) {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+
+	t.mapDisconnected[nodeId] = true
+}
+
+func (t *LoopbackTransport) Reconnect(nodeId uint32) {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+
+	delete(t.mapDisconnected, nodeId)
+}
+
+func (t *LoopbackTransport) Send(msg *RaftMsg) error {
+	t.lck.RLock()
+	defer t.lck.RUnlock()
+
+	if t.mapDisconnected[msg.From] || t.mapDisconnected[msg.To] {
+		return nil
+	}
+
+	n, ok := t.mapId2Node[msg.To]
+	if !ok {
+		return ErrRaftMemberNotExists
+	}
+
+	n.Step(msg)
+	return nil
+}
+
+//======================
+//  RpcRaftTransport
+//======================
+type raftPeer struct {
+	member   *RaftMember
+	rpcPeer  *rpc.Pipeline
+	chanMsg  chan *RaftMsg
+	chanStop chan bool
+}
+
+// RpcRaftTransport send the messages to the RaftMsg rpc of the other reg servers,
+// one pipeline for each member.
+type RpcRaftTransport struct {
+	mapId2Peer map[uint32]*raftPeer
+	lck        *sync.RWMutex
+	logger     *yx.Logger
+}
+
+func NewRpcRaftTransport() *RpcRaftTransport {
+	return &RpcRaftTransport{
+		mapId2Peer: make(map[uint32]*raftPeer),
+		lck:        &sync.RWMutex{},
+		logger:     yx.NewLogger("reg.RpcRaftTransport"),
+	}
+}
+
+// AddPeer add a member with the net connected to it, it must be called before Start.
+func (t *RpcRaftTransport) AddPeer(member *RaftMember, rpcNet rpc.Net) {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+
+	rpcPeer := rpc.NewPipeline(rpcNet, member.PeerType, member.PeerNo, REG_SRV)
+	rpcPeer.SetInterceptor(&rpc.JsonInterceptor{})
+	rpcPeer.SetTimeout(TIME_OUT_SEC)
+
+	t.mapId2Peer[member.NodeId] = &raftPeer{
+		member:   member,
+		rpcPeer:  rpcPeer,
+		chanMsg:  make(chan *RaftMsg, MAX_RAFT_MSG_QUE),
+		chanStop: make(chan bool),
+	}
+}
+
+func (t *RpcRaftTransport) Start() {
+	t.lck.RLock()
+	defer t.lck.RUnlock()
+
+	for _, peer := range t.mapId2Peer {
+		go peer.rpcPeer.Start()
+		go t.sendLoop(peer)
+	}
+}
+
+func (t *RpcRaftTransport) Stop() {
+	t.lck.RLock()
+	defer t.lck.RUnlock()
+
+	for _, peer := range t.mapId2Peer {
+		close(peer.chanStop)
+		peer.rpcPeer.Stop()
+	}
+}
+
+func (t *RpcRaftTransport) Send(msg *RaftMsg) error {
+	t.lck.RLock()
+	peer, ok := t.mapId2Peer[msg.To]
+	t.lck.RUnlock()
+
+	if !ok {
+		return ErrRaftMemberNotExists
+	}
+
+	select {
+	case peer.chanMsg <- msg:
+	default:
+		t.logger.W("send queue of ", msg.To, " is full, drop message")
+	}
+
+	return nil
+}
+
+func (t *RpcRaftTransport) sendLoop(peer *raftPeer) {
+	for {
+		select {
+		case <-peer.chanStop:
+			goto Exit0
+
+		case msg := <-peer.chanMsg:
+			_, err := peer.rpcPeer.Call(REG_SERVIC_NAME, "RaftMsg", msg, nil)
+			if err != nil {
+				t.logger.D("send raft message to ", peer.member.NodeId, " err: ", err)
+			}
+		}
+	}
+
+Exit0:
+	return
+}
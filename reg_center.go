@@ -1,403 +1,2084 @@
-// Copyright 2022 Guan Jianchang. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
-package reg
-
-import (
-	"encoding/json"
-	"strings"
-	"sync"
-
-	"github.com/yxlib/rpc"
-	"github.com/yxlib/yx"
-)
-
-const (
-	DATA_OPR_TYPE_UPDATE = iota + 1
-	DATA_OPR_TYPE_REMOVE
-)
-
-const (
-	MAX_PUSH_QUE = 10
-)
-
-//======================
-//     RegObserver
-//======================
-type RegObserver struct {
-	SrvType uint32
-	SrvNo   uint32
-}
-
-func NewRegObserver(srvType uint32, srvNo uint32) *RegObserver {
-	return &RegObserver{
-		SrvType: srvType,
-		SrvNo:   srvNo,
-	}
-}
-
-func (o *RegObserver) IsSameObserver(srvType uint32, srvNo uint32) bool {
-	return (o.SrvType == srvType && o.SrvNo == srvNo)
-}
-
-type RegObserverList = []*RegObserver
-
-//======================
-//       Pusher
-//======================
-type Pusher interface {
-	Push(dstPeerType uint32, dstPeerNo uint32, payload ...[]byte) error
-}
-
-//======================
-//      regCenter
-//======================
-type regCenter struct {
-	info                   *RegInfo
-	savePath               string
-	bDebug                 bool
-	pusher                 Pusher
-	mapKey2RegObserverList map[string]RegObserverList
-	lckInfoObserver        *sync.RWMutex
-	chanOprPush            chan *DataOprPush
-	connObserverList       RegObserverList
-	lckConnObserver        *sync.RWMutex
-	chanConnChange         chan *ConnChangePush
-	evtSave                *yx.Event
-	logger                 *yx.Logger
-	ec                     *yx.ErrCatcher
-}
-
-var RegCenter = &regCenter{
-	info:                   NewRegInfo(),
-	savePath:               "",
-	bDebug:                 false,
-	pusher:                 nil,
-	mapKey2RegObserverList: make(map[string]RegObserverList),
-	lckInfoObserver:        &sync.RWMutex{},
-	chanOprPush:            make(chan *DataOprPush, MAX_PUSH_QUE),
-	connObserverList:       make([]*RegObserver, 0),
-	lckConnObserver:        &sync.RWMutex{},
-	chanConnChange:         make(chan *ConnChangePush, MAX_PUSH_QUE),
-	evtSave:                yx.NewEvent(),
-	logger:                 yx.NewLogger("RegCenter"),
-	ec:                     yx.NewErrCatcher("RegCenter"),
-}
-
-func (c *regCenter) SetSavePath(savePath string) {
-	c.savePath = savePath
-}
-
-func (c *regCenter) SetDebugMode(bDebug bool) {
-	c.bDebug = bDebug
-}
-
-func (c *regCenter) SetPusher(p Pusher) {
-	c.pusher = p
-}
-
-func (c *regCenter) GetRegInfo() *RegInfo {
-	return c.info
-}
-
-func (c *regCenter) UpdateSrv(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string) {
-	var err error = nil
-	defer c.ec.Catch("UpdateSrv", &err)
-
-	ok := c.info.HasSrv(srvType, srvNo)
-	if !ok {
-		err = c.info.AddSrv(srvType, srvNo, bTemp, dataBase64)
-	} else {
-		err = c.info.SetSrvData(srvType, srvNo, dataBase64)
-	}
-
-	if err != nil {
-		return
-	}
-
-	c.evtSave.Send()
-
-	key := GetSrvKey(srvType, srvNo)
-	pushData := NewDataOprPush(KEY_TYPE_SRV_INFO, key, DATA_OPR_TYPE_UPDATE)
-	c.chanOprPush <- pushData
-	// go s.notifyDataUpdate(key, DATA_OPR_TYPE_UPDATE)
-}
-
-func (c *regCenter) RemoveSrv(srvType uint32, srvNo uint32) {
-	if c.info.HasSrv(srvType, srvNo) {
-		c.info.RemoveSrv(srvType, srvNo)
-		c.evtSave.Send()
-
-		key := GetSrvKey(srvType, srvNo)
-		pushData := NewDataOprPush(KEY_TYPE_SRV_INFO, key, DATA_OPR_TYPE_REMOVE)
-		c.chanOprPush <- pushData
-		// go s.notifyDataUpdate(key, DATA_OPR_TYPE_REMOVE)
-	}
-}
-
-func (c *regCenter) UpdateGlobalData(key string, dataBase64 string) {
-	err := c.info.SetGlobalData(key, dataBase64)
-	if err != nil {
-		c.ec.Catch("UpdateGlobalData", &err)
-		return
-	}
-
-	c.evtSave.Send()
-
-	pushData := NewDataOprPush(KEY_TYPE_GLOBAL_DATA, key, DATA_OPR_TYPE_UPDATE)
-	c.chanOprPush <- pushData
-	// go s.notifyDataUpdate(reqData.Key, DATA_OPR_TYPE_UPDATE)
-}
-
-func (c *regCenter) RemoveGlobalData(key string) {
-	if c.info.HasGlobalData(key) {
-		c.info.RemoveGlobalData(key)
-		c.evtSave.Send()
-
-		pushData := NewDataOprPush(KEY_TYPE_GLOBAL_DATA, key, DATA_OPR_TYPE_REMOVE)
-		c.chanOprPush <- pushData
-		// go s.notifyDataUpdate(reqData.Key, DATA_OPR_TYPE_REMOVE)
-	}
-}
-
-func (c *regCenter) RemoveAllObserverOfSrv(srvType uint32, srvNo uint32) {
-	c.removeAllInfoObserverOfSrv(srvType, srvNo)
-	c.RemoveConnObserver(srvType, srvNo)
-}
-
-func (c *regCenter) NotifyConnChange(srvType uint32, srvNo uint32, connChangeType int) {
-	pushData := NewConnChangePush(srvType, srvNo, connChangeType)
-	c.chanConnChange <- pushData
-}
-
-func (c *regCenter) Start() {
-	go c.pushLoop()
-	go c.saveLoop()
-	// s.BaseService.Start()
-}
-
-func (c *regCenter) Stop() {
-	// s.BaseService.Stop()
-	c.evtSave.Close()
-	close(c.chanOprPush)
-	close(c.chanConnChange)
-}
-
-func (c *regCenter) AddInfoObserver(key string, srvType uint32, srvNo uint32) {
-	c.lckInfoObserver.Lock()
-	defer c.lckInfoObserver.Unlock()
-
-	list, ok := c.mapKey2RegObserverList[key]
-	if !ok {
-		list = make([]*RegObserver, 0)
-	} else if c.existObserver(list, srvType, srvNo) {
-		return
-	}
-
-	o := &RegObserver{
-		SrvType: srvType,
-		SrvNo:   srvNo,
-	}
-
-	c.mapKey2RegObserverList[key] = append(list, o)
-}
-
-func (c *regCenter) RemoveInfoObserver(key string, srvType uint32, srvNo uint32) {
-	c.lckInfoObserver.Lock()
-	defer c.lckInfoObserver.Unlock()
-
-	list, ok := c.mapKey2RegObserverList[key]
-	if ok {
-		c.mapKey2RegObserverList[key] = c.removeObserverFromList(list, srvType, srvNo)
-	}
-}
-
-func (c *regCenter) removeAllInfoObserverOfSrv(srvType uint32, srvNo uint32) {
-	c.lckInfoObserver.Lock()
-	defer c.lckInfoObserver.Unlock()
-
-	for key, list := range c.mapKey2RegObserverList {
-		c.mapKey2RegObserverList[key] = c.removeObserverFromList(list, srvType, srvNo)
-	}
-}
-
-func (c *regCenter) cloneInfoObserverList(key string) (RegObserverList, bool) {
-	c.lckInfoObserver.RLock()
-	defer c.lckInfoObserver.RUnlock()
-
-	list, ok := c.mapKey2RegObserverList[key]
-	if !ok {
-		return nil, false
-	}
-
-	cloneList := make(RegObserverList, len(list))
-	copy(cloneList, list)
-	return cloneList, ok
-}
-
-func (c *regCenter) AddConnObserver(srvType uint32, srvNo uint32) {
-	c.lckConnObserver.Lock()
-	defer c.lckConnObserver.Unlock()
-
-	if c.existObserver(c.connObserverList, srvType, srvNo) {
-		return
-	}
-
-	o := &RegObserver{
-		SrvType: srvType,
-		SrvNo:   srvNo,
-	}
-
-	c.connObserverList = append(c.connObserverList, o)
-}
-
-func (c *regCenter) RemoveConnObserver(srvType uint32, srvNo uint32) {
-	c.lckConnObserver.Lock()
-	defer c.lckConnObserver.Unlock()
-
-	c.connObserverList = c.removeObserverFromList(c.connObserverList, srvType, srvNo)
-}
-
-func (c *regCenter) cloneConnObserverList() RegObserverList {
-	c.lckConnObserver.RLock()
-	defer c.lckConnObserver.RUnlock()
-
-	cloneList := make(RegObserverList, len(c.connObserverList))
-	copy(cloneList, c.connObserverList)
-	return cloneList
-}
-
-func (c *regCenter) existObserver(list []*RegObserver, srvType uint32, srvNo uint32) bool {
-	for _, observer := range list {
-		if observer.IsSameObserver(srvType, srvNo) {
-			return true
-		}
-	}
-
-	return false
-}
-
-func (c *regCenter) removeObserverFromList(list []*RegObserver, srvType uint32, srvNo uint32) []*RegObserver {
-	for i, observer := range list {
-		if observer.IsSameObserver(srvType, srvNo) {
-			if len(list) == 1 {
-				list = make([]*RegObserver, 0)
-			} else {
-				list = append(list[:i], list[i+1:]...)
-			}
-			break
-		}
-	}
-
-	return list
-}
-
-func (c *regCenter) pushLoop() {
-	for {
-		select {
-		case pushData, ok := <-c.chanOprPush:
-			if !ok {
-				goto Exit0
-			}
-
-			c.notifyDataUpdate(pushData)
-
-		case pushData, ok := <-c.chanConnChange:
-			if !ok {
-				goto Exit0
-			}
-
-			c.notifyConnChange(pushData)
-		}
-	}
-
-Exit0:
-	return
-}
-
-func (c *regCenter) notifyDataUpdate(pushData *DataOprPush) {
-	list, ok := c.cloneInfoObserverList(pushData.Key)
-	if ok {
-		c.push(pushData, DATA_OPR_PUSH_FUNC_NO, list)
-	}
-
-	idx := strings.LastIndex(pushData.Key, "/")
-	if idx <= 0 {
-		return
-	}
-
-	parentKey := pushData.Key[:idx]
-	list, ok = c.cloneInfoObserverList(parentKey)
-	if ok {
-		c.push(pushData, DATA_OPR_PUSH_FUNC_NO, list)
-	}
-}
-
-// func (s *Server) pushDataUpdate(key string, opr int, list []*RegObserver) {
-// 	if len(list) == 0 {
-// 		return
-// 	}
-
-// 	pushData := &DataOprPush{
-// 		Key:     key,
-// 		Operate: opr,
-// 	}
-
-// 	s.push(pushData, list)
-// }
-
-func (c *regCenter) notifyConnChange(pushData *ConnChangePush) {
-	list := c.cloneConnObserverList()
-	c.push(pushData, CONN_CHANGE_FUNC_NO, list)
-}
-
-func (c *regCenter) push(pushData interface{}, funcNo uint16, list []*RegObserver) {
-	if len(list) == 0 {
-		return
-	}
-
-	if c.pusher == nil {
-		c.logger.E("pusher is nil")
-		return
-	}
-
-	packData, err := json.Marshal(pushData)
-	if err != nil {
-		c.logger.E("push json.Marshal err: ", err)
-		return
-	}
-
-	h := rpc.NewPackHeader(PUSH_MARK, 0, funcNo)
-	headerData, err := h.Marshal()
-	if err != nil {
-		c.logger.E("push PackHeader.Marshal err: ", err)
-		return
-	}
-
-	payload := make([]rpc.ByteArray, 0, 2)
-	payload = append(payload, headerData, packData)
-
-	for _, observer := range list {
-		c.pusher.Push(observer.SrvType, observer.SrvNo, payload...)
-	}
-}
-
-func (c *regCenter) saveLoop() {
-	for {
-		// _, ok := <-s.evtSave.C
-		// if !ok {
-		// 	break
-		// }
-
-		err := c.evtSave.Wait()
-		if err != nil {
-			break
-		}
-
-		c.info.Save(c.savePath)
-		if c.bDebug {
-			c.info.Dump()
-		}
-	}
-}
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yxlib/rpc"
+	"github.com/yxlib/yx"
+)
+
+const (
+	DATA_OPR_TYPE_UPDATE = iota + 1
+	DATA_OPR_TYPE_REMOVE
+	DATA_OPR_TYPE_HEALTH
+
+	// generated by the client after the watches are set again on reconnect
+	DATA_OPR_TYPE_RESYNCED
+
+	// pushed when the older pushes are dropped by the overflow of the push queue,
+	// the client watch again from the last revision received
+	DATA_OPR_TYPE_RESYNC
+)
+
+const (
+	MAX_PUSH_QUE = 10
+)
+
+const (
+	WATCH_RESTORE_TIMEOUT_SEC = 60
+)
+
+var (
+	ErrRegCenterStopped  = errors.New("reg center stopped")
+	ErrWatchNotPersisted = errors.New("no store to persist the watches")
+)
+
+//======================
+//     RegObserver
+//======================
+type RegObserver struct {
+	SrvType uint32
+	SrvNo   uint32
+	Opt     WatchOpt
+}
+
+func NewRegObserver(srvType uint32, srvNo uint32) *RegObserver {
+	return &RegObserver{
+		SrvType: srvType,
+		SrvNo:   srvNo,
+	}
+}
+
+func (o *RegObserver) IsSameObserver(srvType uint32, srvNo uint32) bool {
+	return (o.SrvType == srvType && o.SrvNo == srvNo)
+}
+
+type RegObserverList = []*RegObserver
+
+type selectorWatch struct {
+	ns        string
+	srvType   uint32
+	bByType   bool
+	selector  *Selector
+	observers RegObserverList
+}
+
+func getSelectorWatchKey(ns string, srvType uint32, bByType bool, selector string) string {
+	if bByType {
+		return GetNsKey(ns, GetSrvTypeKey(srvType)) + "?" + selector
+	}
+
+	return GetNsKey(ns, "") + "?" + selector
+}
+
+func (w *selectorWatch) IsMatch(ns string, info *SrvInfo) bool {
+	if info == nil || ns != w.ns || (w.bByType && info.SrvType != w.srvType) {
+		return false
+	}
+
+	return w.selector.IsMatch(info)
+}
+
+type watchReplayReq struct {
+	key      string
+	observer *RegObserver
+	chanErr  chan error
+}
+
+//======================
+//       Pusher
+//======================
+type Pusher interface {
+	Push(dstPeerType uint32, dstPeerNo uint32, payload ...[]byte) error
+}
+
+//======================
+//      regCenter
+//======================
+type regCenter struct {
+	info                   *RegInfo
+	savePath               string
+	bDebug                 bool
+	pusher                 Pusher
+	mapKey2RegObserverList map[string]RegObserverList
+	treeRecursiveObserver  *MapTree
+	mapKey2SelectorWatch   map[string]*selectorWatch
+	lckInfoObserver        *sync.RWMutex
+	oprPushList            [][]*DataOprPush
+	lckOprPush             *sync.Mutex
+	evtOprPush             *yx.Event
+	events                 *eventLog
+	chanWatchReplay        chan *watchReplayReq
+	connObserverList       RegObserverList
+	lckConnObserver        *sync.RWMutex
+	chanConnChange         chan *ConnChangePush
+	connCloseCbs           []func(srvType uint32, srvNo uint32)
+	evtSave                *yx.Event
+	store                  Store
+	bLoaded                bool
+	sm                     *RegStateMachine
+	raft                   *RaftNode
+	defaultNs              *RegNamespace
+	mapNs2Quota            map[string]*NamespaceQuota
+	locks                  *lockMgr
+	elections              *electionMgr
+	healthChecker          HealthChecker
+	healthInterval         time.Duration
+	healthFailThreshold    uint32
+	healthWorkerNum        int
+	mapKey2HealthFails     map[string]uint32
+	mapKey2HealthProbing   map[string]bool
+	lckHealth              *sync.Mutex
+	mapKey2PushQueue       map[string]*pushQueue
+	lckPushQueue           *sync.Mutex
+	pushQueueSize          int
+	pushOverflowPolicy     int
+	pushBatchWindow        time.Duration
+	pushBatchMax           int
+	bPersistWatch          bool
+	watchRestoreTimeout    time.Duration
+	bWatchChanged          int32
+	mapKey2RestoredWatch   map[string]*RegObserver
+	restoredWatchNum       int32
+	lckRestoredWatch       *sync.Mutex
+	chanStop               chan bool
+	wgLoop                 *sync.WaitGroup
+	wgSave                 *sync.WaitGroup
+	leaseIdSeq             int64
+	logger                 *yx.Logger
+	ec                     *yx.ErrCatcher
+}
+
+var RegCenter = newRegCenter()
+
+func newRegCenter() *regCenter {
+	c := &regCenter{
+		info:                   NewRegInfo(),
+		savePath:               "",
+		bDebug:                 false,
+		pusher:                 nil,
+		mapKey2RegObserverList: make(map[string]RegObserverList),
+		treeRecursiveObserver:  NewMapTree(),
+		mapKey2SelectorWatch:   make(map[string]*selectorWatch),
+		lckInfoObserver:        &sync.RWMutex{},
+		oprPushList:            make([][]*DataOprPush, 0),
+		lckOprPush:             &sync.Mutex{},
+		evtOprPush:             yx.NewEvent(),
+		events:                 newEventLog(MAX_EVENT_LOG),
+		chanWatchReplay:        make(chan *watchReplayReq),
+		connObserverList:       make([]*RegObserver, 0),
+		lckConnObserver:        &sync.RWMutex{},
+		chanConnChange:         make(chan *ConnChangePush, MAX_PUSH_QUE),
+		connCloseCbs:           make([]func(srvType uint32, srvNo uint32), 0),
+		evtSave:                yx.NewEvent(),
+		store:                  nil,
+		bLoaded:                false,
+		sm:                     nil,
+		raft:                   nil,
+		mapNs2Quota:            make(map[string]*NamespaceQuota),
+		locks:                  newLockMgr(),
+		elections:              newElectionMgr(),
+		healthChecker:          nil,
+		healthInterval:         HEALTH_CHECK_INTERVAL_SEC * time.Second,
+		healthFailThreshold:    HEALTH_FAIL_THRESHOLD,
+		healthWorkerNum:        HEALTH_CHECK_WORKER_NUM,
+		mapKey2HealthFails:     make(map[string]uint32),
+		mapKey2HealthProbing:   make(map[string]bool),
+		lckHealth:              &sync.Mutex{},
+		mapKey2PushQueue:       make(map[string]*pushQueue),
+		lckPushQueue:           &sync.Mutex{},
+		pushQueueSize:          PUSH_QUEUE_SIZE,
+		pushOverflowPolicy:     PUSH_OVERFLOW_DISCONNECT,
+		pushBatchWindow:        0,
+		pushBatchMax:           PUSH_BATCH_MAX,
+		bPersistWatch:          false,
+		watchRestoreTimeout:    WATCH_RESTORE_TIMEOUT_SEC * time.Second,
+		bWatchChanged:          0,
+		mapKey2RestoredWatch:   make(map[string]*RegObserver),
+		restoredWatchNum:       0,
+		lckRestoredWatch:       &sync.Mutex{},
+		chanStop:               make(chan bool),
+		wgLoop:                 &sync.WaitGroup{},
+		wgSave:                 &sync.WaitGroup{},
+		leaseIdSeq:             time.Now().UnixNano(),
+		logger:                 yx.NewLogger("RegCenter"),
+		ec:                     yx.NewErrCatcher("RegCenter"),
+	}
+
+	c.defaultNs = newRegNamespace(DEFAULT_NAMESPACE, c)
+	c.sm = NewRegStateMachine(c.info)
+	c.sm.SetApplyCb(c.onDataChanged)
+	return c
+}
+
+// SetSavePath use a JsonFileStore at savePath, which rewrite the whole registry on every save.
+// Call SetStore(NewWalStore(savePath)) instead to append the operations to a write-ahead log,
+// it reads the file saved at savePath as its snapshot.
+func (c *regCenter) SetSavePath(savePath string) {
+	c.savePath = savePath
+	c.store = NewJsonFileStore(savePath)
+}
+
+func (c *regCenter) SetStore(s Store) {
+	c.store = s
+}
+
+func (c *regCenter) GetStore() Store {
+	return c.store
+}
+
+func (c *regCenter) SetDebugMode(bDebug bool) {
+	c.bDebug = bDebug
+}
+
+func (c *regCenter) SetPusher(p Pusher) {
+	c.pusher = p
+}
+
+// SetPushQueue set the size and the overflow policy of the push queue of each observer,
+// it must be called before Start. PUSH_OVERFLOW_DISCONNECT is the default.
+func (c *regCenter) SetPushQueue(size int, policy int) {
+	if size > 0 {
+		c.pushQueueSize = size
+	}
+
+	c.pushOverflowPolicy = policy
+}
+
+// SetPushBatch coalesce the data pushes of each observer by key within the window and send them
+// in a BATCH_PUSH_FUNC_NO push of at most maxNum pushes, it is disabled if windowMs is 0.
+// The clients must support the batch push, it must be called before Start.
+func (c *regCenter) SetPushBatch(windowMs uint32, maxNum int) {
+	c.pushBatchWindow = time.Duration(windowMs) * time.Millisecond
+	if maxNum > 0 {
+		c.pushBatchMax = maxNum
+	}
+}
+
+// SetPersistWatch save the watches of the servers which are not temporary by Store.SaveWatches,
+// and restore them in Load. A restored watcher is removed if it does not watch again or receive a push
+// in restoreTimeoutSec, 0 means WATCH_RESTORE_TIMEOUT_SEC. It must be called before Load and Start,
+// Start fail with ErrWatchNotPersisted if no store is set.
+func (c *regCenter) SetPersistWatch(bPersist bool, restoreTimeoutSec uint32) {
+	c.bPersistWatch = bPersist
+	if restoreTimeoutSec > 0 {
+		c.watchRestoreTimeout = time.Duration(restoreTimeoutSec) * time.Second
+	}
+}
+
+// GetPushQueueStats return the depth and the dropped pushes of the queue of each observer.
+func (c *regCenter) GetPushQueueStats() []*PushQueueStat {
+	c.lckPushQueue.Lock()
+	defer c.lckPushQueue.Unlock()
+
+	stats := make([]*PushQueueStat, 0, len(c.mapKey2PushQueue))
+	for _, q := range c.mapKey2PushQueue {
+		stats = append(stats, q.GetStat())
+	}
+
+	return stats
+}
+
+func (c *regCenter) GetRegInfo() *RegInfo {
+	return c.info
+}
+
+// Load restore the registry information from the store.
+func (c *regCenter) Load() error {
+	if c.store == nil {
+		return nil
+	}
+
+	c.bLoaded = true
+	err := c.store.Load(c.info)
+	if err != nil {
+		return c.ec.Throw("Load", err)
+	}
+
+	if c.bPersistWatch {
+		watches, err := c.store.LoadWatches(c.info)
+		if err != nil {
+			return c.ec.Throw("Load", err)
+		}
+
+		c.restoreWatches(watches)
+	}
+
+	return nil
+}
+
+// Namespace return the registry of the namespace, ErrInvalidNamespace if the name is invalid.
+func (c *regCenter) Namespace(ns string) (*RegNamespace, error) {
+	if !IsValidNamespace(ns) {
+		return nil, c.ec.Throw("Namespace", ErrInvalidNamespace)
+	}
+
+	if ns == DEFAULT_NAMESPACE {
+		return c.defaultNs, nil
+	}
+
+	return newRegNamespace(ns, c), nil
+}
+
+// SetNamespaceQuota limit the number of the keys in the namespace, it must be called before Start.
+// In cluster mode the quotas are replicated by the leader, so the quotas of the leader are checked by all the members.
+func (c *regCenter) SetNamespaceQuota(ns string, quota *NamespaceQuota) error {
+	if !IsValidNamespace(ns) {
+		return c.ec.Throw("SetNamespaceQuota", ErrInvalidNamespace)
+	}
+
+	c.mapNs2Quota[ns] = quota
+	return nil
+}
+
+func (c *regCenter) UpdateSrv(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string) error {
+	return c.defaultNs.UpdateSrv(srvType, srvNo, bTemp, dataBase64)
+}
+
+// UpdateSrvWithLease update the server and grant a lease if ttlSec > 0.
+func (c *regCenter) UpdateSrvWithLease(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string, ttlSec uint32) error {
+	return c.defaultNs.UpdateSrvWithLease(srvType, srvNo, bTemp, dataBase64, ttlSec)
+}
+
+// UpdateSrvWithMeta update the server with the meta, the meta of an existing server is kept if meta is nil.
+func (c *regCenter) UpdateSrvWithMeta(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string, meta *SrvMeta, ttlSec uint32) error {
+	return c.defaultNs.UpdateSrvWithMeta(srvType, srvNo, bTemp, dataBase64, meta, ttlSec)
+}
+
+func (c *regCenter) CompareAndUpdateSrv(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string, meta *SrvMeta, cmp *Compare, ttlSec uint32) (*DataOprPush, error) {
+	return c.defaultNs.CompareAndUpdateSrv(srvType, srvNo, bTemp, dataBase64, meta, cmp, ttlSec)
+}
+
+func (c *regCenter) RemoveSrv(srvType uint32, srvNo uint32) error {
+	return c.defaultNs.RemoveSrv(srvType, srvNo)
+}
+
+// SetSrvStatus set the status of the server, e.g. SRV_STATUS_DRAINING take it out of rotation
+// without unregistering it. The watchers get a push of the updated server.
+func (c *regCenter) SetSrvStatus(srvType uint32, srvNo uint32, status string) error {
+	return c.defaultNs.SetSrvStatus(srvType, srvNo, status)
+}
+
+func (c *regCenter) GrantLease(srvType uint32, srvNo uint32, ttlSec uint32) error {
+	return c.defaultNs.GrantLease(srvType, srvNo, ttlSec)
+}
+
+// KeepAlive renew the lease, in cluster mode only the leader keep the deadlines.
+func (c *regCenter) KeepAlive(srvType uint32, srvNo uint32) (uint32, error) {
+	return c.defaultNs.KeepAlive(srvType, srvNo)
+}
+
+func (c *regCenter) RevokeLease(srvType uint32, srvNo uint32) error {
+	return c.defaultNs.RevokeLease(srvType, srvNo)
+}
+
+func (c *regCenter) UpdateGlobalData(key string, dataBase64 string) error {
+	return c.defaultNs.UpdateGlobalData(key, dataBase64)
+}
+
+func (c *regCenter) CompareAndUpdateGlobalData(key string, dataBase64 string, cmp *Compare) (*DataOprPush, error) {
+	return c.defaultNs.CompareAndUpdateGlobalData(key, dataBase64, cmp)
+}
+
+func (c *regCenter) RemoveGlobalData(key string) error {
+	return c.defaultNs.RemoveGlobalData(key)
+}
+
+func (c *regCenter) Txn(cmps []*TxnCompare, thenOps []*TxnOp, elseOps []*TxnOp) (bool, []*DataOprPush, error) {
+	return c.defaultNs.Txn(cmps, thenOps, elseOps)
+}
+
+// Lock try to acquire the lock for the server, if the lock is held by another server
+// and bWait is true, the server is queued and notified by a LockPush when the lock is handed to it.
+// The lock is released when the server is disconnected, and all the locks are cleared
+// after a restart or a leader change.
+func (c *regCenter) Lock(name string, srvType uint32, srvNo uint32, bWait bool) (bool, error) {
+	key, err := GetLockKey(name)
+	if err != nil {
+		return false, c.ec.Throw("Lock", err)
+	}
+
+	owner := GetLockOwner(srvType, srvNo)
+
+	c.locks.Lock()
+	defer c.locks.Unlock()
+
+	pushData, err := c.CompareAndUpdateGlobalData(key, owner, NewCompareExists(false))
+	if err == nil {
+		return true, nil
+	}
+
+	if err != ErrCompareFailed {
+		return false, c.ec.Throw("Lock", err)
+	}
+
+	if pushData != nil && pushData.DataBase64 == owner {
+		return true, nil
+	}
+
+	if bWait {
+		c.locks.AddWaiter(key, srvType, srvNo)
+	}
+
+	return false, nil
+}
+
+// Unlock release the lock or cancel the waiting of the server,
+// the lock is handed to the first waiter if there is.
+func (c *regCenter) Unlock(name string, srvType uint32, srvNo uint32) error {
+	key, err := GetLockKey(name)
+	if err != nil {
+		return c.ec.Throw("Unlock", err)
+	}
+
+	c.locks.Lock()
+	defer c.locks.Unlock()
+
+	if c.locks.RemoveWaiter(key, srvType, srvNo) {
+		return nil
+	}
+
+	err = c.releaseLock(key, GetLockOwner(srvType, srvNo))
+	return c.ec.Throw("Unlock", err)
+}
+
+// releaseAllLockOfSrv release the locks held by the server and remove it from the queues.
+func (c *regCenter) releaseAllLockOfSrv(srvType uint32, srvNo uint32) {
+	c.locks.Lock()
+	defer c.locks.Unlock()
+
+	c.locks.RemoveAllWaiterOfSrv(srvType, srvNo)
+
+	owner := GetLockOwner(srvType, srvNo)
+	mapKey2Owner := c.info.GetAllGlobalData(LOCK_KEY_PREFIX)
+	for key, lockOwner := range mapKey2Owner {
+		if lockOwner != owner {
+			continue
+		}
+
+		err := c.releaseLock(key, owner)
+		if err != nil {
+			c.logger.W("release lock ", key, " of ", GetSrvKey(srvType, srvNo), " err: ", err)
+		}
+	}
+}
+
+// clearLocks remove all the locks and the waiters, the locks are held by the connections to the leader,
+// so they are stale after a restart or a failover.
+func (c *regCenter) clearLocks() {
+	c.locks.Lock()
+	defer c.locks.Unlock()
+
+	c.locks.Reset()
+
+	mapKey2Owner := c.info.GetAllGlobalData(LOCK_KEY_PREFIX)
+	if len(mapKey2Owner) == 0 {
+		return
+	}
+
+	ops := make([]*TxnOp, 0, len(mapKey2Owner))
+	for key := range mapKey2Owner {
+		ops = append(ops, NewTxnOpRemoveGlobalData(key))
+	}
+
+	_, _, err := c.Txn(nil, ops, nil)
+	if err != nil {
+		c.logger.E("clear locks err: ", err)
+	}
+}
+
+// releaseLock must be called with the lockMgr locked.
+func (c *regCenter) releaseLock(key string, owner string) error {
+	lockOwner, ok := c.info.GetGlobalData(key)
+	if !ok || lockOwner != owner {
+		return ErrLockNotOwner
+	}
+
+	cmp := &Compare{Target: CMP_TARGET_VALUE, DataBase64: owner}
+
+	waiter, ok := c.locks.PopWaiter(key)
+	if ok {
+		_, err := c.CompareAndUpdateGlobalData(key, GetLockOwner(waiter.SrvType, waiter.SrvNo), cmp)
+		if err != nil {
+			return err
+		}
+
+		c.push(&LockPush{Name: key[len(LOCK_KEY_PREFIX)+1:]}, LOCK_PUSH_FUNC_NO, []*RegObserver{waiter})
+		return nil
+	}
+
+	cmps := []*TxnCompare{NewTxnCompare(KEY_TYPE_GLOBAL_DATA, key, cmp)}
+	thenOps := []*TxnOp{NewTxnOpRemoveGlobalData(key)}
+	bSucc, _, err := c.Txn(cmps, thenOps, nil)
+	if err != nil {
+		return err
+	}
+
+	if !bSucc {
+		return ErrLockNotOwner
+	}
+
+	return nil
+}
+
+// Campaign make the server a candidate of the election of its type, return true if it is the leader.
+// Otherwise it becomes the leader in order when the leader resigned,
+// the candidates and the observers are notified by a LeaderPush.
+// The leader resign when it is disconnected, and all the elections are cleared
+// after a restart or a leader change.
+func (c *regCenter) Campaign(srvType uint32, srvNo uint32) (bool, error) {
+	key := GetElectionKey(srvType)
+	data := GetElectionLeaderData(srvNo)
+
+	c.elections.Lock()
+	defer c.elections.Unlock()
+
+	pushData, err := c.CompareAndUpdateGlobalData(key, data, NewCompareExists(false))
+	if err == nil {
+		c.pushLeaderChange(srvType, srvNo, true)
+		return true, nil
+	}
+
+	if err != ErrCompareFailed {
+		return false, c.ec.Throw("Campaign", err)
+	}
+
+	if pushData != nil && pushData.DataBase64 == data {
+		return true, nil
+	}
+
+	c.elections.AddCandidate(srvType, srvNo)
+	return false, nil
+}
+
+// Resign give up the leadership or the candidacy of the server,
+// the leadership is handed to the first candidate if there is.
+func (c *regCenter) Resign(srvType uint32, srvNo uint32) error {
+	c.elections.Lock()
+	defer c.elections.Unlock()
+
+	if c.elections.RemoveCandidate(srvType, srvNo) {
+		return nil
+	}
+
+	key := GetElectionKey(srvType)
+	data := GetElectionLeaderData(srvNo)
+	leaderData, ok := c.info.GetGlobalData(key)
+	if !ok || leaderData != data {
+		return c.ec.Throw("Resign", ErrNotElectionLeader)
+	}
+
+	cmp := &Compare{Target: CMP_TARGET_VALUE, DataBase64: data}
+
+	nextNo, ok := c.elections.PopCandidate(srvType)
+	if ok {
+		_, err := c.CompareAndUpdateGlobalData(key, GetElectionLeaderData(nextNo), cmp)
+		if err != nil {
+			return c.ec.Throw("Resign", err)
+		}
+
+		c.pushLeaderChange(srvType, nextNo, true, srvNo)
+		return nil
+	}
+
+	cmps := []*TxnCompare{NewTxnCompare(KEY_TYPE_GLOBAL_DATA, key, cmp)}
+	thenOps := []*TxnOp{NewTxnOpRemoveGlobalData(key)}
+	bSucc, _, err := c.Txn(cmps, thenOps, nil)
+	if err != nil {
+		return c.ec.Throw("Resign", err)
+	}
+
+	if !bSucc {
+		return c.ec.Throw("Resign", ErrNotElectionLeader)
+	}
+
+	c.pushLeaderChange(srvType, 0, false, srvNo)
+	return nil
+}
+
+func (c *regCenter) GetElectionLeader(srvType uint32) (uint32, bool) {
+	data, ok := c.info.GetGlobalData(GetElectionKey(srvType))
+	if !ok {
+		return 0, false
+	}
+
+	return ParseElectionLeaderData(data)
+}
+
+func (c *regCenter) AddElectionObserver(srvType uint32, observerType uint32, observerNo uint32) {
+	c.elections.Lock()
+	defer c.elections.Unlock()
+
+	c.elections.AddObserver(srvType, observerType, observerNo)
+}
+
+func (c *regCenter) RemoveElectionObserver(srvType uint32, observerType uint32, observerNo uint32) {
+	c.elections.Lock()
+	defer c.elections.Unlock()
+
+	c.elections.RemoveObserver(srvType, observerType, observerNo)
+}
+
+// clearElections remove all the election leaders and the candidates, the leaders are kept by
+// the connections to the leader of the registry, so they are stale after a restart or a failover.
+// The observers are notified that there is no leader.
+func (c *regCenter) clearElections() {
+	c.elections.Lock()
+	defer c.elections.Unlock()
+
+	c.elections.ResetCandidates()
+
+	mapKey2Leader := c.info.GetAllGlobalData(ELECTION_KEY_PREFIX)
+	if len(mapKey2Leader) == 0 {
+		return
+	}
+
+	ops := make([]*TxnOp, 0, len(mapKey2Leader))
+	for key := range mapKey2Leader {
+		ops = append(ops, NewTxnOpRemoveGlobalData(key))
+	}
+
+	_, _, err := c.Txn(nil, ops, nil)
+	if err != nil {
+		c.logger.E("clear elections err: ", err)
+		return
+	}
+
+	for key, leaderData := range mapKey2Leader {
+		srvType, err := strconv.ParseUint(key[len(ELECTION_KEY_PREFIX)+1:], 10, 32)
+		if err != nil {
+			continue
+		}
+
+		leaderNo, _ := ParseElectionLeaderData(leaderData)
+		c.pushLeaderChange(uint32(srvType), 0, false, leaderNo)
+	}
+}
+
+// resignElectionOfSrv is called when the server is gone.
+func (c *regCenter) resignElectionOfSrv(srvType uint32, srvNo uint32) {
+	err := c.Resign(srvType, srvNo)
+	if err != nil && err != ErrNotElectionLeader {
+		c.logger.W("resign ", GetSrvKey(srvType, srvNo), " err: ", err)
+	}
+}
+
+// pushLeaderChange must be called with the electionMgr locked.
+func (c *regCenter) pushLeaderChange(srvType uint32, leaderNo uint32, bHasLeader bool, extraNos ...uint32) {
+	pushData := &LeaderPush{
+		SrvType:   srvType,
+		LeaderNo:  leaderNo,
+		HasLeader: bHasLeader,
+	}
+
+	if bHasLeader {
+		extraNos = append(extraNos, leaderNo)
+	}
+
+	list := c.elections.GetPushList(srvType, extraNos...)
+	c.push(pushData, LEADER_PUSH_FUNC_NO, list)
+}
+
+// SetHealthChecker probe the servers every intervalSec by the checker, it must be called before Start.
+// A server becomes unhealthy after failThreshold failures in a row, zero means the default value.
+// In cluster mode only the leader probes the servers.
+func (c *regCenter) SetHealthChecker(checker HealthChecker, intervalSec uint32, failThreshold uint32) {
+	c.healthChecker = checker
+	if intervalSec > 0 {
+		c.healthInterval = time.Duration(intervalSec) * time.Second
+	}
+
+	if failThreshold > 0 {
+		c.healthFailThreshold = failThreshold
+	}
+}
+
+// SetHealthWorkerNum set the number of the concurrent probes, it must be called before Start.
+func (c *regCenter) SetHealthWorkerNum(workerNum int) {
+	if workerNum > 0 {
+		c.healthWorkerNum = workerNum
+	}
+}
+
+// SetSrvHealth set the health status of the server, the watchers get a push of DATA_OPR_TYPE_HEALTH.
+func (c *regCenter) SetSrvHealth(srvType uint32, srvNo uint32, health int) error {
+	return c.defaultNs.SetSrvHealth(srvType, srvNo, health)
+}
+
+func (c *regCenter) OnHealthPong(srvType uint32, srvNo uint32, seq uint64) {
+	handler, ok := c.healthChecker.(HealthPongHandler)
+	if ok {
+		handler.OnPong(srvType, srvNo, seq)
+	}
+}
+
+// EnableCluster replicate the mutations to the members by raft, it must be called before Start.
+// Writes are only accepted by the leader, the other nodes return ErrRaftNotLeader.
+func (c *regCenter) EnableCluster(selfId uint32, members []*RaftMember, transport RaftTransport) {
+	c.raft = NewRaftNode(selfId, members, transport, c.sm)
+	c.raft.SetLeaderChangeCb(c.onLeaderChange)
+}
+
+func (c *regCenter) GetRaftNode() *RaftNode {
+	return c.raft
+}
+
+// StepRaft handle a raft message from the other members.
+func (c *regCenter) StepRaft(msg *RaftMsg) error {
+	if c.raft == nil {
+		return c.ec.Throw("StepRaft", ErrRaftStopped)
+	}
+
+	c.raft.Step(msg)
+	return nil
+}
+
+// IsRaftPeer check if the peer is the member nodeId, false in standalone mode.
+func (c *regCenter) IsRaftPeer(peerType uint32, peerNo uint32, nodeId uint32) bool {
+	if c.raft == nil {
+		return false
+	}
+
+	m, err := c.raft.GetMember(nodeId)
+	if err != nil {
+		return false
+	}
+
+	return m.PeerType == peerType && m.PeerNo == peerNo
+}
+
+// GetMembers return the members and the leader id, or nil in standalone mode.
+func (c *regCenter) GetMembers() ([]*RaftMember, uint32) {
+	if c.raft == nil {
+		return nil, 0
+	}
+
+	return c.raft.GetMembers(), c.raft.GetLeaderId()
+}
+
+func (c *regCenter) RemoveAllObserverOfSrv(srvType uint32, srvNo uint32) {
+	c.removeAllInfoObserverOfSrv(srvType, srvNo)
+	c.RemoveConnObserver(srvType, srvNo)
+
+	c.elections.Lock()
+	c.elections.RemoveAllObserverOfSrv(srvType, srvNo)
+	c.elections.Unlock()
+}
+
+// ListenConnClose call cb when a server is disconnected, it must be called before Start.
+func (c *regCenter) ListenConnClose(cb func(srvType uint32, srvNo uint32)) {
+	c.connCloseCbs = append(c.connCloseCbs, cb)
+}
+
+func (c *regCenter) NotifyConnChange(srvType uint32, srvNo uint32, connChangeType int) {
+	if connChangeType == CONN_CHANGE_TYPE_OPEN {
+		c.confirmRestoredWatch(srvType, srvNo)
+	}
+
+	if connChangeType == CONN_CHANGE_TYPE_CLOSE {
+		c.removePushQueue(srvType, srvNo)
+		c.releaseAllLockOfSrv(srvType, srvNo)
+		c.resignElectionOfSrv(srvType, srvNo)
+		for _, cb := range c.connCloseCbs {
+			cb(srvType, srvNo)
+		}
+	}
+
+	pushData := NewConnChangePush(srvType, srvNo, connChangeType)
+	c.chanConnChange <- pushData
+}
+
+// Start start the loops and the raft node, it fail if the store can not be opened,
+// so the changes are never applied without being persisted.
+func (c *regCenter) Start() error {
+	if c.bPersistWatch && c.store == nil {
+		return c.ec.Throw("Start", ErrWatchNotPersisted)
+	}
+
+	if !c.bLoaded {
+		err := c.Load()
+		if err != nil {
+			c.logger.E("load err: ", err)
+		}
+	}
+
+	if c.store != nil {
+		err := c.store.Open()
+		if err != nil {
+			return c.ec.Throw("Start", err)
+		}
+	}
+
+	// the revisions before start are not in the event log
+	c.events.SetCompactRev(c.info.GetRevision())
+
+	if c.raft == nil {
+		c.applyQuotas()
+		c.clearLocks()
+		c.clearElections()
+	} else {
+		rs, ok := c.store.(RaftStorage)
+		if ok {
+			c.raft.SetStorage(rs)
+		} else {
+			c.logger.W("the store can not persist the raft state")
+		}
+
+		err := c.raft.Start()
+		if err != nil {
+			return c.ec.Throw("Start", err)
+		}
+	}
+
+	go c.pushLoop()
+	c.wgSave.Add(1)
+	go c.saveLoop()
+	c.wgLoop.Add(1)
+	go c.leaseLoop()
+	if c.hasRestoredWatch() {
+		go c.restoredWatchLoop()
+	}
+
+	if c.healthChecker != nil {
+		c.wgLoop.Add(1)
+		go c.healthLoop()
+	}
+
+	// s.BaseService.Start()
+	return nil
+}
+
+// Stop stop the loops, the lease loop and the health loop are waited for before the store is closed,
+// because they may still apply commands. The changes not saved by the save loop are saved before closing.
+func (c *regCenter) Stop() {
+	// s.BaseService.Stop()
+	close(c.chanStop)
+	c.wgLoop.Wait()
+
+	if c.raft != nil {
+		c.raft.Stop()
+	}
+
+	c.evtSave.Close()
+	c.wgSave.Wait()
+	if c.store != nil {
+		c.save()
+		c.store.Close()
+	}
+
+	c.evtOprPush.Close()
+	close(c.chanConnChange)
+}
+
+func (c *regCenter) isStopped() bool {
+	select {
+	case <-c.chanStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// getInfoWatchKey tag the qualified key with the key type as the first segment,
+// so the watches of the servers and the global data never match each other, e.g. "/1/@dev/1/2".
+func getInfoWatchKey(keyType int, key string) string {
+	typeKey := "/" + strconv.Itoa(keyType)
+	if len(ParseInfoPath(key)) == 0 {
+		return typeKey
+	}
+
+	return typeKey + key
+}
+
+// AddInfoObserver add an observer of the key of keyType, the key of a namespace is qualified by GetNsKey.
+// The options of an existing observer are merged, it may be shared by several watchers of the client.
+// If opt.StartRev is set,
+// the events since StartRev are replayed to the observer before any new event,
+// ErrRevisionCompacted is returned if these events are no longer kept.
+func (c *regCenter) AddInfoObserver(keyType int, key string, srvType uint32, srvNo uint32, opt WatchOpt) error {
+	c.confirmRestoredWatch(srvType, srvNo)
+
+	key = getInfoWatchKey(keyType, key)
+	if opt.StartRev <= 0 {
+		c.addInfoObserver(key, NewRegObserver(srvType, srvNo), opt)
+		return nil
+	}
+
+	req := &watchReplayReq{
+		key:      key,
+		observer: NewRegObserver(srvType, srvNo),
+		chanErr:  make(chan error, 1),
+	}
+
+	req.observer.Opt = opt
+
+	select {
+	case c.chanWatchReplay <- req:
+	case <-c.chanStop:
+		return c.ec.Throw("AddInfoObserver", ErrRegCenterStopped)
+	}
+
+	err := <-req.chanErr
+	return c.ec.Throw("AddInfoObserver", err)
+}
+
+func (c *regCenter) addInfoObserver(key string, o *RegObserver, opt WatchOpt) {
+	c.lckInfoObserver.Lock()
+	defer c.lckInfoObserver.Unlock()
+	defer c.markWatchChanged()
+
+	// start revision is only used when registering
+	opt.StartRev = 0
+
+	if opt.Recursive {
+		c.addRecursiveObserver(key, o, opt)
+		return
+	}
+
+	list, ok := c.mapKey2RegObserverList[key]
+	if !ok {
+		list = make([]*RegObserver, 0)
+	} else if exist, ok := c.findObserver(list, o.SrvType, o.SrvNo); ok {
+		exist.Opt.Merge(opt)
+		return
+	}
+
+	o.Opt = opt
+	c.mapKey2RegObserverList[key] = append(list, o)
+}
+
+func (c *regCenter) addRecursiveObserver(key string, o *RegObserver, opt WatchOpt) {
+	node := c.treeRecursiveObserver.GetRoot()
+	for _, subPath := range ParseInfoPath(key) {
+		child, ok := node.GetChild(subPath)
+		if !ok {
+			child = NewMapTreeNode()
+			node.AddChild(subPath, child)
+		}
+
+		node = child
+	}
+
+	list := c.getNodeObserverList(node)
+	if exist, ok := c.findObserver(list, o.SrvType, o.SrvNo); ok {
+		exist.Opt.Merge(opt)
+		return
+	}
+
+	o.Opt = opt
+	node.SetData(append(list, o))
+}
+
+func (c *regCenter) removeRecursiveObserver(key string, srvType uint32, srvNo uint32) {
+	subPaths := ParseInfoPath(key)
+	nodes := make([]*MapTreeNode, 0, len(subPaths)+1)
+
+	node := c.treeRecursiveObserver.GetRoot()
+	nodes = append(nodes, node)
+	for _, subPath := range subPaths {
+		child, ok := node.GetChild(subPath)
+		if !ok {
+			return
+		}
+
+		node = child
+		nodes = append(nodes, node)
+	}
+
+	list := c.removeObserverFromList(c.getNodeObserverList(node), srvType, srvNo)
+	node.SetData(list)
+
+	// prune the empty nodes
+	for i := len(nodes) - 1; i > 0; i-- {
+		n := nodes[i]
+		if len(c.getNodeObserverList(n)) > 0 || n.GetChildNum() > 0 {
+			break
+		}
+
+		nodes[i-1].RemoveChild(subPaths[i-1])
+	}
+}
+
+func (c *regCenter) removeAllRecursiveObserverOfSrv(node *MapTreeNode, srvType uint32, srvNo uint32) {
+	list := c.getNodeObserverList(node)
+	if len(list) > 0 {
+		node.SetData(c.removeObserverFromList(list, srvType, srvNo))
+	}
+
+	for _, child := range node.AllChilds() {
+		c.removeAllRecursiveObserverOfSrv(child, srvType, srvNo)
+	}
+}
+
+func (c *regCenter) getNodeObserverList(node *MapTreeNode) RegObserverList {
+	d := node.GetData()
+	if d == nil {
+		return make(RegObserverList, 0)
+	}
+
+	return d.(RegObserverList)
+}
+
+func (c *regCenter) RemoveInfoObserver(keyType int, key string, srvType uint32, srvNo uint32) {
+	c.lckInfoObserver.Lock()
+	defer c.lckInfoObserver.Unlock()
+	defer c.markWatchChanged()
+
+	key = getInfoWatchKey(keyType, key)
+	list, ok := c.mapKey2RegObserverList[key]
+	if ok {
+		c.mapKey2RegObserverList[key] = c.removeObserverFromList(list, srvType, srvNo)
+	}
+
+	c.removeRecursiveObserver(key, srvType, srvNo)
+}
+
+// AddSelectorObserver add an observer of the servers of the namespace matched by the selector,
+// all the types are watched if bByType is false. The start revision of opt is ignored.
+func (c *regCenter) AddSelectorObserver(ns string, srvType uint32, bByType bool, selector string, observerType uint32, observerNo uint32, opt WatchOpt) error {
+	c.confirmRestoredWatch(observerType, observerNo)
+
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return c.ec.Throw("AddSelectorObserver", err)
+	}
+
+	c.lckInfoObserver.Lock()
+	defer c.lckInfoObserver.Unlock()
+	defer c.markWatchChanged()
+
+	opt.StartRev = 0
+	key := getSelectorWatchKey(ns, srvType, bByType, selector)
+	w, ok := c.mapKey2SelectorWatch[key]
+	if !ok {
+		w = &selectorWatch{
+			ns:        ns,
+			srvType:   srvType,
+			bByType:   bByType,
+			selector:  sel,
+			observers: make(RegObserverList, 0),
+		}
+
+		c.mapKey2SelectorWatch[key] = w
+	}
+
+	if exist, ok := c.findObserver(w.observers, observerType, observerNo); ok {
+		exist.Opt.Merge(opt)
+		return nil
+	}
+
+	o := NewRegObserver(observerType, observerNo)
+	o.Opt = opt
+	w.observers = append(w.observers, o)
+	return nil
+}
+
+func (c *regCenter) RemoveSelectorObserver(ns string, srvType uint32, bByType bool, selector string, observerType uint32, observerNo uint32) {
+	c.lckInfoObserver.Lock()
+	defer c.lckInfoObserver.Unlock()
+	defer c.markWatchChanged()
+
+	key := getSelectorWatchKey(ns, srvType, bByType, selector)
+	w, ok := c.mapKey2SelectorWatch[key]
+	if !ok {
+		return
+	}
+
+	w.observers = c.removeObserverFromList(w.observers, observerType, observerNo)
+	if len(w.observers) == 0 {
+		delete(c.mapKey2SelectorWatch, key)
+	}
+}
+
+func (c *regCenter) removeAllInfoObserverOfSrv(srvType uint32, srvNo uint32) {
+	c.lckInfoObserver.Lock()
+	defer c.lckInfoObserver.Unlock()
+	defer c.markWatchChanged()
+
+	for key, list := range c.mapKey2RegObserverList {
+		c.mapKey2RegObserverList[key] = c.removeObserverFromList(list, srvType, srvNo)
+	}
+
+	for key, w := range c.mapKey2SelectorWatch {
+		w.observers = c.removeObserverFromList(w.observers, srvType, srvNo)
+		if len(w.observers) == 0 {
+			delete(c.mapKey2SelectorWatch, key)
+		}
+	}
+
+	c.removeAllRecursiveObserverOfSrv(c.treeRecursiveObserver.GetRoot(), srvType, srvNo)
+}
+
+// collectInfoObserverList collect the observers of the key, its parent, all the recursive observers
+// of its ancestors and the selectors matched by the server before or after the change.
+// Only the watches of the same key type are matched.
+// An observer is returned only once with all the options merged.
+func (c *regCenter) collectInfoObserverList(pushData *DataOprPush) RegObserverList {
+	ns := pushData.Namespace
+	key := GetNsKey(ns, pushData.Key)
+
+	c.lckInfoObserver.RLock()
+	defer c.lckInfoObserver.RUnlock()
+
+	collectList := make(RegObserverList, 0)
+	mapId2Observer := make(map[uint64]*RegObserver)
+	collect := func(list RegObserverList) {
+		for _, o := range list {
+			id := uint64(o.SrvType)<<32 | uint64(o.SrvNo)
+			merged, ok := mapId2Observer[id]
+			if !ok {
+				cloneObserver := *o
+				mapId2Observer[id] = &cloneObserver
+				collectList = append(collectList, &cloneObserver)
+				continue
+			}
+
+			merged.Opt.Merge(o.Opt)
+		}
+	}
+
+	collect(c.mapKey2RegObserverList[getInfoWatchKey(pushData.KeyType, key)])
+	if parentKey, ok := c.getParentKey(pushData.Key); ok {
+		collect(c.mapKey2RegObserverList[getInfoWatchKey(pushData.KeyType, GetNsKey(ns, parentKey))])
+	}
+
+	// the recursive observers of the root of the key type only watch the default namespace
+	node, ok := c.treeRecursiveObserver.GetRoot().GetChild(strconv.Itoa(pushData.KeyType))
+	if ok && ns == DEFAULT_NAMESPACE {
+		collect(c.getNodeObserverList(node))
+	}
+
+	for _, subPath := range ParseInfoPath(key) {
+		if !ok {
+			break
+		}
+
+		node, ok = node.GetChild(subPath)
+		if ok {
+			collect(c.getNodeObserverList(node))
+		}
+	}
+
+	if pushData.KeyType == KEY_TYPE_SRV_INFO {
+		for _, w := range c.mapKey2SelectorWatch {
+			if w.IsMatch(ns, pushData.Srv) || w.IsMatch(ns, pushData.PrevSrv) {
+				collect(w.observers)
+			}
+		}
+	}
+
+	return collectList
+}
+
+func (c *regCenter) AddConnObserver(srvType uint32, srvNo uint32) {
+	c.confirmRestoredWatch(srvType, srvNo)
+
+	c.lckConnObserver.Lock()
+	defer c.lckConnObserver.Unlock()
+	defer c.markWatchChanged()
+
+	if c.existObserver(c.connObserverList, srvType, srvNo) {
+		return
+	}
+
+	o := &RegObserver{
+		SrvType: srvType,
+		SrvNo:   srvNo,
+	}
+
+	c.connObserverList = append(c.connObserverList, o)
+}
+
+func (c *regCenter) RemoveConnObserver(srvType uint32, srvNo uint32) {
+	c.lckConnObserver.Lock()
+	defer c.lckConnObserver.Unlock()
+	defer c.markWatchChanged()
+
+	c.connObserverList = c.removeObserverFromList(c.connObserverList, srvType, srvNo)
+}
+
+// markWatchChanged ask the save loop to save the watches, it is called after the observers changed.
+func (c *regCenter) markWatchChanged() {
+	if !c.bPersistWatch {
+		return
+	}
+
+	atomic.StoreInt32(&c.bWatchChanged, 1)
+	c.evtSave.Send()
+}
+
+// getSavedWatches collect the watches of the servers which are not temporary.
+func (c *regCenter) getSavedWatches() []*SavedWatch {
+	watches := make([]*SavedWatch, 0)
+	add := func(w *SavedWatch, o *RegObserver) {
+		bTemp, err := c.info.IsTempSrv(o.SrvType, o.SrvNo)
+		if err == nil && bTemp {
+			return
+		}
+
+		w.ObserverType = o.SrvType
+		w.ObserverNo = o.SrvNo
+		w.Opt = o.Opt
+		watches = append(watches, w)
+	}
+
+	c.lckInfoObserver.RLock()
+	for key, list := range c.mapKey2RegObserverList {
+		for _, o := range list {
+			add(&SavedWatch{Kind: SAVED_WATCH_KIND_INFO, Key: key}, o)
+		}
+	}
+
+	c.visitRecursiveObservers(c.treeRecursiveObserver.GetRoot(), "", func(key string, o *RegObserver) {
+		add(&SavedWatch{Kind: SAVED_WATCH_KIND_INFO, Key: key}, o)
+	})
+
+	for _, w := range c.mapKey2SelectorWatch {
+		for _, o := range w.observers {
+			add(&SavedWatch{
+				Kind:      SAVED_WATCH_KIND_SELECTOR,
+				Namespace: w.ns,
+				SrvType:   w.srvType,
+				ByType:    w.bByType,
+				Selector:  w.selector.String(),
+			}, o)
+		}
+	}
+	c.lckInfoObserver.RUnlock()
+
+	for _, o := range c.cloneConnObserverList() {
+		add(&SavedWatch{Kind: SAVED_WATCH_KIND_CONN}, o)
+	}
+
+	return watches
+}
+
+func (c *regCenter) visitRecursiveObservers(node *MapTreeNode, path string, cb func(key string, o *RegObserver)) {
+	for _, o := range c.getNodeObserverList(node) {
+		cb(path, o)
+	}
+
+	for _, subPath := range node.AllChildKeys() {
+		child, _ := node.GetChild(subPath)
+		c.visitRecursiveObservers(child, path+"/"+subPath, cb)
+	}
+}
+
+// restoreWatches add the saved watches, the watchers are removed if they do not watch again
+// or receive a push before the restore timeout, see confirmRestoredWatch.
+func (c *regCenter) restoreWatches(watches []*SavedWatch) {
+	mapKey2Observer := make(map[string]*RegObserver)
+	for _, w := range watches {
+		switch w.Kind {
+		case SAVED_WATCH_KIND_INFO:
+			c.addInfoObserver(w.Key, NewRegObserver(w.ObserverType, w.ObserverNo), w.Opt)
+
+		case SAVED_WATCH_KIND_SELECTOR:
+			err := c.AddSelectorObserver(w.Namespace, w.SrvType, w.ByType, w.Selector, w.ObserverType, w.ObserverNo, w.Opt)
+			if err != nil {
+				c.logger.W("restore selector watch ", w.Selector, " err: ", err)
+				continue
+			}
+
+		case SAVED_WATCH_KIND_CONN:
+			c.AddConnObserver(w.ObserverType, w.ObserverNo)
+
+		default:
+			continue
+		}
+
+		mapKey2Observer[GetSrvKey(w.ObserverType, w.ObserverNo)] = NewRegObserver(w.ObserverType, w.ObserverNo)
+	}
+
+	// added after all the watches, adding a watch confirm the watcher
+	c.lckRestoredWatch.Lock()
+	defer c.lckRestoredWatch.Unlock()
+
+	for key, o := range mapKey2Observer {
+		c.mapKey2RestoredWatch[key] = o
+	}
+
+	atomic.StoreInt32(&c.restoredWatchNum, int32(len(c.mapKey2RestoredWatch)))
+}
+
+func (c *regCenter) hasRestoredWatch() bool {
+	return atomic.LoadInt32(&c.restoredWatchNum) > 0
+}
+
+// confirmRestoredWatch keep the restored watches of the watcher, it is called when the watcher
+// is connected, watch again or receive a push, so it never depend on the conn change notifications.
+func (c *regCenter) confirmRestoredWatch(srvType uint32, srvNo uint32) {
+	if !c.hasRestoredWatch() {
+		return
+	}
+
+	c.lckRestoredWatch.Lock()
+	defer c.lckRestoredWatch.Unlock()
+
+	delete(c.mapKey2RestoredWatch, GetSrvKey(srvType, srvNo))
+	atomic.StoreInt32(&c.restoredWatchNum, int32(len(c.mapKey2RestoredWatch)))
+}
+
+// restoredWatchLoop remove the restored watchers which are not confirmed before the restore timeout.
+func (c *regCenter) restoredWatchLoop() {
+	timer := time.NewTimer(c.watchRestoreTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.chanStop:
+		return
+	case <-timer.C:
+	}
+
+	c.lckRestoredWatch.Lock()
+	mapKey2Observer := c.mapKey2RestoredWatch
+	c.mapKey2RestoredWatch = make(map[string]*RegObserver)
+	atomic.StoreInt32(&c.restoredWatchNum, 0)
+	c.lckRestoredWatch.Unlock()
+
+	for key, o := range mapKey2Observer {
+		c.logger.I("watcher not confirmed in time, remove the watches of ", key)
+		c.RemoveAllObserverOfSrv(o.SrvType, o.SrvNo)
+	}
+}
+
+func (c *regCenter) cloneConnObserverList() RegObserverList {
+	c.lckConnObserver.RLock()
+	defer c.lckConnObserver.RUnlock()
+
+	cloneList := make(RegObserverList, len(c.connObserverList))
+	copy(cloneList, c.connObserverList)
+	return cloneList
+}
+
+func (c *regCenter) existObserver(list []*RegObserver, srvType uint32, srvNo uint32) bool {
+	_, ok := c.findObserver(list, srvType, srvNo)
+	return ok
+}
+
+func (c *regCenter) findObserver(list []*RegObserver, srvType uint32, srvNo uint32) (*RegObserver, bool) {
+	for _, observer := range list {
+		if observer.IsSameObserver(srvType, srvNo) {
+			return observer, true
+		}
+	}
+
+	return nil, false
+}
+
+func (c *regCenter) removeObserverFromList(list []*RegObserver, srvType uint32, srvNo uint32) []*RegObserver {
+	for i, observer := range list {
+		if observer.IsSameObserver(srvType, srvNo) {
+			if len(list) == 1 {
+				list = make([]*RegObserver, 0)
+			} else {
+				list = append(list[:i], list[i+1:]...)
+			}
+			break
+		}
+	}
+
+	return list
+}
+
+// execCmd apply the command directly, or propose it to the cluster in cluster mode.
+func (c *regCenter) execCmd(cmd *RegCmd) (*RegCmdResult, error) {
+	// the id is set before proposing, so the lease has the same id on every node
+	if cmd.TTL > 0 && cmd.LeaseId == 0 {
+		cmd.LeaseId = atomic.AddInt64(&c.leaseIdSeq, 1)
+	}
+
+	if c.raft == nil {
+		return c.sm.ApplyCmd(cmd)
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return &RegCmdResult{}, err
+	}
+
+	val, err := c.raft.Propose(data)
+	result, ok := val.(*RegCmdResult)
+	if !ok {
+		result = &RegCmdResult{}
+	}
+
+	return result, err
+}
+
+func (c *regCenter) onLeaderChange(leaderId uint32) {
+	c.logger.I("leader changed to ", leaderId)
+	if leaderId == c.raft.GetId() {
+		c.sm.leases.RenewAll()
+		go c.applyQuotas()
+		go c.clearLocks()
+		go c.clearElections()
+	} else {
+		c.locks.Lock()
+		c.locks.Reset()
+		c.locks.Unlock()
+
+		c.elections.Lock()
+		c.elections.ResetCandidates()
+		c.elections.Unlock()
+	}
+}
+
+// applyQuotas apply the quotas set by SetNamespaceQuota, in cluster mode they are proposed by the leader.
+func (c *regCenter) applyQuotas() {
+	for ns, quota := range c.mapNs2Quota {
+		cmd := NewRegCmd(REG_CMD_SET_QUOTA)
+		cmd.Namespace = ns
+		cmd.Quota = quota
+
+		_, err := c.execCmd(cmd)
+		if err != nil {
+			c.logger.E("set quota of namespace ", ns, " err: ", err)
+		}
+	}
+}
+
+// onDataChanged persist and push the changes, the pushes are still sent if the store failed
+// because the changes have been applied, the error is returned to the handler of the command.
+func (c *regCenter) onDataChanged(pushList ...*DataOprPush) error {
+	err := c.appendStore(pushList)
+	c.evtSave.Send()
+	c.sendDataOprPush(pushList...)
+	return err
+}
+
+func (c *regCenter) appendStore(pushList []*DataOprPush) error {
+	if c.store == nil {
+		return nil
+	}
+
+	records := make([]*DataOprPush, 0, len(pushList))
+	for _, pushData := range pushList {
+		if pushData.Srv != nil && pushData.Srv.IsTemp {
+			continue
+		}
+
+		if pushData.PrevSrv != nil && pushData.PrevSrv.IsTemp && pushData.Srv == nil {
+			continue
+		}
+
+		records = append(records, pushData.WithOpt(WatchOpt{WithValue: true}))
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	err := c.store.Append(records...)
+	if err != nil {
+		c.logger.E("append store err: ", err)
+	}
+
+	return err
+}
+
+// sendDataOprPush queue the pushes for the push loop, it never block
+// because it is called in the raft loop.
+func (c *regCenter) sendDataOprPush(pushList ...*DataOprPush) {
+	c.lckOprPush.Lock()
+	c.oprPushList = append(c.oprPushList, pushList)
+	c.lckOprPush.Unlock()
+
+	c.evtOprPush.Send()
+}
+
+func (c *regCenter) popOprPushList() [][]*DataOprPush {
+	c.lckOprPush.Lock()
+	defer c.lckOprPush.Unlock()
+
+	oprPushList := c.oprPushList
+	c.oprPushList = make([][]*DataOprPush, 0)
+	return oprPushList
+}
+
+func (c *regCenter) pushLoop() {
+	for {
+		select {
+		case _, ok := <-c.evtOprPush.C:
+			if !ok {
+				goto Exit0
+			}
+
+			for _, pushList := range c.popOprPushList() {
+				for _, pushData := range pushList {
+					c.events.Append(pushData)
+				}
+
+				if len(pushList) == 1 {
+					c.notifyDataUpdate(pushList[0])
+				} else {
+					c.notifyDataBatch(pushList)
+				}
+			}
+
+		case req := <-c.chanWatchReplay:
+			req.chanErr <- c.replayWatch(req)
+
+		case pushData, ok := <-c.chanConnChange:
+			if !ok {
+				goto Exit0
+			}
+
+			c.notifyConnChange(pushData)
+		}
+	}
+
+Exit0:
+	return
+}
+
+func (c *regCenter) notifyDataUpdate(pushData *DataOprPush) {
+	list := c.collectInfoObserverList(pushData)
+	c.pushDataOpr(pushData, list)
+}
+
+// notifyDataBatch send the pushes of a command, e.g. a txn, to each observer in one batch push,
+// so the observer never see a part of them. The batch of an observer keep the order of the pushes.
+func (c *regCenter) notifyDataBatch(pushList []*DataOprPush) {
+	observers := make([]*RegObserver, 0)
+	mapId2Batch := make(map[uint64]*DataOprBatchPush)
+	for _, pushData := range pushList {
+		for _, o := range c.collectInfoObserverList(pushData) {
+			id := uint64(o.SrvType)<<32 | uint64(o.SrvNo)
+			batch, ok := mapId2Batch[id]
+			if !ok {
+				batch = &DataOprBatchPush{
+					Pushes: make([]*DataOprPush, 0, len(pushList)),
+				}
+
+				mapId2Batch[id] = batch
+				observers = append(observers, o)
+			}
+
+			opt := WatchOpt{
+				WithValue:     o.Opt.WithValue,
+				WithPrevValue: o.Opt.WithPrevValue,
+			}
+
+			batch.Pushes = append(batch.Pushes, pushData.WithOpt(opt))
+		}
+	}
+
+	for _, o := range observers {
+		batch := mapId2Batch[uint64(o.SrvType)<<32|uint64(o.SrvNo)]
+		if len(batch.Pushes) == 1 {
+			c.push(batch.Pushes[0], DATA_OPR_PUSH_FUNC_NO, []*RegObserver{o})
+		} else {
+			c.push(batch, BATCH_PUSH_FUNC_NO, []*RegObserver{o})
+		}
+	}
+}
+
+func (c *regCenter) getParentKey(key string) (string, bool) {
+	idx := strings.LastIndex(key, "/")
+	if idx <= 0 {
+		return "", false
+	}
+
+	return key[:idx], true
+}
+
+// isWatchKeyMatch check if the push is watched by the watch key tagged by getInfoWatchKey.
+func (c *regCenter) isWatchKeyMatch(watchKey string, pushData *DataOprPush, bRecursive bool) bool {
+	key := getInfoWatchKey(pushData.KeyType, GetNsKey(pushData.Namespace, pushData.Key))
+	if key == watchKey {
+		return true
+	}
+
+	if bRecursive {
+		if watchKey == getInfoWatchKey(pushData.KeyType, "") {
+			return pushData.Namespace == DEFAULT_NAMESPACE
+		}
+
+		return strings.HasPrefix(key, watchKey+"/")
+	}
+
+	parentKey, ok := c.getParentKey(pushData.Key)
+	return ok && getInfoWatchKey(pushData.KeyType, GetNsKey(pushData.Namespace, parentKey)) == watchKey
+}
+
+func (c *regCenter) replayWatch(req *watchReplayReq) error {
+	opt := req.observer.Opt
+	list, err := c.events.GetSince(opt.StartRev, func(pushData *DataOprPush) bool {
+		return c.isWatchKeyMatch(req.key, pushData, opt.Recursive)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// the observer is added in push loop, so no event is missed or pushed twice
+	c.addInfoObserver(req.key, req.observer, opt)
+	for _, pushData := range list {
+		c.pushDataOpr(pushData, []*RegObserver{req.observer})
+	}
+
+	return nil
+}
+
+func (c *regCenter) pushDataOpr(pushData *DataOprPush, list []*RegObserver) {
+	mapOpt2List := make(map[WatchOpt][]*RegObserver)
+	for _, observer := range list {
+		opt := WatchOpt{
+			WithValue:     observer.Opt.WithValue,
+			WithPrevValue: observer.Opt.WithPrevValue,
+		}
+
+		mapOpt2List[opt] = append(mapOpt2List[opt], observer)
+	}
+
+	for opt, optList := range mapOpt2List {
+		c.push(pushData.WithOpt(opt), DATA_OPR_PUSH_FUNC_NO, optList)
+	}
+}
+
+// func (s *Server) pushDataUpdate(key string, opr int, list []*RegObserver) {
+// 	if len(list) == 0 {
+// 		return
+// 	}
+
+// 	pushData := &DataOprPush{
+// 		Key:     key,
+// 		Operate: opr,
+// 	}
+
+// 	s.push(pushData, list)
+// }
+
+func (c *regCenter) notifyConnChange(pushData *ConnChangePush) {
+	list := c.cloneConnObserverList()
+	c.push(pushData, CONN_CHANGE_FUNC_NO, list)
+}
+
+// pushTo push to a server by its push queue.
+func (c *regCenter) pushTo(srvType uint32, srvNo uint32, pushData interface{}, funcNo uint16) {
+	c.push(pushData, funcNo, []*RegObserver{NewRegObserver(srvType, srvNo)})
+}
+
+func (c *regCenter) push(pushData interface{}, funcNo uint16, list []*RegObserver) {
+	if len(list) == 0 {
+		return
+	}
+
+	if c.pusher == nil {
+		c.logger.E("pusher is nil")
+		return
+	}
+
+	payload, err := marshalPushPayload(pushData, funcNo)
+	if err != nil {
+		c.logger.E("push marshal err: ", err)
+		return
+	}
+
+	item := &pushItem{
+		key:      getPushCoalesceKey(pushData),
+		funcNo:   funcNo,
+		pushData: pushData,
+		payload:  payload,
+	}
+
+	for _, observer := range list {
+		c.enqueuePush(observer.SrvType, observer.SrvNo, item)
+	}
+}
+
+// enqueuePush add the push to the queue of the observer, so a slow observer never block the others.
+func (c *regCenter) enqueuePush(srvType uint32, srvNo uint32, item *pushItem) {
+	policy := c.pushOverflowPolicy
+	if _, ok := c.pusher.(ObserverCloser); !ok && policy == PUSH_OVERFLOW_DISCONNECT {
+		policy = PUSH_OVERFLOW_DROP_OLDEST
+	}
+
+	q := c.getPushQueue(srvType, srvNo)
+	bStartSender, err := q.Push(item, policy)
+	if err == ErrPushQueueOverflow {
+		c.logger.W("push queue of ", GetSrvKey(srvType, srvNo), " overflow, disconnect it")
+		go c.disconnectSlowObserver(srvType, srvNo)
+		return
+	}
+
+	if bStartSender {
+		go c.sendLoop(q)
+	}
+}
+
+func (c *regCenter) getPushQueue(srvType uint32, srvNo uint32) *pushQueue {
+	c.lckPushQueue.Lock()
+	defer c.lckPushQueue.Unlock()
+
+	key := GetSrvKey(srvType, srvNo)
+	q, ok := c.mapKey2PushQueue[key]
+	if !ok {
+		q = newPushQueue(srvType, srvNo, c.pushQueueSize)
+		c.mapKey2PushQueue[key] = q
+	}
+
+	return q
+}
+
+func (c *regCenter) removePushQueue(srvType uint32, srvNo uint32) {
+	c.lckPushQueue.Lock()
+	defer c.lckPushQueue.Unlock()
+
+	key := GetSrvKey(srvType, srvNo)
+	q, ok := c.mapKey2PushQueue[key]
+	if ok {
+		q.Clear()
+		delete(c.mapKey2PushQueue, key)
+	}
+}
+
+// sendLoop send the pushes of the queue in order, it exits when the queue is empty.
+// If batching is enabled, the data pushes arrive in the window after a data push are sent in a batch.
+func (c *regCenter) sendLoop(q *pushQueue) {
+	for {
+		item, ok := q.Pop()
+		if !ok {
+			break
+		}
+
+		if item.funcNo != DATA_OPR_PUSH_FUNC_NO || c.pushBatchWindow <= 0 {
+			c.sendPayload(q, item.payload)
+			continue
+		}
+
+		time.Sleep(c.pushBatchWindow)
+		items := q.PopBatch(DATA_OPR_PUSH_FUNC_NO, c.pushBatchMax-1)
+		if len(items) == 0 {
+			c.sendPayload(q, item.payload)
+			continue
+		}
+
+		c.sendBatch(q, append([]*pushItem{item}, items...))
+	}
+}
+
+func (c *regCenter) sendBatch(q *pushQueue, items []*pushItem) {
+	list := make([]*DataOprPush, 0, len(items))
+	for _, item := range items {
+		list = append(list, item.pushData.(*DataOprPush))
+	}
+
+	batch := &DataOprBatchPush{
+		Pushes: coalesceDataPushes(list),
+	}
+
+	payload, err := marshalPushPayload(batch, BATCH_PUSH_FUNC_NO)
+	if err != nil {
+		c.logger.E("push marshal err: ", err)
+		return
+	}
+
+	c.sendPayload(q, payload)
+}
+
+func (c *regCenter) sendPayload(q *pushQueue, payload []rpc.ByteArray) {
+	err := c.pusher.Push(q.srvType, q.srvNo, payload...)
+	if err != nil {
+		c.logger.W("push to ", GetSrvKey(q.srvType, q.srvNo), " err: ", err)
+		return
+	}
+
+	c.confirmRestoredWatch(q.srvType, q.srvNo)
+}
+
+// disconnectSlowObserver drop the watches of the observer and close its push connection,
+// the client must watch again and resync after reconnecting. The rpc connection is kept,
+// so the servers, the locks and the elections of the client are not released.
+func (c *regCenter) disconnectSlowObserver(srvType uint32, srvNo uint32) {
+	c.RemoveAllObserverOfSrv(srvType, srvNo)
+
+	err := c.pusher.(ObserverCloser).CloseObserver(srvType, srvNo)
+	if err != nil {
+		c.logger.E("close slow observer err: ", err)
+	}
+}
+
+func marshalPushPayload(pushData interface{}, funcNo uint16) ([]rpc.ByteArray, error) {
+	packData, err := json.Marshal(pushData)
+	if err != nil {
+		return nil, err
+	}
+
+	h := rpc.NewPackHeader(PUSH_MARK, 0, funcNo)
+	headerData, err := h.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]rpc.ByteArray, 0, 2)
+	payload = append(payload, headerData, packData)
+	return payload, nil
+}
+
+func (c *regCenter) saveLoop() {
+	defer c.wgSave.Done()
+
+	for {
+		// _, ok := <-s.evtSave.C
+		// if !ok {
+		// 	break
+		// }
+
+		err := c.evtSave.Wait()
+		if err != nil {
+			break
+		}
+
+		if c.store != nil {
+			c.save()
+		}
+
+		if c.bDebug {
+			c.info.Dump()
+		}
+	}
+}
+
+// save save the changed watches and flush the store.
+func (c *regCenter) save() {
+	if atomic.CompareAndSwapInt32(&c.bWatchChanged, 1, 0) {
+		err := c.store.SaveWatches(c.info, c.getSavedWatches())
+		if err != nil {
+			// saved again on the next change
+			atomic.StoreInt32(&c.bWatchChanged, 1)
+			c.logger.E("save watches err: ", err)
+		}
+	}
+
+	err := c.store.Flush(c.info)
+	if err != nil {
+		c.logger.E("flush store err: ", err)
+	}
+}
+
+func (c *regCenter) leaseLoop() {
+	defer c.wgLoop.Done()
+
+	ticker := time.NewTicker(LEASE_CHECK_INTERVAL_MS * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.chanStop:
+			goto Exit0
+
+		case now := <-ticker.C:
+			if c.raft != nil && !c.raft.IsLeader() {
+				break
+			}
+
+			expired := c.sm.leases.GetExpired(now)
+			for _, l := range expired {
+				// the store is about to be closed
+				if c.isStopped() {
+					goto Exit0
+				}
+
+				// the lease is kept and retried at the next check if failed
+				bRemoved, err := c.expireLease(l)
+				if err != nil {
+					c.logger.E("remove expired server err: ", err)
+					continue
+				}
+
+				if bRemoved {
+					c.logger.I("lease expired, remove server ", l.GetKey())
+					c.resignElectionOfSrv(l.SrvType, l.SrvNo)
+				}
+			}
+		}
+	}
+
+Exit0:
+	return
+}
+
+// expireLease revoke the lease and remove the server in one command, nothing is done
+// if the server is granted again after the lease expired. Return true if the server is removed.
+func (c *regCenter) expireLease(l *Lease) (bool, error) {
+	cmd := NewRegCmd(REG_CMD_EXPIRE_LEASE)
+	cmd.Namespace = l.Namespace
+	cmd.SrvType = l.SrvType
+	cmd.SrvNo = l.SrvNo
+	cmd.LeaseId = l.Id
+
+	result, err := c.execCmd(cmd)
+	if err != nil {
+		return false, err
+	}
+
+	return len(result.PushList) > 0, nil
+}
+
+type healthProbe struct {
+	ns   string
+	info *SrvInfo
+}
+
+// healthLoop dispatch the probes to healthWorkerNum workers every interval,
+// a server is skipped if its last probe is still in flight.
+func (c *regCenter) healthLoop() {
+	defer c.wgLoop.Done()
+
+	chanProbe := make(chan *healthProbe)
+	wgWorker := &sync.WaitGroup{}
+	for i := 0; i < c.healthWorkerNum; i++ {
+		wgWorker.Add(1)
+		go c.healthWorker(chanProbe, wgWorker)
+	}
+
+	ticker := time.NewTicker(c.healthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.chanStop:
+			goto Exit0
+
+		case <-ticker.C:
+			if c.raft != nil && !c.raft.IsLeader() {
+				c.resetHealthFails()
+				break
+			}
+
+			c.checkHealth(chanProbe)
+		}
+	}
+
+Exit0:
+	close(chanProbe)
+	wgWorker.Wait()
+}
+
+func (c *regCenter) healthWorker(chanProbe chan *healthProbe, wgWorker *sync.WaitGroup) {
+	defer wgWorker.Done()
+
+	for p := range chanProbe {
+		err := c.healthChecker.Check(p.info)
+		c.onHealthChecked(p, err)
+	}
+}
+
+// checkHealth dispatch the probes of all the servers of all the namespaces,
+// the failures of the servers no longer registered are dropped.
+func (c *regCenter) checkHealth(chanProbe chan *healthProbe) {
+	nsInfos := c.info.GetAllNamespaces()
+	probes := make([]*healthProbe, 0)
+	mapKey2Exist := make(map[string]bool)
+	for _, nsInfo := range nsInfos {
+		ns := nsInfo.GetNamespaceName()
+		for _, info := range nsInfo.FindSrvInfos(0, false, func(info *SrvInfo) bool {
+			return true
+		}) {
+			// probed by the workers, so the info is copied
+			probes = append(probes, &healthProbe{ns: ns, info: info.Clone()})
+			mapKey2Exist[GetNsKey(ns, GetSrvKey(info.SrvType, info.SrvNo))] = true
+		}
+	}
+
+	c.lckHealth.Lock()
+	for key := range c.mapKey2HealthFails {
+		if !mapKey2Exist[key] {
+			delete(c.mapKey2HealthFails, key)
+		}
+	}
+	c.lckHealth.Unlock()
+
+	for _, p := range probes {
+		key := GetNsKey(p.ns, GetSrvKey(p.info.SrvType, p.info.SrvNo))
+		if !c.startHealthProbe(key) {
+			continue
+		}
+
+		select {
+		case chanProbe <- p:
+		case <-c.chanStop:
+			c.endHealthProbe(key)
+			return
+		}
+	}
+}
+
+// startHealthProbe mark the probe of the server in flight, return false if it is already.
+func (c *regCenter) startHealthProbe(key string) bool {
+	c.lckHealth.Lock()
+	defer c.lckHealth.Unlock()
+
+	if c.mapKey2HealthProbing[key] {
+		return false
+	}
+
+	c.mapKey2HealthProbing[key] = true
+	return true
+}
+
+func (c *regCenter) endHealthProbe(key string) {
+	c.lckHealth.Lock()
+	defer c.lckHealth.Unlock()
+
+	delete(c.mapKey2HealthProbing, key)
+}
+
+func (c *regCenter) resetHealthFails() {
+	c.lckHealth.Lock()
+	defer c.lckHealth.Unlock()
+
+	c.mapKey2HealthFails = make(map[string]uint32)
+}
+
+// onHealthChecked count the failures of the server, and set its health
+// after healthFailThreshold failures in a row or a success.
+func (c *regCenter) onHealthChecked(p *healthProbe, err error) {
+	key := GetNsKey(p.ns, GetSrvKey(p.info.SrvType, p.info.SrvNo))
+	defer c.endHealthProbe(key)
+
+	if err == ErrHealthCheckSkipped {
+		return
+	}
+
+	health := SRV_HEALTH_HEALTHY
+	c.lckHealth.Lock()
+	if err == nil {
+		delete(c.mapKey2HealthFails, key)
+	} else {
+		fails := c.mapKey2HealthFails[key] + 1
+		c.mapKey2HealthFails[key] = fails
+		if fails >= c.healthFailThreshold {
+			health = SRV_HEALTH_UNHEALTHY
+		} else {
+			health = p.info.Health
+		}
+	}
+	c.lckHealth.Unlock()
+
+	if p.info.Health == health {
+		return
+	}
+
+	if c.raft != nil && !c.raft.IsLeader() {
+		return
+	}
+
+	c.logger.I("server ", key, " health changed to ", health, ", err: ", err)
+	err = newRegNamespace(p.ns, c).SetSrvHealth(p.info.SrvType, p.info.SrvNo, health)
+	if err != nil && err != ErrSrvNotExists {
+		c.logger.E("set server health err: ", err)
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrInvalidRegCmd = errors.New("invalid reg command")
+)
+
+const (
+	REG_CMD_UPDATE_SRV = 1 + iota
+	REG_CMD_REMOVE_SRV
+	REG_CMD_COMPARE_AND_UPDATE_SRV
+	REG_CMD_UPDATE_GLOBAL_DATA
+	REG_CMD_REMOVE_GLOBAL_DATA
+	REG_CMD_COMPARE_AND_UPDATE_GLOBAL_DATA
+	REG_CMD_TXN
+	REG_CMD_GRANT_LEASE
+	REG_CMD_REVOKE_LEASE
+	REG_CMD_SET_SRV_HEALTH
+	REG_CMD_SET_SRV_STATUS
+	REG_CMD_SET_QUOTA
+	REG_CMD_EXPIRE_LEASE
+)
+
+//======================
+//       RegCmd
+//======================
+// RegCmd is a mutation of the registry, in cluster mode it is replicated by raft
+// and applied on every node in the same order.
+type RegCmd struct {
+	Type       int             `json:"type"`
+	Namespace  string          `json:"ns,omitempty"`
+	SrvType    uint32          `json:"srv_type,omitempty"`
+	SrvNo      uint32          `json:"srv_no,omitempty"`
+	IsTemp     bool            `json:"bTemp,omitempty"`
+	Key        string          `json:"key,omitempty"`
+	DataBase64 string          `json:"data,omitempty"`
+	Meta       *SrvMeta        `json:"meta,omitempty"`
+	TTL        uint32          `json:"ttl,omitempty"`
+	LeaseId    int64           `json:"lease_id,omitempty"`
+	Health     int             `json:"health,omitempty"`
+	Status     string          `json:"status,omitempty"`
+	Cmp        *Compare        `json:"cmp,omitempty"`
+	Compares   []*TxnCompare   `json:"cmps,omitempty"`
+	Success    []*TxnOp        `json:"then,omitempty"`
+	Failure    []*TxnOp        `json:"else,omitempty"`
+	Quota      *NamespaceQuota `json:"quota,omitempty"`
+}
+
+func NewRegCmd(cmdType int) *RegCmd {
+	return &RegCmd{
+		Type: cmdType,
+	}
+}
+
+// isAddKey check if the command may add a key or set the quota, the namespace is only added by them.
+func (c *RegCmd) isAddKey() bool {
+	return c.Type == REG_CMD_UPDATE_SRV || c.Type == REG_CMD_COMPARE_AND_UPDATE_SRV ||
+		c.Type == REG_CMD_UPDATE_GLOBAL_DATA || c.Type == REG_CMD_COMPARE_AND_UPDATE_GLOBAL_DATA ||
+		c.Type == REG_CMD_TXN || c.Type == REG_CMD_SET_QUOTA
+}
+
+type RegCmdResult struct {
+	Succeeded bool
+	PushList  []*DataOprPush
+}
+
+func (r *RegCmdResult) GetFirstPush() *DataOprPush {
+	if len(r.PushList) == 0 {
+		return nil
+	}
+
+	return r.PushList[0]
+}
+
+//======================
+//  RegStateMachine
+//======================
+type regSnapshot struct {
+	Rev     int64                      `json:"rev"`
+	Records []*DataOprPush             `json:"records"`
+	Leases  []*Lease                   `json:"leases"`
+	Quotas  map[string]*NamespaceQuota `json:"quotas,omitempty"`
+}
+
+// RegStateMachine apply the commands to a RegInfo,
+// the pushes of the changed keys are passed to the apply callback.
+// The error of the callback, e.g. the store failed to persist the changes, is returned by the apply.
+// The commands are applied one by one with their callbacks, so the pushes are passed in order of revision
+// even if the commands are applied directly by several goroutines.
+type RegStateMachine struct {
+	info     *RegInfo
+	leases   *leaseMgr
+	applyCb  func(pushList ...*DataOprPush) error
+	lckApply *sync.Mutex
+}
+
+func NewRegStateMachine(info *RegInfo) *RegStateMachine {
+	return &RegStateMachine{
+		info:     info,
+		leases:   newLeaseMgr(),
+		applyCb:  nil,
+		lckApply: &sync.Mutex{},
+	}
+}
+
+func (m *RegStateMachine) SetApplyCb(cb func(pushList ...*DataOprPush) error) {
+	m.applyCb = cb
+}
+
+func (m *RegStateMachine) GetRegInfo() *RegInfo {
+	return m.info
+}
+
+func (m *RegStateMachine) Apply(data []byte) (interface{}, error) {
+	cmd := &RegCmd{}
+	err := json.Unmarshal(data, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.ApplyCmd(cmd)
+}
+
+func (m *RegStateMachine) Snapshot() ([]byte, error) {
+	rev, records := m.info.GetRecords()
+	snapshot := &regSnapshot{
+		Rev:     rev,
+		Records: records,
+		Leases:  m.leases.GetAll(),
+		Quotas:  m.info.GetAllQuotas(),
+	}
+
+	return json.Marshal(snapshot)
+}
+
+func (m *RegStateMachine) Restore(data []byte) error {
+	snapshot := &regSnapshot{}
+	err := json.Unmarshal(data, snapshot)
+	if err != nil {
+		return err
+	}
+
+	m.lckApply.Lock()
+	defer m.lckApply.Unlock()
+
+	pushList := m.info.Restore(snapshot.Rev, snapshot.Records)
+	m.leases.Reset(snapshot.Leases)
+	m.info.ResetQuotas(snapshot.Quotas)
+	return m.onApplied(pushList...)
+}
+
+func (m *RegStateMachine) GetRevision() int64 {
+	return m.info.GetRevision()
+}
+
+// ApplyCmd apply the command directly, the error is returned with the result,
+// e.g. ErrCompareFailed is returned with a push of the current value.
+func (m *RegStateMachine) ApplyCmd(cmd *RegCmd) (*RegCmdResult, error) {
+	m.lckApply.Lock()
+	defer m.lckApply.Unlock()
+
+	result := &RegCmdResult{
+		Succeeded: true,
+		PushList:  make([]*DataOprPush, 0),
+	}
+
+	info := m.info.GetNamespace(cmd.Namespace)
+	if cmd.isAddKey() {
+		info = m.info.addNamespace(cmd.Namespace)
+	}
+
+	var pushData *DataOprPush = nil
+	var removedList []*DataOprPush = nil
+	var err error = nil
+	ok := true
+
+	switch cmd.Type {
+	case REG_CMD_UPDATE_SRV:
+		if !info.HasSrv(cmd.SrvType, cmd.SrvNo) {
+			pushData, err = info.AddSrvWithMeta(cmd.SrvType, cmd.SrvNo, cmd.IsTemp, cmd.DataBase64, cmd.Meta)
+		} else {
+			pushData, err = info.SetSrvDataWithMeta(cmd.SrvType, cmd.SrvNo, cmd.DataBase64, cmd.Meta)
+		}
+
+		if err == nil && cmd.TTL > 0 {
+			err = m.leases.Grant(cmd.LeaseId, cmd.Namespace, cmd.SrvType, cmd.SrvNo, cmd.TTL)
+		}
+
+	case REG_CMD_REMOVE_SRV:
+		m.leases.Revoke(cmd.Namespace, cmd.SrvType, cmd.SrvNo)
+		removedList, ok = info.RemoveSrv(cmd.SrvType, cmd.SrvNo)
+
+	case REG_CMD_COMPARE_AND_UPDATE_SRV:
+		pushData, err = info.CompareAndSetSrv(cmd.SrvType, cmd.SrvNo, cmd.IsTemp, cmd.DataBase64, cmd.Meta, cmd.Cmp)
+		if err == nil && cmd.TTL > 0 {
+			err = m.leases.Grant(cmd.LeaseId, cmd.Namespace, cmd.SrvType, cmd.SrvNo, cmd.TTL)
+		}
+
+	case REG_CMD_UPDATE_GLOBAL_DATA:
+		pushData, err = info.SetGlobalData(cmd.Key, cmd.DataBase64)
+
+	case REG_CMD_REMOVE_GLOBAL_DATA:
+		removedList, ok = info.RemoveGlobalData(cmd.Key)
+
+	case REG_CMD_COMPARE_AND_UPDATE_GLOBAL_DATA:
+		pushData, err = info.CompareAndSetGlobalData(cmd.Key, cmd.DataBase64, cmd.Cmp)
+
+	case REG_CMD_TXN:
+		return m.applyTxn(info, cmd)
+
+	case REG_CMD_GRANT_LEASE:
+		if !info.HasSrv(cmd.SrvType, cmd.SrvNo) {
+			return result, ErrSrvNotExists
+		}
+
+		err = m.leases.Grant(cmd.LeaseId, cmd.Namespace, cmd.SrvType, cmd.SrvNo, cmd.TTL)
+		return result, err
+
+	case REG_CMD_REVOKE_LEASE:
+		m.leases.Revoke(cmd.Namespace, cmd.SrvType, cmd.SrvNo)
+		return result, nil
+
+	case REG_CMD_EXPIRE_LEASE:
+		// the server granted again after the lease expired is kept
+		if !m.leases.RevokeIfMatch(cmd.LeaseId, cmd.Namespace, cmd.SrvType, cmd.SrvNo) {
+			return result, nil
+		}
+
+		removedList, ok = info.RemoveSrv(cmd.SrvType, cmd.SrvNo)
+
+	case REG_CMD_SET_SRV_HEALTH:
+		pushData, err = info.SetSrvHealth(cmd.SrvType, cmd.SrvNo, cmd.Health)
+
+	case REG_CMD_SET_SRV_STATUS:
+		pushData, err = info.SetSrvStatus(cmd.SrvType, cmd.SrvNo, cmd.Status)
+
+	case REG_CMD_SET_QUOTA:
+		info.SetQuota(cmd.Quota)
+		return result, nil
+
+	default:
+		return result, ErrInvalidRegCmd
+	}
+
+	if pushData != nil && ok {
+		result.PushList = append(result.PushList, pushData)
+	}
+
+	if ok {
+		result.PushList = append(result.PushList, removedList...)
+	}
+
+	if err != nil {
+		result.Succeeded = false
+		return result, err
+	}
+
+	err = m.onApplied(result.PushList...)
+	return result, err
+}
+
+func (m *RegStateMachine) applyTxn(info *RegInfo, cmd *RegCmd) (*RegCmdResult, error) {
+	bSucc, pushList, err := info.Txn(cmd.Compares, cmd.Success, cmd.Failure)
+	if err != nil {
+		return &RegCmdResult{}, err
+	}
+
+	for _, pushData := range pushList {
+		if pushData.KeyType == KEY_TYPE_SRV_INFO && pushData.Operate == DATA_OPR_TYPE_REMOVE {
+			srvType, srvNo := GetSrvTypeAndNo(pushData.Key)
+			m.leases.Revoke(cmd.Namespace, srvType, srvNo)
+		}
+	}
+
+	err = m.onApplied(pushList...)
+	return &RegCmdResult{Succeeded: bSucc, PushList: pushList}, err
+}
+
+func (m *RegStateMachine) onApplied(pushList ...*DataOprPush) error {
+	if len(pushList) == 0 || m.applyCb == nil {
+		return nil
+	}
+
+	return m.applyCb(pushList...)
+}
@@ -1,409 +1,1613 @@
-// Copyright 2022 Guan Jianchang. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
-package reg
-
-import (
-	"encoding/json"
-	"errors"
-	"os"
-	"strconv"
-	"sync"
-
-	"github.com/yxlib/yx"
-)
-
-var (
-	ErrSrvNotExists = errors.New("server not exists")
-	ErrEmptyPath    = errors.New("empty path")
-)
-
-type SrvInfo struct {
-	SrvType    uint32 `json:"type"`
-	SrvNo      uint32 `json:"no"`
-	IsTemp     bool   `json:"bTemp"`
-	DataBase64 string `json:"data"`
-}
-
-type RegSavedInfo struct {
-	SrvInfos          []*SrvInfo        `json:"srv"`
-	MapGlobalKey2Data map[string]string `json:"global"`
-}
-
-func NewRegSavedInfo() *RegSavedInfo {
-	return &RegSavedInfo{
-		SrvInfos:          make([]*SrvInfo, 0),
-		MapGlobalKey2Data: make(map[string]string),
-	}
-}
-
-type RegInfo struct {
-	treeSrvInfos    *MapTree
-	lckSrv          *sync.RWMutex
-	treeGlobalInfos *MapTree
-	lckGlobal       *sync.RWMutex
-	logger          *yx.Logger
-}
-
-func NewRegInfo() *RegInfo {
-	return &RegInfo{
-		treeSrvInfos:    NewMapTree(),
-		lckSrv:          &sync.RWMutex{},
-		treeGlobalInfos: NewMapTree(),
-		lckGlobal:       &sync.RWMutex{},
-		logger:          yx.NewLogger("RegInfo"),
-	}
-}
-
-func (r *RegInfo) AddSrv(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string) error {
-	r.lckSrv.Lock()
-	defer r.lckSrv.Unlock()
-
-	info := &SrvInfo{
-		SrvType:    srvType,
-		SrvNo:      srvNo,
-		IsTemp:     bTemp,
-		DataBase64: dataBase64,
-	}
-
-	key := GetSrvKey(srvType, srvNo)
-	err := r.setData(r.treeSrvInfos, key, info)
-	return err
-}
-
-func (r *RegInfo) RemoveSrv(srvType uint32, srvNo uint32) {
-	r.lckSrv.Lock()
-	defer r.lckSrv.Unlock()
-
-	key := GetSrvKey(srvType, srvNo)
-	r.removeData(r.treeSrvInfos, key)
-}
-
-func (r *RegInfo) IsTempSrv(srvType uint32, srvNo uint32) (bool, error) {
-	r.lckSrv.RLock()
-	defer r.lckSrv.RUnlock()
-
-	key := GetSrvKey(srvType, srvNo)
-	data, ok := r.getData(r.treeSrvInfos, key)
-	if !ok {
-		return false, ErrSrvNotExists
-	}
-
-	info := data.(*SrvInfo)
-	return info.IsTemp, nil
-}
-
-func (r *RegInfo) HasSrv(srvType uint32, srvNo uint32) bool {
-	r.lckSrv.RLock()
-	defer r.lckSrv.RUnlock()
-
-	key := GetSrvKey(srvType, srvNo)
-	_, ok := r.getData(r.treeSrvInfos, key)
-	return ok
-}
-
-func (r *RegInfo) GetSrvData(srvType uint32, srvNo uint32) (string, bool) {
-	info, ok := r.GetSrvInfo(srvType, srvNo)
-	return info.DataBase64, ok
-}
-
-func (r *RegInfo) GetSrvInfo(srvType uint32, srvNo uint32) (*SrvInfo, bool) {
-	key := GetSrvKey(srvType, srvNo)
-	info, ok := r.GetSrvInfoByKey(key)
-	return info, ok
-}
-
-func (r *RegInfo) GetSrvInfoByKey(key string) (*SrvInfo, bool) {
-	r.lckSrv.RLock()
-	defer r.lckSrv.RUnlock()
-
-	data, ok := r.getData(r.treeSrvInfos, key)
-	if !ok {
-		return nil, false
-	}
-
-	info := data.(*SrvInfo)
-	return info, true
-}
-
-func (r *RegInfo) SetSrvData(srvType uint32, srvNo uint32, dataBase64 string) error {
-	r.lckSrv.Lock()
-	defer r.lckSrv.Unlock()
-
-	key := GetSrvKey(srvType, srvNo)
-	d, ok := r.getData(r.treeSrvInfos, key)
-	if !ok {
-		return ErrSrvNotExists
-	}
-
-	info := d.(*SrvInfo)
-	info.DataBase64 = dataBase64
-	return nil
-}
-
-func (r *RegInfo) GetAllSrvNos(srvType uint32) ([]uint32, bool) {
-	r.lckSrv.RLock()
-	defer r.lckSrv.RUnlock()
-
-	key := GetSrvTypeKey(srvType)
-	node, ok := r.getNode(r.treeSrvInfos, key)
-	if !ok {
-		return nil, false
-	}
-
-	childKeys := node.AllChildKeys()
-	srvNos := make([]uint32, 0, len(childKeys))
-	for _, childKey := range childKeys {
-		no, _ := strconv.ParseUint(childKey, 10, 16)
-		srvNos = append(srvNos, uint32(no))
-	}
-
-	return srvNos, true
-}
-
-func (r *RegInfo) GetAllSrvInfos(srvType uint32) ([]*SrvInfo, bool) {
-	r.lckSrv.RLock()
-	defer r.lckSrv.RUnlock()
-
-	key := GetSrvTypeKey(srvType)
-	node, ok := r.getNode(r.treeSrvInfos, key)
-	if !ok {
-		return nil, false
-	}
-
-	childs := node.AllChilds()
-	srvInfos := make([]*SrvInfo, 0, len(childs))
-	for _, child := range childs {
-		d := child.GetData()
-		info := d.(*SrvInfo)
-		srvInfos = append(srvInfos, info)
-	}
-
-	return srvInfos, true
-}
-
-func (r *RegInfo) SetGlobalData(key string, data string) error {
-	r.lckGlobal.Lock()
-	defer r.lckGlobal.Unlock()
-
-	return r.setData(r.treeGlobalInfos, key, data)
-}
-
-func (r *RegInfo) GetGlobalData(key string) (string, bool) {
-	r.lckGlobal.RLock()
-	defer r.lckGlobal.RUnlock()
-
-	data, ok := r.getData(r.treeGlobalInfos, key)
-	if !ok || data == nil {
-		return "", false
-	}
-
-	return data.(string), ok
-}
-
-func (r *RegInfo) HasGlobalData(key string) bool {
-	r.lckGlobal.RLock()
-	defer r.lckGlobal.RUnlock()
-
-	_, ok := r.getData(r.treeGlobalInfos, key)
-	return ok
-}
-
-func (r *RegInfo) RemoveGlobalData(key string) {
-	r.lckGlobal.Lock()
-	defer r.lckGlobal.Unlock()
-
-	r.removeData(r.treeGlobalInfos, key)
-}
-
-func (r *RegInfo) Load(filePath string) error {
-	// open file
-	f, err := os.Open(filePath)
-	if err != nil {
-		return err
-	}
-
-	defer f.Close()
-
-	// unmarshal json
-	savedInfo := &RegSavedInfo{
-		SrvInfos:          make([]*SrvInfo, 0),
-		MapGlobalKey2Data: make(map[string]string),
-	}
-
-	err = json.NewDecoder(f).Decode(savedInfo)
-	if err != nil {
-		return err
-	}
-
-	// unmarshal server informations
-	for _, srvInfo := range savedInfo.SrvInfos {
-		r.AddSrv(srvInfo.SrvType, srvInfo.SrvNo, srvInfo.IsTemp, srvInfo.DataBase64)
-	}
-
-	// unmarshal global informations
-	for key, val := range savedInfo.MapGlobalKey2Data {
-		r.SetGlobalData(key, val)
-	}
-
-	return nil
-}
-
-func (r *RegInfo) Save(filePath string) error {
-	r.lckSrv.RLock()
-	defer r.lckSrv.RUnlock()
-
-	r.lckGlobal.RLock()
-	defer r.lckGlobal.RUnlock()
-
-	savedInfo := NewRegSavedInfo()
-	r.marshalSrvInfos(savedInfo, true)
-	r.marshalGlobalInfos(savedInfo)
-
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return err
-	}
-
-	defer f.Close()
-
-	err = json.NewEncoder(f).Encode(savedInfo)
-	return err
-}
-
-func (r *RegInfo) Dump() {
-	r.lckSrv.RLock()
-	defer r.lckSrv.RUnlock()
-
-	r.lckGlobal.RLock()
-	defer r.lckGlobal.RUnlock()
-
-	savedInfo := NewRegSavedInfo()
-	r.marshalSrvInfos(savedInfo, false)
-	r.marshalGlobalInfos(savedInfo)
-	data, err := json.Marshal(savedInfo)
-	if err != nil {
-		return
-	}
-
-	r.logger.D(string(data))
-}
-
-func (r *RegInfo) setData(tree *MapTree, key string, data interface{}) error {
-	subPaths := ParseInfoPath(key)
-	if len(subPaths) == 0 {
-		return ErrEmptyPath
-	}
-
-	var parent *MapTreeNode = nil
-	ok := false
-	child := tree.root
-	for _, subPath := range subPaths {
-		parent = child
-		child, ok = parent.GetChild(subPath)
-		if !ok {
-			child = NewMapTreeNode()
-			parent.AddChild(subPath, child)
-		}
-	}
-
-	child.SetData(data)
-	return nil
-}
-
-func (r *RegInfo) getData(tree *MapTree, key string) (interface{}, bool) {
-	node, ok := r.getNode(tree, key)
-	if !ok {
-		return nil, false
-	}
-
-	return node.GetData(), true
-}
-
-func (r *RegInfo) removeData(tree *MapTree, key string) {
-	subPaths := ParseInfoPath(key)
-	if len(subPaths) == 0 {
-		return
-	}
-
-	ok := false
-	node := tree.root
-	for i, subPath := range subPaths {
-		if i == len(subPaths)-1 {
-			node.RemoveChild(subPath)
-			break
-		}
-
-		node, ok = node.GetChild(subPath)
-		if !ok {
-			break
-		}
-	}
-}
-
-func (r *RegInfo) getNode(tree *MapTree, key string) (*MapTreeNode, bool) {
-	subPaths := ParseInfoPath(key)
-	if len(subPaths) == 0 {
-		return nil, false
-	}
-
-	ok := false
-	node := tree.root
-	for _, subPath := range subPaths {
-		node, ok = node.GetChild(subPath)
-		if !ok {
-			return nil, false
-		}
-	}
-
-	return node, true
-}
-
-func (r *RegInfo) marshalSrvInfos(savedInfo *RegSavedInfo, bIgnoreTemp bool) {
-	r.visitSaveSrvInfos(savedInfo, bIgnoreTemp, "", r.treeSrvInfos.root)
-}
-
-func (r *RegInfo) visitSaveSrvInfos(savedInfo *RegSavedInfo, bIgnoreTemp bool, parentPath string, parentNode *MapTreeNode) {
-	if parentNode == nil {
-		return
-	}
-
-	d := parentNode.GetData()
-	if d != nil {
-		info := d.(*SrvInfo)
-		if !bIgnoreTemp || !info.IsTemp {
-			savedInfo.SrvInfos = append(savedInfo.SrvInfos, info)
-		}
-	}
-
-	childKeys := parentNode.AllChildKeys()
-	for _, key := range childKeys {
-		path := parentPath + "/" + key
-		childNode, _ := parentNode.GetChild(key)
-		r.visitSaveSrvInfos(savedInfo, bIgnoreTemp, path, childNode)
-	}
-}
-
-func (r *RegInfo) marshalGlobalInfos(savedInfo *RegSavedInfo) {
-	r.visitSaveGlobalInfos(savedInfo, "", r.treeGlobalInfos.root)
-}
-
-func (r *RegInfo) visitSaveGlobalInfos(savedInfo *RegSavedInfo, parentPath string, parentNode *MapTreeNode) {
-	if parentNode == nil {
-		return
-	}
-
-	d := parentNode.GetData()
-	if d != nil {
-		data := d.(string)
-		savedInfo.MapGlobalKey2Data[parentPath] = data
-	}
-
-	childKeys := parentNode.AllChildKeys()
-	for _, key := range childKeys {
-		path := parentPath + "/" + key
-		childNode, _ := parentNode.GetChild(key)
-		r.visitSaveGlobalInfos(savedInfo, path, childNode)
-	}
-}
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/yxlib/yx"
+)
+
+var (
+	ErrSrvNotExists        = errors.New("server not exists")
+	ErrGlobalDataNotExists = errors.New("global data not exists")
+	ErrEmptyPath           = errors.New("empty path")
+	ErrRevisionCompacted   = errors.New("revision compacted")
+	ErrFutureRevision      = errors.New("future revision")
+)
+
+const (
+	MAX_KEY_HISTORY = 16
+)
+
+type SrvInfo struct {
+	SrvType    uint32 `json:"type"`
+	SrvNo      uint32 `json:"no"`
+	IsTemp     bool   `json:"bTemp"`
+	DataBase64 string `json:"data"`
+	Health     int    `json:"health,omitempty"`
+	SrvMeta
+}
+
+// Clone return a deep copy of the server.
+func (i *SrvInfo) Clone() *SrvInfo {
+	info := *i
+	info.SrvMeta = i.SrvMeta.Clone()
+	return &info
+}
+
+type KeyRev struct {
+	CreateRev int64 `json:"create_rev"`
+	ModRev    int64 `json:"mod_rev"`
+}
+
+// RegSavedInfo is the save format of RegInfo, the revisions of the keys are kept
+// in MapKey2Rev by the record keys, e.g. "srv:/1/2" and "global:/a".
+type RegSavedInfo struct {
+	Rev               int64                    `json:"rev"`
+	SrvInfos          []*SrvInfo               `json:"srv"`
+	MapGlobalKey2Data map[string]string        `json:"global"`
+	MapKey2Rev        map[string]KeyRev        `json:"key_rev,omitempty"`
+	Namespaces        map[string]*RegSavedInfo `json:"ns,omitempty"`
+	Watches           []*SavedWatch            `json:"watch,omitempty"`
+}
+
+func NewRegSavedInfo() *RegSavedInfo {
+	return &RegSavedInfo{
+		SrvInfos:          make([]*SrvInfo, 0),
+		MapGlobalKey2Data: make(map[string]string),
+		MapKey2Rev:        make(map[string]KeyRev),
+	}
+}
+
+func (i *RegSavedInfo) IsEmpty() bool {
+	return len(i.SrvInfos) == 0 && len(i.MapGlobalKey2Data) == 0
+}
+
+// the kinds of the saved watches
+const (
+	SAVED_WATCH_KIND_INFO = 1 + iota
+	SAVED_WATCH_KIND_SELECTOR
+	SAVED_WATCH_KIND_CONN
+)
+
+// SavedWatch is a watch registration kept in the save format,
+// Key is qualified by GetNsKey and tagged by the key type.
+type SavedWatch struct {
+	Kind         int      `json:"kind"`
+	Key          string   `json:"key,omitempty"`
+	Namespace    string   `json:"ns,omitempty"`
+	SrvType      uint32   `json:"type,omitempty"`
+	ByType       bool     `json:"by_type,omitempty"`
+	Selector     string   `json:"selector,omitempty"`
+	ObserverType uint32   `json:"observer_type"`
+	ObserverNo   uint32   `json:"observer_no"`
+	Opt          WatchOpt `json:"opt"`
+}
+
+// RegInfo hold the servers and the global data of a namespace, the RegInfo of
+// the default namespace is the root which hold the other namespaces and the revision
+// shared by all of them. Load, Save, Dump, GetRecords and Restore of the root
+// cover all the namespaces.
+type RegInfo struct {
+	revision        int64
+	namespace       string
+	root            *RegInfo
+	quota           *NamespaceQuota
+	treeSrvInfos    *MapTree
+	srvNum          int
+	lckSrv          *sync.RWMutex
+	treeGlobalInfos *MapTree
+	globalNum       int
+	lckGlobal       *sync.RWMutex
+	mapNs2Info      map[string]*RegInfo
+	lckNs           *sync.RWMutex
+	savedWatches    []*SavedWatch
+	bWatchChanged   bool
+	lckWatch        *sync.Mutex
+	logger          *yx.Logger
+}
+
+func NewRegInfo() *RegInfo {
+	r := newNsRegInfo(DEFAULT_NAMESPACE, nil)
+	r.root = r
+	r.mapNs2Info = make(map[string]*RegInfo)
+	r.lckNs = &sync.RWMutex{}
+	r.lckWatch = &sync.Mutex{}
+	return r
+}
+
+func newNsRegInfo(ns string, root *RegInfo) *RegInfo {
+	return &RegInfo{
+		revision:        0,
+		namespace:       ns,
+		root:            root,
+		quota:           nil,
+		treeSrvInfos:    NewMapTree(),
+		srvNum:          0,
+		lckSrv:          &sync.RWMutex{},
+		treeGlobalInfos: NewMapTree(),
+		globalNum:       0,
+		lckGlobal:       &sync.RWMutex{},
+		mapNs2Info:      nil,
+		lckNs:           nil,
+		savedWatches:    nil,
+		bWatchChanged:   false,
+		lckWatch:        nil,
+		logger:          yx.NewLogger("RegInfo"),
+	}
+}
+
+func (r *RegInfo) GetRevision() int64 {
+	return atomic.LoadInt64(&r.root.revision)
+}
+
+func (r *RegInfo) GetNamespaceName() string {
+	return r.namespace
+}
+
+// GetNamespace return the RegInfo of the namespace, an empty RegInfo which is not kept
+// by the root is returned if the namespace not exists, so the reads never add a namespace.
+func (r *RegInfo) GetNamespace(ns string) *RegInfo {
+	root := r.root
+	if ns == DEFAULT_NAMESPACE {
+		return root
+	}
+
+	root.lckNs.RLock()
+	info, ok := root.mapNs2Info[ns]
+	root.lckNs.RUnlock()
+	if ok {
+		return info
+	}
+
+	return newNsRegInfo(ns, root)
+}
+
+// addNamespace return the RegInfo of the namespace, it is created if not exists.
+func (r *RegInfo) addNamespace(ns string) *RegInfo {
+	root := r.root
+	if ns == DEFAULT_NAMESPACE {
+		return root
+	}
+
+	root.lckNs.RLock()
+	info, ok := root.mapNs2Info[ns]
+	root.lckNs.RUnlock()
+	if ok {
+		return info
+	}
+
+	root.lckNs.Lock()
+	defer root.lckNs.Unlock()
+
+	info, ok = root.mapNs2Info[ns]
+	if !ok {
+		info = newNsRegInfo(ns, root)
+		root.mapNs2Info[ns] = info
+	}
+
+	return info
+}
+
+// GetAllNamespaces return the RegInfo of all the namespaces, the default namespace is the first.
+func (r *RegInfo) GetAllNamespaces() []*RegInfo {
+	root := r.root
+
+	root.lckNs.RLock()
+	defer root.lckNs.RUnlock()
+
+	infos := make([]*RegInfo, 0, len(root.mapNs2Info)+1)
+	infos = append(infos, root)
+	for _, info := range root.mapNs2Info {
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// SetQuota limit the number of the keys in the namespace, nil means no limit.
+// The quota is only checked when a new key is added, the replayed logs and snapshots are not limited.
+// In cluster mode it must be set by REG_CMD_SET_QUOTA, so all the members check the same quota.
+func (r *RegInfo) SetQuota(quota *NamespaceQuota) {
+	r.lckSrv.Lock()
+	defer r.lckSrv.Unlock()
+
+	r.lckGlobal.Lock()
+	defer r.lckGlobal.Unlock()
+
+	r.quota = quota
+}
+
+// GetAllQuotas return the quotas of all the namespaces which are limited.
+func (r *RegInfo) GetAllQuotas() map[string]*NamespaceQuota {
+	mapNs2Quota := make(map[string]*NamespaceQuota)
+	for _, info := range r.GetAllNamespaces() {
+		info.lckSrv.RLock()
+		if info.quota != nil {
+			mapNs2Quota[info.namespace] = info.quota
+		}
+
+		info.lckSrv.RUnlock()
+	}
+
+	return mapNs2Quota
+}
+
+// ResetQuotas replace the quotas of all the namespaces, the namespaces not in mapNs2Quota are not limited.
+func (r *RegInfo) ResetQuotas(mapNs2Quota map[string]*NamespaceQuota) {
+	for ns := range mapNs2Quota {
+		r.addNamespace(ns)
+	}
+
+	for _, info := range r.GetAllNamespaces() {
+		info.SetQuota(mapNs2Quota[info.namespace])
+	}
+}
+
+func (r *RegInfo) AddSrv(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string) (*DataOprPush, error) {
+	return r.AddSrvWithMeta(srvType, srvNo, bTemp, dataBase64, nil)
+}
+
+func (r *RegInfo) AddSrvWithMeta(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string, meta *SrvMeta) (*DataOprPush, error) {
+	r.lckSrv.Lock()
+	defer r.lckSrv.Unlock()
+
+	info := &SrvInfo{
+		SrvType:    srvType,
+		SrvNo:      srvNo,
+		IsTemp:     bTemp,
+		DataBase64: dataBase64,
+	}
+
+	if meta != nil {
+		info.SrvMeta = *meta
+	}
+
+	key := GetSrvKey(srvType, srvNo)
+	err := r.checkSrvQuota(key, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.setSrv(key, info, r.nextRevision())
+}
+
+// RemoveSrv remove the server, the first push is of the server, followed by the pushes of the removed descendants.
+func (r *RegInfo) RemoveSrv(srvType uint32, srvNo uint32) ([]*DataOprPush, bool) {
+	r.lckSrv.Lock()
+	defer r.lckSrv.Unlock()
+
+	key := GetSrvKey(srvType, srvNo)
+	if _, ok := r.getNode(r.treeSrvInfos, key); !ok {
+		return nil, false
+	}
+
+	return r.removeSrv(key, r.nextRevision())
+}
+
+func (r *RegInfo) IsTempSrv(srvType uint32, srvNo uint32) (bool, error) {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	key := GetSrvKey(srvType, srvNo)
+	data, ok := r.getData(r.treeSrvInfos, key)
+	if !ok {
+		return false, ErrSrvNotExists
+	}
+
+	info := data.(*SrvInfo)
+	return info.IsTemp, nil
+}
+
+func (r *RegInfo) HasSrv(srvType uint32, srvNo uint32) bool {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	key := GetSrvKey(srvType, srvNo)
+	_, ok := r.getData(r.treeSrvInfos, key)
+	return ok
+}
+
+func (r *RegInfo) GetSrvData(srvType uint32, srvNo uint32) (string, bool) {
+	info, ok := r.GetSrvInfo(srvType, srvNo)
+	return info.DataBase64, ok
+}
+
+func (r *RegInfo) GetSrvInfo(srvType uint32, srvNo uint32) (*SrvInfo, bool) {
+	key := GetSrvKey(srvType, srvNo)
+	info, ok := r.GetSrvInfoByKey(key)
+	return info, ok
+}
+
+func (r *RegInfo) GetSrvInfoByKey(key string) (*SrvInfo, bool) {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	data, ok := r.getData(r.treeSrvInfos, key)
+	if !ok {
+		return nil, false
+	}
+
+	info := data.(*SrvInfo)
+	return info, true
+}
+
+func (r *RegInfo) GetSrvInfoAtRev(srvType uint32, srvNo uint32, rev int64) (*SrvInfo, KeyRev, error) {
+	key := GetSrvKey(srvType, srvNo)
+	return r.GetSrvInfoByKeyAtRev(key, rev)
+}
+
+func (r *RegInfo) GetSrvInfoByKeyAtRev(key string, rev int64) (*SrvInfo, KeyRev, error) {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	data, kr, err := r.getDataAtRev(r.treeSrvInfos, key, rev)
+	if err == ErrMTRevNotExists {
+		return nil, kr, ErrSrvNotExists
+	} else if err != nil {
+		return nil, kr, err
+	}
+
+	info := data.(*SrvInfo)
+	return info, kr, nil
+}
+
+func (r *RegInfo) SetSrvData(srvType uint32, srvNo uint32, dataBase64 string) (*DataOprPush, error) {
+	return r.SetSrvDataWithMeta(srvType, srvNo, dataBase64, nil)
+}
+
+// SetSrvDataWithMeta set the data and merge the meta by SrvMeta.Merge, the meta is kept if it is nil.
+func (r *RegInfo) SetSrvDataWithMeta(srvType uint32, srvNo uint32, dataBase64 string, meta *SrvMeta) (*DataOprPush, error) {
+	r.lckSrv.Lock()
+	defer r.lckSrv.Unlock()
+
+	key := GetSrvKey(srvType, srvNo)
+	d, ok := r.getData(r.treeSrvInfos, key)
+	if !ok || d == nil {
+		return nil, ErrSrvNotExists
+	}
+
+	// copy on write, the old value is kept in history
+	info := *(d.(*SrvInfo))
+	info.DataBase64 = dataBase64
+	if meta != nil {
+		info.SrvMeta.Merge(meta)
+	}
+
+	return r.setSrv(key, &info, r.nextRevision())
+}
+
+// CompareAndSetSrv set the server only if cmp matches,
+// otherwise ErrCompareFailed is returned with a push of the current value.
+// The meta of an existing server is kept if meta is nil.
+func (r *RegInfo) CompareAndSetSrv(srvType uint32, srvNo uint32, bTemp bool, dataBase64 string, meta *SrvMeta, cmp *Compare) (*DataOprPush, error) {
+	if cmp == nil || !cmp.IsValid() {
+		return nil, ErrInvalidCompare
+	}
+
+	r.lckSrv.Lock()
+	defer r.lckSrv.Unlock()
+
+	key := GetSrvKey(srvType, srvNo)
+	d, kr, err := r.getDataAtRev(r.treeSrvInfos, key, 0)
+	bExists := (err == nil)
+
+	var curInfo *SrvInfo = nil
+	curData := ""
+	if bExists {
+		curInfo = d.(*SrvInfo)
+		curData = curInfo.DataBase64
+	}
+
+	if !cmp.IsMatch(bExists, curData, kr) {
+		pushData := r.newDataOprPush(KEY_TYPE_SRV_INFO, key, 0, kr)
+		pushData.Srv = curInfo
+		return pushData, ErrCompareFailed
+	}
+
+	err = r.checkSrvQuota(key, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &SrvInfo{
+		SrvType:    srvType,
+		SrvNo:      srvNo,
+		IsTemp:     bTemp,
+		DataBase64: dataBase64,
+	}
+
+	if bExists {
+		copyInfo := *curInfo
+		copyInfo.DataBase64 = dataBase64
+		info = &copyInfo
+	}
+
+	if meta != nil && bExists {
+		info.SrvMeta.Merge(meta)
+	} else if meta != nil {
+		info.SrvMeta = *meta
+	}
+
+	return r.setSrv(key, info, r.nextRevision())
+}
+
+// SetSrvStatus set the status of the server and keep the other meta,
+// the push is nil if the status is not changed.
+func (r *RegInfo) SetSrvStatus(srvType uint32, srvNo uint32, status string) (*DataOprPush, error) {
+	r.lckSrv.Lock()
+	defer r.lckSrv.Unlock()
+
+	key := GetSrvKey(srvType, srvNo)
+	d, ok := r.getData(r.treeSrvInfos, key)
+	if !ok || d == nil {
+		return nil, ErrSrvNotExists
+	}
+
+	info := *(d.(*SrvInfo))
+	if info.Status == status {
+		return nil, nil
+	}
+
+	info.Status = status
+	return r.setSrv(key, &info, r.nextRevision())
+}
+
+// SetSrvHealth set the health status of the server, the push is nil if the status is not changed.
+func (r *RegInfo) SetSrvHealth(srvType uint32, srvNo uint32, health int) (*DataOprPush, error) {
+	r.lckSrv.Lock()
+	defer r.lckSrv.Unlock()
+
+	key := GetSrvKey(srvType, srvNo)
+	d, ok := r.getData(r.treeSrvInfos, key)
+	if !ok || d == nil {
+		return nil, ErrSrvNotExists
+	}
+
+	info := *(d.(*SrvInfo))
+	if info.Health == health {
+		return nil, nil
+	}
+
+	info.Health = health
+	pushData, err := r.setSrv(key, &info, r.nextRevision())
+	if err != nil {
+		return nil, err
+	}
+
+	pushData.Operate = DATA_OPR_TYPE_HEALTH
+	return pushData, nil
+}
+
+func (r *RegInfo) GetAllSrvNos(srvType uint32) ([]uint32, bool) {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	key := GetSrvTypeKey(srvType)
+	node, ok := r.getNode(r.treeSrvInfos, key)
+	if !ok {
+		return nil, false
+	}
+
+	childKeys := node.AllChildKeys()
+	srvNos := make([]uint32, 0, len(childKeys))
+	for _, childKey := range childKeys {
+		no, _ := strconv.ParseUint(childKey, 10, 16)
+		srvNos = append(srvNos, uint32(no))
+	}
+
+	return srvNos, true
+}
+
+func (r *RegInfo) GetAllSrvInfos(srvType uint32) ([]*SrvInfo, bool) {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	key := GetSrvTypeKey(srvType)
+	node, ok := r.getNode(r.treeSrvInfos, key)
+	if !ok {
+		return nil, false
+	}
+
+	childs := node.AllChilds()
+	srvInfos := make([]*SrvInfo, 0, len(childs))
+	for _, child := range childs {
+		d := child.GetData()
+		info := d.(*SrvInfo)
+		srvInfos = append(srvInfos, info)
+	}
+
+	return srvInfos, true
+}
+
+// GetAllSrvInfosWithRev return the servers of the type with their revisions by index.
+func (r *RegInfo) GetAllSrvInfosWithRev(srvType uint32) ([]*SrvInfo, []KeyRev, bool) {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	key := GetSrvTypeKey(srvType)
+	node, ok := r.getNode(r.treeSrvInfos, key)
+	if !ok {
+		return nil, nil, false
+	}
+
+	childs := node.AllChilds()
+	srvInfos := make([]*SrvInfo, 0, len(childs))
+	revs := make([]KeyRev, 0, len(childs))
+	for _, child := range childs {
+		d := child.GetData()
+		info := d.(*SrvInfo)
+		srvInfos = append(srvInfos, info)
+		revs = append(revs, KeyRev{CreateRev: child.GetCreateRev(), ModRev: child.GetModRev()})
+	}
+
+	return srvInfos, revs, true
+}
+
+// FindSrvInfos return the servers which match, all the types are searched if bByType is false.
+func (r *RegInfo) FindSrvInfos(srvType uint32, bByType bool, match func(info *SrvInfo) bool) []*SrvInfo {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	typeNodes := make([]*MapTreeNode, 0)
+	if bByType {
+		node, ok := r.getNode(r.treeSrvInfos, GetSrvTypeKey(srvType))
+		if ok {
+			typeNodes = append(typeNodes, node)
+		}
+	} else {
+		typeNodes = append(typeNodes, r.treeSrvInfos.GetRoot().AllChilds()...)
+	}
+
+	srvInfos := make([]*SrvInfo, 0)
+	for _, typeNode := range typeNodes {
+		for _, child := range typeNode.AllChilds() {
+			d := child.GetData()
+			if d == nil {
+				continue
+			}
+
+			info := d.(*SrvInfo)
+			if match(info) {
+				srvInfos = append(srvInfos, info)
+			}
+		}
+	}
+
+	return srvInfos
+}
+
+func (r *RegInfo) SetGlobalData(key string, data string) (*DataOprPush, error) {
+	r.lckGlobal.Lock()
+	defer r.lckGlobal.Unlock()
+
+	if len(ParseInfoPath(key)) == 0 {
+		return nil, ErrEmptyPath
+	}
+
+	err := checkNsKey(r.namespace, key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.checkGlobalQuota(key, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.setGlobal(key, data, r.nextRevision())
+}
+
+// CompareAndSetGlobalData set the global data only if cmp matches,
+// otherwise ErrCompareFailed is returned with a push of the current value.
+func (r *RegInfo) CompareAndSetGlobalData(key string, data string, cmp *Compare) (*DataOprPush, error) {
+	if cmp == nil || !cmp.IsValid() {
+		return nil, ErrInvalidCompare
+	}
+
+	if len(ParseInfoPath(key)) == 0 {
+		return nil, ErrEmptyPath
+	}
+
+	err := checkNsKey(r.namespace, key)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lckGlobal.Lock()
+	defer r.lckGlobal.Unlock()
+
+	d, kr, err := r.getDataAtRev(r.treeGlobalInfos, key, 0)
+	bExists := (err == nil)
+
+	curData := ""
+	if bExists {
+		curData = d.(string)
+	}
+
+	if !cmp.IsMatch(bExists, curData, kr) {
+		pushData := r.newDataOprPush(KEY_TYPE_GLOBAL_DATA, key, 0, kr)
+		pushData.DataBase64 = curData
+		return pushData, ErrCompareFailed
+	}
+
+	err = r.checkGlobalQuota(key, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.setGlobal(key, data, r.nextRevision())
+}
+
+func (r *RegInfo) GetGlobalData(key string) (string, bool) {
+	r.lckGlobal.RLock()
+	defer r.lckGlobal.RUnlock()
+
+	data, ok := r.getData(r.treeGlobalInfos, key)
+	if !ok || data == nil {
+		return "", false
+	}
+
+	return data.(string), ok
+}
+
+func (r *RegInfo) GetGlobalDataAtRev(key string, rev int64) (string, KeyRev, error) {
+	r.lckGlobal.RLock()
+	defer r.lckGlobal.RUnlock()
+
+	data, kr, err := r.getDataAtRev(r.treeGlobalInfos, key, rev)
+	if err == ErrMTRevNotExists {
+		return "", kr, ErrGlobalDataNotExists
+	} else if err != nil {
+		return "", kr, err
+	}
+
+	return data.(string), kr, nil
+}
+
+func (r *RegInfo) HasGlobalData(key string) bool {
+	r.lckGlobal.RLock()
+	defer r.lckGlobal.RUnlock()
+
+	_, ok := r.getData(r.treeGlobalInfos, key)
+	return ok
+}
+
+// GetAllGlobalData return the global data of the key and all its descendants.
+func (r *RegInfo) GetAllGlobalData(key string) map[string]string {
+	r.lckGlobal.RLock()
+	defer r.lckGlobal.RUnlock()
+
+	savedInfo := NewRegSavedInfo()
+	node, ok := r.getNode(r.treeGlobalInfos, key)
+	if ok {
+		r.visitSaveGlobalInfos(savedInfo, key, node)
+	}
+
+	return savedInfo.MapGlobalKey2Data
+}
+
+// RemoveGlobalData remove the global data with its descendants,
+// the first push is of the key, followed by the pushes of the removed descendants.
+func (r *RegInfo) RemoveGlobalData(key string) ([]*DataOprPush, bool) {
+	r.lckGlobal.Lock()
+	defer r.lckGlobal.Unlock()
+
+	if _, ok := r.getNode(r.treeGlobalInfos, key); !ok {
+		return nil, false
+	}
+
+	return r.removeGlobal(key, r.nextRevision())
+}
+
+// Txn check all the compares, then apply thenOps if all of them matched, or elseOps if not.
+// All the operations share one revision and are applied under both locks,
+// the returned push list is in the same order of the operations,
+// the pushes of the descendants removed with a key follow the push of the key.
+// No revision is used if none of the operations changes anything.
+func (r *RegInfo) Txn(cmps []*TxnCompare, thenOps []*TxnOp, elseOps []*TxnOp) (bool, []*DataOprPush, error) {
+	for _, cmp := range cmps {
+		if cmp == nil || !cmp.IsValid() {
+			return false, nil, ErrInvalidCompare
+		}
+	}
+
+	for _, ops := range [][]*TxnOp{thenOps, elseOps} {
+		for _, op := range ops {
+			if op == nil || !op.IsValid() {
+				return false, nil, ErrInvalidTxnOp
+			}
+
+			if op.Type == TXN_OP_UPDATE_GLOBAL_DATA {
+				err := checkNsKey(r.namespace, op.GetKey())
+				if err != nil {
+					return false, nil, err
+				}
+			}
+		}
+	}
+
+	r.lckSrv.Lock()
+	defer r.lckSrv.Unlock()
+
+	r.lckGlobal.Lock()
+	defer r.lckGlobal.Unlock()
+
+	bSucc := true
+	for _, cmp := range cmps {
+		if !r.isTxnCompareMatch(cmp) {
+			bSucc = false
+			break
+		}
+	}
+
+	ops := thenOps
+	if !bSucc {
+		ops = elseOps
+	}
+
+	pushList := make([]*DataOprPush, 0, len(ops))
+	if len(ops) == 0 {
+		return bSucc, pushList, nil
+	}
+
+	err := r.checkTxnQuota(ops)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if !r.isTxnChanging(ops) {
+		return bSucc, pushList, nil
+	}
+
+	rev := r.nextRevision()
+	for _, op := range ops {
+		opPushList, ok := r.applyTxnOp(op, rev)
+		if ok {
+			pushList = append(pushList, opPushList...)
+		}
+	}
+
+	return bSucc, pushList, nil
+}
+
+func (r *RegInfo) Load(filePath string) error {
+	// open file
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	// unmarshal json
+	savedInfo := &RegSavedInfo{
+		SrvInfos:          make([]*SrvInfo, 0),
+		MapGlobalKey2Data: make(map[string]string),
+	}
+
+	err = json.NewDecoder(f).Decode(savedInfo)
+	if err != nil {
+		return err
+	}
+
+	r.loadSavedInfo(savedInfo)
+	for ns, nsSavedInfo := range savedInfo.Namespaces {
+		r.addNamespace(ns).loadSavedInfo(nsSavedInfo)
+	}
+
+	r.lckWatch.Lock()
+	r.savedWatches = savedInfo.Watches
+	r.lckWatch.Unlock()
+
+	// keep revision monotonic across restarts
+	r.updateRevision(savedInfo.Rev)
+
+	return nil
+}
+
+// SetSavedWatches set the watches saved with the registry, they are only kept by the root.
+func (r *RegInfo) SetSavedWatches(watches []*SavedWatch) {
+	r.root.lckWatch.Lock()
+	defer r.root.lckWatch.Unlock()
+
+	r.root.savedWatches = watches
+	r.root.bWatchChanged = true
+}
+
+// GetSavedWatches return the watches set by SetSavedWatches or loaded by Load.
+func (r *RegInfo) GetSavedWatches() []*SavedWatch {
+	r.root.lckWatch.Lock()
+	defer r.root.lckWatch.Unlock()
+
+	return r.root.savedWatches
+}
+
+// IsWatchChanged check if the saved watches are changed after the last Save.
+func (r *RegInfo) IsWatchChanged() bool {
+	r.root.lckWatch.Lock()
+	defer r.root.lckWatch.Unlock()
+
+	return r.root.bWatchChanged
+}
+
+// Save save the servers which are not temporary, the global data of all the namespaces and the saved watches.
+func (r *RegInfo) Save(filePath string) error {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	r.lckGlobal.RLock()
+	defer r.lckGlobal.RUnlock()
+
+	savedInfo := NewRegSavedInfo()
+	savedInfo.Rev = r.GetRevision()
+	r.marshalSrvInfos(savedInfo, true)
+	r.marshalGlobalInfos(savedInfo)
+	savedInfo.Namespaces = r.marshalNamespaces(true)
+
+	r.lckWatch.Lock()
+	savedInfo.Watches = r.savedWatches
+	r.bWatchChanged = false
+	r.lckWatch.Unlock()
+
+	data, err := json.Marshal(savedInfo)
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(filePath, data)
+}
+
+// ApplyDataOpr apply an operation with its revision to the namespace of the push,
+// it is used to replay the logs.
+func (r *RegInfo) ApplyDataOpr(pushData *DataOprPush) error {
+	if pushData.Namespace != r.namespace {
+		return r.addNamespace(pushData.Namespace).ApplyDataOpr(pushData)
+	}
+
+	var err error = nil
+
+	if pushData.KeyType == KEY_TYPE_SRV_INFO {
+		r.lckSrv.Lock()
+		defer r.lckSrv.Unlock()
+
+		if pushData.Operate != DATA_OPR_TYPE_REMOVE {
+			if pushData.Srv == nil {
+				return ErrSrvNotExists
+			}
+
+			srvInfo := *pushData.Srv
+			_, err = r.setSrv(pushData.Key, &srvInfo, pushData.ModRev)
+			if err == nil {
+				r.restoreCreateRev(r.treeSrvInfos, pushData)
+			}
+		} else {
+			r.removeSrv(pushData.Key, pushData.ModRev)
+		}
+
+	} else {
+		r.lckGlobal.Lock()
+		defer r.lckGlobal.Unlock()
+
+		if pushData.Operate == DATA_OPR_TYPE_UPDATE {
+			_, err = r.setGlobal(pushData.Key, pushData.DataBase64, pushData.ModRev)
+			if err == nil {
+				r.restoreCreateRev(r.treeGlobalInfos, pushData)
+			}
+		} else {
+			r.removeGlobal(pushData.Key, pushData.ModRev)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	r.updateRevision(pushData.ModRev)
+	return nil
+}
+
+// restoreCreateRev set the create revision of the record, the records before it
+// may be compacted by the store.
+func (r *RegInfo) restoreCreateRev(tree *MapTree, pushData *DataOprPush) {
+	if pushData.CreateRev <= 0 {
+		return
+	}
+
+	node, ok := r.getNode(tree, pushData.Key)
+	if ok {
+		node.SetCreateRev(pushData.CreateRev)
+	}
+}
+
+// GetRecords return the current revision and a record of every key of all the namespaces,
+// temporary servers included.
+func (r *RegInfo) GetRecords() (int64, []*DataOprPush) {
+	rev := r.GetRevision()
+	records := make([]*DataOprPush, 0)
+	for _, info := range r.GetAllNamespaces() {
+		records = append(records, info.getRecords()...)
+	}
+
+	return rev, records
+}
+
+func (r *RegInfo) getRecords() []*DataOprPush {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	r.lckGlobal.RLock()
+	defer r.lckGlobal.RUnlock()
+
+	records := make([]*DataOprPush, 0)
+	r.visitRecords(&records, KEY_TYPE_SRV_INFO, "", r.treeSrvInfos.root)
+	r.visitRecords(&records, KEY_TYPE_GLOBAL_DATA, "", r.treeGlobalInfos.root)
+	return records
+}
+
+// Restore replace all the data of all the namespaces with the records got from GetRecords,
+// and return the pushes of the keys which are changed.
+func (r *RegInfo) Restore(rev int64, records []*DataOprPush) []*DataOprPush {
+	mapNs2Records := make(map[string][]*DataOprPush)
+	for _, rec := range records {
+		mapNs2Records[rec.Namespace] = append(mapNs2Records[rec.Namespace], rec)
+	}
+
+	for ns := range mapNs2Records {
+		r.addNamespace(ns)
+	}
+
+	atomic.StoreInt64(&r.root.revision, rev)
+
+	pushList := make([]*DataOprPush, 0)
+	for _, info := range r.GetAllNamespaces() {
+		pushList = append(pushList, info.restore(rev, mapNs2Records[info.namespace])...)
+	}
+
+	return pushList
+}
+
+func (r *RegInfo) restore(rev int64, records []*DataOprPush) []*DataOprPush {
+	r.lckSrv.Lock()
+	defer r.lckSrv.Unlock()
+
+	r.lckGlobal.Lock()
+	defer r.lckGlobal.Unlock()
+
+	oldRecords := make([]*DataOprPush, 0)
+	r.visitRecords(&oldRecords, KEY_TYPE_SRV_INFO, "", r.treeSrvInfos.root)
+	r.visitRecords(&oldRecords, KEY_TYPE_GLOBAL_DATA, "", r.treeGlobalInfos.root)
+
+	mapKey2Old := make(map[string]*DataOprPush)
+	for _, rec := range oldRecords {
+		mapKey2Old[rec.GetRecordKey()] = rec
+	}
+
+	r.treeSrvInfos = NewMapTree()
+	r.treeGlobalInfos = NewMapTree()
+
+	pushList := make([]*DataOprPush, 0)
+	for _, rec := range records {
+		tree := r.treeGlobalInfos
+		var data interface{} = rec.DataBase64
+		if rec.KeyType == KEY_TYPE_SRV_INFO {
+			tree = r.treeSrvInfos
+			data = rec.Srv
+		}
+
+		_, _, err := r.setDataWithRev(tree, rec.Key, data, rec.ModRev)
+		if err != nil {
+			continue
+		}
+
+		node, _ := r.getNode(tree, rec.Key)
+		node.SetCreateRev(rec.CreateRev)
+
+		recordKey := rec.GetRecordKey()
+		old, ok := mapKey2Old[recordKey]
+		delete(mapKey2Old, recordKey)
+		if !ok || old.ModRev != rec.ModRev {
+			pushData := r.newDataOprPush(rec.KeyType, rec.Key, DATA_OPR_TYPE_UPDATE, rec.KeyRev)
+			if ok {
+				pushData.SetValue(data, old.GetValue())
+			} else {
+				pushData.SetValue(data, nil)
+			}
+
+			pushList = append(pushList, pushData)
+		}
+	}
+
+	r.srvNum = countNodeData(r.treeSrvInfos.root)
+	r.globalNum = countNodeData(r.treeGlobalInfos.root)
+
+	for _, old := range mapKey2Old {
+		pushData := r.newDataOprPush(old.KeyType, old.Key, DATA_OPR_TYPE_REMOVE, KeyRev{CreateRev: old.CreateRev, ModRev: rev})
+		pushData.SetValue(nil, old.GetValue())
+		pushList = append(pushList, pushData)
+	}
+
+	return pushList
+}
+
+func (r *RegInfo) Dump() {
+	r.lckSrv.RLock()
+	defer r.lckSrv.RUnlock()
+
+	r.lckGlobal.RLock()
+	defer r.lckGlobal.RUnlock()
+
+	savedInfo := NewRegSavedInfo()
+	savedInfo.Rev = r.GetRevision()
+	r.marshalSrvInfos(savedInfo, false)
+	r.marshalGlobalInfos(savedInfo)
+	savedInfo.Namespaces = r.marshalNamespaces(false)
+	data, err := json.Marshal(savedInfo)
+	if err != nil {
+		return
+	}
+
+	r.logger.D(string(data))
+}
+
+func (r *RegInfo) nextRevision() int64 {
+	return atomic.AddInt64(&r.root.revision, 1)
+}
+
+func (r *RegInfo) updateRevision(rev int64) {
+	for {
+		curRev := atomic.LoadInt64(&r.root.revision)
+		if rev <= curRev || atomic.CompareAndSwapInt64(&r.root.revision, curRev, rev) {
+			break
+		}
+	}
+}
+
+func (r *RegInfo) setDataWithRev(tree *MapTree, key string, data interface{}, rev int64) (KeyRev, interface{}, error) {
+	subPaths := ParseInfoPath(key)
+	if len(subPaths) == 0 {
+		return KeyRev{}, nil, ErrEmptyPath
+	}
+
+	var parent *MapTreeNode = nil
+	ok := false
+	child := tree.root
+	for _, subPath := range subPaths {
+		parent = child
+		child, ok = parent.GetChild(subPath)
+		if !ok {
+			child = NewMapTreeNode()
+			parent.AddChild(subPath, child)
+		}
+	}
+
+	prev := child.GetData()
+	child.UpdateData(data, rev, MAX_KEY_HISTORY)
+	return KeyRev{CreateRev: child.GetCreateRev(), ModRev: rev}, prev, nil
+}
+
+func (r *RegInfo) getData(tree *MapTree, key string) (interface{}, bool) {
+	node, ok := r.getNode(tree, key)
+	if !ok {
+		return nil, false
+	}
+
+	return node.GetData(), true
+}
+
+func (r *RegInfo) getDataAtRev(tree *MapTree, key string, rev int64) (interface{}, KeyRev, error) {
+	node, ok := r.getNode(tree, key)
+	if !ok {
+		return nil, KeyRev{}, ErrMTRevNotExists
+	}
+
+	if rev <= 0 {
+		data := node.GetData()
+		if data == nil {
+			return nil, KeyRev{}, ErrMTRevNotExists
+		}
+
+		return data, KeyRev{CreateRev: node.GetCreateRev(), ModRev: node.GetModRev()}, nil
+	}
+
+	if rev > r.GetRevision() {
+		return nil, KeyRev{}, ErrFutureRevision
+	}
+
+	data, modRev, err := node.GetDataAtRev(rev)
+	if err == ErrMTRevCompacted {
+		return nil, KeyRev{}, ErrRevisionCompacted
+	} else if err != nil {
+		return nil, KeyRev{}, err
+	}
+
+	return data, KeyRev{CreateRev: node.GetCreateRev(), ModRev: modRev}, nil
+}
+
+// removedData is a data removed with its key and revisions.
+type removedData struct {
+	key  string
+	kr   KeyRev
+	data interface{}
+}
+
+// removeDataWithRev remove the node of the key with its subtree, and return the removed data,
+// the first one is of the key, which may be nil, then the data of the descendants.
+func (r *RegInfo) removeDataWithRev(tree *MapTree, key string, rev int64) ([]*removedData, bool) {
+	subPaths := ParseInfoPath(key)
+	if len(subPaths) == 0 {
+		return nil, false
+	}
+
+	ok := false
+	node := tree.root
+	for i, subPath := range subPaths {
+		if i == len(subPaths)-1 {
+			child, ok := node.GetChild(subPath)
+			if !ok {
+				break
+			}
+
+			node.RemoveChild(subPath)
+			removedList := []*removedData{{
+				key:  key,
+				kr:   KeyRev{CreateRev: child.GetCreateRev(), ModRev: rev},
+				data: child.GetData(),
+			}}
+
+			return collectRemovedData(removedList, child, key, rev), true
+		}
+
+		node, ok = node.GetChild(subPath)
+		if !ok {
+			break
+		}
+	}
+
+	return nil, false
+}
+
+// collectRemovedData append the data of the descendants of the node.
+func collectRemovedData(removedList []*removedData, node *MapTreeNode, key string, rev int64) []*removedData {
+	for _, subPath := range node.AllChildKeys() {
+		child, _ := node.GetChild(subPath)
+		childKey := key + "/" + subPath
+		if child.GetData() != nil {
+			removedList = append(removedList, &removedData{
+				key:  childKey,
+				kr:   KeyRev{CreateRev: child.GetCreateRev(), ModRev: rev},
+				data: child.GetData(),
+			})
+		}
+
+		removedList = collectRemovedData(removedList, child, childKey, rev)
+	}
+
+	return removedList
+}
+
+// newRemovePushList return a push of DATA_OPR_TYPE_REMOVE for each removed data,
+// so the watchers, the event log and the store get the removed descendants too.
+func (r *RegInfo) newRemovePushList(keyType int, removedList []*removedData) ([]*DataOprPush, int) {
+	pushList := make([]*DataOprPush, 0, len(removedList))
+	num := 0
+	for _, removed := range removedList {
+		if removed.data != nil {
+			num++
+		}
+
+		pushData := r.newDataOprPush(keyType, removed.key, DATA_OPR_TYPE_REMOVE, removed.kr)
+		pushData.SetValue(nil, removed.data)
+		pushList = append(pushList, pushData)
+	}
+
+	return pushList, num
+}
+
+func (r *RegInfo) setSrv(key string, info *SrvInfo, rev int64) (*DataOprPush, error) {
+	kr, prev, err := r.setDataWithRev(r.treeSrvInfos, key, info, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev == nil {
+		r.srvNum++
+	}
+
+	pushData := r.newDataOprPush(KEY_TYPE_SRV_INFO, key, DATA_OPR_TYPE_UPDATE, kr)
+	pushData.SetValue(info, prev)
+	return pushData, nil
+}
+
+func (r *RegInfo) removeSrv(key string, rev int64) ([]*DataOprPush, bool) {
+	removedList, ok := r.removeDataWithRev(r.treeSrvInfos, key, rev)
+	if !ok {
+		return nil, false
+	}
+
+	pushList, num := r.newRemovePushList(KEY_TYPE_SRV_INFO, removedList)
+	r.srvNum -= num
+	return pushList, true
+}
+
+func (r *RegInfo) setGlobal(key string, data string, rev int64) (*DataOprPush, error) {
+	kr, prev, err := r.setDataWithRev(r.treeGlobalInfos, key, data, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev == nil {
+		r.globalNum++
+	}
+
+	pushData := r.newDataOprPush(KEY_TYPE_GLOBAL_DATA, key, DATA_OPR_TYPE_UPDATE, kr)
+	pushData.SetValue(data, prev)
+	return pushData, nil
+}
+
+func (r *RegInfo) removeGlobal(key string, rev int64) ([]*DataOprPush, bool) {
+	removedList, ok := r.removeDataWithRev(r.treeGlobalInfos, key, rev)
+	if !ok {
+		return nil, false
+	}
+
+	pushList, num := r.newRemovePushList(KEY_TYPE_GLOBAL_DATA, removedList)
+	r.globalNum -= num
+	return pushList, true
+}
+
+func (r *RegInfo) getNode(tree *MapTree, key string) (*MapTreeNode, bool) {
+	subPaths := ParseInfoPath(key)
+	if len(subPaths) == 0 {
+		return nil, false
+	}
+
+	ok := false
+	node := tree.root
+	for _, subPath := range subPaths {
+		node, ok = node.GetChild(subPath)
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return node, true
+}
+
+func (r *RegInfo) isTxnCompareMatch(cmp *TxnCompare) bool {
+	tree := r.treeGlobalInfos
+	if cmp.KeyType == KEY_TYPE_SRV_INFO {
+		tree = r.treeSrvInfos
+	}
+
+	d, kr, err := r.getDataAtRev(tree, cmp.Key, 0)
+	bExists := (err == nil)
+
+	curData := ""
+	if bExists {
+		if cmp.KeyType == KEY_TYPE_SRV_INFO {
+			curData = d.(*SrvInfo).DataBase64
+		} else {
+			curData = d.(string)
+		}
+	}
+
+	return cmp.IsMatch(bExists, curData, kr)
+}
+
+// isTxnChanging check if any of the operations changes the data, it must be called with both locks held.
+// A remove can't add a key, so it changes nothing if the key not exists before the txn.
+func (r *RegInfo) isTxnChanging(ops []*TxnOp) bool {
+	for _, op := range ops {
+		switch op.Type {
+		case TXN_OP_REMOVE_SRV:
+			if _, ok := r.getNode(r.treeSrvInfos, op.GetKey()); ok {
+				return true
+			}
+
+		case TXN_OP_REMOVE_GLOBAL_DATA:
+			if _, ok := r.getNode(r.treeGlobalInfos, op.GetKey()); ok {
+				return true
+			}
+
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *RegInfo) applyTxnOp(op *TxnOp, rev int64) ([]*DataOprPush, bool) {
+	key := op.GetKey()
+
+	switch op.Type {
+	case TXN_OP_UPDATE_SRV:
+		info := &SrvInfo{
+			SrvType:    op.SrvType,
+			SrvNo:      op.SrvNo,
+			IsTemp:     op.IsTemp,
+			DataBase64: op.DataBase64,
+		}
+
+		d, ok := r.getData(r.treeSrvInfos, key)
+		bExists := (ok && d != nil)
+		if bExists {
+			copyInfo := *(d.(*SrvInfo))
+			copyInfo.DataBase64 = op.DataBase64
+			info = &copyInfo
+		}
+
+		if op.Meta != nil && bExists {
+			info.SrvMeta.Merge(op.Meta)
+		} else if op.Meta != nil {
+			info.SrvMeta = *op.Meta
+		}
+
+		pushData, err := r.setSrv(key, info, rev)
+		return []*DataOprPush{pushData}, (err == nil)
+
+	case TXN_OP_REMOVE_SRV:
+		return r.removeSrv(key, rev)
+
+	case TXN_OP_UPDATE_GLOBAL_DATA:
+		pushData, err := r.setGlobal(key, op.DataBase64, rev)
+		return []*DataOprPush{pushData}, (err == nil)
+
+	case TXN_OP_REMOVE_GLOBAL_DATA:
+		return r.removeGlobal(key, rev)
+	}
+
+	return nil, false
+}
+
+func (r *RegInfo) newDataOprPush(keyType int, key string, operate int, kr KeyRev) *DataOprPush {
+	pushData := NewDataOprPush(keyType, key, operate, kr)
+	pushData.Namespace = r.namespace
+	return pushData
+}
+
+// checkSrvQuota check if addNum servers can be added, the key is not counted if it exists.
+func (r *RegInfo) checkSrvQuota(key string, addNum int) error {
+	if r.quota == nil || r.quota.MaxSrvNum <= 0 {
+		return nil
+	}
+
+	if d, ok := r.getData(r.treeSrvInfos, key); ok && d != nil {
+		return nil
+	}
+
+	if r.srvNum+addNum > r.quota.MaxSrvNum {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// checkGlobalQuota check if addNum global data can be added, the key is not counted if it exists.
+func (r *RegInfo) checkGlobalQuota(key string, addNum int) error {
+	if r.quota == nil || r.quota.MaxGlobalDataNum <= 0 {
+		return nil
+	}
+
+	if d, ok := r.getData(r.treeGlobalInfos, key); ok && d != nil {
+		return nil
+	}
+
+	if r.globalNum+addNum > r.quota.MaxGlobalDataNum {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// checkTxnQuota check the new keys of the operations, the removals are not deducted.
+func (r *RegInfo) checkTxnQuota(ops []*TxnOp) error {
+	if r.quota == nil {
+		return nil
+	}
+
+	mapNewSrvKey := make(map[string]bool)
+	mapNewGlobalKey := make(map[string]bool)
+	for _, op := range ops {
+		key := op.GetKey()
+		if op.Type == TXN_OP_UPDATE_SRV {
+			if d, ok := r.getData(r.treeSrvInfos, key); !ok || d == nil {
+				mapNewSrvKey[key] = true
+			}
+		} else if op.Type == TXN_OP_UPDATE_GLOBAL_DATA {
+			if d, ok := r.getData(r.treeGlobalInfos, key); !ok || d == nil {
+				mapNewGlobalKey[key] = true
+			}
+		}
+	}
+
+	if len(mapNewSrvKey) > 0 && r.quota.MaxSrvNum > 0 &&
+		r.srvNum+len(mapNewSrvKey) > r.quota.MaxSrvNum {
+		return ErrQuotaExceeded
+	}
+
+	if len(mapNewGlobalKey) > 0 && r.quota.MaxGlobalDataNum > 0 &&
+		r.globalNum+len(mapNewGlobalKey) > r.quota.MaxGlobalDataNum {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+func countNodeData(node *MapTreeNode) int {
+	count := 0
+	if node.GetData() != nil {
+		count++
+	}
+
+	for _, child := range node.AllChilds() {
+		count += countNodeData(child)
+	}
+
+	return count
+}
+
+// loadSavedInfo add the saved data with their saved revisions without checking the quota,
+// the keys saved without the revisions get the next revisions.
+func (r *RegInfo) loadSavedInfo(savedInfo *RegSavedInfo) {
+	r.lckSrv.Lock()
+	defer r.lckSrv.Unlock()
+
+	r.lckGlobal.Lock()
+	defer r.lckGlobal.Unlock()
+
+	// unmarshal server informations
+	for _, srvInfo := range savedInfo.SrvInfos {
+		info := &SrvInfo{
+			SrvType:    srvInfo.SrvType,
+			SrvNo:      srvInfo.SrvNo,
+			IsTemp:     srvInfo.IsTemp,
+			DataBase64: srvInfo.DataBase64,
+			SrvMeta:    srvInfo.SrvMeta,
+		}
+
+		key := GetSrvKey(info.SrvType, info.SrvNo)
+		kr, ok := savedInfo.MapKey2Rev[getRecordKey(KEY_TYPE_SRV_INFO, key)]
+		if !ok {
+			r.setSrv(key, info, r.nextRevision())
+			continue
+		}
+
+		r.setSrv(key, info, kr.ModRev)
+		r.loadKeyRev(r.treeSrvInfos, key, kr)
+	}
+
+	// unmarshal global informations
+	for key, val := range savedInfo.MapGlobalKey2Data {
+		if len(ParseInfoPath(key)) == 0 {
+			continue
+		}
+
+		kr, ok := savedInfo.MapKey2Rev[getRecordKey(KEY_TYPE_GLOBAL_DATA, key)]
+		if !ok {
+			r.setGlobal(key, val, r.nextRevision())
+			continue
+		}
+
+		r.setGlobal(key, val, kr.ModRev)
+		r.loadKeyRev(r.treeGlobalInfos, key, kr)
+	}
+}
+
+// loadKeyRev set the saved create revision of the key, and keep the revision not less than the saved one.
+func (r *RegInfo) loadKeyRev(tree *MapTree, key string, kr KeyRev) {
+	node, ok := r.getNode(tree, key)
+	if ok {
+		node.SetCreateRev(kr.CreateRev)
+	}
+
+	r.updateRevision(kr.ModRev)
+}
+
+// marshalNamespaces marshal the namespaces except the default one, the empty namespaces are skipped.
+func (r *RegInfo) marshalNamespaces(bIgnoreTemp bool) map[string]*RegSavedInfo {
+	mapNs2SavedInfo := make(map[string]*RegSavedInfo)
+	for _, info := range r.GetAllNamespaces() {
+		if info == r {
+			continue
+		}
+
+		info.lckSrv.RLock()
+		info.lckGlobal.RLock()
+		savedInfo := NewRegSavedInfo()
+		info.marshalSrvInfos(savedInfo, bIgnoreTemp)
+		info.marshalGlobalInfos(savedInfo)
+		info.lckGlobal.RUnlock()
+		info.lckSrv.RUnlock()
+
+		if !savedInfo.IsEmpty() {
+			mapNs2SavedInfo[info.namespace] = savedInfo
+		}
+	}
+
+	if len(mapNs2SavedInfo) == 0 {
+		return nil
+	}
+
+	return mapNs2SavedInfo
+}
+
+func (r *RegInfo) visitRecords(records *[]*DataOprPush, keyType int, parentPath string, parentNode *MapTreeNode) {
+	if parentNode == nil {
+		return
+	}
+
+	d := parentNode.GetData()
+	if d != nil {
+		kr := KeyRev{CreateRev: parentNode.GetCreateRev(), ModRev: parentNode.GetModRev()}
+		rec := r.newDataOprPush(keyType, parentPath, DATA_OPR_TYPE_UPDATE, kr)
+		rec.SetValue(d, nil)
+		*records = append(*records, rec)
+	}
+
+	childKeys := parentNode.AllChildKeys()
+	for _, key := range childKeys {
+		path := parentPath + "/" + key
+		childNode, _ := parentNode.GetChild(key)
+		r.visitRecords(records, keyType, path, childNode)
+	}
+}
+
+func (r *RegInfo) marshalSrvInfos(savedInfo *RegSavedInfo, bIgnoreTemp bool) {
+	r.visitSaveSrvInfos(savedInfo, bIgnoreTemp, "", r.treeSrvInfos.root)
+}
+
+func (r *RegInfo) visitSaveSrvInfos(savedInfo *RegSavedInfo, bIgnoreTemp bool, parentPath string, parentNode *MapTreeNode) {
+	if parentNode == nil {
+		return
+	}
+
+	d := parentNode.GetData()
+	if d != nil {
+		info := d.(*SrvInfo)
+		if !bIgnoreTemp || !info.IsTemp {
+			savedInfo.SrvInfos = append(savedInfo.SrvInfos, info)
+			savedInfo.MapKey2Rev[getRecordKey(KEY_TYPE_SRV_INFO, parentPath)] = KeyRev{CreateRev: parentNode.GetCreateRev(), ModRev: parentNode.GetModRev()}
+		}
+	}
+
+	childKeys := parentNode.AllChildKeys()
+	for _, key := range childKeys {
+		path := parentPath + "/" + key
+		childNode, _ := parentNode.GetChild(key)
+		r.visitSaveSrvInfos(savedInfo, bIgnoreTemp, path, childNode)
+	}
+}
+
+func (r *RegInfo) marshalGlobalInfos(savedInfo *RegSavedInfo) {
+	r.visitSaveGlobalInfos(savedInfo, "", r.treeGlobalInfos.root)
+}
+
+func (r *RegInfo) visitSaveGlobalInfos(savedInfo *RegSavedInfo, parentPath string, parentNode *MapTreeNode) {
+	if parentNode == nil {
+		return
+	}
+
+	d := parentNode.GetData()
+	if d != nil {
+		data := d.(string)
+		savedInfo.MapGlobalKey2Data[parentPath] = data
+		savedInfo.MapKey2Rev[getRecordKey(KEY_TYPE_GLOBAL_DATA, parentPath)] = KeyRev{CreateRev: parentNode.GetCreateRev(), ModRev: parentNode.GetModRev()}
+	}
+
+	childKeys := parentNode.AllChildKeys()
+	for _, key := range childKeys {
+		path := parentPath + "/" + key
+		childNode, _ := parentNode.GetChild(key)
+		r.visitSaveGlobalInfos(savedInfo, path, childNode)
+	}
+}
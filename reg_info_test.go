@@ -0,0 +1,51 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"testing"
+)
+
+func TestRemoveGlobalDataSubtree(t *testing.T) {
+	info := NewRegInfo()
+	for _, key := range []string{"/a", "/a/b", "/a/b/c", "/ab"} {
+		_, err := info.SetGlobalData(key, key)
+		if err != nil {
+			t.Fatal("set ", key, " err: ", err)
+		}
+	}
+
+	pushList, ok := info.RemoveGlobalData("/a")
+	if !ok {
+		t.Fatal("/a should be removed")
+	}
+
+	mapKey2Prev := make(map[string]string)
+	for _, pushData := range pushList {
+		if pushData.Operate != DATA_OPR_TYPE_REMOVE || pushData.ModRev != info.GetRevision() {
+			t.Fatal("the push of ", pushData.Key, " should be a remove at the current revision")
+		}
+
+		mapKey2Prev[pushData.Key] = pushData.PrevDataBase64
+	}
+
+	if len(pushList) != 3 || pushList[0].Key != "/a" {
+		t.Fatal("the pushes should be /a and its descendants, num: ", len(pushList))
+	}
+
+	for _, key := range []string{"/a", "/a/b", "/a/b/c"} {
+		if mapKey2Prev[key] != key {
+			t.Fatal("the remove push of ", key, " should keep the previous value")
+		}
+
+		if _, ok := info.GetGlobalData(key); ok {
+			t.Fatal(key, " should be removed")
+		}
+	}
+
+	if _, ok := info.GetGlobalData("/ab"); !ok {
+		t.Fatal("/ab should be kept")
+	}
+}
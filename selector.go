@@ -0,0 +1,266 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidSelector = errors.New("invalid selector")
+)
+
+const (
+	SELECTOR_OP_EXISTS = 1 + iota
+	SELECTOR_OP_NOT_EXISTS
+	SELECTOR_OP_EQUAL
+	SELECTOR_OP_NOT_EQUAL
+	SELECTOR_OP_IN
+	SELECTOR_OP_NOT_IN
+)
+
+type SelectorRequirement struct {
+	Key    string
+	Op     int
+	Values []string
+}
+
+func (r *SelectorRequirement) IsMatch(info *SrvInfo) bool {
+	value, ok := getSelectorValue(info, r.Key)
+
+	switch r.Op {
+	case SELECTOR_OP_EXISTS:
+		return ok
+	case SELECTOR_OP_NOT_EXISTS:
+		return !ok
+	case SELECTOR_OP_EQUAL:
+		return ok && value == r.Values[0]
+	case SELECTOR_OP_NOT_EQUAL:
+		return !ok || value != r.Values[0]
+	case SELECTOR_OP_IN:
+		return ok && r.hasValue(value)
+	case SELECTOR_OP_NOT_IN:
+		return !ok || !r.hasValue(value)
+	default:
+		return false
+	}
+}
+
+func (r *SelectorRequirement) hasValue(value string) bool {
+	for _, v := range r.Values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+//======================
+//      Selector
+//======================
+// Selector select the servers by the labels like the kubernetes label selector,
+// e.g. "zone=eu,version!=1.2,canary,!deprecated,tier in (web,api),env notin (test)".
+// The keys "version" and "status" fall back to the meta fields if there is no such label.
+// An empty selector selects all the servers.
+type Selector struct {
+	expr         string
+	requirements []*SelectorRequirement
+}
+
+func ParseSelector(expr string) (*Selector, error) {
+	s := &Selector{
+		expr:         expr,
+		requirements: make([]*SelectorRequirement, 0),
+	}
+
+	if strings.TrimSpace(expr) == "" {
+		return s, nil
+	}
+
+	terms, err := splitSelectorTerms(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, term := range terms {
+		r, err := parseSelectorTerm(term)
+		if err != nil {
+			return nil, err
+		}
+
+		s.requirements = append(s.requirements, r)
+	}
+
+	return s, nil
+}
+
+func (s *Selector) String() string {
+	return s.expr
+}
+
+func (s *Selector) GetRequirements() []*SelectorRequirement {
+	return s.requirements
+}
+
+func (s *Selector) IsMatch(info *SrvInfo) bool {
+	if info == nil {
+		return false
+	}
+
+	for _, r := range s.requirements {
+		if !r.IsMatch(info) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func getSelectorValue(info *SrvInfo, key string) (string, bool) {
+	value, ok := info.GetLabel(key)
+	if ok {
+		return value, true
+	}
+
+	if key == "version" && info.Version != "" {
+		return info.Version, true
+	}
+
+	if key == "status" && info.Status != "" {
+		return info.Status, true
+	}
+
+	return "", false
+}
+
+// splitSelectorTerms split the expression by the commas out of the parentheses.
+func splitSelectorTerms(expr string) ([]string, error) {
+	terms := make([]string, 0)
+	depth := 0
+	start := 0
+	for i, ch := range expr {
+		switch ch {
+		case '(':
+			depth++
+			if depth > 1 {
+				return nil, ErrInvalidSelector
+			}
+
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, ErrInvalidSelector
+			}
+
+		case ',':
+			if depth == 0 {
+				terms = append(terms, expr[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	if depth != 0 {
+		return nil, ErrInvalidSelector
+	}
+
+	return append(terms, expr[start:]), nil
+}
+
+func parseSelectorTerm(term string) (*SelectorRequirement, error) {
+	term = strings.TrimSpace(term)
+	if term == "" {
+		return nil, ErrInvalidSelector
+	}
+
+	if strings.HasPrefix(term, "!") && !strings.Contains(term, "=") {
+		return newSelectorRequirement(term[1:], SELECTOR_OP_NOT_EXISTS, nil)
+	}
+
+	if idx := strings.Index(term, "!="); idx >= 0 {
+		return newSelectorRequirement(term[:idx], SELECTOR_OP_NOT_EQUAL, []string{term[idx+2:]})
+	}
+
+	if idx := strings.Index(term, "=="); idx >= 0 {
+		return newSelectorRequirement(term[:idx], SELECTOR_OP_EQUAL, []string{term[idx+2:]})
+	}
+
+	if idx := strings.Index(term, "="); idx >= 0 {
+		return newSelectorRequirement(term[:idx], SELECTOR_OP_EQUAL, []string{term[idx+1:]})
+	}
+
+	if idx := strings.Index(term, " notin "); idx >= 0 {
+		values, err := parseSelectorValues(term[idx+len(" notin "):])
+		if err != nil {
+			return nil, err
+		}
+
+		return newSelectorRequirement(term[:idx], SELECTOR_OP_NOT_IN, values)
+	}
+
+	if idx := strings.Index(term, " in "); idx >= 0 {
+		values, err := parseSelectorValues(term[idx+len(" in "):])
+		if err != nil {
+			return nil, err
+		}
+
+		return newSelectorRequirement(term[:idx], SELECTOR_OP_IN, values)
+	}
+
+	return newSelectorRequirement(term, SELECTOR_OP_EXISTS, nil)
+}
+
+// parseSelectorValues parse the value set like "(a, b)".
+func parseSelectorValues(str string) ([]string, error) {
+	str = strings.TrimSpace(str)
+	if !strings.HasPrefix(str, "(") || !strings.HasSuffix(str, ")") {
+		return nil, ErrInvalidSelector
+	}
+
+	values := make([]string, 0)
+	for _, v := range strings.Split(str[1:len(str)-1], ",") {
+		v = strings.TrimSpace(v)
+		if !isValidSelectorToken(v) {
+			return nil, ErrInvalidSelector
+		}
+
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+func newSelectorRequirement(key string, op int, values []string) (*SelectorRequirement, error) {
+	key = strings.TrimSpace(key)
+	if key == "" || !isValidSelectorToken(key) {
+		return nil, ErrInvalidSelector
+	}
+
+	for i, v := range values {
+		v = strings.TrimSpace(v)
+		if op != SELECTOR_OP_IN && op != SELECTOR_OP_NOT_IN && !isValidSelectorValue(v) {
+			return nil, ErrInvalidSelector
+		}
+
+		values[i] = v
+	}
+
+	return &SelectorRequirement{
+		Key:    key,
+		Op:     op,
+		Values: values,
+	}, nil
+}
+
+func isValidSelectorToken(token string) bool {
+	return token != "" && isValidSelectorValue(token)
+}
+
+// isValidSelectorValue check the value has no operator or space, an empty value is valid.
+func isValidSelectorValue(value string) bool {
+	return !strings.ContainsAny(value, "=!(), \t")
+}
@@ -1,244 +1,929 @@
-// Copyright 2022 Guan Jianchang. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
-package reg
-
-import (
-	"errors"
-
-	"github.com/yxlib/server"
-	"github.com/yxlib/yx"
-)
-
-var (
-	ErrSrvServNotExist       = errors.New("server not exists")
-	ErrSrvServTypeNotExist   = errors.New("server type not exists")
-	ErrSrvGlobalDataNotExist = errors.New("global data not exists")
-)
-
-type Service struct {
-	*server.BaseService
-
-	logger *yx.Logger
-	ec     *yx.ErrCatcher
-}
-
-func NewService() *Service {
-	return &Service{
-		BaseService: server.NewBaseService(REG_SRV),
-		logger:      yx.NewLogger("reg.Server"),
-		ec:          yx.NewErrCatcher("reg.Server"),
-	}
-
-	// s.Start()
-
-	// s.SetName(REG_SRV)
-	// s.SetInterceptor(&rpc.JsonInterceptor{})
-	// return s
-}
-
-// func (s *Service) GetRegInfo() *RegInfo {
-// 	return s.info
-// }
-
-// func (s *Server) Save() {
-// 	s.evtSave.Send()
-// }
-
-func (s *Service) OnUpdateSrv(req *server.Request, resp *server.Response) (int32, error) {
-	reqData, _ := req.ExtData.(*UpdateSrvReq)
-	RegCenter.UpdateSrv(reqData.SrvType, reqData.SrvNo, reqData.IsTemp, reqData.DataBase64)
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnRemoveSrv(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*RemoveSrvReq)
-	RegCenter.RemoveSrv(reqData.SrvType, reqData.SrvNo)
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnGetSrv(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*GetSrvReq)
-	respData := resp.ExtData.(*GetSrvResp)
-
-	regInfo := RegCenter.GetRegInfo()
-	srvInfo, ok := regInfo.GetSrvInfo(reqData.SrvType, reqData.SrvNo)
-	if !ok {
-		return RES_CODE_SRV_NOT_EXISTS, s.ec.Throw("OnGetSrv", ErrSrvServNotExist)
-	}
-	// if ok {
-	// 	respData.SetResult(RES_CODE_SUCC, "")
-	// } else {
-	// 	respData.SetResult(RES_CODE_SRV_NOT_EXISTS, "server not exists")
-	// }
-
-	respData.Data = srvInfo
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnGetSrvByKey(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*GetSrvByKeyReq)
-	respData := resp.ExtData.(*GetSrvByKeyResp)
-
-	regInfo := RegCenter.GetRegInfo()
-	srvInfo, ok := regInfo.GetSrvInfoByKey(reqData.Key)
-	if !ok {
-		return RES_CODE_SRV_NOT_EXISTS, s.ec.Throw("OnGetSrvByKey", ErrSrvServNotExist)
-	}
-	// if ok {
-	// 	respData.SetResult(RES_CODE_SUCC, "")
-	// } else {
-	// 	respData.SetResult(RES_CODE_SRV_NOT_EXISTS, "server not exists")
-	// }
-
-	respData.Data = srvInfo
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnGetSrvsByType(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*GetSrvsByTypeReq)
-	respData := resp.ExtData.(*GetSrvsByTypeResp)
-
-	regInfo := RegCenter.GetRegInfo()
-	infos, ok := regInfo.GetAllSrvInfos(reqData.SrvType)
-	if !ok {
-		return RES_CODE_SRV_TYPE_NOT_EXISTS, s.ec.Throw("OnGetSrvsByType", ErrSrvServTypeNotExist)
-	}
-	// if ok {
-	// 	respData.SetResult(RES_CODE_SUCC, "")
-	// } else {
-	// 	respData.SetResult(RES_CODE_SRV_TYPE_NOT_EXISTS, "server type not exists")
-	// }
-
-	respData.Data = infos
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnWatchSrv(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*WatchSrvReq)
-	key := GetSrvKey(reqData.SrvType, reqData.SrvNo)
-	RegCenter.AddInfoObserver(key, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnStopWatchSrv(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*StopWatchSrvReq)
-	key := GetSrvKey(reqData.SrvType, reqData.SrvNo)
-	RegCenter.RemoveInfoObserver(key, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnWatchSrvsByType(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*WatchSrvsByTypeReq)
-	key := GetSrvTypeKey(reqData.SrvType)
-	RegCenter.AddInfoObserver(key, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnStopWatchSrvsByType(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*StopWatchSrvsByTypeReq)
-	key := GetSrvTypeKey(reqData.SrvType)
-	RegCenter.RemoveInfoObserver(key, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnUpdateGlobalData(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*UpdateGlobalDataReq)
-	RegCenter.UpdateGlobalData(reqData.Key, reqData.DataBase64)
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnRemoveGlobalData(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*RemoveGlobalDataReq)
-	RegCenter.RemoveGlobalData(reqData.Key)
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnGetGlobalData(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*GetGlobalDataReq)
-	respData := resp.ExtData.(*GetGlobalDataResp)
-
-	regInfo := RegCenter.GetRegInfo()
-	dataBase64, ok := regInfo.GetGlobalData(reqData.Key)
-	if !ok {
-		return RES_CODE_GLOBAL_DATA_NOT_EXISTS, s.ec.Throw("OnGetGlobalData", ErrSrvGlobalDataNotExist)
-	}
-	// if ok {
-	// 	respData.SetResult(RES_CODE_SUCC, "")
-	// } else {
-	// 	respData.SetResult(RES_CODE_GLOBAL_DATA_NOT_EXISTS, "global data not exists")
-	// }
-
-	respData.DataBase64 = dataBase64
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnWatchGlobalData(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*WatchGlobalDataReq)
-	RegCenter.AddInfoObserver(reqData.Key, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnStopWatchGlobalData(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*StopWatchGlobalDataReq)
-	RegCenter.RemoveInfoObserver(reqData.Key, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnWatchConn(req *server.Request, resp *server.Response) (int32, error) {
-	// reqData := req.(*WatchConnReq)
-	RegCenter.AddConnObserver(uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnStopWatchConn(req *server.Request, resp *server.Response) (int32, error) {
-	// reqData := req.(*StopWatchConnReq)
-	RegCenter.RemoveConnObserver(uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
-
-func (s *Service) OnStopAllWatch(req *server.Request, resp *server.Response) (int32, error) {
-	reqData := req.ExtData.(*StopAllWatchReq)
-	RegCenter.RemoveAllObserverOfSrv(reqData.SrvType, reqData.SrvNo)
-
-	// respData := resp.(*BaseResp)
-	// respData.SetResult(RES_CODE_SUCC, "")
-	return server.RESP_CODE_SUCCESS, nil
-}
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"errors"
+
+	"github.com/yxlib/server"
+	"github.com/yxlib/yx"
+)
+
+var (
+	ErrSrvServNotExist       = errors.New("server not exists")
+	ErrSrvServTypeNotExist   = errors.New("server type not exists")
+	ErrSrvGlobalDataNotExist = errors.New("global data not exists")
+)
+
+type Service struct {
+	*server.BaseService
+
+	acl    *Acl
+	logger *yx.Logger
+	ec     *yx.ErrCatcher
+}
+
+func NewService() *Service {
+	s := &Service{
+		BaseService: server.NewBaseService(REG_SRV),
+		acl:         nil,
+		logger:      yx.NewLogger("reg.Server"),
+		ec:          yx.NewErrCatcher("reg.Server"),
+	}
+
+	RegCenter.ListenConnClose(s.onConnClose)
+	return s
+
+	// s.Start()
+
+	// s.SetName(REG_SRV)
+	// s.SetInterceptor(&rpc.JsonInterceptor{})
+	// return s
+}
+
+// SetAcl authorize the requests by the acl, all the requests are allowed if it is not set.
+func (s *Service) SetAcl(acl *Acl) {
+	s.acl = acl
+}
+
+// func (s *Service) GetRegInfo() *RegInfo {
+// 	return s.info
+// }
+
+// func (s *Server) Save() {
+// 	s.evtSave.Send()
+// }
+
+func (s *Service) OnUpdateSrv(req *server.Request, resp *server.Response) (int32, error) {
+	reqData, _ := req.ExtData.(*UpdateSrvReq)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnUpdateSrv", err)
+	}
+
+	err = s.checkSrvPerm(req, reqData.Namespace, reqData.SrvType, reqData.SrvNo, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnUpdateSrv", err)
+	}
+
+	err = ns.UpdateSrvWithMeta(reqData.SrvType, reqData.SrvNo, reqData.IsTemp, reqData.DataBase64, reqData.Meta, reqData.TTL)
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnUpdateSrv", err)
+	}
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnCompareAndUpdateSrv(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*CompareAndUpdateSrvReq)
+	respData := resp.ExtData.(*CompareAndUpdateSrvResp)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnCompareAndUpdateSrv", err)
+	}
+
+	err = s.checkSrvPerm(req, reqData.Namespace, reqData.SrvType, reqData.SrvNo, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnCompareAndUpdateSrv", err)
+	}
+
+	pushData, err := ns.CompareAndUpdateSrv(reqData.SrvType, reqData.SrvNo, reqData.IsTemp, reqData.DataBase64, reqData.Meta, reqData.Cmp, reqData.TTL)
+	if pushData != nil {
+		respData.Data = pushData.Srv
+		respData.KeyRev = pushData.KeyRev
+	}
+
+	if err != nil {
+		return s.getCompareResCode(err), s.ec.Throw("OnCompareAndUpdateSrv", err)
+	}
+
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnRemoveSrv(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*RemoveSrvReq)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnRemoveSrv", err)
+	}
+
+	err = s.checkSrvPerm(req, reqData.Namespace, reqData.SrvType, reqData.SrvNo, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnRemoveSrv", err)
+	}
+
+	err = ns.RemoveSrv(reqData.SrvType, reqData.SrvNo)
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnRemoveSrv", err)
+	}
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnSetSrvStatus(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*SetSrvStatusReq)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnSetSrvStatus", err)
+	}
+
+	err = s.checkSrvPerm(req, reqData.Namespace, reqData.SrvType, reqData.SrvNo, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnSetSrvStatus", err)
+	}
+
+	err = ns.SetSrvStatus(reqData.SrvType, reqData.SrvNo, reqData.Status)
+	if err == ErrSrvNotExists {
+		return RES_CODE_SRV_NOT_EXISTS, s.ec.Throw("OnSetSrvStatus", err)
+	}
+
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnSetSrvStatus", err)
+	}
+
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnKeepAlive(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*KeepAliveReq)
+	respData := resp.ExtData.(*KeepAliveResp)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnKeepAlive", err)
+	}
+
+	err = s.checkSrvPerm(req, reqData.Namespace, reqData.SrvType, reqData.SrvNo, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnKeepAlive", err)
+	}
+
+	ttlSec, err := ns.KeepAlive(reqData.SrvType, reqData.SrvNo)
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_LEASE_NOT_EXISTS), s.ec.Throw("OnKeepAlive", err)
+	}
+
+	respData.TTL = ttlSec
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnGetSrv(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*GetSrvReq)
+	respData := resp.ExtData.(*GetSrvResp)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnGetSrv", err)
+	}
+
+	err = s.checkSrvPerm(req, reqData.Namespace, reqData.SrvType, reqData.SrvNo, ACL_PERM_READ)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnGetSrv", err)
+	}
+
+	regInfo := ns.GetRegInfo()
+	rev := regInfo.GetRevision()
+	srvInfo, kr, err := regInfo.GetSrvInfoAtRev(reqData.SrvType, reqData.SrvNo, reqData.Rev)
+	if err != nil {
+		return s.getRevResCode(err, RES_CODE_SRV_NOT_EXISTS), s.ec.Throw("OnGetSrv", err)
+	}
+	// if ok {
+	// 	respData.SetResult(RES_CODE_SUCC, "")
+	// } else {
+	// 	respData.SetResult(RES_CODE_SRV_NOT_EXISTS, "server not exists")
+	// }
+
+	respData.Data = srvInfo
+	respData.KeyRev = kr
+	respData.Rev = rev
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnGetSrvByKey(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*GetSrvByKeyReq)
+	respData := resp.ExtData.(*GetSrvByKeyResp)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnGetSrvByKey", err)
+	}
+
+	srvType, srvNo := GetSrvTypeAndNo(reqData.Key)
+	err = s.checkSrvPerm(req, reqData.Namespace, srvType, srvNo, ACL_PERM_READ)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnGetSrvByKey", err)
+	}
+
+	regInfo := ns.GetRegInfo()
+	rev := regInfo.GetRevision()
+	srvInfo, kr, err := regInfo.GetSrvInfoByKeyAtRev(reqData.Key, reqData.Rev)
+	if err != nil {
+		return s.getRevResCode(err, RES_CODE_SRV_NOT_EXISTS), s.ec.Throw("OnGetSrvByKey", err)
+	}
+	// if ok {
+	// 	respData.SetResult(RES_CODE_SUCC, "")
+	// } else {
+	// 	respData.SetResult(RES_CODE_SRV_NOT_EXISTS, "server not exists")
+	// }
+
+	respData.Data = srvInfo
+	respData.KeyRev = kr
+	respData.Rev = rev
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnGetSrvsByType(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*GetSrvsByTypeReq)
+	respData := resp.ExtData.(*GetSrvsByTypeResp)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnGetSrvsByType", err)
+	}
+
+	err = s.checkSrvTypePerm(req, reqData.Namespace, reqData.SrvType, false, ACL_PERM_READ)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnGetSrvsByType", err)
+	}
+
+	regInfo := ns.GetRegInfo()
+	infos, revs, ok := regInfo.GetAllSrvInfosWithRev(reqData.SrvType)
+	if !ok {
+		return RES_CODE_SRV_TYPE_NOT_EXISTS, s.ec.Throw("OnGetSrvsByType", ErrSrvServTypeNotExist)
+	}
+	// if ok {
+	// 	respData.SetResult(RES_CODE_SUCC, "")
+	// } else {
+	// 	respData.SetResult(RES_CODE_SRV_TYPE_NOT_EXISTS, "server type not exists")
+	// }
+
+	respData.Data, respData.Revs = FilterSrvInfosWithRev(infos, revs, reqData.Filter)
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnTxn(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*TxnReq)
+	respData := resp.ExtData.(*TxnResp)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnTxn", err)
+	}
+
+	err = s.checkTxnPerm(req, reqData)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnTxn", err)
+	}
+
+	bSucc, pushList, err := ns.Txn(reqData.Compares, reqData.Success, reqData.Failure)
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnTxn", err)
+	}
+
+	respData.Succeeded = bSucc
+	respData.Results = s.filterTxnResults(req, reqData.Namespace, pushList)
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnWatchSrv(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*WatchSrvReq)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnWatchSrv", err)
+	}
+
+	err = s.checkSrvPerm(req, reqData.Namespace, reqData.SrvType, reqData.SrvNo, ACL_PERM_WATCH)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnWatchSrv", err)
+	}
+
+	key := GetNsKey(ns.GetName(), GetSrvKey(reqData.SrvType, reqData.SrvNo))
+	err = RegCenter.AddInfoObserver(KEY_TYPE_SRV_INFO, key, uint32(req.Src.PeerType), uint32(req.Src.PeerNo), reqData.WatchOpt)
+	if err != nil {
+		return s.getRevResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnWatchSrv", err)
+	}
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnStopWatchSrv(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*StopWatchSrvReq)
+	key := GetNsKey(reqData.Namespace, GetSrvKey(reqData.SrvType, reqData.SrvNo))
+	RegCenter.RemoveInfoObserver(KEY_TYPE_SRV_INFO, key, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnWatchSrvsByType(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*WatchSrvsByTypeReq)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnWatchSrvsByType", err)
+	}
+
+	err = s.checkSrvTypePerm(req, reqData.Namespace, reqData.SrvType, false, ACL_PERM_WATCH)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnWatchSrvsByType", err)
+	}
+
+	key := GetNsKey(ns.GetName(), GetSrvTypeKey(reqData.SrvType))
+	err = RegCenter.AddInfoObserver(KEY_TYPE_SRV_INFO, key, uint32(req.Src.PeerType), uint32(req.Src.PeerNo), reqData.WatchOpt)
+	if err != nil {
+		return s.getRevResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnWatchSrvsByType", err)
+	}
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnStopWatchSrvsByType(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*StopWatchSrvsByTypeReq)
+	key := GetNsKey(reqData.Namespace, GetSrvTypeKey(reqData.SrvType))
+	RegCenter.RemoveInfoObserver(KEY_TYPE_SRV_INFO, key, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnUpdateGlobalData(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*UpdateGlobalDataReq)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnUpdateGlobalData", err)
+	}
+
+	err = s.checkGlobalPerm(req, reqData.Namespace, reqData.Key, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnUpdateGlobalData", err)
+	}
+
+	err = checkWritableKey(reqData.Namespace, reqData.Key)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnUpdateGlobalData", err)
+	}
+
+	err = ns.UpdateGlobalData(reqData.Key, reqData.DataBase64)
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnUpdateGlobalData", err)
+	}
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnCompareAndUpdateGlobalData(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*CompareAndUpdateGlobalDataReq)
+	respData := resp.ExtData.(*CompareAndUpdateGlobalDataResp)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnCompareAndUpdateGlobalData", err)
+	}
+
+	err = s.checkGlobalPerm(req, reqData.Namespace, reqData.Key, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnCompareAndUpdateGlobalData", err)
+	}
+
+	err = checkWritableKey(reqData.Namespace, reqData.Key)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnCompareAndUpdateGlobalData", err)
+	}
+
+	pushData, err := ns.CompareAndUpdateGlobalData(reqData.Key, reqData.DataBase64, reqData.Cmp)
+	if pushData != nil {
+		respData.DataBase64 = pushData.DataBase64
+		respData.KeyRev = pushData.KeyRev
+	}
+
+	if err != nil {
+		return s.getCompareResCode(err), s.ec.Throw("OnCompareAndUpdateGlobalData", err)
+	}
+
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnRemoveGlobalData(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*RemoveGlobalDataReq)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnRemoveGlobalData", err)
+	}
+
+	err = s.checkGlobalPerm(req, reqData.Namespace, reqData.Key, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnRemoveGlobalData", err)
+	}
+
+	err = checkWritableKey(reqData.Namespace, reqData.Key)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnRemoveGlobalData", err)
+	}
+
+	err = ns.RemoveGlobalData(reqData.Key)
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnRemoveGlobalData", err)
+	}
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnGetGlobalData(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*GetGlobalDataReq)
+	respData := resp.ExtData.(*GetGlobalDataResp)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnGetGlobalData", err)
+	}
+
+	err = s.checkGlobalPerm(req, reqData.Namespace, reqData.Key, ACL_PERM_READ)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnGetGlobalData", err)
+	}
+
+	regInfo := ns.GetRegInfo()
+	rev := regInfo.GetRevision()
+	dataBase64, kr, err := regInfo.GetGlobalDataAtRev(reqData.Key, reqData.Rev)
+	if err != nil {
+		return s.getRevResCode(err, RES_CODE_GLOBAL_DATA_NOT_EXISTS), s.ec.Throw("OnGetGlobalData", err)
+	}
+	// if ok {
+	// 	respData.SetResult(RES_CODE_SUCC, "")
+	// } else {
+	// 	respData.SetResult(RES_CODE_GLOBAL_DATA_NOT_EXISTS, "global data not exists")
+	// }
+
+	respData.DataBase64 = dataBase64
+	respData.KeyRev = kr
+	respData.Rev = rev
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnWatchGlobalData(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*WatchGlobalDataReq)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnWatchGlobalData", err)
+	}
+
+	err = s.checkGlobalPerm(req, reqData.Namespace, reqData.Key, ACL_PERM_WATCH)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnWatchGlobalData", err)
+	}
+
+	err = checkNsKey(ns.GetName(), reqData.Key)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnWatchGlobalData", err)
+	}
+
+	err = RegCenter.AddInfoObserver(KEY_TYPE_GLOBAL_DATA, GetNsKey(ns.GetName(), reqData.Key), uint32(req.Src.PeerType), uint32(req.Src.PeerNo), reqData.WatchOpt)
+	if err != nil {
+		return s.getRevResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnWatchGlobalData", err)
+	}
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnStopWatchGlobalData(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*StopWatchGlobalDataReq)
+	RegCenter.RemoveInfoObserver(KEY_TYPE_GLOBAL_DATA, GetNsKey(reqData.Namespace, reqData.Key), uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnWatchConn(req *server.Request, resp *server.Response) (int32, error) {
+	// reqData := req.(*WatchConnReq)
+
+	err := s.checkSrvTypePerm(req, DEFAULT_NAMESPACE, 0, true, ACL_PERM_WATCH)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnWatchConn", err)
+	}
+
+	RegCenter.AddConnObserver(uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnStopWatchConn(req *server.Request, resp *server.Response) (int32, error) {
+	// reqData := req.(*StopWatchConnReq)
+	RegCenter.RemoveConnObserver(uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnStopAllWatch(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*StopAllWatchReq)
+
+	err := s.checkSrvPerm(req, DEFAULT_NAMESPACE, reqData.SrvType, reqData.SrvNo, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnStopAllWatch", err)
+	}
+
+	RegCenter.RemoveAllObserverOfSrv(reqData.SrvType, reqData.SrvNo)
+
+	// respData := resp.(*BaseResp)
+	// respData.SetResult(RES_CODE_SUCC, "")
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+// OnRaftMsg only accept the messages from the members, sent by the peer configured for msg.From.
+func (s *Service) OnRaftMsg(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*RaftMsg)
+	if !RegCenter.IsRaftPeer(uint32(req.Src.PeerType), uint32(req.Src.PeerNo), reqData.From) {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnRaftMsg", ErrPermissionDenied)
+	}
+
+	err := RegCenter.StepRaft(reqData)
+	if err != nil {
+		return RES_CODE_UNAVAILABLE, s.ec.Throw("OnRaftMsg", err)
+	}
+
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+// OnGetMembers check no permission, the clients ask for the leader before they are authorized.
+func (s *Service) OnGetMembers(req *server.Request, resp *server.Response) (int32, error) {
+	// reqData := req.ExtData.(*GetMembersReq)
+	respData := resp.ExtData.(*GetMembersResp)
+
+	members, leaderId := RegCenter.GetMembers()
+	respData.Members = members
+	respData.LeaderId = leaderId
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnLock(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*LockReq)
+	respData := resp.ExtData.(*LockResp)
+
+	key, err := GetLockKey(reqData.Name)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnLock", err)
+	}
+
+	err = s.checkGlobalPerm(req, DEFAULT_NAMESPACE, key, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnLock", err)
+	}
+
+	bAcquired, err := RegCenter.Lock(reqData.Name, uint32(req.Src.PeerType), uint32(req.Src.PeerNo), reqData.Wait)
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnLock", err)
+	}
+
+	respData.Acquired = bAcquired
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnUnlock(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*UnlockReq)
+
+	key, err := GetLockKey(reqData.Name)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnUnlock", err)
+	}
+
+	err = s.checkGlobalPerm(req, DEFAULT_NAMESPACE, key, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnUnlock", err)
+	}
+
+	err = RegCenter.Unlock(reqData.Name, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+	if err == ErrLockNotOwner {
+		return RES_CODE_LOCK_NOT_OWNER, s.ec.Throw("OnUnlock", err)
+	}
+
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnUnlock", err)
+	}
+
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+// OnCampaign need the write permission on the server type of the peer,
+// the leader is shared by all the servers of the type.
+func (s *Service) OnCampaign(req *server.Request, resp *server.Response) (int32, error) {
+	// reqData := req.ExtData.(*CampaignReq)
+	respData := resp.ExtData.(*CampaignResp)
+
+	err := s.checkSrvTypePerm(req, DEFAULT_NAMESPACE, uint32(req.Src.PeerType), false, ACL_PERM_WRITE)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnCampaign", err)
+	}
+
+	bLeader, err := RegCenter.Campaign(uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_INVALID_PARAM), s.ec.Throw("OnCampaign", err)
+	}
+
+	respData.IsLeader = bLeader
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+// OnResign check no permission, a peer can only resign the leadership of itself.
+func (s *Service) OnResign(req *server.Request, resp *server.Response) (int32, error) {
+	// reqData := req.ExtData.(*ResignReq)
+	err := RegCenter.Resign(uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+	if err != nil {
+		return s.getWriteResCode(err, RES_CODE_NOT_ELECTION_LEADER), s.ec.Throw("OnResign", err)
+	}
+
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnGetLeader(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*GetLeaderReq)
+	respData := resp.ExtData.(*GetLeaderResp)
+
+	err := s.checkSrvTypePerm(req, DEFAULT_NAMESPACE, reqData.SrvType, false, ACL_PERM_READ)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnGetLeader", err)
+	}
+
+	respData.LeaderNo, respData.HasLeader = RegCenter.GetElectionLeader(reqData.SrvType)
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnObserveLeader(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*ObserveLeaderReq)
+
+	err := s.checkSrvTypePerm(req, DEFAULT_NAMESPACE, reqData.SrvType, false, ACL_PERM_WATCH)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnObserveLeader", err)
+	}
+
+	RegCenter.AddElectionObserver(reqData.SrvType, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnStopObserveLeader(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*StopObserveLeaderReq)
+	RegCenter.RemoveElectionObserver(reqData.SrvType, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnFindSrvs(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*FindSrvsReq)
+	respData := resp.ExtData.(*FindSrvsResp)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnFindSrvs", err)
+	}
+
+	selector, err := ParseSelector(reqData.Selector)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnFindSrvs", err)
+	}
+
+	if reqData.ByType {
+		err = s.checkSrvTypePerm(req, reqData.Namespace, reqData.SrvType, false, ACL_PERM_READ)
+		if err != nil {
+			return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnFindSrvs", err)
+		}
+	}
+
+	// the servers of the types without the read permission are skipped
+	regInfo := ns.GetRegInfo()
+	respData.Data = regInfo.FindSrvInfos(reqData.SrvType, reqData.ByType, func(info *SrvInfo) bool {
+		return selector.IsMatch(info) && s.checkSrvPerm(req, reqData.Namespace, info.SrvType, info.SrvNo, ACL_PERM_READ) == nil
+	})
+
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnWatchSrvsBySelector(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*WatchSrvsBySelectorReq)
+
+	ns, err := RegCenter.Namespace(reqData.Namespace)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnWatchSrvsBySelector", err)
+	}
+
+	err = s.checkSrvTypePerm(req, reqData.Namespace, reqData.SrvType, !reqData.ByType, ACL_PERM_WATCH)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnWatchSrvsBySelector", err)
+	}
+
+	err = RegCenter.AddSelectorObserver(ns.GetName(), reqData.SrvType, reqData.ByType, reqData.Selector, uint32(req.Src.PeerType), uint32(req.Src.PeerNo), reqData.WatchOpt)
+	if err != nil {
+		return RES_CODE_INVALID_PARAM, s.ec.Throw("OnWatchSrvsBySelector", err)
+	}
+
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnStopWatchSrvsBySelector(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*StopWatchSrvsBySelectorReq)
+	RegCenter.RemoveSelectorObserver(reqData.Namespace, reqData.SrvType, reqData.ByType, reqData.Selector, uint32(req.Src.PeerType), uint32(req.Src.PeerNo))
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+// OnHealthPong check no permission, a peer can only answer the pings sent to itself.
+func (s *Service) OnHealthPong(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*HealthPongReq)
+	RegCenter.OnHealthPong(uint32(req.Src.PeerType), uint32(req.Src.PeerNo), reqData.Seq)
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) OnAuth(req *server.Request, resp *server.Response) (int32, error) {
+	reqData := req.ExtData.(*AuthReq)
+	respData := resp.ExtData.(*AuthResp)
+
+	if s.acl == nil {
+		return server.RESP_CODE_SUCCESS, nil
+	}
+
+	identity, err := s.acl.Auth(uint32(req.Src.PeerType), uint32(req.Src.PeerNo), reqData.Token)
+	if err != nil {
+		return RES_CODE_PERMISSION_DENIED, s.ec.Throw("OnAuth", err)
+	}
+
+	respData.Identity = identity
+	return server.RESP_CODE_SUCCESS, nil
+}
+
+func (s *Service) onConnClose(srvType uint32, srvNo uint32) {
+	if s.acl != nil {
+		s.acl.Unbind(srvType, srvNo)
+	}
+}
+
+func (s *Service) checkSrvPerm(req *server.Request, ns string, srvType uint32, srvNo uint32, perm string) error {
+	if s.acl == nil {
+		return nil
+	}
+
+	return s.acl.CheckSrv(uint32(req.Src.PeerType), uint32(req.Src.PeerNo), ns, srvType, srvNo, perm)
+}
+
+// checkSrvTypePerm check the permission on the server type, or all the server types if bAllTypes is true.
+func (s *Service) checkSrvTypePerm(req *server.Request, ns string, srvType uint32, bAllTypes bool, perm string) error {
+	if s.acl == nil {
+		return nil
+	}
+
+	if bAllTypes {
+		return s.acl.CheckAllSrvTypes(uint32(req.Src.PeerType), uint32(req.Src.PeerNo), ns, perm)
+	}
+
+	return s.acl.CheckSrvType(uint32(req.Src.PeerType), uint32(req.Src.PeerNo), ns, srvType, perm)
+}
+
+func (s *Service) checkGlobalPerm(req *server.Request, ns string, key string, perm string) error {
+	if s.acl == nil {
+		return nil
+	}
+
+	return s.acl.CheckGlobalData(uint32(req.Src.PeerType), uint32(req.Src.PeerNo), ns, key, perm)
+}
+
+// checkTxnPerm check the read permission of the compares and the write permission of the ops,
+// the keys kept by the registry can not be written by the ops.
+func (s *Service) checkTxnPerm(req *server.Request, reqData *TxnReq) error {
+	for _, cmp := range reqData.Compares {
+		err := s.checkKeyPerm(req, reqData.Namespace, cmp.KeyType, cmp.Key, ACL_PERM_READ)
+		if err != nil {
+			return err
+		}
+	}
+
+	ops := make([]*TxnOp, 0, len(reqData.Success)+len(reqData.Failure))
+	ops = append(ops, reqData.Success...)
+	ops = append(ops, reqData.Failure...)
+	for _, op := range ops {
+		keyType := KEY_TYPE_GLOBAL_DATA
+		if op.Type == TXN_OP_UPDATE_SRV || op.Type == TXN_OP_REMOVE_SRV {
+			keyType = KEY_TYPE_SRV_INFO
+		}
+
+		err := s.checkKeyPerm(req, reqData.Namespace, keyType, op.GetKey(), ACL_PERM_WRITE)
+		if err != nil {
+			return err
+		}
+
+		if keyType == KEY_TYPE_GLOBAL_DATA {
+			err = checkWritableKey(reqData.Namespace, op.GetKey())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// filterTxnResults strip the values of the keys which can not be read by the peer,
+// the ops only need the write permission, so the values must not be leaked by the results.
+func (s *Service) filterTxnResults(req *server.Request, ns string, pushList []*DataOprPush) []*DataOprPush {
+	if s.acl == nil {
+		return pushList
+	}
+
+	results := make([]*DataOprPush, 0, len(pushList))
+	for _, pushData := range pushList {
+		err := s.checkKeyPerm(req, ns, pushData.KeyType, pushData.Key, ACL_PERM_READ)
+		if err != nil {
+			pushData = pushData.WithOpt(WatchOpt{})
+		}
+
+		results = append(results, pushData)
+	}
+
+	return results
+}
+
+// checkWritableKey reject the requests to write the keys kept by the registry, the locks and the elections.
+func checkWritableKey(ns string, key string) error {
+	if ns != DEFAULT_NAMESPACE {
+		return nil
+	}
+
+	if isLockKey(key) {
+		return ErrLockKeyReserved
+	}
+
+	if isElectionKey(key) {
+		return ErrElectionKeyReserved
+	}
+
+	return nil
+}
+
+func (s *Service) checkKeyPerm(req *server.Request, ns string, keyType int, key string, perm string) error {
+	if keyType == KEY_TYPE_SRV_INFO {
+		srvType, srvNo := GetSrvTypeAndNo(key)
+		return s.checkSrvPerm(req, ns, srvType, srvNo, perm)
+	}
+
+	return s.checkGlobalPerm(req, ns, key, perm)
+}
+
+func (s *Service) getRevResCode(err error, notExistsCode int32) int32 {
+	if err == ErrRevisionCompacted {
+		return RES_CODE_REVISION_COMPACTED
+	}
+
+	if err == ErrFutureRevision {
+		return RES_CODE_FUTURE_REVISION
+	}
+
+	return notExistsCode
+}
+
+func (s *Service) getCompareResCode(err error) int32 {
+	if err == ErrCompareFailed {
+		return RES_CODE_COMPARE_FAILED
+	}
+
+	return s.getWriteResCode(err, RES_CODE_INVALID_PARAM)
+}
+
+func (s *Service) getWriteResCode(err error, defaultCode int32) int32 {
+	if err == ErrRaftNotLeader {
+		return RES_CODE_NOT_LEADER
+	}
+
+	if err == ErrQuotaExceeded {
+		return RES_CODE_QUOTA_EXCEEDED
+	}
+
+	if err == ErrRaftProposeTimeout || err == ErrRaftStopped {
+		return RES_CODE_UNAVAILABLE
+	}
+
+	return defaultCode
+}
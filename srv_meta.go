@@ -0,0 +1,202 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidSrvStatus = errors.New("invalid server status")
+)
+
+// the status lifecycle of a server, an empty status is treated as serving
+const (
+	SRV_STATUS_STARTING    = "starting"
+	SRV_STATUS_SERVING     = "serving"
+	SRV_STATUS_DRAINING    = "draining"
+	SRV_STATUS_MAINTENANCE = "maintenance"
+)
+
+func IsValidSrvStatus(status string) bool {
+	return status == SRV_STATUS_STARTING || status == SRV_STATUS_SERVING ||
+		status == SRV_STATUS_DRAINING || status == SRV_STATUS_MAINTENANCE
+}
+
+// IsAdminSrvStatus check if the status is set by the admin, it is not changed by the server itself.
+func IsAdminSrvStatus(status string) bool {
+	return status == SRV_STATUS_DRAINING || status == SRV_STATUS_MAINTENANCE
+}
+
+// isValidSrvMeta check the meta reported by the server, the status can be empty.
+func isValidSrvMeta(meta *SrvMeta) bool {
+	return meta == nil || meta.Status == "" || IsValidSrvStatus(meta.Status)
+}
+
+type Endpoint struct {
+	Protocol string `json:"protocol,omitempty"`
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+}
+
+func NewEndpoint(protocol string, host string, port uint16) *Endpoint {
+	return &Endpoint{
+		Protocol: protocol,
+		Host:     host,
+		Port:     port,
+	}
+}
+
+// SrvMeta is the structured information of a server, all the fields are optional.
+type SrvMeta struct {
+	Endpoints []*Endpoint       `json:"endpoints,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Weight    uint32            `json:"weight,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	Status    string            `json:"status,omitempty"`
+}
+
+// Merge replace the meta by the one reported by the server, the status is kept
+// if it is set by the admin or the reported one is empty.
+func (m *SrvMeta) Merge(meta *SrvMeta) {
+	status := m.Status
+	*m = *meta
+	if IsAdminSrvStatus(status) || meta.Status == "" {
+		m.Status = status
+	}
+}
+
+// Clone return a deep copy of the meta.
+func (m *SrvMeta) Clone() SrvMeta {
+	meta := *m
+	if m.Endpoints != nil {
+		meta.Endpoints = make([]*Endpoint, 0, len(m.Endpoints))
+		for _, ep := range m.Endpoints {
+			if ep == nil {
+				meta.Endpoints = append(meta.Endpoints, nil)
+				continue
+			}
+
+			copyEp := *ep
+			meta.Endpoints = append(meta.Endpoints, &copyEp)
+		}
+	}
+
+	if m.Labels != nil {
+		meta.Labels = make(map[string]string, len(m.Labels))
+		for name, value := range m.Labels {
+			meta.Labels[name] = value
+		}
+	}
+
+	return meta
+}
+
+func (m *SrvMeta) GetLabel(name string) (string, bool) {
+	value, ok := m.Labels[name]
+	return value, ok
+}
+
+// GetEndpoint return the first endpoint of the protocol, any protocol if protocol is empty.
+func (m *SrvMeta) GetEndpoint(protocol string) (*Endpoint, bool) {
+	for _, ep := range m.Endpoints {
+		if protocol == "" || ep.Protocol == protocol {
+			return ep, true
+		}
+	}
+
+	return nil, false
+}
+
+// IsInRotation check if the server can take new requests,
+// the servers starting, draining, in maintenance or unhealthy are out of rotation.
+func IsInRotation(info *SrvInfo) bool {
+	if info.Health == SRV_HEALTH_UNHEALTHY {
+		return false
+	}
+
+	return info.Status != SRV_STATUS_STARTING && info.Status != SRV_STATUS_DRAINING &&
+		info.Status != SRV_STATUS_MAINTENANCE
+}
+
+//======================
+//      SrvFilter
+//======================
+// SrvFilter match the servers by the meta, the empty fields are ignored.
+type SrvFilter struct {
+	Labels     map[string]string `json:"labels,omitempty"`
+	Version    string            `json:"version,omitempty"`
+	Status     string            `json:"status,omitempty"`
+	MinWeight  uint32            `json:"min_weight,omitempty"`
+	Protocol   string            `json:"protocol,omitempty"`
+	InRotation bool              `json:"in_rotation,omitempty"`
+}
+
+func (f *SrvFilter) IsMatch(info *SrvInfo) bool {
+	for name, value := range f.Labels {
+		label, ok := info.GetLabel(name)
+		if !ok || label != value {
+			return false
+		}
+	}
+
+	if f.Version != "" && info.Version != f.Version {
+		return false
+	}
+
+	if f.Status != "" && info.Status != f.Status {
+		return false
+	}
+
+	if info.Weight < f.MinWeight {
+		return false
+	}
+
+	if f.Protocol != "" {
+		_, ok := info.GetEndpoint(f.Protocol)
+		if !ok {
+			return false
+		}
+	}
+
+	if f.InRotation && !IsInRotation(info) {
+		return false
+	}
+
+	return true
+}
+
+func FilterSrvInfos(infos []*SrvInfo, filter *SrvFilter) []*SrvInfo {
+	if filter == nil {
+		return infos
+	}
+
+	matched := make([]*SrvInfo, 0, len(infos))
+	for _, info := range infos {
+		if filter.IsMatch(info) {
+			matched = append(matched, info)
+		}
+	}
+
+	return matched
+}
+
+// FilterSrvInfosWithRev return the servers which match the filter with their revisions by index.
+func FilterSrvInfosWithRev(infos []*SrvInfo, revs []KeyRev, filter *SrvFilter) ([]*SrvInfo, []KeyRev) {
+	if filter == nil {
+		return infos, revs
+	}
+
+	matched := make([]*SrvInfo, 0, len(infos))
+	matchedRevs := make([]KeyRev, 0, len(revs))
+	for i, info := range infos {
+		if filter.IsMatch(info) {
+			matched = append(matched, info)
+			matchedRevs = append(matchedRevs, revs[i])
+		}
+	}
+
+	return matched, matchedRevs
+}
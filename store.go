@@ -0,0 +1,276 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrStoreNotOpen = errors.New("store not open")
+)
+
+//======================
+//        Store
+//======================
+type Store interface {
+	// Load restore the registry information into info.
+	Load(info *RegInfo) error
+
+	// Open prepare the store for writing, it is called after Load.
+	Open() error
+
+	// Append persist the operations right after they are applied.
+	Append(records ...*DataOprPush) error
+
+	// Flush is called by the save loop when the data changed.
+	Flush(info *RegInfo) error
+
+	// SaveWatches persist the watches of the observers, they replace the saved ones.
+	// It is called by the save loop before Flush.
+	SaveWatches(info *RegInfo, watches []*SavedWatch) error
+
+	// LoadWatches return the watches persisted by SaveWatches, it is called after Load.
+	LoadWatches(info *RegInfo) ([]*SavedWatch, error)
+
+	Close() error
+}
+
+// replayRecords apply the records after afterRev in order of revision.
+// A broken record is skipped and the first error is returned.
+func replayRecords(info *RegInfo, records []*DataOprPush, afterRev int64) error {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].ModRev < records[j].ModRev
+	})
+
+	var firstErr error = nil
+	for _, rec := range records {
+		if rec.ModRev <= afterRev {
+			continue
+		}
+
+		err := info.ApplyDataOpr(rec)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+//======================
+//    JsonFileStore
+//======================
+// JsonFileStore rewrite the whole registry to a json file on every flush,
+// the raft state is kept in the files next to it.
+type JsonFileStore struct {
+	*FileRaftStorage
+	path string
+}
+
+func NewJsonFileStore(path string) *JsonFileStore {
+	return &JsonFileStore{
+		FileRaftStorage: NewFileRaftStorage(path),
+		path:            path,
+	}
+}
+
+func (s *JsonFileStore) Load(info *RegInfo) error {
+	err := info.Load(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *JsonFileStore) Open() error {
+	return nil
+}
+
+func (s *JsonFileStore) Append(records ...*DataOprPush) error {
+	return nil
+}
+
+func (s *JsonFileStore) Flush(info *RegInfo) error {
+	return info.Save(s.path)
+}
+
+// SaveWatches keep the watches in the save format of info, they are written by Flush.
+func (s *JsonFileStore) SaveWatches(info *RegInfo, watches []*SavedWatch) error {
+	info.SetSavedWatches(watches)
+	return nil
+}
+
+func (s *JsonFileStore) LoadWatches(info *RegInfo) ([]*SavedWatch, error) {
+	return info.GetSavedWatches(), nil
+}
+
+func (s *JsonFileStore) Close() error {
+	return s.FileRaftStorage.Close()
+}
+
+//======================
+//      WalStore
+//======================
+// WalStore append every operation to a write-ahead log,
+// and take a snapshot when the log grows too long.
+// The raft state is kept in the files next to the snapshot.
+type WalStore struct {
+	*FileRaftStorage
+	snapshotPath string
+	wal          *Wal
+	maxRecordNum int
+}
+
+func NewWalStore(snapshotPath string) *WalStore {
+	return &WalStore{
+		FileRaftStorage: NewFileRaftStorage(snapshotPath),
+		snapshotPath:    snapshotPath,
+		wal:             NewWal(snapshotPath + WAL_FILE_SUFFIX),
+		maxRecordNum:    MAX_WAL_RECORD_SNAPSHOT,
+	}
+}
+
+func (s *WalStore) SetMaxRecordNum(maxRecordNum int) {
+	s.maxRecordNum = maxRecordNum
+}
+
+func (s *WalStore) Load(info *RegInfo) error {
+	err := info.Load(s.snapshotPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	snapshotRev := info.GetRevision()
+	records := make([]*DataOprPush, 0)
+	err = s.wal.Replay(func(rec *DataOprPush) {
+		records = append(records, rec)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return replayRecords(info, records, snapshotRev)
+}
+
+func (s *WalStore) Open() error {
+	return s.wal.Open()
+}
+
+func (s *WalStore) Append(records ...*DataOprPush) error {
+	return s.wal.Append(records...)
+}
+
+// Flush take a snapshot when the log grows too long, or when the saved watches changed,
+// which are not in the log.
+func (s *WalStore) Flush(info *RegInfo) error {
+	if s.wal.GetRecordNum() < s.maxRecordNum && !info.IsWatchChanged() {
+		return nil
+	}
+
+	return s.wal.Compact(func() error {
+		return info.Save(s.snapshotPath)
+	})
+}
+
+// SaveWatches keep the watches in the save format of info, they are written by the snapshot of Flush.
+func (s *WalStore) SaveWatches(info *RegInfo, watches []*SavedWatch) error {
+	info.SetSavedWatches(watches)
+	return nil
+}
+
+func (s *WalStore) LoadWatches(info *RegInfo) ([]*SavedWatch, error) {
+	return info.GetSavedWatches(), nil
+}
+
+func (s *WalStore) Close() error {
+	err := s.wal.Close()
+	raftErr := s.FileRaftStorage.Close()
+	if err == nil {
+		err = raftErr
+	}
+
+	return err
+}
+
+//======================
+//      MemStore
+//======================
+// MemStore keep the latest record of every key in memory, it is useful in tests.
+// The records of the removed keys are kept too, so the revision can be restored.
+type MemStore struct {
+	*MemRaftStorage
+	mapKey2Record map[string]*DataOprPush
+	watches       []*SavedWatch
+	lck           *sync.Mutex
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		MemRaftStorage: NewMemRaftStorage(),
+		mapKey2Record:  make(map[string]*DataOprPush),
+		watches:        nil,
+		lck:            &sync.Mutex{},
+	}
+}
+
+func (s *MemStore) Load(info *RegInfo) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	records := make([]*DataOprPush, 0, len(s.mapKey2Record))
+	for _, rec := range s.mapKey2Record {
+		records = append(records, rec)
+	}
+
+	return replayRecords(info, records, 0)
+}
+
+func (s *MemStore) Open() error {
+	return nil
+}
+
+func (s *MemStore) Append(records ...*DataOprPush) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	for _, rec := range records {
+		storeKey := rec.GetRecordKey()
+		old, ok := s.mapKey2Record[storeKey]
+		if !ok || old.ModRev <= rec.ModRev {
+			s.mapKey2Record[storeKey] = rec
+		}
+	}
+
+	return nil
+}
+
+func (s *MemStore) Flush(info *RegInfo) error {
+	return nil
+}
+
+func (s *MemStore) SaveWatches(info *RegInfo, watches []*SavedWatch) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	s.watches = watches
+	return nil
+}
+
+func (s *MemStore) LoadWatches(info *RegInfo) ([]*SavedWatch, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	return s.watches, nil
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
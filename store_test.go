@@ -0,0 +1,223 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type testStoreCase struct {
+	name string
+	open func() Store
+}
+
+// newTestStoreCases return the stores to test, every call of open return
+// a store on the same data, like a restart.
+func newTestStoreCases(t *testing.T) []*testStoreCase {
+	dir := t.TempDir()
+	mem := NewMemStore()
+	return []*testStoreCase{
+		{"mem", func() Store { return mem }},
+		{"wal", func() Store { return NewWalStore(filepath.Join(dir, "reg.json")) }},
+		{"bolt", func() Store { return NewBoltStore(filepath.Join(dir, "reg.db")) }},
+	}
+}
+
+func newTestGlobalPush(key string, data string, rev int64) *DataOprPush {
+	pushData := NewDataOprPush(KEY_TYPE_GLOBAL_DATA, key, DATA_OPR_TYPE_UPDATE, KeyRev{CreateRev: rev, ModRev: rev})
+	pushData.Namespace = DEFAULT_NAMESPACE
+	pushData.SetValue(data, nil)
+	return pushData
+}
+
+func setTestGlobalData(t *testing.T, info *RegInfo, key string, data string) *DataOprPush {
+	pushData, err := info.SetGlobalData(key, data)
+	if err != nil {
+		t.Fatal("set ", key, " err: ", err)
+	}
+
+	return pushData
+}
+
+// appendAndReload append the records in order, close the store and load it again.
+func appendAndReload(t *testing.T, open func() Store, records ...*DataOprPush) *RegInfo {
+	s := open()
+	err := s.Load(NewRegInfo())
+	if err != nil {
+		t.Fatal("load err: ", err)
+	}
+
+	err = s.Open()
+	if err != nil {
+		t.Fatal("open err: ", err)
+	}
+
+	for _, rec := range records {
+		err = s.Append(rec)
+		if err != nil {
+			t.Fatal("append ", rec.Key, " err: ", err)
+		}
+	}
+
+	s.Close()
+
+	s = open()
+	defer s.Close()
+
+	info := NewRegInfo()
+	err = s.Load(info)
+	if err != nil {
+		t.Fatal("reload err: ", err)
+	}
+
+	return info
+}
+
+func checkTestGlobalData(t *testing.T, info *RegInfo, key string, data string, kr KeyRev) {
+	curData, curKr, err := info.GetGlobalDataAtRev(key, 0)
+	if err != nil {
+		t.Fatal("get ", key, " err: ", err)
+	}
+
+	if curData != data || curKr != kr {
+		t.Fatal(key, " should be ", data, " ", kr, ", but ", curData, " ", curKr)
+	}
+}
+
+func TestStoreLoadRevision(t *testing.T) {
+	for _, c := range newTestStoreCases(t) {
+		info := NewRegInfo()
+		records := []*DataOprPush{
+			setTestGlobalData(t, info, "/a", "1"),
+			setTestGlobalData(t, info, "/a", "2"),
+			setTestGlobalData(t, info, "/b", "3"),
+		}
+
+		pushList, _ := info.RemoveGlobalData("/b")
+		records = append(records, pushList...)
+
+		loadedInfo := appendAndReload(t, c.open, records...)
+		checkTestGlobalData(t, loadedInfo, "/a", "2", KeyRev{CreateRev: 1, ModRev: 2})
+		if loadedInfo.HasGlobalData("/b") {
+			t.Fatal(c.name, ": /b should be removed")
+		}
+
+		// the revision of the remove is restored too
+		if loadedInfo.GetRevision() != 4 {
+			t.Fatal(c.name, ": the revision should be 4, but ", loadedInfo.GetRevision())
+		}
+	}
+}
+
+func TestStoreAppendOutOfOrder(t *testing.T) {
+	for _, c := range newTestStoreCases(t) {
+		info := NewRegInfo()
+		push1 := setTestGlobalData(t, info, "/a", "1")
+		push2 := setTestGlobalData(t, info, "/a", "2")
+
+		loadedInfo := appendAndReload(t, c.open, push2, push1)
+		checkTestGlobalData(t, loadedInfo, "/a", "2", KeyRev{CreateRev: 1, ModRev: 2})
+		if loadedInfo.GetRevision() != 2 {
+			t.Fatal(c.name, ": the revision should be 2, but ", loadedInfo.GetRevision())
+		}
+	}
+}
+
+func TestWalStoreSkipSnapshotRevision(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "reg.json")
+	info := NewRegInfo()
+	setTestGlobalData(t, info, "/a", "1")
+	setTestGlobalData(t, info, "/b", "2")
+	info.RemoveGlobalData("/b")
+	err := info.Save(snapshotPath)
+	if err != nil {
+		t.Fatal("save err: ", err)
+	}
+
+	// crash before the log is cleared, the records at or below
+	// the snapshot revision 3 must not be applied again
+	open := func() Store { return NewWalStore(snapshotPath) }
+	loadedInfo := appendAndReload(t, open,
+		newTestGlobalPush("/b", "2", 2),
+		newTestGlobalPush("/c", "3", 3),
+		setTestGlobalData(t, info, "/a", "4"))
+
+	checkTestGlobalData(t, loadedInfo, "/a", "4", KeyRev{CreateRev: 1, ModRev: 4})
+	for _, key := range []string{"/b", "/c"} {
+		if loadedInfo.HasGlobalData(key) {
+			t.Fatal(key, " should not be replayed")
+		}
+	}
+
+	if loadedInfo.GetRevision() != 4 {
+		t.Fatal("the revision should be 4, but ", loadedInfo.GetRevision())
+	}
+}
+
+func TestBoltStoreFlushTombstones(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reg.db")
+	s := NewBoltStore(path)
+	err := s.Load(NewRegInfo())
+	if err != nil {
+		t.Fatal("load err: ", err)
+	}
+
+	info := NewRegInfo()
+	records := []*DataOprPush{
+		setTestGlobalData(t, info, "/a", "1"),
+		setTestGlobalData(t, info, "/b", "2"),
+	}
+
+	pushList, _ := info.RemoveGlobalData("/b")
+	records = append(records, pushList...)
+	err = s.Append(records...)
+	if err != nil {
+		t.Fatal("append err: ", err)
+	}
+
+	hasTombstone := func() bool {
+		bExists := false
+		s.db.View(func(tx *bolt.Tx) error {
+			bExists = (tx.Bucket(BOLT_BUCKET_GLOBAL).Get([]byte("/b")) != nil)
+			return nil
+		})
+
+		return bExists
+	}
+
+	// not enough tombstones
+	err = s.Flush(info)
+	if err != nil || !hasTombstone() || atomic.LoadInt64(&s.tombstoneNum) != 1 {
+		t.Fatal("the tombstone should be kept, err: ", err)
+	}
+
+	// pretend the others are appended
+	atomic.StoreInt64(&s.tombstoneNum, BOLT_MAX_TOMBSTONE_NUM)
+	err = s.Flush(info)
+	if err != nil || hasTombstone() || atomic.LoadInt64(&s.tombstoneNum) != BOLT_MAX_TOMBSTONE_NUM-1 {
+		t.Fatal("the tombstone should be compacted, err: ", err)
+	}
+
+	s.Close()
+
+	// the revision of the compacted tombstone is kept in the meta bucket
+	s = NewBoltStore(path)
+	defer s.Close()
+
+	loadedInfo := NewRegInfo()
+	err = s.Load(loadedInfo)
+	if err != nil {
+		t.Fatal("reload err: ", err)
+	}
+
+	checkTestGlobalData(t, loadedInfo, "/a", "1", KeyRev{CreateRev: 1, ModRev: 1})
+	if loadedInfo.HasGlobalData("/b") || loadedInfo.GetRevision() != 3 {
+		t.Fatal("/b should be removed at the revision 3, but ", loadedInfo.GetRevision())
+	}
+}
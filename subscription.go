@@ -0,0 +1,284 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	SUBSCRIPTION_BUF_SIZE = 64
+)
+
+// SubscribeFilter select the data pushes of a subscription, the empty fields are ignored.
+// KeyPrefix match the whole segments of the key, e.g. "/1" match "/1" and "/1/2" but not "/10".
+type SubscribeFilter struct {
+	KeyPrefix string
+	KeyType   int
+	Operates  []int
+}
+
+// isKeyUnderPrefix check if the key is the prefix or one of its descendants.
+func isKeyUnderPrefix(key string, prefix string) bool {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+
+	return key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+func (f *SubscribeFilter) IsMatch(pushData *DataOprPush) bool {
+	if f == nil {
+		return true
+	}
+
+	if f.KeyType != 0 && pushData.KeyType != f.KeyType {
+		return false
+	}
+
+	if f.KeyPrefix != "" && !isKeyUnderPrefix(pushData.Key, f.KeyPrefix) {
+		return false
+	}
+
+	if len(f.Operates) == 0 {
+		return true
+	}
+
+	for _, opr := range f.Operates {
+		if opr == pushData.Operate {
+			return true
+		}
+	}
+
+	return false
+}
+
+//======================
+//     Subscription
+//======================
+// Subscription receive the data pushes matched by the filter in its own buffer.
+// The pushes are dropped if the buffer is full, so a slow subscriber never block the others.
+// The channel is closed when the subscription is canceled or the client is stopped.
+type Subscription struct {
+	id        uint64
+	filter    *SubscribeFilter
+	chanEvent chan *DataOprPush
+	dropped   uint64
+	cancelCb  func(id uint64)
+	onceClose *sync.Once
+}
+
+func newSubscription(id uint64, filter *SubscribeFilter, bufSize int, cancelCb func(id uint64)) *Subscription {
+	if bufSize <= 0 {
+		bufSize = SUBSCRIPTION_BUF_SIZE
+	}
+
+	return &Subscription{
+		id:        id,
+		filter:    filter,
+		chanEvent: make(chan *DataOprPush, bufSize),
+		dropped:   0,
+		cancelCb:  cancelCb,
+		onceClose: &sync.Once{},
+	}
+}
+
+func (s *Subscription) C() <-chan *DataOprPush {
+	return s.chanEvent
+}
+
+// Next wait for the next push, return false if the subscription is closed.
+func (s *Subscription) Next() (*DataOprPush, bool) {
+	pushData, ok := <-s.chanEvent
+	return pushData, ok
+}
+
+func (s *Subscription) Cancel() {
+	s.cancelCb(s.id)
+}
+
+func (s *Subscription) GetDropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) deliver(pushData *DataOprPush) {
+	if !s.filter.IsMatch(pushData) {
+		return
+	}
+
+	select {
+	case s.chanEvent <- pushData:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (s *Subscription) close() {
+	s.onceClose.Do(func() {
+		close(s.chanEvent)
+	})
+}
+
+//======================
+//   ConnSubscription
+//======================
+// ConnSubscription receive the connection change pushes in its own buffer, the pushes are dropped if it is full.
+type ConnSubscription struct {
+	id        uint64
+	chanEvent chan *ConnChangePush
+	dropped   uint64
+	cancelCb  func(id uint64)
+	onceClose *sync.Once
+}
+
+func newConnSubscription(id uint64, bufSize int, cancelCb func(id uint64)) *ConnSubscription {
+	if bufSize <= 0 {
+		bufSize = SUBSCRIPTION_BUF_SIZE
+	}
+
+	return &ConnSubscription{
+		id:        id,
+		chanEvent: make(chan *ConnChangePush, bufSize),
+		dropped:   0,
+		cancelCb:  cancelCb,
+		onceClose: &sync.Once{},
+	}
+}
+
+func (s *ConnSubscription) C() <-chan *ConnChangePush {
+	return s.chanEvent
+}
+
+// Next wait for the next push, return false if the subscription is closed.
+func (s *ConnSubscription) Next() (*ConnChangePush, bool) {
+	pushData, ok := <-s.chanEvent
+	return pushData, ok
+}
+
+func (s *ConnSubscription) Cancel() {
+	s.cancelCb(s.id)
+}
+
+func (s *ConnSubscription) GetDropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *ConnSubscription) deliver(pushData *ConnChangePush) {
+	select {
+	case s.chanEvent <- pushData:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+func (s *ConnSubscription) close() {
+	s.onceClose.Do(func() {
+		close(s.chanEvent)
+	})
+}
+
+//======================
+//    subscriptionMgr
+//======================
+type subscriptionMgr struct {
+	lastId        uint64
+	mapId2Sub     map[uint64]*Subscription
+	mapId2ConnSub map[uint64]*ConnSubscription
+	bClosed       bool
+	lck           *sync.RWMutex
+}
+
+func newSubscriptionMgr() *subscriptionMgr {
+	return &subscriptionMgr{
+		lastId:        0,
+		mapId2Sub:     make(map[uint64]*Subscription),
+		mapId2ConnSub: make(map[uint64]*ConnSubscription),
+		bClosed:       false,
+		lck:           &sync.RWMutex{},
+	}
+}
+
+func (m *subscriptionMgr) Subscribe(filter *SubscribeFilter, bufSize int) *Subscription {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	m.lastId++
+	sub := newSubscription(m.lastId, filter, bufSize, m.unsubscribe)
+	if m.bClosed {
+		sub.close()
+		return sub
+	}
+
+	m.mapId2Sub[sub.id] = sub
+	return sub
+}
+
+func (m *subscriptionMgr) SubscribeConnChange(bufSize int) *ConnSubscription {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	m.lastId++
+	sub := newConnSubscription(m.lastId, bufSize, m.unsubscribe)
+	if m.bClosed {
+		sub.close()
+		return sub
+	}
+
+	m.mapId2ConnSub[sub.id] = sub
+	return sub
+}
+
+func (m *subscriptionMgr) DeliverDataOpr(pushData *DataOprPush) {
+	m.lck.RLock()
+	defer m.lck.RUnlock()
+
+	for _, sub := range m.mapId2Sub {
+		sub.deliver(pushData)
+	}
+}
+
+func (m *subscriptionMgr) DeliverConnChange(pushData *ConnChangePush) {
+	m.lck.RLock()
+	defer m.lck.RUnlock()
+
+	for _, sub := range m.mapId2ConnSub {
+		sub.deliver(pushData)
+	}
+}
+
+// Close close all the subscriptions, the later subscriptions are closed immediately.
+func (m *subscriptionMgr) Close() {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	m.bClosed = true
+	for id, sub := range m.mapId2Sub {
+		sub.close()
+		delete(m.mapId2Sub, id)
+	}
+
+	for id, sub := range m.mapId2ConnSub {
+		sub.close()
+		delete(m.mapId2ConnSub, id)
+	}
+}
+
+func (m *subscriptionMgr) unsubscribe(id uint64) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	if sub, ok := m.mapId2Sub[id]; ok {
+		sub.close()
+		delete(m.mapId2Sub, id)
+	}
+
+	if sub, ok := m.mapId2ConnSub[id]; ok {
+		sub.close()
+		delete(m.mapId2ConnSub, id)
+	}
+}
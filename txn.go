@@ -0,0 +1,106 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+var (
+	ErrInvalidTxnOp = errors.New("invalid txn operation")
+)
+
+const (
+	TXN_OP_UPDATE_SRV = 1 + iota
+	TXN_OP_REMOVE_SRV
+	TXN_OP_UPDATE_GLOBAL_DATA
+	TXN_OP_REMOVE_GLOBAL_DATA
+)
+
+type TxnCompare struct {
+	KeyType int    `json:"key_type"`
+	Key     string `json:"key"`
+	Compare
+}
+
+func NewTxnCompare(keyType int, key string, cmp *Compare) *TxnCompare {
+	return &TxnCompare{
+		KeyType: keyType,
+		Key:     key,
+		Compare: *cmp,
+	}
+}
+
+func (c *TxnCompare) IsValid() bool {
+	if c.KeyType != KEY_TYPE_SRV_INFO && c.KeyType != KEY_TYPE_GLOBAL_DATA {
+		return false
+	}
+
+	return c.Compare.IsValid()
+}
+
+type TxnOp struct {
+	Type       int      `json:"type"`
+	SrvType    uint32   `json:"srv_type"`
+	SrvNo      uint32   `json:"srv_no"`
+	IsTemp     bool     `json:"bTemp"`
+	Key        string   `json:"key"`
+	DataBase64 string   `json:"data"`
+	Meta       *SrvMeta `json:"meta,omitempty"`
+}
+
+func NewTxnOpUpdateSrv(srvType uint32, srvNo uint32, bTemp bool, data []byte) *TxnOp {
+	return &TxnOp{
+		Type:       TXN_OP_UPDATE_SRV,
+		SrvType:    srvType,
+		SrvNo:      srvNo,
+		IsTemp:     bTemp,
+		DataBase64: base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+func NewTxnOpRemoveSrv(srvType uint32, srvNo uint32) *TxnOp {
+	return &TxnOp{
+		Type:    TXN_OP_REMOVE_SRV,
+		SrvType: srvType,
+		SrvNo:   srvNo,
+	}
+}
+
+func NewTxnOpUpdateGlobalData(key string, data []byte) *TxnOp {
+	return &TxnOp{
+		Type:       TXN_OP_UPDATE_GLOBAL_DATA,
+		Key:        key,
+		DataBase64: base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+func NewTxnOpRemoveGlobalData(key string) *TxnOp {
+	return &TxnOp{
+		Type: TXN_OP_REMOVE_GLOBAL_DATA,
+		Key:  key,
+	}
+}
+
+func (o *TxnOp) GetKey() string {
+	if o.Type == TXN_OP_UPDATE_SRV || o.Type == TXN_OP_REMOVE_SRV {
+		return GetSrvKey(o.SrvType, o.SrvNo)
+	}
+
+	return o.Key
+}
+
+func (o *TxnOp) IsValid() bool {
+	if o.Type < TXN_OP_UPDATE_SRV || o.Type > TXN_OP_REMOVE_GLOBAL_DATA {
+		return false
+	}
+
+	if !isValidSrvMeta(o.Meta) {
+		return false
+	}
+
+	return len(ParseInfoPath(o.GetKey())) > 0
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func encodeTestData(data string) string {
+	return base64.StdEncoding.EncodeToString([]byte(data))
+}
+
+// newTestTxnInfo return a RegInfo with /a set to "1" at the revision 1.
+func newTestTxnInfo(t *testing.T) *RegInfo {
+	info := NewRegInfo()
+	setTestGlobalData(t, info, "/a", encodeTestData("1"))
+	return info
+}
+
+func TestCompareAndSetGlobalData(t *testing.T) {
+	cases := []struct {
+		name  string
+		key   string
+		cmp   *Compare
+		bSucc bool
+	}{
+		{"exists", "/a", NewCompareExists(true), true},
+		{"not exists", "/b", NewCompareExists(false), true},
+		{"value", "/a", NewCompareValue([]byte("1")), true},
+		{"value mismatch", "/a", NewCompareValue([]byte("2")), false},
+		{"mod rev", "/a", NewCompareModRev(1), true},
+		{"mod rev mismatch", "/a", NewCompareModRev(2), false},
+		{"create rev mismatch", "/a", NewCompareCreateRev(0), false},
+		{"missing key value", "/b", NewCompareValue([]byte("")), false},
+	}
+
+	for _, c := range cases {
+		info := newTestTxnInfo(t)
+		pushData, err := info.CompareAndSetGlobalData(c.key, encodeTestData("new"), c.cmp)
+		if c.bSucc {
+			if err != nil || pushData.ModRev != 2 || info.GetRevision() != 2 {
+				t.Fatal(c.name, ": the data should be set at the revision 2, err: ", err)
+			}
+
+			continue
+		}
+
+		if err != ErrCompareFailed {
+			t.Fatal(c.name, ": the compare should fail, err: ", err)
+		}
+
+		// the current value is returned, and nothing is changed
+		curData, curKr, _ := info.GetGlobalDataAtRev(c.key, 0)
+		if pushData.DataBase64 != curData || pushData.KeyRev != curKr {
+			t.Fatal(c.name, ": the current value should be returned, but ", pushData.DataBase64, " ", pushData.KeyRev)
+		}
+
+		if info.GetRevision() != 1 {
+			t.Fatal(c.name, ": the revision should be kept, but ", info.GetRevision())
+		}
+	}
+}
+
+func TestTxn(t *testing.T) {
+	cmpMatch := []*TxnCompare{NewTxnCompare(KEY_TYPE_GLOBAL_DATA, "/a", NewCompareValue([]byte("1")))}
+	cmpMismatch := []*TxnCompare{NewTxnCompare(KEY_TYPE_GLOBAL_DATA, "/a", NewCompareValue([]byte("2")))}
+	setOps := []*TxnOp{
+		NewTxnOpUpdateGlobalData("/a", []byte("2")),
+		NewTxnOpUpdateGlobalData("/b", []byte("3")),
+	}
+
+	removeOps := []*TxnOp{
+		NewTxnOpRemoveGlobalData("/a"),
+		NewTxnOpUpdateGlobalData("/b", []byte("3")),
+	}
+
+	cases := []struct {
+		name    string
+		cmps    []*TxnCompare
+		thenOps []*TxnOp
+		elseOps []*TxnOp
+		bSucc   bool
+		pushNum int
+		rev     int64
+		bExists bool
+	}{
+		{"then", cmpMatch, setOps, removeOps, true, 2, 2, true},
+		{"else", cmpMismatch, setOps, removeOps, false, 2, 2, false},
+		{"no compare", nil, removeOps, setOps, true, 2, 2, false},
+		{"no ops", cmpMatch, nil, removeOps, true, 0, 1, true},
+		{"remove not exists", cmpMismatch, setOps, []*TxnOp{NewTxnOpRemoveGlobalData("/c")}, false, 0, 1, true},
+	}
+
+	for _, c := range cases {
+		info := newTestTxnInfo(t)
+		bSucc, pushList, err := info.Txn(c.cmps, c.thenOps, c.elseOps)
+		if err != nil || bSucc != c.bSucc {
+			t.Fatal(c.name, ": the txn should succeed ", c.bSucc, ", err: ", err)
+		}
+
+		if len(pushList) != c.pushNum {
+			t.Fatal(c.name, ": the push num should be ", c.pushNum, ", but ", len(pushList))
+		}
+
+		// all the operations share one revision, a txn changing nothing use no revision
+		for _, pushData := range pushList {
+			if pushData.ModRev != c.rev {
+				t.Fatal(c.name, ": ", pushData.Key, " should be at the revision ", c.rev, ", but ", pushData.ModRev)
+			}
+		}
+
+		if info.GetRevision() != c.rev {
+			t.Fatal(c.name, ": the revision should be ", c.rev, ", but ", info.GetRevision())
+		}
+
+		if info.HasGlobalData("/a") != c.bExists {
+			t.Fatal(c.name, ": /a should exist ", c.bExists)
+		}
+	}
+}
+
+func TestTxnRemoveSrvRevokeLease(t *testing.T) {
+	sm := NewRegStateMachine(NewRegInfo())
+	applyTestCmd(t, sm, newTestUpdateSrvCmd(1, 1, 10, 100))
+
+	cmd := NewRegCmd(REG_CMD_TXN)
+	cmd.Compares = []*TxnCompare{NewTxnCompare(KEY_TYPE_SRV_INFO, GetSrvKey(1, 1), NewCompareExists(true))}
+	cmd.Success = []*TxnOp{NewTxnOpRemoveSrv(1, 1)}
+	result := applyTestCmd(t, sm, cmd)
+	if !result.Succeeded || len(result.PushList) != 1 || result.PushList[0].Operate != DATA_OPR_TYPE_REMOVE {
+		t.Fatal("the server should be removed by the txn")
+	}
+
+	_, err := sm.leases.KeepAlive(DEFAULT_NAMESPACE, 1, 1)
+	if err != ErrLeaseNotExists {
+		t.Fatal("the lease of the removed server should be revoked, err: ", err)
+	}
+}
@@ -1,59 +1,109 @@
-// Copyright 2022 Guan Jianchang. All rights reserved.
-// Use of this source code is governed by a BSD-style
-// license that can be found in the LICENSE file.
-
-package reg
-
-import (
-	"fmt"
-	"strconv"
-	"strings"
-)
-
-func GetSrvTypeKey(srvType uint32) string {
-	return fmt.Sprintf("/%d", srvType)
-}
-
-func GetSrvKey(srvType uint32, srvNo uint32) string {
-	return fmt.Sprintf("/%d/%d", srvType, srvNo)
-}
-
-func GetSrvTypeAndNo(key string) (uint32, uint32) {
-	subPaths := ParseInfoPath(key)
-	if len(subPaths) < 2 {
-		return 0, 0
-	}
-
-	peerType, err := strconv.ParseUint(subPaths[0], 10, 32)
-	if err != nil {
-		return 0, 0
-	}
-
-	peerNo, err := strconv.ParseUint(subPaths[1], 10, 32)
-	if err != nil {
-		return 0, 0
-	}
-
-	return uint32(peerType), uint32(peerNo)
-}
-
-func ParseInfoPath(path string) []string {
-	subPaths := make([]string, 0)
-
-	if len(path) <= 1 {
-		return subPaths
-	}
-
-	idx := strings.Index(path, "/")
-	if idx != 0 {
-		return subPaths
-	}
-
-	// subPath = append(subPath, "/")
-	// if len(path) == 1 {
-	// 	return subPath
-	// }
-
-	subStr := strings.Split(path[1:], "/")
-	return append(subPaths, subStr...)
-}
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func GetSrvTypeKey(srvType uint32) string {
+	return fmt.Sprintf("/%d", srvType)
+}
+
+func GetSrvKey(srvType uint32, srvNo uint32) string {
+	return fmt.Sprintf("/%d/%d", srvType, srvNo)
+}
+
+func GetSrvTypeAndNo(key string) (uint32, uint32) {
+	subPaths := ParseInfoPath(key)
+	if len(subPaths) < 2 {
+		return 0, 0
+	}
+
+	peerType, err := strconv.ParseUint(subPaths[0], 10, 32)
+	if err != nil {
+		return 0, 0
+	}
+
+	peerNo, err := strconv.ParseUint(subPaths[1], 10, 32)
+	if err != nil {
+		return 0, 0
+	}
+
+	return uint32(peerType), uint32(peerNo)
+}
+
+func ParseInfoPath(path string) []string {
+	subPaths := make([]string, 0)
+
+	if len(path) <= 1 {
+		return subPaths
+	}
+
+	idx := strings.Index(path, "/")
+	if idx != 0 {
+		return subPaths
+	}
+
+	// subPath = append(subPath, "/")
+	// if len(path) == 1 {
+	// 	return subPath
+	// }
+
+	subStr := strings.Split(path[1:], "/")
+	return append(subPaths, subStr...)
+}
+
+// WriteFileAtomic write data to a temporary file and rename it to filePath,
+// so filePath always holds either the old or the new content. The directory is synced after the rename.
+func WriteFileAtomic(filePath string, data []byte) error {
+	tmpPath := filePath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, filePath)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(filePath))
+}
+
+// syncDir fsync the directory, so the renamed entry is durable.
+func syncDir(dirPath string) error {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	closeErr := d.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrWalNotOpen = errors.New("wal not open")
+)
+
+const (
+	WAL_FILE_SUFFIX         = ".wal"
+	MAX_WAL_RECORD_SNAPSHOT = 1000
+)
+
+// Wal is an append-only log of the data operations, one json record per line.
+type Wal struct {
+	path      string
+	f         *os.File
+	recordNum int
+	validSize int64
+	lck       *sync.Mutex
+}
+
+func NewWal(path string) *Wal {
+	return &Wal{
+		path:      path,
+		f:         nil,
+		recordNum: 0,
+		validSize: 0,
+		lck:       &sync.Mutex{},
+	}
+}
+
+func (w *Wal) GetPath() string {
+	return w.path
+}
+
+// Replay read all the records in order of revision.
+// A broken tail left by a crash is ignored and will be cut when Open.
+func (w *Wal) Replay(cb func(rec *DataOprPush)) error {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	f, err := os.Open(w.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	records := make([]*DataOprPush, 0)
+	validSize := int64(0)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+
+			break
+		}
+
+		rec := &DataOprPush{}
+		err = json.Unmarshal(bytes.TrimSpace(line), rec)
+		if err != nil {
+			break
+		}
+
+		records = append(records, rec)
+		validSize += int64(len(line))
+	}
+
+	// records of different trees may be appended out of order
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].ModRev < records[j].ModRev
+	})
+
+	for _, rec := range records {
+		cb(rec)
+	}
+
+	w.recordNum = len(records)
+	w.validSize = validSize
+	return nil
+}
+
+func (w *Wal) Open() error {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(w.validSize)
+	if err == nil {
+		_, err = f.Seek(w.validSize, io.SeekStart)
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f = f
+	return nil
+}
+
+func (w *Wal) Close() error {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// Append write the records and sync them to disk.
+func (w *Wal) Append(records ...*DataOprPush) error {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	if w.f == nil {
+		return ErrWalNotOpen
+	}
+
+	buff := &bytes.Buffer{}
+	enc := json.NewEncoder(buff)
+	for _, rec := range records {
+		err := enc.Encode(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := w.f.Write(buff.Bytes())
+	w.validSize += int64(n)
+	if err != nil {
+		return err
+	}
+
+	w.recordNum += len(records)
+	return w.f.Sync()
+}
+
+func (w *Wal) GetRecordNum() int {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	return w.recordNum
+}
+
+// Compact take a snapshot and clear the log. No record can be appended in between,
+// so every record is either in the snapshot or kept in the log.
+func (w *Wal) Compact(snapshot func() error) error {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	if w.f == nil {
+		return ErrWalNotOpen
+	}
+
+	err := snapshot()
+	if err != nil {
+		return err
+	}
+
+	err = w.f.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	w.recordNum = 0
+	w.validSize = 0
+	return w.f.Sync()
+}
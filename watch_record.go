@@ -0,0 +1,152 @@
+// Copyright 2022 Guan Jianchang. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package reg
+
+import (
+	"strconv"
+	"sync"
+)
+
+const (
+	WATCH_RECORD_CONN = "conn"
+)
+
+func getSrvWatchRecordKey(srvType uint32, srvNo uint32) string {
+	return "srv:" + GetSrvKey(srvType, srvNo)
+}
+
+func getSrvTypeWatchRecordKey(srvType uint32) string {
+	return "type:" + GetSrvTypeKey(srvType)
+}
+
+func getSelectorWatchRecordKey(srvType uint32, bByType bool, selector string) string {
+	if !bByType {
+		return "selector:" + selector
+	}
+
+	return "selector:" + strconv.FormatUint(uint64(srvType), 10) + ":" + selector
+}
+
+func getGlobalDataWatchRecordKey(key string) string {
+	return "global:" + key
+}
+
+func getLeaderWatchRecordKey(srvType uint32) string {
+	return "leader:" + strconv.FormatUint(uint64(srvType), 10)
+}
+
+// watchRecord is a watch set by the client, newReq build the request to set it again.
+// The watch may be shared by the user and refNum internal watchers, e.g. the picker.
+type watchRecord struct {
+	funcName string
+	opt      WatchOpt
+	bDataRev bool
+	newReq   func(opt WatchOpt) interface{}
+	bUser    bool
+	refNum   int
+}
+
+//======================
+//     watchRecords
+//======================
+// watchRecords keep the watches set by the client, they are set again after reconnect.
+type watchRecords struct {
+	mapKey2Record map[string]*watchRecord
+	lck           *sync.Mutex
+}
+
+func newWatchRecords() *watchRecords {
+	return &watchRecords{
+		mapKey2Record: make(map[string]*watchRecord),
+		lck:           &sync.Mutex{},
+	}
+}
+
+// Add record the watch of key set by the user, the start revision is only used by the first watch.
+// The options are merged with the internal watchers of the key, as the registry does.
+func (r *watchRecords) Add(key string, record *watchRecord) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	record.opt.StartRev = 0
+	record.bUser = true
+	record.refNum = 0
+	exist, ok := r.mapKey2Record[key]
+	if ok && exist.refNum > 0 {
+		record.opt.Merge(exist.opt)
+		record.refNum = exist.refNum
+	}
+
+	r.mapKey2Record[key] = record
+}
+
+// AddRef record the watch of key set by an internal watcher.
+func (r *watchRecords) AddRef(key string, record *watchRecord) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	exist, ok := r.mapKey2Record[key]
+	if ok {
+		exist.opt.Merge(record.opt)
+		exist.refNum++
+		return
+	}
+
+	record.opt.StartRev = 0
+	record.bUser = false
+	record.refNum = 1
+	r.mapKey2Record[key] = record
+}
+
+// Remove remove the watch of key set by the user,
+// return false if it is still used by the internal watchers.
+func (r *watchRecords) Remove(key string) bool {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	exist, ok := r.mapKey2Record[key]
+	if ok && exist.refNum > 0 {
+		exist.bUser = false
+		return false
+	}
+
+	delete(r.mapKey2Record, key)
+	return true
+}
+
+// Release remove the watch of key set by an internal watcher,
+// return false if it is still used by the user or the other internal watchers.
+func (r *watchRecords) Release(key string) bool {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	exist, ok := r.mapKey2Record[key]
+	if !ok {
+		return false
+	}
+
+	if exist.refNum > 0 {
+		exist.refNum--
+	}
+
+	if exist.refNum > 0 || exist.bUser {
+		return false
+	}
+
+	delete(r.mapKey2Record, key)
+	return true
+}
+
+func (r *watchRecords) GetAll() []*watchRecord {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	records := make([]*watchRecord, 0, len(r.mapKey2Record))
+	for _, record := range r.mapKey2Record {
+		records = append(records, record)
+	}
+
+	return records
+}